@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/diff"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// runDiff implements the `diff` subcommand, reporting what changed between two crawls.
+func runDiff(args []string, logger *utils.Logger) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	format := fs.String("format", "text", "Report format: "+strings.Join(diff.Formats, ", "))
+	outputFile := fs.String("output", "", "File to write the report to (default stdout)")
+	dataDir := fs.String("data-dir", "", "Service data directory, so stored runs can be given by job ID")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		logger.Error("USAGE: ./monzo-web-crawler diff [-format=text|json|markdown] [-data-dir=jobs] old.json new.json")
+		return nil
+	}
+
+	if !slices.Contains(diff.Formats, *format) {
+		return fmt.Errorf("unknown diff format %q (available: %s)", *format, strings.Join(diff.Formats, ", "))
+	}
+
+	results := make([]*output.Result, 2)
+	paths := make([]string, 2)
+	for i, arg := range fs.Args() {
+		paths[i] = arg
+		// A job ID names a stored run when the argument is not a file of its own.
+		if _, err := os.Stat(arg); err != nil && *dataDir != "" {
+			paths[i] = filepath.Join(*dataDir, arg)
+		}
+		result, err := diff.Load(paths[i])
+		if err != nil {
+			return err
+		}
+		results[i] = result
+	}
+
+	report := diff.Compare(results[0], results[1])
+	report.Old.Path, report.New.Path = fs.Arg(0), fs.Arg(1)
+
+	var w io.Writer = os.Stdout
+	if *outputFile != "" {
+		f, err := os.Create(*outputFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return diff.Write(w, report, *format)
+}
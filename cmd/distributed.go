@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/config"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/distributed"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shared"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/store"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+	"github.com/ivan-vladimirov/monzo-web-crawler/pkg/crawler"
+)
+
+// shutdownGrace keeps the coordinator answering 410 for a moment after the crawl finishes,
+// so polling workers learn the crawl is over instead of seeing connection errors.
+const shutdownGrace = 2 * time.Second
+
+// runCoordinator serves the frontier to workers until the crawl completes, then writes the output.
+// The crawl, parse and trap settings of cfg decide which URLs are handed out.
+// With redisAddr set, the crawl state is kept in that Redis-protocol server instead of in memory;
+// the state of an earlier crawl under the same prefix is cleared first unless resume is set.
+func runCoordinator(cfg *config.Config, listen string, leaseTTL time.Duration, redisAddr string, redisPrefix string, resume bool, formats []output.Format, logger *utils.Logger) error {
+	var backend store.Backend = store.NewMemory()
+	if redisAddr != "" {
+		redis, err := store.NewRedis(redisAddr, redisPrefix)
+		if err != nil {
+			return err
+		}
+		if resume {
+			logger.Info("Resuming the crawl state in Redis", "addr", redisAddr, "prefix", redisPrefix)
+		} else if err := redis.Reset(); err != nil {
+			redis.Close()
+			return err
+		}
+		backend = redis
+	}
+	defer backend.Close()
+
+	domain := strings.Join(cfg.Crawl.URLs, ",")
+	startedAt := time.Now()
+	coord := distributed.NewCoordinator(domain, cfg.Crawl.MaxDepth, leaseTTL, backend, logger)
+	if err := cfg.ConfigureCoordinator(coord); err != nil {
+		return err
+	}
+	if err := coord.Seed(domain); err != nil {
+		return err
+	}
+
+	server := &http.Server{Addr: listen, Handler: coord.Handler()}
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.Info("Coordinator listening", "addr", listen)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	interrupt, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go coord.ReapExpired(interrupt)
+
+	select {
+	case <-coord.Done():
+		time.Sleep(shutdownGrace)
+	case err := <-serveErr:
+		return err
+	case <-interrupt.Done():
+		logger.Warn("Interrupted, writing partial results")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Coordinator shutdown failed", "error", err)
+	}
+
+	results, err := coord.Results()
+	if err != nil {
+		return err
+	}
+	pages, err := coord.Pages()
+	if err != nil {
+		return err
+	}
+	result := newResult([]string{domain}, results, pages, startedAt)
+	result.Traps = coord.Traps()
+	result.StoppedBy = coord.StoppedBy()
+	return writeResults(result, formats, cfg.Output.Path, true, logger)
+}
+
+// runWorker leases URLs from the coordinator until it reports the crawl is finished, fetching
+// and parsing them with the crawl, fetch, parse and output settings of cfg.
+func runWorker(cfg *config.Config, id string, coordinatorURL string, logger *utils.Logger) error {
+	// Validate has already checked the settings, so this cannot fail.
+	opts, _ := cfg.CrawlerOptions()
+	cr, err := crawler.New(append(opts, crawler.WithLogger(logger.Logger))...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cr.Close(); err != nil {
+			logger.Error("Failed to finish crawl outputs", "error", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = cr.RunWorker(ctx, coordinatorURL, id)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// newResult gathers what the output formats need once a crawl has finished.
+func newResult(seeds []string, crawled *shared.UsedURL, pages []output.Record, startedAt time.Time) *output.Result {
+	crawled.Mux.RLock()
+	defer crawled.Mux.RUnlock()
+
+	urls := make(map[string]bool, len(crawled.CrawledURLs))
+	for url, ok := range crawled.CrawledURLs {
+		urls[url] = ok
+	}
+	return &output.Result{
+		Seeds:      seeds,
+		URLs:       urls,
+		Pages:      pages,
+		Duplicates: output.Clusters(pages),
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+	}
+}
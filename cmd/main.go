@@ -1,69 +1,456 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"github.com/ivan-vladimirov/monzo-web-crawler/internal/crawler"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/config"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/distributed"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
-	"github.com/ivan-vladimirov/monzo-web-crawler/internal/parser"
-	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shared"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/frontier"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/metrics"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/notify"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/progress"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+	"github.com/ivan-vladimirov/monzo-web-crawler/pkg/crawler"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"sort"
+	"strings"
 	"time"
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run runs the command given by the arguments and returns its exit code. Deferred cleanup, such
+// as closing archives and flushing traces, runs before the process exits.
+func run() int {
 	logger := utils.NewLogger()
 
-	domain := flag.String("url", "", "Starting URL for the web crawler")
-	maxDepth := flag.Int("max-depth", 3, "Maximum depth to crawl")
-	outputFile := flag.String("output", "output.json", "File to save the JSON output")
-	delay := flag.Duration("delay", 100*time.Millisecond, "Delay between requests (e.g., 100ms, 1s)")
+	if len(os.Args) > 1 && os.Args[1] == "merge" {
+		if err := runMerge(os.Args[2:], logger); err != nil {
+			logger.Error("Merge failed", "error", err)
+			return 1
+		}
+		return 0
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		if err := runDiff(os.Args[2:], logger); err != nil {
+			logger.Error("Diff failed", "error", err)
+			return 1
+		}
+		return 0
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		if err := runServe(os.Args[2:], logger); err != nil {
+			logger.Error("Service failed", "error", err)
+			return 1
+		}
+		return 0
+	}
+
+	defaults := config.Default()
+	configFile := flag.String("config", "", "YAML, TOML or JSON file with crawler settings; flags take precedence over it")
+	profile := flag.String("profile", "", "Settings profile to apply on top of the config file: "+strings.Join(config.Profiles(), ", ")+" or one defined in the file")
+
+	// Flags for settings that can also come from the config file are read through config.Config.
+	flag.String("url", "", "Starting URL for the web crawler (comma-separated for several seeds)")
+	flag.Int("max-depth", defaults.Crawl.MaxDepth, "Maximum depth to crawl")
+	flag.Duration("delay", time.Duration(defaults.Crawl.Delay), "Wait at least this long between two requests to one host (e.g., 100ms, 1s)")
+	flag.Duration("rate-limit", time.Duration(defaults.Crawl.RateLimit), "Minimum interval between two requests across all workers")
+	flag.Int("workers", defaults.Crawl.Workers, "Number of pages fetched concurrently")
+	flag.Int("duplicate-distance", defaults.Crawl.DuplicateDistance, "SimHash bits in which near-duplicate pages may differ (0 for exact duplicates only, -1 to turn detection off)")
+	flag.Bool("skip-duplicates", false, "Do not follow links on pages that duplicate a page already crawled")
+	flag.Int("max-pages", 0, "Stop the crawl after fetching this many pages (0 for no limit)")
+	flag.Int64("max-size", 0, "Stop the crawl after downloading this many MB (0 for no limit)")
+	flag.Duration("max-duration", 0, "Stop the crawl after running this long (0 for no limit)")
+	flag.Int("max-pages-per-host", 0, "Fetch at most this many pages from each host (0 for no limit)")
+	flag.String("score", "", "Comma-separated scorers deciding which URL is crawled first: "+strings.Join(frontier.ScorerNames(), ", ")+" (e.g. depth,inlinks?weight=0.5,regex?pattern=/blog/&weight=2)")
+	flag.Int("host-concurrency", 0, "Fetch at most this many pages from one host at once (0 for no limit)")
+	flag.Duration("host-delay", 0, "Wait at least this long between two fetches from one host")
+	flag.String("max-pages-per-path", "", "Comma-separated path prefixes with their own page cap (e.g. /blog=100,/docs/api=20)")
+	flag.Int("trap-max-url-length", defaults.Traps.MaxURLLength, "Skip links to URLs longer than this many characters (0 for no limit)")
+	flag.Int("trap-max-repeats", defaults.Traps.MaxRepeats, "Skip links whose path repeats a segment more than this many times (0 for no limit)")
+	flag.Int("trap-pattern-budget", defaults.Traps.PatternBudget, "Crawl at most this many URLs per path pattern such as /calendar/{n}/{n} (0 for no limit)")
+	flag.Int("trap-query-variants", defaults.Traps.QueryVariants, "Report pages linked with more than this many query strings (0 to turn off)")
+	flag.String("trap-budget", "", "Comma-separated path patterns with their own URL budget (e.g. /calendar/**=50,/search/*=20)")
+	flag.Duration("timeout", time.Duration(defaults.Fetch.Timeout), "HTTP client timeout")
+	flag.Duration("request-timeout", time.Duration(defaults.Fetch.RequestTimeout), "Timeout for each attempt at a request")
+	flag.Int("retry-attempts", defaults.Fetch.RetryAttempts, "Attempts per request made by the retry middleware")
+	flag.Duration("retry-delay", time.Duration(defaults.Fetch.RetryDelay), "Delay before the first retry; it doubles after each attempt")
+	flag.String("middleware", strings.Join(defaults.Fetch.Middleware, ","), "Comma-separated fetch middlewares, outermost first: "+strings.Join(fetcher.MiddlewareNames(), ", "))
+	flag.String("replay", "", "Comma-separated WARC or HAR files to serve responses from instead of the network")
+	flag.Bool("incremental", false, "Request pages conditionally using the validators saved by the previous run in -state")
+	flag.String("state", defaults.Fetch.State, "File holding the run state of incremental crawls")
+	flag.String("cache-dir", "", "Keep responses in this directory and reuse them while they are fresh, following Cache-Control")
+	flag.Int64("cache-max-size", defaults.Fetch.CacheMaxSizeMB, "Remove the least recently used cached responses once the cache passes this many MB")
+	flag.Bool("offline", false, "Serve every response from -cache-dir without touching the network")
+	flag.Bool("subdomains", defaults.Parse.Subdomains, "Treat subdomains of the starting host as internal")
+	flag.String("exclude-ext", strings.Join(defaults.Parse.ExcludedExtensions, ","), "Comma-separated file extensions that are not fetched")
+	flag.String("output", defaults.Output.Path, "File to save the JSON output")
+	flag.String("format", strings.Join(defaults.Output.Formats, ","), "Comma-separated output formats: "+strings.Join(output.Names(), ", "))
+	flag.String("jsonl", "", "Stream one JSON record per page to this file, named pipe or - for stdout")
+	flag.Duration("flush-interval", time.Duration(defaults.Output.FlushInterval), "How often streamed records are flushed")
+	flag.String("warc-dir", "", "Archive every fetched response as WARC files in this directory")
+	flag.String("warc-prefix", defaults.Output.WARCPrefix, "File name prefix for WARC archives")
+	flag.Int64("warc-max-size", defaults.Output.WARCMaxSizeMB, "Start a new WARC file once the current one reaches this many MB")
+	flag.String("mirror", "", "Save crawled pages to this directory with links rewritten for offline browsing")
+	flag.Bool("mirror-assets", false, "Also save images, scripts and stylesheets when mirroring")
+	flag.String("notify", "", "Comma-separated notifiers told when the crawl finishes: "+strings.Join(notify.Names(), ", ")+" (e.g. webhook?url=https://example.com/hook&on=failed+threshold)")
+	flag.String("notify-when", "", "Comma-separated conditions that raise a threshold notification (e.g. broken>0,pages_drop>10%)")
+	flag.String("log-level", defaults.Log.Level, "Minimum level to log: debug, info, warn or error")
+	flag.String("log-format", defaults.Log.Format, "Log format: text or json")
+	flag.String("log-file", "", "Append logs to this file instead of stderr")
+
+	mode := flag.String("mode", "standalone", "Run mode: standalone, coordinator or worker")
+	listen := flag.String("listen", ":8090", "Address the coordinator listens on")
+	coordinatorURL := flag.String("coordinator", "http://localhost:8090", "Coordinator URL used in worker mode")
+	workerID := flag.String("worker-id", "", "Worker identifier (defaults to hostname-pid)")
+	leaseTTL := flag.Duration("lease-ttl", distributed.DefaultLeaseTTL, "How long a worker may hold a URL without renewing it before it is reassigned")
+	redisAddr := flag.String("redis-addr", "", "Redis-protocol server holding the coordinator's crawl state (default: in memory)")
+	redisPrefix := flag.String("redis-prefix", "crawler:", "Key prefix for crawl state in the Redis-protocol server")
+	redisResume := flag.Bool("redis-resume", false, "Carry on with the crawl state left in the Redis-protocol server instead of starting afresh")
+	shardIndex := flag.Int("shard-index", 0, "Index of this crawler instance when sharding by host")
+	shardCount := flag.Int("shard-count", 1, "Total number of crawler instances sharing the crawl")
+	shardInbox := flag.String("shard-inbox", "shards", "Directory shards use to forward URLs to each other")
+	shardPeers := flag.String("shard-peers", "", "Comma-separated inbox endpoints indexed by shard, used instead of -shard-inbox")
+	shardListen := flag.String("shard-listen", ":8100", "Address this shard's inbox listens on when -shard-peers is set")
+	shardIdle := flag.Duration("shard-idle", 10*time.Second, "How long a shard waits with no work before finishing")
+
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics on this address at /metrics (e.g. :9090)")
+	showProgress := flag.Bool("progress", false, "Show live crawl progress on stderr")
+	progressInterval := flag.Duration("progress-interval", 0, "How often progress is updated (default 1s on a terminal, 10s otherwise)")
+	traceFile := flag.String("trace-file", "", "Write OTLP/JSON trace spans to this file")
+	traceEndpoint := flag.String("trace-endpoint", "", "Export OTLP/JSON trace spans to this collector (e.g. http://localhost:4318)")
 
 	flag.Parse()
 
-	if *domain == "" {
-		logger.Error.Println("USAGE: ./monzo-web-crawler -url=http://monzo.com -max-depth=3 -delay=100ms -output=mozno.json")
-		return
+	cfg, err := config.Load(*configFile, *profile)
+	if err == nil {
+		err = cfg.ApplyFlags(flag.CommandLine)
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		logger.Error("Invalid configuration", "error", err)
+		return 1
 	}
 
-	fetcher := fetcher.NewFetcher(10 * time.Second)
-	parser := parser.NewParser()
-	rateLimiter := time.NewTicker(100 * time.Millisecond)
+	logger, err = newLogger(cfg.Log.Level, cfg.Log.Format, cfg.Log.File)
+	if err != nil {
+		logger.Error("Invalid logging settings", "error", err)
+		return 1
+	}
 
-	defer rateLimiter.Stop()
+	formats, err := output.ParseFormats(strings.Join(cfg.Output.Formats, ","))
+	if err != nil {
+		logger.Error("Invalid output formats", "error", err)
+		return 1
+	}
 
-	cr := crawler.NewCrawler(fetcher, parser, logger, rateLimiter, 10)
+	switch *mode {
+	case "standalone":
+	case "coordinator":
+		if len(cfg.Crawl.URLs) == 0 {
+			logger.Error("USAGE: ./monzo-web-crawler -mode=coordinator -url=http://monzo.com -listen=:8090 -lease-ttl=30s")
+			return 0
+		}
+		if err := runCoordinator(&cfg, *listen, *leaseTTL, *redisAddr, *redisPrefix, *redisResume, formats, logger); err != nil {
+			logger.Error("Coordinator failed", "error", err)
+			return 1
+		}
+		return 0
+	case "worker":
+		if err := runWorker(&cfg, *workerID, *coordinatorURL, logger); err != nil {
+			logger.Error("Worker failed", "error", err)
+			return 1
+		}
+		return 0
+	default:
+		logger.Error("Unknown mode, expected standalone, coordinator or worker", "mode", *mode)
+		return 1
+	}
 
-	crawled := &shared.UsedURL{
-		CrawledURLs:  make(map[string]bool),
-		VisitedPaths: make(map[string]bool),
+	if len(cfg.Crawl.URLs) == 0 {
+		logger.Error("USAGE: ./monzo-web-crawler -url=http://monzo.com -max-depth=3 -delay=100ms -output=mozno.json")
+		return 0
 	}
 
-	wg := &sync.WaitGroup{}
+	seeds := cfg.Crawl.URLs
 
-	wg.Add(1)
-	cr.Crawl(*domain, *maxDepth, *domain, *delay, crawled, wg, logger)
-	wg.Wait()
+	// Validate has already checked the settings, so this cannot fail.
+	opts, _ := cfg.CrawlerOptions()
+	opts = append(opts, crawler.WithLogger(logger.Logger))
 
-	crawledJSON, err := json.MarshalIndent(struct {
-		URLs map[string]bool `json:"urls"`
-	}{
-		URLs: crawled.CrawledURLs,
-	}, "", "  ")
+	// The run state is the previous run's page records: incremental crawls reuse its validators
+	// and notifications compare with it.
+	keepState := cfg.Fetch.Incremental || len(cfg.Notify.Targets) > 0
+	var previous *output.Result
+	if keepState {
+		previous, err = output.LoadResult(cfg.Fetch.State)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			logger.Info("No run state yet, crawling every page", "state", cfg.Fetch.State)
+		case err != nil:
+			logger.Error("Failed to load run state", "state", cfg.Fetch.State, "error", err)
+			return 1
+		case cfg.Fetch.Incremental:
+			logger.Info("Recrawling incrementally", "state", cfg.Fetch.State, "pages", len(previous.Pages))
+			opts = append(opts, crawler.WithPrevious(previous))
+		}
+	}
+
+	crawlMetrics := crawler.NewMetrics()
+	opts = append(opts, crawler.WithMetrics(crawlMetrics))
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr, crawlMetrics, logger)
+	}
+	if *traceFile != "" || *traceEndpoint != "" {
+		opts = append(opts, crawler.WithTraceExport(*traceFile, *traceEndpoint))
+	}
+	if *shardCount > 1 {
+		var peers []string
+		if *shardPeers != "" {
+			peers = strings.Split(*shardPeers, ",")
+		}
+		opts = append(opts, crawler.WithShards(crawler.Shards{
+			Index:    *shardIndex,
+			Count:    *shardCount,
+			InboxDir: *shardInbox,
+			Peers:    peers,
+			Listen:   *shardListen,
+			Idle:     *shardIdle,
+		}))
+	}
+	// Keep stdout for the stream when it is being written there.
+	echo := cfg.Output.JSONL != "-"
+
+	cr, err := crawler.New(opts...)
+	if err != nil {
+		logger.Error("Invalid crawler settings", "error", err)
+		return 1
+	}
+	// The mirror's links are rewritten and the archives, streams and traces flushed on Close.
+	defer func() {
+		if err := cr.Close(); err != nil {
+			logger.Error("Failed to finish crawl outputs", "error", err)
+		}
+	}()
+	stopProgress := func() {}
+	if *showProgress {
+		stopProgress = startProgress(cr, *progressInterval)
+	}
 
+	state := notify.EventSucceeded
+	interrupt, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	result, err := cr.Run(interrupt, seeds...)
 	if err != nil {
-		logger.Error.Println("Error while marshalling URLs:", err)
+		logger.Warn("Interrupted, writing partial results")
+		state = notify.EventCanceled
+	}
+	stopProgress()
+	logSummary(crawlMetrics, logger)
+	if result.StoppedBy != "" {
+		logger.Warn("Crawl budget ran out, results are partial", "budget", result.StoppedBy)
+	}
+
+	writeErr := writeResults(result, formats, cfg.Output.Path, echo, logger)
+	// An interrupted crawl would forget the validators of the pages it did not reach, and one
+	// stopped by a budget keeps those of the previous run for them.
+	if keepState && state != notify.EventCanceled {
+		saved := result
+		if result.StoppedBy != "" {
+			saved = output.MergeResult(previous, result)
+		}
+		if err := output.SaveResult(saved, cfg.Fetch.State); err != nil {
+			logger.Error("Failed to save run state", "state", cfg.Fetch.State, "error", err)
+			writeErr = err
+		}
+	}
+	if writeErr != nil {
+		state = notify.EventFailed
+	}
+	sendNotifications(&cfg, state, writeErr, result, previous, crawlMetrics, logger)
+	if writeErr != nil {
+		return 1
+	}
+	return 0
+}
+
+// sendNotifications tells the configured notifiers about the finished crawl, compared with the
+// previous result if there is one. err is why the crawl failed, if it did.
+func sendNotifications(cfg *config.Config, state string, err error, result, previous *output.Result, m *metrics.Crawl, logger *utils.Logger) {
+	// Validate has already checked the notifier settings.
+	targets, conditions, _ := cfg.Notifiers()
+	if len(targets) == 0 {
 		return
 	}
+	summary := m.Summary()
+	run := notify.Run{
+		Name:     cfg.Output.Path,
+		State:    state,
+		Seeds:    cfg.Crawl.URLs,
+		Result:   result,
+		Bytes:    summary.Bytes,
+		Requests: summary.Requests,
+		Elapsed:  summary.Elapsed,
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	var prev *notify.Run
+	if previous != nil {
+		prev = &notify.Run{Result: previous}
+	}
+	payload := notify.NewPayload(run, prev, conditions)
+	if err := notify.Send(context.Background(), targets, payload); err != nil {
+		logger.Error("Failed to send notifications", "error", err)
+		return
+	}
+	logger.Info("Sent notifications", "events", payload.Events, "alerts", len(payload.Alerts))
+}
+
+// newLogger builds the logger selected by the logging flags. On error it still returns a usable
+// logger so the problem can be reported.
+func newLogger(level, format, file string) (*utils.Logger, error) {
+	fallback := utils.NewLogger()
+	parsed, err := utils.ParseLevel(level)
+	if err != nil {
+		return fallback, err
+	}
+
+	var w io.Writer = os.Stderr
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fallback, err
+		}
+		w = f
+	}
+
+	logger, err := utils.NewLoggerTo(w, format, parsed)
+	if err != nil {
+		return fallback, err
+	}
+	return logger, nil
+}
+
+// serveMetrics exposes m on addr/metrics for the lifetime of the process.
+func serveMetrics(addr string, m *metrics.Crawl, logger *utils.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", m.Handler())
+	go func() {
+		logger.Info("Serving metrics", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Error("Metrics server stopped", "error", err)
+		}
+	}()
+}
 
-	err1 := utils.SaveJSONToFile(crawledJSON, *outputFile)
-	if err1 != nil {
-		logger.Error.Printf("Failed to save JSON to file: %v", err)
-		os.Exit(1)
+// startProgress renders crawl progress on stderr until the returned function is called.
+func startProgress(cr *crawler.Crawler, interval time.Duration) func() {
+	tty := progress.IsTerminal(os.Stderr)
+	if interval <= 0 {
+		interval = progress.DefaultInterval
+		if !tty {
+			interval = 10 * time.Second
+		}
 	}
+	reporter := progress.NewReporter(os.Stderr, interval, tty)
+	cr.OnEvent(reporter.Handle)
+	reporter.Start()
+	return reporter.Stop
+}
+
+// summaryHosts is the most hosts logSummary reports a request rate for, busiest first.
+const summaryHosts = 10
 
-	fmt.Println(string(crawledJSON))
+// logSummary reports the headline numbers of a finished crawl: pages by status class, bytes,
+// requests and retries, fetch latency, skipped URLs by reason and the busiest hosts' request rates.
+func logSummary(m *metrics.Crawl, logger *utils.Logger) {
+	summary := m.Summary()
+	args := []any{
+		"pages", summary.Total(),
+		"bytes", summary.Bytes,
+		"requests", summary.Requests,
+		"retries", summary.Retries,
+		"elapsed", summary.Elapsed.Round(time.Millisecond),
+	}
+	for _, class := range []string{"2xx", "3xx", "4xx", "5xx", "error"} {
+		if n := summary.Pages[class]; n > 0 {
+			args = append(args, "pages_"+class, n)
+		}
+	}
+	skipped := uint64(0)
+	reasons := make([]string, 0, len(summary.Skipped))
+	for reason, n := range summary.Skipped {
+		skipped += n
+		reasons = append(reasons, reason)
+	}
+	args = append(args, "skipped", skipped)
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		args = append(args, "skipped_"+reason, summary.Skipped[reason])
+	}
+	logger.Info("Crawl finished", args...)
+
+	if summary.Requests > 0 {
+		latency := summary.Latency
+		logger.Info("Fetch latency",
+			"mean", latency.Mean.Round(time.Millisecond),
+			"p50", latency.P50.Round(time.Millisecond),
+			"p90", latency.P90.Round(time.Millisecond),
+			"p99", latency.P99.Round(time.Millisecond),
+			"max", latency.Max.Round(time.Millisecond))
+	}
+
+	hosts := make([]string, 0, len(summary.Hosts))
+	for host := range summary.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if summary.Hosts[hosts[i]] != summary.Hosts[hosts[j]] {
+			return summary.Hosts[hosts[i]] > summary.Hosts[hosts[j]]
+		}
+		return hosts[i] < hosts[j]
+	})
+	for _, host := range hosts[:min(len(hosts), summaryHosts)] {
+		logger.Info("Requests by host", "host", host, "requests", summary.Hosts[host],
+			"per_second", math.Round(summary.HostRate(host)*100)/100)
+	}
+	if len(hosts) > summaryHosts {
+		logger.Info("Requests by host", "other_hosts", len(hosts)-summaryHosts)
+	}
+}
+
+// writeResults writes the result in every requested format, deriving each file name from outputFile.
+// If echo is set and JSON is among the formats, the JSON is also printed to stdout.
+func writeResults(result *output.Result, formats []output.Format, outputFile string, echo bool, logger *utils.Logger) error {
+	for _, format := range formats {
+		path := output.PathFor(outputFile, format)
+		if err := format.Write(result, path); err != nil {
+			logger.Error("Failed to write output", "format", format.Name, "path", path, "error", err)
+			return err
+		}
+		logger.Info("Wrote output", "format", format.Name, "path", path)
+
+		if echo && format.Name == "json" {
+			crawledJSON, err := output.MarshalURLs(result.URLs)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(crawledJSON))
+		}
+	}
+	return nil
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/service"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// runServe implements the `serve` subcommand, running crawl jobs submitted over a REST API until
+// interrupted.
+func runServe(args []string, logger *utils.Logger) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8080", "Address the API listens on")
+	token := fs.String("token", os.Getenv("CRAWLER_API_TOKEN"), "Bearer token every API request must carry (default $CRAWLER_API_TOKEN); required unless listening on loopback")
+	allow := fs.String("allow-notifiers", "webhook", "Comma-separated notifiers jobs may use; file and exec act on this host")
+	allowEnv := fs.String("allow-secret-env", "", "Comma-separated environment variables webhooks in jobs may read their secret from with secret_env")
+	dataDir := fs.String("data-dir", "jobs", "Directory job metadata and results are stored in")
+	maxJobs := fs.Int("max-jobs", service.DefaultMaxJobs, "How many jobs may run at once; the rest wait")
+	fs.Parse(args)
+
+	if *token == "" && !loopback(*listen) {
+		return fmt.Errorf("-listen=%s is reachable from other hosts, so -token or CRAWLER_API_TOKEN must be set", *listen)
+	}
+	manager, err := service.NewManager(*dataDir, *maxJobs, logger)
+	if err != nil {
+		return err
+	}
+	manager.AllowNotifiers(strings.Split(*allow, ",")...)
+	manager.AllowSecretEnv(strings.Split(*allowEnv, ",")...)
+
+	handler := manager.Handler()
+	if *token != "" {
+		handler = service.RequireToken(*token, handler)
+	}
+	server := &http.Server{Addr: *listen, Handler: handler}
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.Info("Serving crawl API", "addr", *listen)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	interrupt, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-interrupt.Done():
+		logger.Info("Shutting down, cancelling running jobs")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("API shutdown failed", "error", err)
+	}
+	manager.Shutdown()
+	return nil
+}
+
+// loopback reports whether addr only accepts connections from this host.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shard"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// runMerge implements the `merge` subcommand, combining shard outputs into one JSON file.
+func runMerge(args []string, logger *utils.Logger) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	outputFile := fs.String("output", "merged.json", "File to save the merged JSON output")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		logger.Error("USAGE: ./monzo-web-crawler merge -output=merged.json shard-0.json shard-1.json ...")
+		return nil
+	}
+
+	urls, err := shard.MergeOutputs(fs.Args()...)
+	if err != nil {
+		return err
+	}
+
+	mergedJSON, err := output.MarshalURLs(urls)
+	if err != nil {
+		return err
+	}
+	return utils.SaveJSONToFile(mergedJSON, *outputFile)
+}
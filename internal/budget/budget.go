@@ -0,0 +1,234 @@
+// Package budget caps how much a crawl may do: pages, bytes and time for the whole crawl, and
+// pages per host and per path prefix.
+package budget
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the budgets, as reported by Tracker.Admit and in output.Result.StoppedBy.
+const (
+	MaxPages        = "max_pages"
+	MaxBytes        = "max_bytes"
+	MaxDuration     = "max_duration"
+	MaxPagesPerHost = "max_pages_per_host"
+	MaxPagesPerPath = "max_pages_per_path"
+)
+
+// Limits are the budgets of a crawl. A zero limit is no limit. MaxPages, MaxBytes and MaxDuration
+// stop the whole crawl once they run out; the per-host and per-path caps only skip the URLs over
+// them.
+type Limits struct {
+	MaxPages        int
+	MaxBytes        int64
+	MaxDuration     time.Duration
+	MaxPagesPerHost int
+	MaxPagesPerPath []PathLimit
+}
+
+// PathLimit caps the number of pages fetched under Prefix, which matches whole path segments:
+// /blog covers /blog and /blog/post but not /blogger.
+type PathLimit struct {
+	Prefix string
+	Max    int
+}
+
+// ParsePathLimit parses a cap written as prefix=max, such as /blog=100.
+func ParsePathLimit(spec string) (PathLimit, error) {
+	prefix, limit, ok := strings.Cut(spec, "=")
+	if !ok {
+		return PathLimit{}, fmt.Errorf("path budget %q must be prefix=max, such as /blog=100", spec)
+	}
+	prefix = strings.TrimSpace(prefix)
+	if !strings.HasPrefix(prefix, "/") {
+		return PathLimit{}, fmt.Errorf("path budget prefix %q must start with /", prefix)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(limit))
+	if err != nil || n < 0 {
+		return PathLimit{}, fmt.Errorf("path budget %q must end in a number of pages", spec)
+	}
+	return PathLimit{Prefix: strings.TrimRight(prefix, "/"), Max: n}, nil
+}
+
+// ParsePathLimits parses each of specs with ParsePathLimit.
+func ParsePathLimits(specs []string) ([]PathLimit, error) {
+	var limits []PathLimit
+	var errs []error
+	for _, spec := range specs {
+		limit, err := ParsePathLimit(spec)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		limits = append(limits, limit)
+	}
+	return limits, errors.Join(errs...)
+}
+
+func (l PathLimit) covers(p string) bool {
+	return l.Prefix == "" || p == l.Prefix || strings.HasPrefix(p, l.Prefix+"/")
+}
+
+// Tracker spends a crawl's budgets. The clock for MaxDuration starts with the first call to
+// Admit, and MaxDuration runs out when it is up, whether or not anything is admitted then. It is
+// safe for concurrent use.
+type Tracker struct {
+	limits Limits
+
+	mu        sync.Mutex
+	started   time.Time
+	timer     *time.Timer
+	pages     int
+	bytes     int64
+	hosts     map[string]int
+	paths     []int
+	exhausted string
+	handlers  []func(name string)
+}
+
+// New returns a tracker that enforces limits.
+func New(limits Limits) *Tracker {
+	return &Tracker{
+		limits: limits,
+		hosts:  make(map[string]int),
+		paths:  make([]int, len(limits.MaxPagesPerPath)),
+	}
+}
+
+// Admit takes one page out of the budgets for rawURL, a normalised URL about to be fetched. It
+// returns "" if the URL may be fetched, or the name of the budget that ran out. Once MaxPages,
+// MaxBytes or MaxDuration has run out, every URL is refused and Exhausted names it.
+func (t *Tracker) Admit(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	p := strings.TrimRight(u.Path, "/")
+
+	notify := func() {}
+	defer func() { notify() }()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.started.IsZero() {
+		t.started = time.Now()
+		if t.limits.MaxDuration > 0 {
+			t.timer = time.AfterFunc(t.limits.MaxDuration, func() {
+				t.mu.Lock()
+				notify := t.exhaust(MaxDuration)
+				t.mu.Unlock()
+				notify()
+			})
+		}
+	}
+	if t.exhausted != "" {
+		return t.exhausted
+	}
+	if t.limits.MaxDuration > 0 && time.Since(t.started) >= t.limits.MaxDuration {
+		notify = t.exhaust(MaxDuration)
+		return t.exhausted
+	}
+	if t.limits.MaxPages > 0 && t.pages >= t.limits.MaxPages {
+		notify = t.exhaust(MaxPages)
+		return t.exhausted
+	}
+	if t.limits.MaxPagesPerHost > 0 && t.hosts[u.Host] >= t.limits.MaxPagesPerHost {
+		return MaxPagesPerHost
+	}
+	// Every cap covering the path must have room, so nested prefixes can be capped separately.
+	for i, limit := range t.limits.MaxPagesPerPath {
+		if limit.covers(p) && t.paths[i] >= limit.Max {
+			return MaxPagesPerPath
+		}
+	}
+
+	t.pages++
+	t.hosts[u.Host]++
+	for i, limit := range t.limits.MaxPagesPerPath {
+		if limit.covers(p) {
+			t.paths[i]++
+		}
+	}
+	return ""
+}
+
+// Release gives back the page Admit took for rawURL, for URLs that were not fetched after all,
+// such as those disallowed by robots.txt.
+func (t *Tracker) Release(rawURL string) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+	p := strings.TrimRight(u.Path, "/")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pages--
+	t.hosts[u.Host]--
+	for i, limit := range t.limits.MaxPagesPerPath {
+		if limit.covers(p) {
+			t.paths[i]--
+		}
+	}
+}
+
+// AddBytes counts n bytes downloaded and returns MaxBytes if that used up the byte budget, or ""
+// otherwise.
+func (t *Tracker) AddBytes(n int) string {
+	notify := func() {}
+	defer func() { notify() }()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bytes += int64(n)
+	if t.limits.MaxBytes > 0 && t.bytes >= t.limits.MaxBytes && t.exhausted == "" {
+		notify = t.exhaust(MaxBytes)
+		return t.exhausted
+	}
+	return ""
+}
+
+// OnExhausted registers fn to be called with the budget's name once MaxPages, MaxBytes or
+// MaxDuration runs out. MaxDuration calls it from a timer, even while nothing is being admitted,
+// so a crawl can cancel the fetches it has under way.
+func (t *Tracker) OnExhausted(fn func(name string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handlers = append(t.handlers, fn)
+}
+
+// Stop stops the MaxDuration clock, for a crawl that is over. Exhausted keeps its value.
+func (t *Tracker) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// exhaust records that the budget name ran out, unless another already has, and returns a
+// function calling the OnExhausted handlers, to be called once t.mu is released. t.mu must be held.
+func (t *Tracker) exhaust(name string) func() {
+	if t.exhausted != "" {
+		return func() {}
+	}
+	t.exhausted = name
+	handlers := slices.Clone(t.handlers)
+	return func() {
+		for _, fn := range handlers {
+			fn(name)
+		}
+	}
+}
+
+// Exhausted returns the name of the crawl-wide budget that ran out, or "" if none has.
+func (t *Tracker) Exhausted() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.exhausted
+}
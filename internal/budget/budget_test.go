@@ -0,0 +1,81 @@
+package budget_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/budget"
+)
+
+func TestTracker_SpendsBudgets(t *testing.T) {
+	paths, err := budget.ParsePathLimits([]string{"/blog=2", "/blog/drafts=0"})
+	if err != nil {
+		t.Fatalf("ParsePathLimits failed: %v", err)
+	}
+	tracker := budget.New(budget.Limits{MaxPages: 6, MaxPagesPerHost: 4, MaxPagesPerPath: paths})
+
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{"https://example.com/blog/one", ""},
+		{"https://example.com/blog/drafts/two", budget.MaxPagesPerPath},
+		{"https://example.com/blogger", ""},
+		{"https://example.com/blog", ""},
+		{"https://example.com/blog/three", budget.MaxPagesPerPath},
+		{"https://example.com/about", ""},
+		{"https://example.com/careers", budget.MaxPagesPerHost},
+		{"https://other.example/", ""},
+		{"https://other.example/help", ""},
+		{"https://other.example/faq", budget.MaxPages},
+		{"https://third.example/", budget.MaxPages},
+	} {
+		if got := tracker.Admit(tc.url); got != tc.want {
+			t.Errorf("Admit(%s) = %q, want %q", tc.url, got, tc.want)
+		}
+		if tc.url == "https://example.com/about" {
+			// A page disallowed by robots.txt gives its place back.
+			tracker.Release(tc.url)
+			if got := tracker.Admit(tc.url); got != "" {
+				t.Errorf("Expected a released page to be admitted again, got %q", got)
+			}
+		}
+	}
+	if tracker.Exhausted() != budget.MaxPages {
+		t.Errorf("Expected max_pages to be exhausted, got %q", tracker.Exhausted())
+	}
+
+	bytes := budget.New(budget.Limits{MaxBytes: 100})
+	if bytes.AddBytes(60) != "" || bytes.AddBytes(60) != budget.MaxBytes || bytes.Admit("https://example.com/") != budget.MaxBytes {
+		t.Errorf("Expected the byte budget to run out at 120 bytes, got %q", bytes.Exhausted())
+	}
+
+	clock := budget.New(budget.Limits{MaxDuration: 20 * time.Millisecond})
+	if clock.Admit("https://example.com/") != "" {
+		t.Error("Expected the first page to be admitted")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if clock.Admit("https://example.com/about") != budget.MaxDuration {
+		t.Errorf("Expected the time budget to run out, got %q", clock.Exhausted())
+	}
+
+	// The clock runs out on its own, telling OnExhausted even though nothing else is admitted.
+	timer := budget.New(budget.Limits{MaxDuration: 20 * time.Millisecond})
+	ranOut := make(chan string, 1)
+	timer.OnExhausted(func(name string) { ranOut <- name })
+	timer.Admit("https://example.com/")
+	select {
+	case name := <-ranOut:
+		if name != budget.MaxDuration || timer.Exhausted() != budget.MaxDuration {
+			t.Errorf("Expected max_duration to run out, got %q", name)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected OnExhausted to be called once the time budget ran out")
+	}
+
+	for _, spec := range []string{"/blog", "blog=5", "/blog=-1", "/blog=lots"} {
+		if _, err := budget.ParsePathLimit(spec); err == nil {
+			t.Errorf("Expected path budget %q to be rejected", spec)
+		}
+	}
+}
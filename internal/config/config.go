@@ -0,0 +1,427 @@
+// Package config loads crawler settings from a YAML, TOML or JSON file, named profiles,
+// environment variables and command-line flags, in increasing order of precedence.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/budget"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/distributed"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fingerprint"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/frontier"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/notify"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/trap"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/warc"
+	"github.com/ivan-vladimirov/monzo-web-crawler/pkg/crawler"
+)
+
+// Config is every setting of a crawl. Field names in files and environment variables follow the
+// json tags; the flag tags name the command-line flag that overrides each one.
+type Config struct {
+	Crawl  Crawl  `json:"crawl"`
+	Fetch  Fetch  `json:"fetch"`
+	Parse  Parse  `json:"parse"`
+	Output Output `json:"output"`
+	Notify Notify `json:"notify"`
+	Traps  Traps  `json:"traps"`
+	Log    Log    `json:"log"`
+}
+
+// Crawl controls what is crawled and how fast.
+type Crawl struct {
+	URLs     []string `json:"urls" flag:"url"`
+	MaxDepth int      `json:"max_depth" flag:"max-depth"`
+	// Delay is the least time between two fetches from one host, like HostDelay; the longer applies.
+	Delay     Duration `json:"delay" flag:"delay"`
+	RateLimit Duration `json:"rate_limit" flag:"rate-limit"`
+	Workers   int      `json:"workers" flag:"workers"`
+	// DuplicateDistance is how many SimHash bits near-duplicate pages may differ in; a negative
+	// distance turns duplicate detection off.
+	DuplicateDistance int  `json:"duplicate_distance" flag:"duplicate-distance"`
+	SkipDuplicates    bool `json:"skip_duplicates" flag:"skip-duplicates"`
+	// The crawl stops once MaxPages, MaxSizeMB or MaxDuration runs out; pages over the per-host
+	// and per-path caps, such as /blog=100, are skipped. Zero is no limit.
+	MaxPages        int      `json:"max_pages" flag:"max-pages"`
+	MaxSizeMB       int64    `json:"max_size_mb" flag:"max-size"`
+	MaxDuration     Duration `json:"max_duration" flag:"max-duration"`
+	MaxPagesPerHost int      `json:"max_pages_per_host" flag:"max-pages-per-host"`
+	MaxPagesPerPath []string `json:"max_pages_per_path" flag:"max-pages-per-path"`
+	// Scorers order the URLs waiting to be crawled, such as "depth" or "regex?pattern=/blog/";
+	// without any, URLs are crawled in the order they are found. HostConcurrency and HostDelay
+	// hold back a host whatever its scores; zero is no limit.
+	Scorers         []string `json:"scorers" flag:"score"`
+	HostConcurrency int      `json:"host_concurrency" flag:"host-concurrency"`
+	HostDelay       Duration `json:"host_delay" flag:"host-delay"`
+}
+
+// Fetch controls how pages are requested.
+type Fetch struct {
+	Timeout        Duration `json:"timeout" flag:"timeout"`
+	RequestTimeout Duration `json:"request_timeout" flag:"request-timeout"`
+	RetryAttempts  int      `json:"retry_attempts" flag:"retry-attempts"`
+	RetryDelay     Duration `json:"retry_delay" flag:"retry-delay"`
+	Middleware     []string `json:"middleware" flag:"middleware"`
+	Replay         []string `json:"replay" flag:"replay"`
+	// Incremental sends conditional requests using the validators of the previous run, which
+	// the command line keeps in State and the service takes from the job's previous run.
+	Incremental bool   `json:"incremental" flag:"incremental"`
+	State       string `json:"state" flag:"state"`
+	// CacheDir keeps responses on disk between runs; Offline serves only from it.
+	CacheDir       string `json:"cache_dir" flag:"cache-dir"`
+	CacheMaxSizeMB int64  `json:"cache_max_size_mb" flag:"cache-max-size"`
+	Offline        bool   `json:"offline" flag:"offline"`
+}
+
+// Parse controls which links found on a page are followed.
+type Parse struct {
+	Subdomains         bool     `json:"subdomains" flag:"subdomains"`
+	ExcludedExtensions []string `json:"excluded_extensions" flag:"exclude-ext"`
+}
+
+// Output controls where results are written.
+type Output struct {
+	Path          string   `json:"path" flag:"output"`
+	Formats       []string `json:"formats" flag:"format"`
+	JSONL         string   `json:"jsonl" flag:"jsonl"`
+	FlushInterval Duration `json:"flush_interval" flag:"flush-interval"`
+	WARCDir       string   `json:"warc_dir" flag:"warc-dir"`
+	WARCPrefix    string   `json:"warc_prefix" flag:"warc-prefix"`
+	WARCMaxSizeMB int64    `json:"warc_max_size_mb" flag:"warc-max-size"`
+	Mirror        string   `json:"mirror" flag:"mirror"`
+	MirrorAssets  bool     `json:"mirror_assets" flag:"mirror-assets"`
+}
+
+// Notify controls who is told when a crawl finishes. Targets are notifier specs such as
+// "webhook?url=https://example.com/hook&on=failed+threshold"; conditions such as "broken > 0"
+// add the threshold event when they are met.
+type Notify struct {
+	Targets    []string `json:"targets" flag:"notify"`
+	Conditions []string `json:"conditions" flag:"notify-when"`
+}
+
+// Traps sets when links count as a spider trap and are not followed; a zero limit turns its check
+// off. Budgets give path patterns their own number of URLs, such as /calendar/**=50.
+type Traps struct {
+	MaxURLLength  int      `json:"max_url_length" flag:"trap-max-url-length"`
+	MaxRepeats    int      `json:"max_repeats" flag:"trap-max-repeats"`
+	PatternBudget int      `json:"pattern_budget" flag:"trap-pattern-budget"`
+	QueryVariants int      `json:"query_variants" flag:"trap-query-variants"`
+	Budgets       []string `json:"budgets" flag:"trap-budget"`
+}
+
+// Log controls logging.
+type Log struct {
+	Level  string `json:"level" flag:"log-level"`
+	Format string `json:"format" flag:"log-format"`
+	File   string `json:"file" flag:"log-file"`
+}
+
+// Default returns the settings used when nothing else is configured.
+func Default() Config {
+	traps := trap.DefaultLimits()
+	return Config{
+		Crawl: Crawl{
+			MaxDepth:  crawler.DefaultMaxDepth,
+			Delay:     Duration(crawler.DefaultDelay),
+			RateLimit: Duration(crawler.DefaultRateLimit),
+			Workers:   crawler.DefaultWorkers,
+
+			DuplicateDistance: fingerprint.DefaultDistance,
+		},
+		Fetch: Fetch{
+			Timeout:        Duration(crawler.DefaultTimeout),
+			RequestTimeout: Duration(fetcher.RequestTimeout),
+			RetryAttempts:  fetcher.MaxRetry,
+			RetryDelay:     Duration(fetcher.InitialRetryDelay),
+			Middleware:     []string{"retry", "logging"},
+			State:          "crawl-state.json",
+			CacheMaxSizeMB: fetcher.DefaultCacheSize >> 20,
+		},
+		Parse: Parse{
+			ExcludedExtensions: append([]string(nil), utils.DefaultExcludedFileTypes...),
+		},
+		Output: Output{
+			Path:          "output.json",
+			Formats:       []string{"json"},
+			FlushInterval: Duration(output.DefaultFlushInterval),
+			WARCPrefix:    "crawl",
+			WARCMaxSizeMB: warc.DefaultMaxSize >> 20,
+		},
+		Traps: Traps{
+			MaxURLLength:  traps.MaxURLLength,
+			MaxRepeats:    traps.MaxRepeats,
+			PatternBudget: traps.PatternBudget,
+			QueryVariants: traps.QueryVariants,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+// Validate checks every setting and reports all problems at once, each prefixed with the
+// setting's name in the file. It only checks the settings: nothing is opened, started or fetched.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, name string, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(c.Crawl.MaxDepth >= 0, "crawl.max_depth", "must not be negative, got %d", c.Crawl.MaxDepth)
+	check(c.Crawl.Delay >= 0, "crawl.delay", "must not be negative, got %s", c.Crawl.Delay)
+	check(c.Crawl.RateLimit > 0, "crawl.rate_limit", "must be positive, got %s", c.Crawl.RateLimit)
+	check(c.Crawl.Workers >= 1, "crawl.workers", "must be at least 1, got %d", c.Crawl.Workers)
+	check(c.Crawl.DuplicateDistance <= fingerprint.MaxDistance, "crawl.duplicate_distance", "must be at most %d, got %d", fingerprint.MaxDistance, c.Crawl.DuplicateDistance)
+	check(c.Crawl.MaxPages >= 0, "crawl.max_pages", "must not be negative, got %d", c.Crawl.MaxPages)
+	check(c.Crawl.MaxSizeMB >= 0, "crawl.max_size_mb", "must not be negative, got %d", c.Crawl.MaxSizeMB)
+	check(c.Crawl.MaxDuration >= 0, "crawl.max_duration", "must not be negative, got %s", c.Crawl.MaxDuration)
+	check(c.Crawl.MaxPagesPerHost >= 0, "crawl.max_pages_per_host", "must not be negative, got %d", c.Crawl.MaxPagesPerHost)
+	if _, err := budget.ParsePathLimits(c.Crawl.MaxPagesPerPath); err != nil {
+		errs = append(errs, fmt.Errorf("crawl.max_pages_per_path: %w", err))
+	}
+	if _, err := frontier.ParseScorers(c.Crawl.Scorers); err != nil {
+		errs = append(errs, fmt.Errorf("crawl.scorers: %w", err))
+	}
+	check(c.Crawl.HostConcurrency >= 0, "crawl.host_concurrency", "must not be negative, got %d", c.Crawl.HostConcurrency)
+	check(c.Crawl.HostDelay >= 0, "crawl.host_delay", "must not be negative, got %s", c.Crawl.HostDelay)
+
+	check(c.Fetch.Timeout > 0, "fetch.timeout", "must be positive, got %s", c.Fetch.Timeout)
+	check(c.Fetch.RequestTimeout > 0, "fetch.request_timeout", "must be positive, got %s", c.Fetch.RequestTimeout)
+	check(c.Fetch.RetryAttempts >= 1, "fetch.retry_attempts", "must be at least 1, got %d", c.Fetch.RetryAttempts)
+	check(c.Fetch.RetryDelay >= 0, "fetch.retry_delay", "must not be negative, got %s", c.Fetch.RetryDelay)
+	if _, err := c.Middlewares(); err != nil {
+		errs = append(errs, fmt.Errorf("fetch.middleware: %w", err))
+	}
+	check(!c.Fetch.Incremental || c.Fetch.State != "", "fetch.state", "must be set for incremental crawls")
+	check(c.Fetch.CacheMaxSizeMB > 0, "fetch.cache_max_size_mb", "must be positive, got %d", c.Fetch.CacheMaxSizeMB)
+	check(!c.Fetch.Offline || c.Fetch.CacheDir != "", "fetch.offline", "needs fetch.cache_dir to serve from")
+
+	for _, ext := range c.Parse.ExcludedExtensions {
+		check(strings.HasPrefix(ext, ".") && len(ext) > 1, "parse.excluded_extensions", "%q must be an extension starting with a dot, such as .pdf", ext)
+	}
+
+	check(c.Output.Path != "", "output.path", "must not be empty")
+	if _, err := output.ParseFormats(strings.Join(c.Output.Formats, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("output.formats: %w", err))
+	}
+	check(c.Output.FlushInterval > 0, "output.flush_interval", "must be positive, got %s", c.Output.FlushInterval)
+	check(c.Output.WARCMaxSizeMB > 0, "output.warc_max_size_mb", "must be positive, got %d", c.Output.WARCMaxSizeMB)
+	check(c.Output.WARCPrefix != "", "output.warc_prefix", "must not be empty")
+
+	if _, err := notify.ParseTargets(c.Notify.Targets); err != nil {
+		errs = append(errs, fmt.Errorf("notify.targets: %w", err))
+	}
+	if _, err := notify.ParseConditions(c.Notify.Conditions); err != nil {
+		errs = append(errs, fmt.Errorf("notify.conditions: %w", err))
+	}
+
+	check(c.Traps.MaxURLLength >= 0, "traps.max_url_length", "must not be negative, got %d", c.Traps.MaxURLLength)
+	check(c.Traps.MaxRepeats >= 0, "traps.max_repeats", "must not be negative, got %d", c.Traps.MaxRepeats)
+	check(c.Traps.PatternBudget >= 0, "traps.pattern_budget", "must not be negative, got %d", c.Traps.PatternBudget)
+	check(c.Traps.QueryVariants >= 0, "traps.query_variants", "must not be negative, got %d", c.Traps.QueryVariants)
+	if _, err := trap.ParseBudgets(c.Traps.Budgets); err != nil {
+		errs = append(errs, fmt.Errorf("traps.budgets: %w", err))
+	}
+
+	if _, err := utils.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format", "must be text or json, got %q", c.Log.Format)
+
+	return errors.Join(errs...)
+}
+
+// Middlewares builds the fetch middleware chain, with the retry settings as the defaults of the
+// retry middleware.
+func (c *Config) Middlewares() ([]fetcher.Middleware, error) {
+	spec := c.Fetch.Middleware
+	// With a cache directory the cache goes innermost, unless the chain places it already, so
+	// cached responses are still logged but neither rate limited nor sent.
+	if c.Fetch.CacheDir != "" && !slices.ContainsFunc(spec, func(entry string) bool {
+		name, _, _ := strings.Cut(strings.TrimSpace(entry), "?")
+		return name == "cache"
+	}) {
+		spec = append(spec[:len(spec):len(spec)], "cache")
+	}
+	return fetcher.ParseMiddlewaresWithDefaults(strings.Join(spec, ","), map[string]url.Values{
+		"retry": {
+			"attempts": {strconv.Itoa(c.Fetch.RetryAttempts)},
+			"delay":    {c.Fetch.RetryDelay.String()},
+		},
+		"cache": {
+			"dir":         {c.Fetch.CacheDir},
+			"max_size_mb": {strconv.FormatInt(c.Fetch.CacheMaxSizeMB, 10)},
+			"offline":     {strconv.FormatBool(c.Fetch.Offline)},
+		},
+	})
+}
+
+// Notifiers builds the notification targets and the conditions checked for them.
+func (c *Config) Notifiers() ([]notify.Target, []notify.Condition, error) {
+	targets, err := notify.ParseTargets(c.Notify.Targets)
+	if err != nil {
+		return nil, nil, err
+	}
+	conditions, err := notify.ParseConditions(c.Notify.Conditions)
+	if err != nil {
+		return nil, nil, err
+	}
+	return targets, conditions, nil
+}
+
+// CrawlerOptions returns the options for a crawler with these crawl, fetch, parse and trap
+// settings, budgets included, and the replay archives, WARC files, mirror and JSONL stream they
+// name.
+func (c *Config) CrawlerOptions() ([]crawler.Option, error) {
+	middlewares, err := c.Middlewares()
+	if err != nil {
+		return nil, err
+	}
+	traps, err := c.trapLimits()
+	if err != nil {
+		return nil, err
+	}
+	limits, err := c.budgetLimits()
+	if err != nil {
+		return nil, err
+	}
+	scorers, err := frontier.ParseScorers(c.Crawl.Scorers)
+	if err != nil {
+		return nil, err
+	}
+	opts := []crawler.Option{
+		crawler.WithMaxDepth(c.Crawl.MaxDepth),
+		crawler.WithDelay(time.Duration(c.Crawl.Delay)),
+		crawler.WithRateLimit(time.Duration(c.Crawl.RateLimit)),
+		crawler.WithWorkers(c.Crawl.Workers),
+		crawler.WithDuplicateDistance(c.Crawl.DuplicateDistance),
+		crawler.WithSkipDuplicates(c.Crawl.SkipDuplicates),
+		crawler.WithTimeout(time.Duration(c.Fetch.Timeout)),
+		crawler.WithRequestTimeout(time.Duration(c.Fetch.RequestTimeout)),
+		crawler.WithExcludedFileTypes(c.Parse.ExcludedExtensions...),
+		crawler.WithSubdomains(c.Parse.Subdomains),
+		crawler.WithMiddlewares(middlewares...),
+		crawler.WithTrapLimits(traps),
+		crawler.WithBudget(limits),
+		crawler.WithScorers(scorers...),
+		crawler.WithPoliteness(crawler.Politeness{
+			HostConcurrency: c.Crawl.HostConcurrency,
+			HostDelay:       time.Duration(c.Crawl.HostDelay),
+		}),
+	}
+	if len(c.Fetch.Replay) > 0 {
+		opts = append(opts, crawler.WithReplay(c.Fetch.Replay...))
+	}
+	if c.Output.WARCDir != "" {
+		opts = append(opts, crawler.WithWARC(c.Output.WARCDir, c.Output.WARCPrefix, c.Output.WARCMaxSizeMB<<20))
+	}
+	if c.Output.Mirror != "" {
+		opts = append(opts, crawler.WithMirror(c.Output.Mirror, c.Output.MirrorAssets))
+	}
+	if c.Output.JSONL != "" {
+		opts = append(opts, crawler.WithJSONL(c.Output.JSONL, time.Duration(c.Output.FlushInterval)))
+	}
+	return opts, nil
+}
+
+// ConfigureCoordinator applies the settings that decide which URLs are handed out to coord: the
+// excluded file types, trap limits, budgets, politeness, with crawl.delay as the least host
+// delay, and duplicate detection. Settings a coordinator cannot apply, such as crawl.scorers, are
+// reported as errors.
+func (c *Config) ConfigureCoordinator(coord *distributed.Coordinator) error {
+	if len(c.Crawl.Scorers) > 0 {
+		return errors.New("crawl.scorers: not supported in coordinator mode")
+	}
+	traps, err := c.trapLimits()
+	if err != nil {
+		return err
+	}
+	limits, err := c.budgetLimits()
+	if err != nil {
+		return err
+	}
+	if c.Parse.ExcludedExtensions != nil {
+		coord.SetExcludedFileTypes(c.Parse.ExcludedExtensions)
+	}
+	coord.SetTraps(trap.New(traps))
+	coord.SetBudget(budget.New(limits))
+	coord.SetPoliteness(frontier.Politeness{
+		HostConcurrency: c.Crawl.HostConcurrency,
+		HostDelay:       max(time.Duration(c.Crawl.HostDelay), time.Duration(c.Crawl.Delay)),
+	})
+	if c.Crawl.DuplicateDistance >= 0 {
+		coord.SetDuplicates(fingerprint.NewIndex(c.Crawl.DuplicateDistance), c.Crawl.SkipDuplicates)
+	}
+	return nil
+}
+
+// trapLimits returns the trap settings as the limits of a trap detector.
+func (c *Config) trapLimits() (trap.Limits, error) {
+	budgets, err := trap.ParseBudgets(c.Traps.Budgets)
+	if err != nil {
+		return trap.Limits{}, err
+	}
+	return trap.Limits{
+		MaxURLLength:  c.Traps.MaxURLLength,
+		MaxRepeats:    c.Traps.MaxRepeats,
+		PatternBudget: c.Traps.PatternBudget,
+		QueryVariants: c.Traps.QueryVariants,
+		Budgets:       budgets,
+	}, nil
+}
+
+// budgetLimits returns the crawl budgets.
+func (c *Config) budgetLimits() (budget.Limits, error) {
+	paths, err := budget.ParsePathLimits(c.Crawl.MaxPagesPerPath)
+	if err != nil {
+		return budget.Limits{}, err
+	}
+	return budget.Limits{
+		MaxPages:        c.Crawl.MaxPages,
+		MaxBytes:        c.Crawl.MaxSizeMB << 20,
+		MaxDuration:     time.Duration(c.Crawl.MaxDuration),
+		MaxPagesPerHost: c.Crawl.MaxPagesPerHost,
+		MaxPagesPerPath: paths,
+	}, nil
+}
+
+// Duration is a time.Duration written as a string such as "500ms" or "1m30s".
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("must be a duration such as \"500ms\", got %s", data)
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("must be a duration such as \"500ms\", got %q", s)
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,190 @@
+package config_test
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/config"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/distributed"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/store"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestLoad_AppliesFileProfileEnvAndFlagsInOrder(t *testing.T) {
+	path := writeFile(t, "crawler.yaml", `
+crawl:
+  urls: [https://monzo.com]
+  max_depth: 5
+  workers: 8
+fetch:
+  retry_delay: 250ms
+parse:
+  excluded_extensions: [.pdf, .zip]
+output:
+  formats: [json, csv]
+profiles:
+  gentle:
+    crawl:
+      workers: 1
+`)
+	t.Setenv("CRAWLER_FETCH_RETRY_ATTEMPTS", "7")
+	t.Setenv("CRAWLER_CRAWL_MAX_DEPTH", "4")
+
+	cfg, err := config.Load(path, "gentle")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	fs := flag.NewFlagSet("crawler", flag.ContinueOnError)
+	fs.Int("max-depth", 3, "")
+	fs.Duration("delay", 0, "")
+	if err := fs.Parse([]string{"-max-depth=1"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if err := cfg.ApplyFlags(fs); err != nil {
+		t.Fatalf("ApplyFlags failed: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	checks := []struct {
+		name      string
+		got, want any
+	}{
+		{"urls from the file", strings.Join(cfg.Crawl.URLs, ","), "https://monzo.com"},
+		{"workers from the file's profile over the built-in one", cfg.Crawl.Workers, 1},
+		{"rate limit from the built-in profile", cfg.Crawl.RateLimit, config.Duration(time.Second)},
+		{"retry delay from the built-in profile over the file", cfg.Fetch.RetryDelay, config.Duration(2 * time.Second)},
+		{"retry attempts from the environment", cfg.Fetch.RetryAttempts, 7},
+		{"max depth from the flag over the environment", cfg.Crawl.MaxDepth, 1},
+		{"delay from the profile, as the flag was not set", cfg.Crawl.Delay, config.Duration(time.Second)},
+		{"excluded extensions from the file", strings.Join(cfg.Parse.ExcludedExtensions, ","), ".pdf,.zip"},
+		{"formats from the file", strings.Join(cfg.Output.Formats, ","), "json,csv"},
+		{"log level left at its default", cfg.Log.Level, "info"},
+	}
+	for _, check := range checks {
+		if check.got != check.want {
+			t.Errorf("Expected %s to be %v, got %v", check.name, check.want, check.got)
+		}
+	}
+}
+
+func TestLoad_ReadsTOML(t *testing.T) {
+	path := writeFile(t, "crawler.toml", `
+[crawl]
+workers = 3
+delay = "2s"
+
+[profiles.nightly.output]
+path = "nightly.json"
+`)
+	cfg, err := config.Load(path, "nightly")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Crawl.Workers != 3 || cfg.Crawl.Delay != config.Duration(2*time.Second) || cfg.Output.Path != "nightly.json" {
+		t.Errorf("Unexpected settings: %+v", cfg)
+	}
+}
+
+func TestLoad_ReportsClearErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		profile string
+		env     string
+		want    string
+	}{
+		{"unknown setting", "crawl:\n  wokers: 2\n", "", "", "crawl.wokers: unknown setting"},
+		{"wrong type", "fetch:\n  timeout: 5\n", "", "", `fetch.timeout: must be a duration such as "500ms"`},
+		{"unknown profile", "crawl:\n  workers: 2\n", "nightly", "", `unknown profile "nightly" (available: ci, gentle)`},
+		{"bad environment variable", "", "", "many", `CRAWLER_CRAWL_WORKERS: must be a whole number, got "many"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.file != "" {
+				path = writeFile(t, "crawler.yaml", tt.file)
+			}
+			if tt.env != "" {
+				t.Setenv("CRAWLER_CRAWL_WORKERS", tt.env)
+			}
+			_, err := config.Load(path, tt.profile)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestValidate_ReportsEveryProblem(t *testing.T) {
+	cfg := config.Default()
+	cfg.Crawl.Workers = 0
+	cfg.Fetch.Middleware = []string{"retry", "teleport"}
+	cfg.Parse.ExcludedExtensions = []string{"pdf"}
+	cfg.Output.Formats = []string{"yaml"}
+	cfg.Log.Format = "xml"
+	cfg.Fetch.Offline = true
+	cfg.Crawl.MaxPagesPerPath = []string{"/blog"}
+	cfg.Crawl.Scorers = []string{"pagerank"}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Expected validation errors")
+	}
+	for _, want := range []string{
+		"crawl.workers: must be at least 1, got 0",
+		`fetch.middleware: unknown middleware "teleport"`,
+		`parse.excluded_extensions: "pdf" must be an extension starting with a dot`,
+		"output.formats:",
+		`log.format: must be text or json, got "xml"`,
+		"fetch.offline: needs fetch.cache_dir",
+		`crawl.max_pages_per_path: path budget "/blog" must be prefix=max`,
+		`crawl.scorers: unknown scorer "pagerank"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in the errors, got:\n%v", want, err)
+		}
+	}
+
+	defaults := config.Default()
+	if err := defaults.Validate(); err != nil {
+		t.Errorf("Expected the defaults to be valid, got %v", err)
+	}
+
+	// Validating touches nothing: the cache directory and the sitemap are left for the crawl.
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	defaults.Fetch.CacheDir = cacheDir
+	defaults.Crawl.Scorers = []string{"sitemap?src=" + filepath.Join(t.TempDir(), "missing.xml")}
+	if err := defaults.Validate(); err != nil {
+		t.Errorf("Expected a cache and a sitemap that are not there yet to be valid, got %v", err)
+	}
+	if _, err := os.Stat(cacheDir); !os.IsNotExist(err) {
+		t.Errorf("Expected Validate not to create the cache directory, got %v", err)
+	}
+}
+
+func TestConfigureCoordinator_RejectsScorers(t *testing.T) {
+	cfg := config.Default()
+	cfg.Crawl.Scorers = []string{"depth"}
+
+	coord := distributed.NewCoordinator("https://example.com", 3, time.Minute, store.NewMemory(), utils.NewLogger())
+	err := cfg.ConfigureCoordinator(coord)
+	if err == nil || !strings.Contains(err.Error(), "crawl.scorers: not supported in coordinator mode") {
+		t.Errorf("Expected scorers to be rejected in coordinator mode, got %v", err)
+	}
+}
@@ -0,0 +1,386 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the name of every environment variable that overrides a setting. The rest of
+// the name is the setting's path in upper case, such as CRAWLER_CRAWL_WORKERS for crawl.workers.
+const EnvPrefix = "CRAWLER_"
+
+// ProfileEnv selects a profile when none is passed to Load.
+const ProfileEnv = EnvPrefix + "PROFILE"
+
+// builtinProfiles can be selected without defining them in a file. A file may define a profile
+// with the same name, whose settings are applied on top.
+var builtinProfiles = map[string]map[string]any{
+	// gentle crawls slowly, a second between requests, backs off for longer and obeys robots.txt.
+	"gentle": {
+		"crawl": map[string]any{"workers": 2, "delay": "1s", "rate_limit": "1s"},
+		"fetch": map[string]any{
+			"request_timeout": "10s",
+			"retry_attempts":  5,
+			"retry_delay":     "2s",
+			"middleware":      []any{"robots", "retry", "logging"},
+		},
+	},
+	// ci crawls a shallow slice of the site quickly and logs machine-readable warnings only.
+	"ci": {
+		"crawl": map[string]any{"max_depth": 2, "workers": 4, "delay": "0s", "rate_limit": "10ms"},
+		"fetch": map[string]any{"timeout": "5s", "retry_attempts": 1},
+		"log":   map[string]any{"level": "warn", "format": "json"},
+	},
+}
+
+// Profiles returns the names of the built-in profiles in alphabetical order.
+func Profiles() []string {
+	return sortedKeys(builtinProfiles)
+}
+
+// Load returns the default settings overridden, in order, by the file at path, the named profile
+// and environment variables. path may be empty to use no file; profile may be empty to use the
+// one named by CRAWLER_PROFILE, if any. The result is not validated, so flags can still be
+// applied; call Validate once they are.
+func Load(path string, profile string) (Config, error) {
+	var doc map[string]any
+	if path != "" {
+		var err error
+		doc, err = readFile(path)
+		if err != nil {
+			return Default(), err
+		}
+	}
+	if profile == "" {
+		profile = os.Getenv(ProfileEnv)
+	}
+	cfg, err := load(doc, profile)
+	if err != nil {
+		if path != "" && !errors.Is(err, errUnknownProfile) {
+			err = fmt.Errorf("%s: %w", path, err)
+		}
+		return cfg, err
+	}
+
+	if err := applyEnv(&cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// Decode reads settings in format ("yaml", "toml" or "json") on top of the defaults, then
+// applies the named profile if profile is not empty. Unlike Load, it ignores environment
+// variables.
+func Decode(data []byte, format string, profile string) (Config, error) {
+	doc, err := unmarshal(data, format)
+	if err != nil {
+		return Default(), err
+	}
+	return load(doc, profile)
+}
+
+var errUnknownProfile = errors.New("unknown profile")
+
+// load applies doc, without its profiles, and then the named profile to the defaults.
+func load(doc map[string]any, profile string) (Config, error) {
+	cfg := Default()
+	profiles, err := fileProfiles(doc)
+	if err != nil {
+		return cfg, err
+	}
+	settings := make(map[string]any, len(doc))
+	for key, value := range doc {
+		if key != "profiles" {
+			settings[key] = value
+		}
+	}
+	if err := decode(settings, &cfg); err != nil {
+		return cfg, err
+	}
+	if profile == "" {
+		return cfg, nil
+	}
+
+	builtin, isBuiltin := builtinProfiles[profile]
+	custom, isCustom := profiles[profile]
+	if !isBuiltin && !isCustom {
+		names := Profiles()
+		for _, name := range sortedKeys(profiles) {
+			if _, ok := builtinProfiles[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		return cfg, fmt.Errorf("%w %q (available: %s)", errUnknownProfile, profile, strings.Join(names, ", "))
+	}
+	if err := decode(builtin, &cfg); err != nil {
+		return cfg, fmt.Errorf("profile %s: %w", profile, err)
+	}
+	if err := decode(custom, &cfg); err != nil {
+		return cfg, fmt.Errorf("profiles.%s.%w", profile, err)
+	}
+	return cfg, nil
+}
+
+// ApplyFlags overrides settings with every flag that was set on fs and names a setting.
+func (c *Config) ApplyFlags(fs *flag.FlagSet) error {
+	fields := make(map[string]reflect.Value)
+	walk(reflect.ValueOf(c).Elem(), "", func(field reflect.StructField, value reflect.Value, path string) {
+		if name := field.Tag.Get("flag"); name != "" {
+			fields[name] = value
+		}
+	})
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		value, ok := fields[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		if setErr := setString(value, f.Value.String()); setErr != nil {
+			err = fmt.Errorf("-%s: %w", f.Name, setErr)
+		}
+	})
+	return err
+}
+
+func readFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var format string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = "yaml"
+	case ".toml":
+		format = "toml"
+	case ".json":
+		format = "json"
+	default:
+		return nil, fmt.Errorf("%s: unknown config format, expected a .yaml, .yml, .toml or .json file", path)
+	}
+	doc, err := unmarshal(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return doc, nil
+}
+
+func unmarshal(data []byte, format string) (map[string]any, error) {
+	doc := make(map[string]any)
+	var err error
+	switch format {
+	case "yaml":
+		err = yaml.Unmarshal(data, &doc)
+	case "toml":
+		err = toml.Unmarshal(data, &doc)
+	case "json":
+		err = json.Unmarshal(data, &doc)
+	default:
+		return nil, fmt.Errorf("unknown config format %q, expected yaml, toml or json", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func fileProfiles(doc map[string]any) (map[string]map[string]any, error) {
+	raw, ok := doc["profiles"]
+	if !ok {
+		return nil, nil
+	}
+	table, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("profiles: must be a table of named profiles")
+	}
+	profiles := make(map[string]map[string]any, len(table))
+	for name, settings := range table {
+		profile, ok := settings.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("profiles.%s: must be a table of settings", name)
+		}
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+// decode sets the fields of cfg named in doc, leaving the others untouched.
+func decode(doc map[string]any, cfg *Config) error {
+	return decodeStruct(doc, reflect.ValueOf(cfg).Elem(), "")
+}
+
+func decodeStruct(doc map[string]any, v reflect.Value, prefix string) error {
+	fields := make(map[string]int)
+	for i := 0; i < v.NumField(); i++ {
+		fields[v.Type().Field(i).Tag.Get("json")] = i
+	}
+
+	for _, key := range sortedKeys(doc) {
+		path := prefix + key
+		i, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("%s: unknown setting (expected one of %s)", path, strings.Join(sortedKeys(fields), ", "))
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			table, ok := doc[key].(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: must be a table of settings", path)
+			}
+			if err := decodeStruct(table, field, path+"."); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := setValue(field, doc[key]); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// setValue sets a setting from a value decoded from a file.
+func setValue(field reflect.Value, value any) error {
+	if s, ok := value.(string); ok {
+		return setString(field, s)
+	}
+
+	switch {
+	case field.Type() == durationType:
+		return fmt.Errorf("must be a duration such as \"500ms\", got %v", value)
+	case field.Kind() == reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("must be true or false, got %v", value)
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Int || field.Kind() == reflect.Int64:
+		n, ok := wholeNumber(value)
+		if !ok {
+			return fmt.Errorf("must be a whole number, got %v", value)
+		}
+		field.SetInt(n)
+	case field.Kind() == reflect.Slice:
+		items, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("must be a list of strings, got %v", value)
+		}
+		list := make([]string, 0, len(items))
+		for _, item := range items {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("must be a list of strings, got %v in it", item)
+			}
+			list = append(list, s)
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("must be text, got %v", value)
+	}
+	return nil
+}
+
+func wholeNumber(value any) (int64, bool) {
+	switch n := value.(type) {
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	case float64:
+		return int64(n), n == math.Trunc(n)
+	}
+	return 0, false
+}
+
+// setString sets a setting from text, as given in an environment variable or flag. Lists are
+// comma-separated.
+func setString(field reflect.Value, s string) error {
+	switch {
+	case field.Type() == durationType:
+		return field.Addr().Interface().(*Duration).parse(s)
+	case field.Kind() == reflect.String:
+		field.SetString(s)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("must be true or false, got %q", s)
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Int || field.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("must be a whole number, got %q", s)
+		}
+		field.SetInt(n)
+	case field.Kind() == reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	}
+	return nil
+}
+
+// applyEnv overrides settings with the environment variables named after them.
+func applyEnv(cfg *Config) error {
+	var err error
+	walk(reflect.ValueOf(cfg).Elem(), "", func(field reflect.StructField, value reflect.Value, path string) {
+		name := EnvName(path)
+		s, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+		if setErr := setString(value, s); setErr != nil {
+			err = fmt.Errorf("%s: %w", name, setErr)
+		}
+	})
+	return err
+}
+
+// EnvName returns the environment variable that overrides the setting at path, such as
+// "crawl.workers".
+func EnvName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// walk calls fn for every setting in v, with its dotted path.
+func walk(v reflect.Value, prefix string, fn func(field reflect.StructField, value reflect.Value, path string)) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		path := prefix + field.Tag.Get("json")
+		if field.Type.Kind() == reflect.Struct {
+			walk(v.Field(i), path+".", fn)
+			continue
+		}
+		fn(field, v.Field(i), path)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
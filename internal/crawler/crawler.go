@@ -1,32 +1,156 @@
 package crawler
 
 import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/budget"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fingerprint"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/frontier"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/metrics"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/parser"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shard"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shared"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/tracing"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/trap"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Crawler struct {
-	fetcher     *fetcher.Fetcher
-	parser      *parser.Parser
-	logger      *utils.Logger
-	rateLimiter *time.Ticker
-	workerPool  chan struct{}
+	fetcher   *fetcher.Fetcher
+	parser    *parser.Parser
+	logger    *utils.Logger
+	frontier  *frontier.Frontier
+	shard     *shard.Assignment
+	forwarder shard.Forwarder
+	forwarded sync.Map
+	referrers sync.Map
+	sink      output.Sink
+	metrics   *metrics.Crawl
+	handlers  []EventHandler
+	tracer    *tracing.Tracer
+	fileTypes []string
+
+	// previous holds the pages of the last crawl by URL, for conditional requests.
+	previous map[string]output.Record
+
+	duplicates     *fingerprint.Index
+	skipDuplicates bool
+	traps          *trap.Detector
+	budget         *budget.Tracker
+
+	linkFilters    []LinkFilter
+	requestFilters []RequestFilter
+	stopped        atomic.Bool
+
+	// halt is cancelled once a crawl-wide budget runs out, cancelling the fetches under way.
+	halt   context.Context
+	cancel context.CancelFunc
+}
+
+func NewCrawler(fetcherInstance *fetcher.Fetcher, parser *parser.Parser, logger *utils.Logger, rateLimiter *time.Ticker, workerPoolSize int) *Crawler {
+	c := &Crawler{
+		fetcher:   fetcherInstance,
+		parser:    parser,
+		logger:    logger,
+		frontier:  frontier.New(workerPoolSize, frontier.Politeness{}),
+		fileTypes: utils.DefaultExcludedFileTypes,
+	}
+	c.halt, c.cancel = context.WithCancel(context.Background())
+	// Requests are spaced out by the rate limiter closest to the network, so retries wait too.
+	fetcherInstance.Use(fetcher.RateLimit(rateLimiter.C))
+	parser.SetSkipHandler(c.parserSkipped)
+	return c
+}
+
+// Stop makes the crawler skip every URL it has not started fetching yet. Pages already being
+// fetched finish normally, so Crawl returns soon after.
+func (c *Crawler) Stop() {
+	c.stopped.Store(true)
+}
+
+// SetFrontier replaces the frontier that hands out worker slots, which by default has as many
+// slots as the worker pool size and lets URLs through in the order they arrive.
+func (c *Crawler) SetFrontier(f *frontier.Frontier) {
+	c.frontier = f
+}
+
+// SetExcludedFileTypes replaces the file extensions, such as ".pdf", whose URLs are skipped
+// instead of fetched. It defaults to utils.DefaultExcludedFileTypes.
+func (c *Crawler) SetExcludedFileTypes(types []string) {
+	c.fileTypes = types
 }
 
-func NewCrawler(fetcher *fetcher.Fetcher, parser *parser.Parser, logger *utils.Logger, rateLimiter *time.Ticker, workerPoolSize int) *Crawler {
-	return &Crawler{
-		fetcher:     fetcher,
-		parser:      parser,
-		logger:      logger,
-		rateLimiter: rateLimiter,
-		workerPool:  make(chan struct{}, workerPoolSize), // Worker pool size
+// SetPrevious makes the crawl incremental: pages of previous that had an ETag or Last-Modified
+// header are requested with If-None-Match or If-Modified-Since, and if the server answers 304 Not
+// Modified, their links are followed from previous instead of being parsed again.
+func (c *Crawler) SetPrevious(previous *output.Result) {
+	c.previous = make(map[string]output.Record, len(previous.Pages))
+	for _, record := range previous.Pages {
+		if record.Status == http.StatusOK && (record.ETag != "" || record.LastModified != "") {
+			c.previous[record.URL] = record
+		}
 	}
 }
 
+// SetDuplicates looks up every page's fingerprint in index, so records of pages repeating an
+// earlier page's text name it in DuplicateOf. If skip is set, links on those pages are not followed.
+func (c *Crawler) SetDuplicates(index *fingerprint.Index, skip bool) {
+	c.duplicates = index
+	c.skipDuplicates = skip
+}
+
+// SetTraps checks every internal link with detector before it is queued, and skips those that
+// fall into a spider trap with the reason "trap".
+func (c *Crawler) SetTraps(detector *trap.Detector) {
+	c.traps = detector
+}
+
+// SetBudget takes every page out of tracker before fetching it. URLs over a per-host or per-path
+// cap are skipped with the reason "budget"; once a crawl-wide budget runs out, the crawler stops
+// and the fetches under way are cancelled.
+func (c *Crawler) SetBudget(tracker *budget.Tracker) {
+	c.budget = tracker
+	tracker.OnExhausted(func(name string) {
+		c.exhaust(name, c.logger)
+		c.cancel()
+	})
+}
+
+// SetSharding restricts the crawler to hosts owned by the given shard. Links to hosts owned
+// by other shards are handed to the forwarder instead of being crawled locally.
+func (c *Crawler) SetSharding(assignment *shard.Assignment, forwarder shard.Forwarder) {
+	c.shard = assignment
+	c.forwarder = forwarder
+}
+
+// SetSink streams a record for every fetched page to sink as soon as the page completes.
+func (c *Crawler) SetSink(sink output.Sink) {
+	c.sink = sink
+}
+
+// SetMetrics records crawl metrics in m, including those of the crawler's fetcher and parser.
+func (c *Crawler) SetMetrics(m *metrics.Crawl) {
+	c.metrics = m
+	c.fetcher.SetMetrics(m)
+	c.parser.SetMetrics(m)
+}
+
+// SetTracer records a span for every crawled URL, with the fetcher's spans and link filtering
+// as children.
+func (c *Crawler) SetTracer(tracer *tracing.Tracer) {
+	c.tracer = tracer
+	c.fetcher.SetTracer(tracer)
+}
+
 // Crawl recursively visits a given URL and extracts internal links within the same domain and subdomain.
 // It ensures depth constraints, avoids duplicate crawling using a mutex-protected map, and filters out
 // unnecessary links such as those pointing to non-HTML files or fragments.
@@ -43,6 +167,7 @@ func NewCrawler(fetcher *fetcher.Fetcher, parser *parser.Parser, logger *utils.L
 // Behavior:
 // - Normalizes the URL to maintain consistency and detect duplicates.
 // - Skips URLs exceeding max depth, those with invalid formats, or non-HTML file extensions.
+// - Waits for the frontier to hand it a worker slot, so the best-scored waiting URLs are fetched first.
 // - Fetches links from the URL using the fetcher package, then filters internal links via the parser package.
 // - Uses concurrency with goroutines to crawl multiple links in parallel, while ensuring thread safety.
 //
@@ -52,62 +177,307 @@ func (c *Crawler) Crawl(url string, maxDepth int, baseURL string, delay time.Dur
 	defer wg.Done()
 
 	depth, err := utils.CalculateDepthFromPath(url)
-	logger.Info.Printf("Depth: %d, URL: %s\n", depth, url)
 	if err != nil {
-		logger.Error.Println("Error calculating depth for URL:", url, err)
+		logger.Warn("Error calculating depth for URL", "url", url, "error", err)
 		return
 	}
 
 	if depth > maxDepth {
-		logger.Info.Printf("[MAX DEPTH REACHED] Depth: %d, URL: %s\n", depth, url)
+		logger.Debug("Skipping URL", "url", url, "depth", depth, "reason", "max_depth")
+		c.skip(url, depth, metrics.SkipMaxDepth)
 		return
 	}
 
-	if utils.IsExcludedFileType(url) {
-		logger.Info.Printf("[SKIPPED FILE] Filetype at Depth: %d, URL: %s\n", depth, url)
+	if utils.HasFileType(url, c.fileTypes) {
+		logger.Debug("Skipping URL", "url", url, "depth", depth, "reason", "file_type")
+		c.skip(url, depth, metrics.SkipFileType)
 		return
 	}
 
 	canonicalURL, err := utils.NormalizeURL(url, baseURL)
 	if err != nil {
-		logger.Error.Printf("[MALFORMED] Skipping malformed URL: %s, Error: %v\n", url, err)
+		logger.Warn("Skipping URL", "url", url, "depth", depth, "reason", "malformed", "error", err)
+		c.skip(url, depth, metrics.SkipMalformed)
 		return
 	}
 
 	if used.IsCrawledURL(canonicalURL) {
-		logger.Info.Printf("[DUPLICATE] Depth: %d, URL: %s\n", depth, canonicalURL)
+		logger.Debug("Skipping URL", "url", canonicalURL, "depth", depth, "reason", "duplicate")
+		c.skip(canonicalURL, depth, metrics.SkipDuplicate)
 		return
 	}
 
-	c.workerPool <- struct{}{}
-	defer func() { <-c.workerPool }()
-	<-c.rateLimiter.C
+	if c.stopped.Load() {
+		c.skip(canonicalURL, depth, metrics.SkipStopped)
+		return
+	}
+
+	request := &Request{URL: canonicalURL, Depth: depth, Header: make(http.Header)}
+	if !c.allowRequest(request) {
+		logger.Debug("Skipping URL", "url", canonicalURL, "depth", depth, "reason", "filtered")
+		c.skip(canonicalURL, depth, metrics.SkipFiltered)
+		return
+	}
+
+	c.metrics.Enqueue()
+	c.emit(Event{Type: EventQueued, URL: canonicalURL, Depth: depth})
+	referrer, _ := c.referrers.Load(canonicalURL)
+	referrerURL, _ := referrer.(string)
+	release := c.frontier.Acquire(frontier.Candidate{URL: canonicalURL, Depth: depth, Referrer: referrerURL})
+	c.metrics.Dequeue()
+	c.metrics.WorkerStarted()
+	defer func() {
+		c.metrics.WorkerDone()
+		release()
+	}()
+	if c.stopped.Load() {
+		c.skip(canonicalURL, depth, metrics.SkipStopped)
+		return
+	}
+
+	if c.budget != nil {
+		if name := c.budget.Admit(canonicalURL); name != "" {
+			// A crawl-wide budget has stopped the crawl through OnExhausted.
+			if c.budget.Exhausted() != "" {
+				c.skip(canonicalURL, depth, metrics.SkipStopped)
+				return
+			}
+			logger.Debug("Skipping URL", "url", canonicalURL, "depth", depth, "reason", "budget", "budget", name)
+			c.skip(canonicalURL, depth, metrics.SkipBudget)
+			return
+		}
+	}
+
+	logger.Debug("Crawling URL", "url", canonicalURL, "depth", depth)
 
-	logger.Info.Printf("[CRAWLED] Depth: %d, URL: %s\n", depth, canonicalURL)
+	ctx, span := c.tracer.Start(c.halt, "crawl", tracing.KindInternal, tracing.String("url", canonicalURL), tracing.Int("depth", depth))
+	defer span.End()
+	previous, conditional := c.previous[canonicalURL]
+	if conditional {
+		if previous.ETag != "" {
+			request.Header.Set("If-None-Match", previous.ETag)
+		}
+		if previous.LastModified != "" {
+			request.Header.Set("If-Modified-Since", previous.LastModified)
+		}
+	}
+	if len(request.Header) > 0 {
+		ctx = fetcher.WithHeader(ctx, request.Header)
+	}
+	ctx = fetcher.WithCrawlInfo(ctx, fetcher.CrawlInfo{Depth: depth, Referrer: referrerURL})
 
-	links, err := c.fetcher.FetchLinks(canonicalURL, logger)
+	start := time.Now()
+	page, err := c.fetcher.FetchContext(ctx, canonicalURL, logger)
+	if errors.Is(err, fetcher.ErrDisallowed) {
+		if c.budget != nil {
+			c.budget.Release(canonicalURL)
+		}
+		c.skip(canonicalURL, depth, metrics.SkipRobots)
+		return
+	}
+	if err != nil && c.halt.Err() != nil {
+		logger.Debug("Skipping URL", "url", canonicalURL, "depth", depth, "reason", "stopped", "error", err)
+		c.skip(canonicalURL, depth, metrics.SkipStopped)
+		return
+	}
 	if err != nil {
-		logger.Info.Printf("[ERROR] Depth: %d, URL: %s, Error: %v\n", depth, canonicalURL, err)
+		logger.Warn("Failed to fetch URL", "url", canonicalURL, "depth", depth, "error", err)
+		span.RecordError(err)
+		c.metrics.ObservePage(statusOf(err))
+		c.emit(Event{Type: EventFailed, URL: canonicalURL, Depth: depth, Status: statusOf(err), Duration: time.Since(start), Err: err})
+		c.emitError(canonicalURL, depth, err, logger)
 		return
 	}
+	if c.budget != nil {
+		c.budget.AddBytes(len(page.Body))
+	}
+	content := fingerprint.Of(page.Body)
+	if page.NotModified {
+		if !conditional {
+			err := errors.New("304 Not Modified for a request that was not conditional")
+			logger.Warn("Failed to fetch URL", "url", canonicalURL, "depth", depth, "error", err)
+			span.RecordError(err)
+			c.metrics.ObservePage(page.StatusCode)
+			c.emit(Event{Type: EventFailed, URL: canonicalURL, Depth: depth, Status: page.StatusCode, Duration: page.Duration, Err: err})
+			c.emitError(canonicalURL, depth, err, logger)
+			return
+		}
+		logger.Debug("Page not modified, reusing its links", "url", canonicalURL, "links", len(previous.Links))
+		for _, link := range previous.Links {
+			page.Links[link] = true
+		}
+		page.Title, page.Canonical = previous.Title, previous.Canonical
+		content, _ = fingerprint.Parse(previous.TextHash, previous.SimHash)
+	}
+	var duplicateOf string
+	if c.duplicates != nil {
+		duplicateOf, _ = c.duplicates.Add(canonicalURL, content)
+	}
 	used.AddCrawledURL(canonicalURL)
+	span.SetAttributes(tracing.Int("http.status_code", page.StatusCode))
+	c.metrics.ObservePage(page.StatusCode)
+	c.emit(Event{Type: EventFetched, URL: canonicalURL, Depth: depth, Status: page.StatusCode, Duration: page.Duration, Page: page})
+	c.emitPage(page, depth, content, duplicateOf, logger)
+	if duplicateOf != "" && c.skipDuplicates {
+		logger.Debug("Not following links of duplicate page", "url", canonicalURL, "duplicate_of", duplicateOf)
+		return
+	}
 
+	links := page.Links
+	if c.traps != nil {
+		c.traps.ObserveLinks(canonicalURL, links)
+	}
+	c.frontier.ObserveLinks(canonicalURL, links)
+
+	_, checkSpan := c.tracer.Start(ctx, "check_internal", tracing.KindInternal, tracing.Int("links", len(links)))
 	internalLinks := c.parser.CheckInternal(url, links, logger, canonicalURL, used)
+	checkSpan.SetAttributes(tracing.Int("internal_links", len(internalLinks)))
+	checkSpan.End()
 	if len(internalLinks) == 0 {
-		logger.Info.Printf("[SKIPPED] No valid internal links found for URL: %s\n", canonicalURL)
+		logger.Debug("No valid internal links found", "url", canonicalURL, "depth", depth)
 		return
 	}
 
 	for _, link := range internalLinks {
 		normalizedLink, err := utils.NormalizeURL(link, baseURL)
 		if err != nil {
-			logger.Error.Printf("[MALFORMED] Skipping malformed URL: %s, Error: %v\n", url, err)
+			logger.Warn("Skipping URL", "url", link, "depth", depth+1, "reason", "malformed", "error", err)
+			c.skip(link, depth+1, metrics.SkipMalformed)
 			return
 		}
 
+		if len(c.linkFilters) > 0 {
+			linkDepth, _ := utils.CalculateDepthFromPath(normalizedLink)
+			candidate := &Link{URL: normalizedLink, Referrer: canonicalURL, Depth: linkDepth}
+			if !c.allowLink(candidate) {
+				logger.Debug("Skipping URL", "url", normalizedLink, "depth", linkDepth, "reason", "filtered")
+				c.skip(normalizedLink, linkDepth, metrics.SkipFiltered)
+				continue
+			}
+			if candidate.URL != normalizedLink {
+				if normalizedLink, err = utils.NormalizeURL(candidate.URL, baseURL); err != nil {
+					logger.Warn("Skipping URL", "url", candidate.URL, "depth", linkDepth, "reason", "malformed", "error", err)
+					c.skip(candidate.URL, linkDepth, metrics.SkipMalformed)
+					continue
+				}
+			}
+		}
+
+		if c.traps != nil {
+			if kind := c.traps.Check(normalizedLink); kind != "" {
+				linkDepth, _ := utils.CalculateDepthFromPath(normalizedLink)
+				logger.Debug("Skipping URL", "url", normalizedLink, "depth", linkDepth, "reason", "trap", "trap", kind)
+				c.skip(normalizedLink, linkDepth, metrics.SkipTrap)
+				continue
+			}
+		}
+
+		if c.shard != nil && !c.shard.Owns(normalizedLink) {
+			c.forward(normalizedLink, baseURL, logger)
+			continue
+		}
+
 		if !used.IsCrawledURL(normalizedLink) {
+			c.referrers.LoadOrStore(normalizedLink, canonicalURL)
 			wg.Add(1)
 			go c.Crawl(normalizedLink, maxDepth, baseURL, delay, used, wg, logger)
 		}
 	}
 }
+
+// exhaust stops the crawl because the budget called name ran out.
+func (c *Crawler) exhaust(name string, logger *utils.Logger) {
+	if !c.stopped.Swap(true) {
+		logger.Info("Crawl budget exhausted, stopping", "budget", name)
+	}
+}
+
+// forward hands a link to the shard that owns its host, at most once per URL.
+func (c *Crawler) forward(link string, baseURL string, logger *utils.Logger) {
+	if _, seen := c.forwarded.LoadOrStore(link, true); seen {
+		return
+	}
+
+	owner, err := c.shard.OwnerOf(link)
+	if err != nil {
+		logger.Warn("Cannot shard URL", "url", link, "reason", "malformed", "error", err)
+		return
+	}
+
+	if err := c.forwarder.Forward(owner, shard.Entry{URL: link, Base: baseURL}); err != nil {
+		logger.Error("Failed to forward URL", "url", link, "shard", owner, "error", err)
+		c.forwarded.Delete(link)
+		return
+	}
+	logger.Debug("Forwarded URL", "url", link, "shard", owner)
+}
+
+// emitPage writes a record for a successfully fetched page to the sink, if one is set.
+// Links are resolved against the page URL so the record is usable on its own.
+func (c *Crawler) emitPage(page *fetcher.Page, depth int, content fingerprint.Fingerprint, duplicateOf string, logger *utils.Logger) {
+	if c.sink == nil {
+		return
+	}
+
+	links := make([]string, 0, len(page.Links))
+	for link := range page.Links {
+		if normalized, err := utils.NormalizeURL(link, page.URL); err == nil {
+			links = append(links, normalized)
+		}
+	}
+	sort.Strings(links)
+
+	record := output.Record{
+		URL:          page.URL,
+		Depth:        depth,
+		Status:       page.StatusCode,
+		Links:        links,
+		Title:        page.Title,
+		Canonical:    page.Canonical,
+		ContentHash:  fmt.Sprintf("%x", sha256.Sum256(page.Body)),
+		TextHash:     content.Hash,
+		SimHash:      content.Hex(),
+		DuplicateOf:  duplicateOf,
+		ETag:         page.Header.Get("ETag"),
+		LastModified: page.Header.Get("Last-Modified"),
+		FetchedAt:    page.FetchedAt,
+		Duration:     float64(page.Duration.Microseconds()) / 1000,
+	}
+	if previous, ok := c.previous[page.URL]; ok && page.NotModified {
+		// The page is the one fetched last time; a 304 may also refresh its validators.
+		record.Status = previous.Status
+		record.ContentHash = previous.ContentHash
+		record.Unchanged = true
+		if record.ETag == "" {
+			record.ETag = previous.ETag
+		}
+		if record.LastModified == "" {
+			record.LastModified = previous.LastModified
+		}
+	}
+	c.writeRecord(record, logger)
+}
+
+// emitError writes a record for a page that could not be fetched to the sink, if one is set.
+func (c *Crawler) emitError(url string, depth int, err error, logger *utils.Logger) {
+	if c.sink == nil {
+		return
+	}
+
+	record := output.Record{URL: url, Depth: depth, Status: statusOf(err), Error: err.Error(), FetchedAt: time.Now()}
+	c.writeRecord(record, logger)
+}
+
+// statusOf returns the HTTP status a fetch error stands for, or 0 if no response was received.
+func statusOf(err error) int {
+	if errors.Is(err, fetcher.ErrNotFound) {
+		return 404
+	}
+	return 0
+}
+
+func (c *Crawler) writeRecord(record output.Record, logger *utils.Logger) {
+	if err := c.sink.Write(record); err != nil {
+		logger.Error("Failed to write record", "url", record.URL, "error", err)
+	}
+}
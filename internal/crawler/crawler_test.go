@@ -1,13 +1,20 @@
 package crawler_test
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/crawler"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/metrics"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/parser"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/replay"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shared"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
 )
@@ -82,3 +89,129 @@ func TestCrawl(t *testing.T) {
 		}
 	})
 }
+
+type recordingSink struct {
+	mu      sync.Mutex
+	records []output.Record
+}
+
+func (s *recordingSink) Write(record output.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+func TestCrawl_StreamsRecordsToSink(t *testing.T) {
+	var site *httptest.Server
+	site = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<title> Home </title><link rel="canonical" href="/"><a href="/about">About</a><a href="/missing">Missing</a>`)
+		case "/about":
+			fmt.Fprintf(w, `<a href="%s/">Home</a>`, site.URL)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = site.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	sink := &recordingSink{}
+	cr := crawler.NewCrawler(fetcher.NewFetcher(time.Second), parser.NewParser(), utils.NewLogger(), time.NewTicker(time.Millisecond), 2)
+	cr.SetSink(sink)
+
+	used := &shared.UsedURL{
+		CrawledURLs:  make(map[string]bool),
+		VisitedPaths: make(map[string]bool),
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	cr.Crawl(site.URL, 3, site.URL, 0, used, &wg, utils.NewLogger())
+	wg.Wait()
+
+	byURL := make(map[string]output.Record)
+	for _, record := range sink.records {
+		byURL[record.URL] = record
+	}
+
+	home := byURL[site.URL]
+	if home.Status != http.StatusOK || len(home.Links) != 2 || home.Links[0] != site.URL+"/about" {
+		t.Errorf("Unexpected record for home page: %+v", home)
+	}
+	if home.Title != "Home" || home.Canonical != site.URL+"/" || len(home.ContentHash) != 64 {
+		t.Errorf("Expected the home page's title, canonical URL and content hash, got %+v", home)
+	}
+	if about := byURL[site.URL+"/about"]; about.Depth != 1 || about.Status != http.StatusOK || about.ContentHash == home.ContentHash {
+		t.Errorf("Unexpected record for about page: %+v", about)
+	}
+	if missing := byURL[site.URL+"/missing"]; missing.Status != http.StatusNotFound || missing.Error == "" {
+		t.Errorf("Expected 404 record for missing page, got %+v", missing)
+	}
+}
+
+func TestCrawl_ReplaysHARFixture(t *testing.T) {
+	archive, err := replay.Load("testdata/site.har")
+	if err != nil {
+		t.Fatalf("Failed to load fixture: %v", err)
+	}
+	f := fetcher.NewFetcher(time.Second)
+	f.SetTransport(archive)
+
+	sink := &recordingSink{}
+	cr := crawler.NewCrawler(f, parser.NewParser(), utils.NewLogger(), time.NewTicker(time.Millisecond), 2)
+	cr.SetSink(sink)
+	crawlMetrics := metrics.New()
+	cr.SetMetrics(crawlMetrics)
+	var eventsMu sync.Mutex
+	events := make(map[crawler.EventType]int)
+	cr.OnEvent(func(event crawler.Event) {
+		eventsMu.Lock()
+		defer eventsMu.Unlock()
+		events[event.Type]++
+	})
+
+	used := &shared.UsedURL{
+		CrawledURLs:  make(map[string]bool),
+		VisitedPaths: make(map[string]bool),
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	cr.Crawl("https://example.com", 3, "https://example.com", 0, used, &wg, utils.NewLogger())
+	wg.Wait()
+
+	byURL := make(map[string]output.Record)
+	for _, record := range sink.records {
+		byURL[record.URL] = record
+	}
+
+	if home := byURL["https://example.com"]; home.Status != http.StatusOK || len(home.Links) != 3 {
+		t.Errorf("Unexpected record for home page: %+v", home)
+	}
+	if about := byURL["https://example.com/about"]; about.Status != http.StatusOK || about.Depth != 1 {
+		t.Errorf("Unexpected record for about page: %+v", about)
+	}
+	if blog := byURL["https://example.com/blog"]; blog.Status != http.StatusNotFound {
+		t.Errorf("Expected archived 404 for blog, got %+v", blog)
+	}
+	if team := byURL["https://example.com/about/team"]; team.Error == "" {
+		t.Errorf("Expected a not-in-archive error for a page missing from the fixture, got %+v", team)
+	}
+	summary := crawlMetrics.Summary()
+	if summary.Pages["2xx"] != 2 || summary.Pages["4xx"] != 1 || summary.Pages["error"] != 1 || summary.Skipped[metrics.SkipExternal] != 1 {
+		t.Errorf("Unexpected metrics summary: %+v", summary)
+	}
+	if events[crawler.EventQueued] != 4 || events[crawler.EventFetched] != 2 || events[crawler.EventFailed] != 2 {
+		t.Errorf("Unexpected crawl events: %v", events)
+	}
+	if _, err := f.Fetch("https://example.com/about/team", utils.NewLogger()); !errors.Is(err, fetcher.ErrNotInArchive) {
+		t.Errorf("Expected ErrNotInArchive, got %v", err)
+	}
+}
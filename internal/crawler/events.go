@@ -0,0 +1,66 @@
+package crawler
+
+import (
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+)
+
+// EventType identifies what happened to a URL.
+type EventType int
+
+const (
+	// EventQueued is sent when a URL passes the crawl filters and waits for a worker.
+	EventQueued EventType = iota
+	// EventFetched is sent when a page was fetched successfully.
+	EventFetched
+	// EventFailed is sent when a page could not be fetched.
+	EventFailed
+	// EventSkipped is sent when a URL or link is not crawled; Reason says why.
+	EventSkipped
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventQueued:
+		return "queued"
+	case EventFetched:
+		return "fetched"
+	case EventFailed:
+		return "failed"
+	case EventSkipped:
+		return "skipped"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes one step of the crawl. Status and Duration are only set once a URL has been
+// fetched, Page only for EventFetched, Err only for EventFailed and Reason only for EventSkipped.
+type Event struct {
+	Type     EventType
+	URL      string
+	Depth    int
+	Status   int
+	Duration time.Duration
+	Page     *fetcher.Page
+	Err      error
+	Reason   string
+	Time     time.Time
+}
+
+// EventHandler receives crawl events. It is called synchronously from crawl goroutines,
+// possibly concurrently, so it must be safe for concurrent use and should return quickly.
+type EventHandler func(Event)
+
+// OnEvent adds a handler that receives every crawl event.
+func (c *Crawler) OnEvent(handler EventHandler) {
+	c.handlers = append(c.handlers, handler)
+}
+
+func (c *Crawler) emit(event Event) {
+	event.Time = time.Now()
+	for _, handler := range c.handlers {
+		handler(event)
+	}
+}
@@ -0,0 +1,73 @@
+package crawler
+
+import (
+	"net/http"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// Link is an internal link found on a page, about to be crawled.
+type Link struct {
+	URL      string
+	Referrer string
+	Depth    int
+}
+
+// LinkFilter is called for every internal link before it is crawled. It may rewrite link.URL;
+// returning false drops the link.
+type LinkFilter func(link *Link) bool
+
+// Request is a URL about to be queued for fetching.
+type Request struct {
+	URL    string
+	Depth  int
+	Header http.Header
+}
+
+// RequestFilter is called for every URL before it is queued. Headers it sets are sent with
+// every attempt; returning false skips the URL.
+type RequestFilter func(request *Request) bool
+
+// FilterLinks adds a filter applied to every link found while crawling. Filters run in the order
+// they were added; the first to return false drops the link.
+func (c *Crawler) FilterLinks(filter LinkFilter) {
+	c.linkFilters = append(c.linkFilters, filter)
+}
+
+// FilterRequests adds a filter applied to every URL before it is queued, including seeds.
+func (c *Crawler) FilterRequests(filter RequestFilter) {
+	c.requestFilters = append(c.requestFilters, filter)
+}
+
+func (c *Crawler) allowLink(link *Link) bool {
+	for _, filter := range c.linkFilters {
+		if !filter(link) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Crawler) allowRequest(request *Request) bool {
+	for _, filter := range c.requestFilters {
+		if !filter(request) {
+			return false
+		}
+	}
+	return true
+}
+
+// skip records a URL that will not be crawled.
+func (c *Crawler) skip(url string, depth int, reason string) {
+	c.metrics.Skip(reason)
+	c.emit(Event{Type: EventSkipped, URL: url, Depth: depth, Reason: reason})
+}
+
+// parserSkipped reports a link rejected by the parser. The parser counts its own metrics.
+func (c *Crawler) parserSkipped(link string, reason string) {
+	if len(c.handlers) == 0 {
+		return
+	}
+	depth, _ := utils.CalculateDepthFromPath(link)
+	c.emit(Event{Type: EventSkipped, URL: link, Depth: depth, Reason: reason})
+}
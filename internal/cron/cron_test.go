@@ -0,0 +1,67 @@
+package cron_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/cron"
+)
+
+func TestParse_Next(t *testing.T) {
+	// A Wednesday.
+	from := time.Date(2024, time.November, 20, 10, 17, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.November, 20, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.November, 20, 10, 30, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2024, time.November, 21, 2, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.November, 21, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, time.November, 20, 11, 0, 0, 0, time.UTC)},
+		{"30 9 * * mon-fri", time.Date(2024, time.November, 21, 9, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, time.November, 24, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 29 2 *", time.Date(2028, time.February, 29, 12, 0, 0, 0, time.UTC)},
+		{"5,10/20 3 * * *", time.Date(2024, time.November, 21, 3, 5, 0, 0, time.UTC)},
+		// Both day fields restricted: the 1st of the month or any Friday, whichever comes first.
+		{"0 0 1 * fri", time.Date(2024, time.November, 22, 0, 0, 0, 0, time.UTC)},
+		{"@every 90m", time.Date(2024, time.November, 20, 11, 47, 30, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		schedule, err := cron.Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if got := schedule.Next(from); !got.Equal(tt.want) {
+			t.Errorf("Parse(%q).Next = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	never, err := cron.Parse("0 0 30 2 *")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if got := never.Next(from); !got.IsZero() {
+		t.Errorf("Expected February 30th never to fire, got %v", got)
+	}
+}
+
+func TestParse_RejectsInvalidExpressions(t *testing.T) {
+	tests := map[string]string{
+		"* * * *":       "expected 5 fields",
+		"60 * * * *":    "minute: 60 is out of range 0-59",
+		"* * * foo *":   `month: invalid value "foo"`,
+		"*/0 * * * *":   `minute: invalid step "0"`,
+		"5-1 * * * *":   `range "5-1" runs backwards`,
+		"@every banana": "@every needs a positive duration",
+	}
+	for expr, want := range tests {
+		_, err := cron.Parse(expr)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Parse(%q): expected an error containing %q, got %v", expr, want, err)
+		}
+	}
+}
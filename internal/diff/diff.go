@@ -0,0 +1,199 @@
+// Package diff compares two crawls of the same site and reports what changed between them.
+package diff
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+)
+
+// Report is what changed from an old crawl to a new one. Lists are sorted by URL.
+type Report struct {
+	Old     Source   `json:"old"`
+	New     Source   `json:"new"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// StatusChanges are pages whose HTTP status changed. A status of 0 means the page could not
+	// be fetched.
+	StatusChanges []StatusChange `json:"status_changes"`
+	// NewBroken are pages that are broken in the new crawl but were not in the old one,
+	// including added pages that are broken.
+	NewBroken        []Broken     `json:"new_broken"`
+	TitleChanges     []TextChange `json:"title_changes"`
+	CanonicalChanges []TextChange `json:"canonical_changes"`
+	// ContentChanges are pages whose body changed.
+	ContentChanges []TextChange `json:"content_changes"`
+	// Notes explain what could not be compared, such as page details missing from a crawl.
+	Notes []string `json:"notes,omitempty"`
+}
+
+// Source describes one side of the comparison.
+type Source struct {
+	Path  string `json:"path"`
+	URLs  int    `json:"urls"`
+	Pages int    `json:"pages"`
+}
+
+// StatusChange is a page whose status changed.
+type StatusChange struct {
+	URL string `json:"url"`
+	Old int    `json:"old"`
+	New int    `json:"new"`
+}
+
+// Broken is a page that returned 4xx or 5xx or could not be fetched.
+type Broken struct {
+	URL    string `json:"url"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// TextChange is a page whose title, canonical URL or content hash changed.
+type TextChange struct {
+	URL string `json:"url"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// Changed reports whether anything differs between the two crawls.
+func (r *Report) Changed() bool {
+	return len(r.Added)+len(r.Removed)+len(r.StatusChanges)+len(r.NewBroken)+
+		len(r.TitleChanges)+len(r.CanonicalChanges)+len(r.ContentChanges) > 0
+}
+
+// Compare reports the differences from old to new. URLs are compared for any pair of results;
+// statuses, titles, canonical URLs and content only for pages whose records both results have.
+func Compare(old, new *output.Result) *Report {
+	r := &Report{
+		Old:              Source{URLs: len(urls(old)), Pages: len(old.Pages)},
+		New:              Source{URLs: len(urls(new)), Pages: len(new.Pages)},
+		Added:            []string{},
+		Removed:          []string{},
+		StatusChanges:    []StatusChange{},
+		NewBroken:        []Broken{},
+		TitleChanges:     []TextChange{},
+		CanonicalChanges: []TextChange{},
+		ContentChanges:   []TextChange{},
+	}
+	if len(old.Pages) == 0 || len(new.Pages) == 0 {
+		r.Notes = append(r.Notes, "statuses, titles, canonical URLs and content were not compared: one crawl has no page records, as is the case for json outputs")
+	}
+
+	oldURLs, newURLs := urls(old), urls(new)
+	for url := range newURLs {
+		if !oldURLs[url] {
+			r.Added = append(r.Added, url)
+		}
+	}
+	for url := range oldURLs {
+		if !newURLs[url] {
+			r.Removed = append(r.Removed, url)
+		}
+	}
+
+	oldPages := records(old)
+	for _, page := range records(new) {
+		before, ok := oldPages[page.URL]
+		if broken(page) && ((!ok && !oldURLs[page.URL]) || (ok && !broken(before))) {
+			r.NewBroken = append(r.NewBroken, Broken{URL: page.URL, Status: page.Status, Error: page.Error})
+		}
+		if !ok {
+			continue
+		}
+		if page.Status != before.Status {
+			r.StatusChanges = append(r.StatusChanges, StatusChange{URL: page.URL, Old: before.Status, New: page.Status})
+		}
+		// Only pages fetched in both crawls by a crawler that records content can be compared.
+		if page.ContentHash == "" || before.ContentHash == "" {
+			continue
+		}
+		if page.Title != before.Title {
+			r.TitleChanges = append(r.TitleChanges, TextChange{URL: page.URL, Old: before.Title, New: page.Title})
+		}
+		if page.Canonical != before.Canonical {
+			r.CanonicalChanges = append(r.CanonicalChanges, TextChange{URL: page.URL, Old: before.Canonical, New: page.Canonical})
+		}
+		if page.ContentHash != before.ContentHash {
+			r.ContentChanges = append(r.ContentChanges, TextChange{URL: page.URL, Old: before.ContentHash, New: page.ContentHash})
+		}
+	}
+
+	sort.Strings(r.Added)
+	sort.Strings(r.Removed)
+	sort.Slice(r.StatusChanges, func(i, j int) bool { return r.StatusChanges[i].URL < r.StatusChanges[j].URL })
+	sort.Slice(r.NewBroken, func(i, j int) bool { return r.NewBroken[i].URL < r.NewBroken[j].URL })
+	for _, changes := range [][]TextChange{r.TitleChanges, r.CanonicalChanges, r.ContentChanges} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].URL < changes[j].URL })
+	}
+	return r
+}
+
+// urls returns every URL of a result, whether it is in the URL set or only has a record.
+func urls(result *output.Result) map[string]bool {
+	all := make(map[string]bool, len(result.URLs))
+	for url := range result.URLs {
+		all[url] = true
+	}
+	for _, page := range result.Pages {
+		all[page.URL] = true
+	}
+	return all
+}
+
+func records(result *output.Result) map[string]output.Record {
+	pages := make(map[string]output.Record, len(result.Pages))
+	for _, page := range result.Pages {
+		pages[page.URL] = page
+	}
+	return pages
+}
+
+func broken(record output.Record) bool {
+	return record.Status >= 400 || record.Error != ""
+}
+
+// Load reads a crawl to compare: a stored service run (its directory, holding result.json), a
+// JSONL stream of page records, or a JSON output or stored result.
+func Load(path string) (*output.Result, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return output.LoadResult(filepath.Join(path, "result.json"))
+	}
+	if strings.EqualFold(filepath.Ext(path), ".jsonl") {
+		return loadJSONL(path)
+	}
+	return output.LoadResult(path)
+}
+
+func loadJSONL(path string) (*output.Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := &output.Result{URLs: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var record output.Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		result.URLs[record.URL] = true
+		result.Pages = append(result.Pages, record)
+	}
+	return result, scanner.Err()
+}
@@ -0,0 +1,90 @@
+package diff_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/diff"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+)
+
+func TestCompare_ReportsEveryKindOfChange(t *testing.T) {
+	old := &output.Result{Pages: []output.Record{
+		{URL: "https://example.com/", Status: 200, Title: "Home", Canonical: "https://example.com/", ContentHash: "aa"},
+		{URL: "https://example.com/about", Status: 200, Title: "About", ContentHash: "bb"},
+		{URL: "https://example.com/gone", Status: 200, ContentHash: "cc"},
+		{URL: "https://example.com/old-404", Status: 404, Error: "not found"},
+	}}
+	new := &output.Result{Pages: []output.Record{
+		{URL: "https://example.com/", Status: 200, Title: "Home", Canonical: "https://example.com/home", ContentHash: "a2"},
+		{URL: "https://example.com/about", Status: 500, Error: "unexpected status 500"},
+		{URL: "https://example.com/new", Status: 200, Title: "New", ContentHash: "dd"},
+		{URL: "https://example.com/new-404", Status: 404, Error: "not found"},
+		{URL: "https://example.com/old-404", Status: 404, Error: "not found"},
+	}}
+
+	r := diff.Compare(old, new)
+	if strings.Join(r.Added, ",") != "https://example.com/new,https://example.com/new-404" || strings.Join(r.Removed, ",") != "https://example.com/gone" {
+		t.Errorf("Unexpected added %v and removed %v", r.Added, r.Removed)
+	}
+	if len(r.StatusChanges) != 1 || r.StatusChanges[0] != (diff.StatusChange{URL: "https://example.com/about", Old: 200, New: 500}) {
+		t.Errorf("Unexpected status changes: %+v", r.StatusChanges)
+	}
+	if len(r.NewBroken) != 2 || r.NewBroken[0].URL != "https://example.com/about" || r.NewBroken[1].URL != "https://example.com/new-404" {
+		t.Errorf("Expected the about page and the added 404 to be newly broken, got %+v", r.NewBroken)
+	}
+	if len(r.TitleChanges) != 0 || len(r.CanonicalChanges) != 1 || r.CanonicalChanges[0].New != "https://example.com/home" {
+		t.Errorf("Unexpected title %+v or canonical %+v changes", r.TitleChanges, r.CanonicalChanges)
+	}
+	if len(r.ContentChanges) != 1 || r.ContentChanges[0].URL != "https://example.com/" {
+		t.Errorf("Unexpected content changes: %+v", r.ContentChanges)
+	}
+
+	r.Old.Path, r.New.Path = "yesterday.jsonl", "today.jsonl"
+	var text, markdown bytes.Buffer
+	diff.Write(&text, r, "text")
+	diff.Write(&markdown, r, "markdown")
+	if !strings.Contains(text.String(), "  https://example.com/about: 200 -> 500\n") || !strings.Contains(text.String(), "  + https://example.com/new\n") {
+		t.Errorf("Unexpected text report:\n%s", text.String())
+	}
+	if !strings.Contains(markdown.String(), "| New broken links | 2 |") || !strings.Contains(markdown.String(), "| https://example.com/new-404 | 404 |") {
+		t.Errorf("Unexpected Markdown report:\n%s", markdown.String())
+	}
+	if err := diff.Write(&text, r, "html"); err == nil {
+		t.Errorf("Expected an unknown format to be rejected")
+	}
+}
+
+func TestLoad_ReadsOutputsAndStoredRuns(t *testing.T) {
+	dir := t.TempDir()
+	urlsOnly := filepath.Join(dir, "monzo.json")
+	os.WriteFile(urlsOnly, []byte(`{"urls": {"https://example.com/": true, "https://example.com/a": true}}`), 0o644)
+	stream := filepath.Join(dir, "pages.jsonl")
+	os.WriteFile(stream, []byte(`{"url": "https://example.com/", "status": 200}`+"\n\n"+`{"url": "https://example.com/b", "status": 404}`+"\n"), 0o644)
+	run := filepath.Join(dir, "job-1")
+	os.Mkdir(run, 0o755)
+	output.SaveResult(&output.Result{URLs: map[string]bool{"https://example.com/": true}}, filepath.Join(run, "result.json"))
+
+	var results []*output.Result
+	for _, path := range []string{urlsOnly, stream, run} {
+		result, err := diff.Load(path)
+		if err != nil {
+			t.Fatalf("Load(%s) failed: %v", path, err)
+		}
+		results = append(results, result)
+	}
+	if len(results[0].URLs) != 2 || len(results[1].Pages) != 2 || len(results[2].URLs) != 1 {
+		t.Fatalf("Unexpected results: %+v", results)
+	}
+
+	r := diff.Compare(results[0], results[1])
+	if strings.Join(r.Added, ",") != "https://example.com/b" || strings.Join(r.Removed, ",") != "https://example.com/a" {
+		t.Errorf("Expected URLs to be compared, got added %v and removed %v", r.Added, r.Removed)
+	}
+	if len(r.Notes) != 1 || len(r.NewBroken) != 1 {
+		t.Errorf("Expected a note that pages were not compared and only the added 404 as broken, got %+v", r)
+	}
+}
@@ -0,0 +1,185 @@
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Formats lists the formats Write accepts.
+var Formats = []string{"text", "json", "markdown"}
+
+// Write writes the report to w in format, one of Formats.
+func Write(w io.Writer, r *Report, format string) error {
+	switch format {
+	case "text":
+		return writeText(w, r)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "markdown":
+		return writeMarkdown(w, r)
+	default:
+		return fmt.Errorf("unknown diff format %q (available: %s)", format, strings.Join(Formats, ", "))
+	}
+}
+
+func writeText(w io.Writer, r *Report) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Comparing %s (%d URLs) with %s (%d URLs)\n", r.Old.Path, r.Old.URLs, r.New.Path, r.New.URLs)
+	if !r.Changed() {
+		b.WriteString("\nNo changes.\n")
+	}
+
+	section := func(title string, n int) bool {
+		if n == 0 {
+			return false
+		}
+		fmt.Fprintf(&b, "\n%s (%d):\n", title, n)
+		return true
+	}
+	if section("Added", len(r.Added)) {
+		for _, url := range r.Added {
+			fmt.Fprintf(&b, "  + %s\n", url)
+		}
+	}
+	if section("Removed", len(r.Removed)) {
+		for _, url := range r.Removed {
+			fmt.Fprintf(&b, "  - %s\n", url)
+		}
+	}
+	if section("Status changes", len(r.StatusChanges)) {
+		for _, c := range r.StatusChanges {
+			fmt.Fprintf(&b, "  %s: %s -> %s\n", c.URL, status(c.Old), status(c.New))
+		}
+	}
+	if section("New broken links", len(r.NewBroken)) {
+		for _, l := range r.NewBroken {
+			fmt.Fprintf(&b, "  %s (%s)\n", l.URL, brokenReason(l))
+		}
+	}
+	if section("Title changes", len(r.TitleChanges)) {
+		for _, c := range r.TitleChanges {
+			fmt.Fprintf(&b, "  %s: %q -> %q\n", c.URL, c.Old, c.New)
+		}
+	}
+	if section("Canonical changes", len(r.CanonicalChanges)) {
+		for _, c := range r.CanonicalChanges {
+			fmt.Fprintf(&b, "  %s: %s -> %s\n", c.URL, orNone(c.Old), orNone(c.New))
+		}
+	}
+	if section("Content changes", len(r.ContentChanges)) {
+		for _, c := range r.ContentChanges {
+			fmt.Fprintf(&b, "  %s\n", c.URL)
+		}
+	}
+	for _, note := range r.Notes {
+		fmt.Fprintf(&b, "\nNote: %s\n", note)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeMarkdown(w io.Writer, r *Report) error {
+	var b strings.Builder
+	b.WriteString("# Crawl diff\n\n")
+	fmt.Fprintf(&b, "Comparing `%s` (%d URLs) with `%s` (%d URLs).\n\n", r.Old.Path, r.Old.URLs, r.New.Path, r.New.URLs)
+	b.WriteString("| Change | Pages |\n|--------|-------|\n")
+	for _, row := range []struct {
+		name string
+		n    int
+	}{
+		{"Added", len(r.Added)},
+		{"Removed", len(r.Removed)},
+		{"Status changes", len(r.StatusChanges)},
+		{"New broken links", len(r.NewBroken)},
+		{"Title changes", len(r.TitleChanges)},
+		{"Canonical changes", len(r.CanonicalChanges)},
+		{"Content changes", len(r.ContentChanges)},
+	} {
+		fmt.Fprintf(&b, "| %s | %d |\n", row.name, row.n)
+	}
+
+	list := func(title string, urls []string) {
+		if len(urls) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n", title)
+		for _, url := range urls {
+			fmt.Fprintf(&b, "- %s\n", url)
+		}
+	}
+	table := func(title, header string, rows []string) {
+		if len(rows) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n", title, header)
+		for _, row := range rows {
+			b.WriteString(row + "\n")
+		}
+	}
+
+	list("Added", r.Added)
+	list("Removed", r.Removed)
+	var rows []string
+	for _, c := range r.StatusChanges {
+		rows = append(rows, fmt.Sprintf("| %s | %s | %s |", c.URL, status(c.Old), status(c.New)))
+	}
+	table("Status changes", "| URL | Old | New |\n|-----|-----|-----|", rows)
+	rows = nil
+	for _, l := range r.NewBroken {
+		rows = append(rows, fmt.Sprintf("| %s | %s |", l.URL, escape(brokenReason(l))))
+	}
+	table("New broken links", "| URL | Problem |\n|-----|---------|", rows)
+	for _, changes := range []struct {
+		title   string
+		changes []TextChange
+	}{
+		{"Title changes", r.TitleChanges},
+		{"Canonical changes", r.CanonicalChanges},
+	} {
+		rows = nil
+		for _, c := range changes.changes {
+			rows = append(rows, fmt.Sprintf("| %s | %s | %s |", c.URL, escape(orNone(c.Old)), escape(orNone(c.New))))
+		}
+		table(changes.title, "| URL | Old | New |\n|-----|-----|-----|", rows)
+	}
+	var changed []string
+	for _, c := range r.ContentChanges {
+		changed = append(changed, c.URL)
+	}
+	list("Content changes", changed)
+	for _, note := range r.Notes {
+		fmt.Fprintf(&b, "\n> %s\n", note)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func status(code int) string {
+	if code == 0 {
+		return "error"
+	}
+	return fmt.Sprint(code)
+}
+
+func brokenReason(l Broken) string {
+	if l.Status != 0 {
+		return fmt.Sprint(l.Status)
+	}
+	return l.Error
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+// escape keeps text from breaking a Markdown table row.
+func escape(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
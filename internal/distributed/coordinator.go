@@ -0,0 +1,656 @@
+package distributed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/budget"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fingerprint"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/frontier"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shared"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/store"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/trap"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// maxLeaseScan is the most queued URLs a lease looks through for one whose host politeness
+// allows it to be fetched now.
+const maxLeaseScan = 100
+
+// DefaultLeaseTTL is how long a worker may hold a URL without renewing it before it is reassigned.
+const DefaultLeaseTTL = 30 * time.Second
+
+// Coordinator owns the frontier and the visited set of a distributed crawl.
+// Workers lease URLs from it over HTTP, crawl them and report the links they found.
+// Leases that are neither completed nor renewed in time are returned to the frontier so another
+// worker can pick them up.
+//
+// The crawl state itself lives in a store.Backend, in memory by default or in a Redis-protocol
+// server shared by several coordinators. Trap, budget and politeness state is kept by each
+// coordinator for the URLs it hands out.
+type Coordinator struct {
+	baseURL    string
+	maxDepth   int
+	leaseTTL   time.Duration
+	backend    store.Backend
+	logger     *utils.Logger
+	now        func() time.Time
+	fileTypes  []string
+	traps      *trap.Detector
+	budget     *budget.Tracker
+	politeness frontier.Politeness
+	duplicates *fingerprint.Index
+	skipDups   bool
+
+	mu       sync.Mutex
+	idPrefix string
+	nextID   int
+	failed   int
+	requeued int
+	hosts    map[string]*hostState
+	admitted map[string]bool
+	done     chan struct{}
+	finished bool
+}
+
+// hostState is what politeness needs to know about one host's leases.
+type hostState struct {
+	leased int
+	next   time.Time
+}
+
+func NewCoordinator(baseURL string, maxDepth int, leaseTTL time.Duration, backend store.Backend, logger *utils.Logger) *Coordinator {
+	if leaseTTL <= 0 {
+		leaseTTL = DefaultLeaseTTL
+	}
+	if backend == nil {
+		backend = store.NewMemory()
+	}
+	return &Coordinator{
+		baseURL:   baseURL,
+		maxDepth:  maxDepth,
+		leaseTTL:  leaseTTL,
+		backend:   backend,
+		logger:    logger,
+		now:       time.Now,
+		fileTypes: utils.DefaultExcludedFileTypes,
+		idPrefix:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		hosts:     make(map[string]*hostState),
+		admitted:  make(map[string]bool),
+		done:      make(chan struct{}),
+	}
+}
+
+// SetExcludedFileTypes replaces the file extensions, such as ".pdf", whose URLs are not queued.
+// It defaults to utils.DefaultExcludedFileTypes. Call it, like the other setters, before Seed.
+func (c *Coordinator) SetExcludedFileTypes(types []string) {
+	c.fileTypes = types
+}
+
+// SetTraps checks every link reported by workers with detector before it is queued, and drops
+// those that fall into a spider trap.
+func (c *Coordinator) SetTraps(detector *trap.Detector) {
+	c.traps = detector
+}
+
+// SetBudget takes every URL out of tracker before leasing it. URLs over a per-host or per-path
+// cap are dropped; once a crawl-wide budget runs out, the frontier is emptied so the crawl ends
+// when the outstanding leases do.
+func (c *Coordinator) SetBudget(tracker *budget.Tracker) {
+	c.budget = tracker
+}
+
+// SetPoliteness limits the URLs of one host leased at once and the time between leasing them.
+// While a host is held back, URLs of other hosts further down the frontier are leased first.
+func (c *Coordinator) SetPoliteness(p frontier.Politeness) {
+	c.politeness = p
+}
+
+// SetDuplicates looks up the fingerprint of every page workers report in index, in the order
+// they complete, so records of pages repeating an earlier page's text name it in DuplicateOf. If
+// skip is set, links on those pages are not queued.
+func (c *Coordinator) SetDuplicates(index *fingerprint.Index, skip bool) {
+	c.duplicates = index
+	c.skipDups = skip
+}
+
+// Traps returns the spider traps found so far.
+func (c *Coordinator) Traps() []output.Trap {
+	if c.traps == nil {
+		return nil
+	}
+	return c.traps.Traps()
+}
+
+// StoppedBy returns the crawl-wide budget that ran out, or "" if none has.
+func (c *Coordinator) StoppedBy() string {
+	if c.budget == nil {
+		return ""
+	}
+	return c.budget.Exhausted()
+}
+
+// Seed adds the starting URL to the frontier.
+func (c *Coordinator) Seed(url string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.enqueue(url, false); err != nil {
+		return err
+	}
+	return c.checkDone()
+}
+
+// Done is closed once the frontier is empty and no leases are outstanding.
+func (c *Coordinator) Done() <-chan struct{} {
+	return c.done
+}
+
+// Results returns the URLs crawled so far.
+func (c *Coordinator) Results() (*shared.UsedURL, error) {
+	urls, err := c.backend.Crawled()
+	if err != nil {
+		return nil, err
+	}
+	used := &shared.UsedURL{
+		CrawledURLs:  make(map[string]bool, len(urls)),
+		VisitedPaths: make(map[string]bool),
+	}
+	for _, url := range urls {
+		used.CrawledURLs[url] = true
+	}
+	return used, nil
+}
+
+// Status returns a snapshot of the crawl progress.
+func (c *Coordinator) Status() (Status, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reapExpired(); err != nil {
+		return Status{}, err
+	}
+
+	queued, err := c.backend.QueueLen()
+	if err != nil {
+		return Status{}, err
+	}
+	leased, err := c.backend.LeaseCount()
+	if err != nil {
+		return Status{}, err
+	}
+	crawled, err := c.backend.Crawled()
+	if err != nil {
+		return Status{}, err
+	}
+
+	return Status{
+		Queued:   queued,
+		Leased:   leased,
+		Crawled:  len(crawled),
+		Failed:   c.failed,
+		Requeued: c.requeued,
+		Done:     c.finished,
+	}, nil
+}
+
+// Lease hands the next URL on the frontier to a worker.
+// It returns nil when nothing is available right now; callers should check Done to tell
+// a temporarily empty frontier apart from a finished crawl.
+func (c *Coordinator) Lease(worker string) (*Lease, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reapExpired(); err != nil {
+		return nil, err
+	}
+
+	next, err := c.nextTask()
+	if err != nil {
+		return nil, err
+	}
+	if next == nil {
+		// The budget may have dropped the last queued URLs.
+		return nil, c.checkDone()
+	}
+	c.nextID++
+
+	lease := &Lease{
+		ID:        fmt.Sprintf("lease-%s-%d", c.idPrefix, c.nextID),
+		URL:       next.URL,
+		Base:      c.baseURL,
+		Depth:     next.Depth,
+		Worker:    worker,
+		ExpiresAt: c.now().Add(c.leaseTTL),
+		TTLMillis: c.leaseTTL.Milliseconds(),
+	}
+	err = c.backend.AddLease(store.Lease{ID: lease.ID, Task: *next, Worker: worker, ExpiresAt: lease.ExpiresAt})
+	if err != nil {
+		// Put the task back so it is not lost with the failed lease.
+		c.backend.Push(*next)
+		return nil, err
+	}
+	host := c.host(next.URL)
+	host.leased++
+	host.next = c.now().Add(c.politeness.HostDelay)
+	c.logger.Debug("Leased URL", "url", lease.URL, "depth", lease.Depth, "worker", worker, "lease", lease.ID)
+
+	return lease, nil
+}
+
+// Renew extends a lease by the lease TTL from now, for a worker still crawling its URL. It
+// returns nil if the lease is unknown, has already expired or belongs to a different worker.
+func (c *Coordinator) Renew(req RenewRequest) (*Lease, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reapExpired(); err != nil {
+		return nil, err
+	}
+
+	held, err := c.backend.TakeLease(req.Lease)
+	if err != nil || held == nil {
+		return nil, err
+	}
+	if held.Worker != req.Worker {
+		return nil, c.backend.AddLease(*held)
+	}
+	held.ExpiresAt = c.now().Add(c.leaseTTL)
+	if err := c.backend.AddLease(*held); err != nil {
+		// Put the task back so it is not lost with the failed renewal.
+		c.backend.Push(held.Task)
+		return nil, err
+	}
+	return &Lease{
+		ID:        held.ID,
+		URL:       held.Task.URL,
+		Base:      c.baseURL,
+		Depth:     held.Task.Depth,
+		Worker:    held.Worker,
+		ExpiresAt: held.ExpiresAt,
+		TTLMillis: c.leaseTTL.Milliseconds(),
+	}, nil
+}
+
+// ReapExpired puts the URLs of expired leases back on the frontier every quarter of the lease TTL
+// until ctx is done, so the URLs of workers that died are requeued and the status stays accurate
+// even while no worker calls in.
+func (c *Coordinator) ReapExpired(ctx context.Context) {
+	ticker := time.NewTicker(c.leaseTTL / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		err := c.reapExpired()
+		c.mu.Unlock()
+		if err != nil {
+			c.logger.Error("Failed to requeue expired leases", "error", err)
+		}
+	}
+}
+
+// Complete records the result of a lease. It returns false if the lease is unknown,
+// has already expired and been reassigned, or belongs to a different worker.
+func (c *Coordinator) Complete(req CompleteRequest) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reapExpired(); err != nil {
+		return false, err
+	}
+
+	lease, err := c.backend.TakeLease(req.Lease)
+	if err != nil {
+		return false, err
+	}
+	if lease == nil {
+		return false, nil
+	}
+	if lease.Worker != req.Worker {
+		// Not ours to complete; restore it untouched.
+		return false, c.backend.AddLease(*lease)
+	}
+
+	c.release(lease.Task.URL)
+	if c.budget != nil && c.budget.AddBytes(req.Bytes) != "" {
+		c.logger.Warn("Crawl budget used up, stopping the crawl", "budget", c.budget.Exhausted())
+		if err := c.drain(); err != nil {
+			return false, err
+		}
+	}
+	duplicateOf := ""
+	if c.duplicates != nil && req.Error == "" && req.Page != nil {
+		if content, err := fingerprint.Parse(req.Page.TextHash, req.Page.SimHash); err == nil {
+			duplicateOf, _ = c.duplicates.Add(lease.Task.URL, content)
+		}
+		req.Page.DuplicateOf = duplicateOf
+	}
+	if err := c.savePage(lease, req); err != nil {
+		return false, err
+	}
+	if req.Error != "" {
+		c.failed++
+		c.logger.Warn("Worker failed to crawl URL", "url", lease.Task.URL, "depth", lease.Task.Depth, "worker", req.Worker, "error", req.Error)
+	} else {
+		if err := c.backend.MarkCrawled(lease.Task.URL); err != nil {
+			return false, err
+		}
+		if duplicateOf != "" && c.skipDups {
+			c.logger.Debug("Not following links of duplicate page", "url", lease.Task.URL, "duplicate_of", duplicateOf)
+			return true, c.checkDone()
+		}
+		if c.traps != nil {
+			links := req.Links
+			if req.Page != nil {
+				links = req.Page.Links
+			}
+			observed := make(map[string]bool, len(links))
+			for _, link := range links {
+				observed[link] = true
+			}
+			c.traps.ObserveLinks(lease.Task.URL, observed)
+		}
+		for _, link := range req.Links {
+			if err := c.enqueue(link, true); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	return true, c.checkDone()
+}
+
+// savePage stores the record of a completed lease. The URL and depth are the lease's, whatever
+// the worker reported. Callers must hold c.mu.
+func (c *Coordinator) savePage(lease *store.Lease, req CompleteRequest) error {
+	record := output.Record{Links: req.Links, Error: req.Error, FetchedAt: c.now()}
+	if req.Page != nil {
+		record = *req.Page
+	}
+	record.URL = lease.Task.URL
+	record.Depth = lease.Task.Depth
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return c.backend.SavePage(record.URL, payload)
+}
+
+// Pages returns the records of every completed lease, in the order the pages were fetched.
+func (c *Coordinator) Pages() ([]output.Record, error) {
+	payloads, err := c.backend.Pages()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]output.Record, len(payloads))
+	for i, payload := range payloads {
+		if err := json.Unmarshal(payload, &records[i]); err != nil {
+			return nil, fmt.Errorf("decoding page record: %w", err)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].FetchedAt.Equal(records[j].FetchedAt) {
+			return records[i].FetchedAt.Before(records[j].FetchedAt)
+		}
+		return records[i].URL < records[j].URL
+	})
+	return records, nil
+}
+
+// enqueue applies the same filtering as the standalone crawler before adding a URL to the frontier.
+// Links found on pages are also checked for spider traps. Callers must hold c.mu.
+func (c *Coordinator) enqueue(url string, link bool) error {
+	if c.budget != nil && c.budget.Exhausted() != "" {
+		return nil
+	}
+	depth, err := utils.CalculateDepthFromPath(url)
+	if err != nil {
+		c.logger.Warn("Error calculating depth for URL", "url", url, "error", err)
+		return nil
+	}
+	if depth > c.maxDepth {
+		c.logger.Debug("Skipping URL", "url", url, "depth", depth, "reason", "max_depth")
+		return nil
+	}
+	if utils.HasFileType(url, c.fileTypes) {
+		c.logger.Debug("Skipping URL", "url", url, "depth", depth, "reason", "file_type")
+		return nil
+	}
+
+	canonicalURL, err := utils.NormalizeURL(url, c.baseURL)
+	if err != nil {
+		c.logger.Warn("Skipping URL", "url", url, "depth", depth, "reason", "malformed", "error", err)
+		return nil
+	}
+	if link && c.traps != nil {
+		if kind := c.traps.Check(canonicalURL); kind != "" {
+			c.logger.Debug("Skipping URL", "url", canonicalURL, "depth", depth, "reason", "trap", "trap", kind)
+			return nil
+		}
+	}
+
+	claimed, err := c.backend.Claim(canonicalURL)
+	if err != nil || !claimed {
+		return err
+	}
+	return c.backend.Push(store.Task{URL: canonicalURL, Depth: depth})
+}
+
+// nextTask pops the first queued task whose host politeness allows it to be leased now and that
+// the budget admits, putting the tasks of hosts that are held back at the end of the frontier. It
+// returns nil if there is none. Callers must hold c.mu.
+func (c *Coordinator) nextTask() (task *store.Task, err error) {
+	var held []store.Task
+	defer func() {
+		for _, t := range held {
+			if pushErr := c.backend.Push(t); pushErr != nil && err == nil {
+				err = pushErr
+			}
+		}
+	}()
+
+	for i := 0; i < maxLeaseScan; i++ {
+		next, err := c.backend.Pop()
+		if err != nil || next == nil {
+			return nil, err
+		}
+		host := c.host(next.URL)
+		if (c.politeness.HostConcurrency > 0 && host.leased >= c.politeness.HostConcurrency) || c.now().Before(host.next) {
+			held = append(held, *next)
+			continue
+		}
+		// A URL requeued after its lease expired was already admitted.
+		if c.budget == nil || c.admitted[next.URL] {
+			return next, nil
+		}
+		name := c.budget.Admit(next.URL)
+		if name == "" {
+			c.admitted[next.URL] = true
+			return next, nil
+		}
+		if c.budget.Exhausted() != "" {
+			c.logger.Warn("Crawl budget used up, stopping the crawl", "budget", name)
+			held = nil
+			return nil, c.drain()
+		}
+		c.logger.Debug("Skipping URL", "url", next.URL, "depth", next.Depth, "reason", "budget", "budget", name)
+	}
+	return nil, nil
+}
+
+// drain empties the frontier once a crawl-wide budget has run out. Callers must hold c.mu.
+func (c *Coordinator) drain() error {
+	for {
+		next, err := c.backend.Pop()
+		if err != nil || next == nil {
+			return err
+		}
+		c.logger.Debug("Skipping URL", "url", next.URL, "depth", next.Depth, "reason", "stopped")
+	}
+}
+
+// host returns the politeness state of rawURL's host. Callers must hold c.mu.
+func (c *Coordinator) host(rawURL string) *hostState {
+	name := ""
+	if u, err := url.Parse(rawURL); err == nil {
+		name = u.Host
+	}
+	state, ok := c.hosts[name]
+	if !ok {
+		state = &hostState{}
+		c.hosts[name] = state
+	}
+	return state
+}
+
+// release gives back the host slot taken by the lease of rawURL. Callers must hold c.mu.
+func (c *Coordinator) release(rawURL string) {
+	if host := c.host(rawURL); host.leased > 0 {
+		host.leased--
+	}
+}
+
+// reapExpired puts URLs from expired leases back on the frontier. Callers must hold c.mu.
+func (c *Coordinator) reapExpired() error {
+	expired, err := c.backend.ExpiredLeases(c.now())
+	if err != nil {
+		return err
+	}
+	for _, lease := range expired {
+		c.requeued++
+		c.release(lease.Task.URL)
+		if err := c.backend.Push(lease.Task); err != nil {
+			return err
+		}
+		c.logger.Warn("Lease expired, requeued URL", "url", lease.Task.URL, "worker", lease.Worker, "lease", lease.ID)
+	}
+	return nil
+}
+
+// checkDone closes the done channel once there is no more work. Callers must hold c.mu.
+func (c *Coordinator) checkDone() error {
+	if c.finished {
+		return nil
+	}
+	queued, err := c.backend.QueueLen()
+	if err != nil || queued > 0 {
+		return err
+	}
+	leased, err := c.backend.LeaseCount()
+	if err != nil || leased > 0 {
+		return err
+	}
+	c.finished = true
+	close(c.done)
+	return nil
+}
+
+// Handler exposes the coordinator over HTTP/JSON.
+//
+// Endpoints:
+// - POST /lease: returns 200 with a Lease, 204 when the frontier is temporarily empty, or 410 once the crawl is done.
+// - POST /complete: accepts a CompleteRequest; returns 409 if the lease is no longer held by the worker.
+// - POST /renew: accepts a RenewRequest and returns the Lease with its new expiry; returns 409 if the lease is no longer held by the worker.
+// - GET /status: returns a Status snapshot.
+// - GET /results: returns the crawled URLs in the same shape as the standalone JSON output.
+func (c *Coordinator) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST "+LeasePath, func(w http.ResponseWriter, r *http.Request) {
+		var req LeaseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Worker == "" {
+			http.Error(w, "worker id is required", http.StatusBadRequest)
+			return
+		}
+
+		lease, err := c.Lease(req.Worker)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if lease == nil {
+			select {
+			case <-c.done:
+				w.WriteHeader(http.StatusGone)
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		}
+		writeJSON(w, lease)
+	})
+
+	mux.HandleFunc("POST "+CompletePath, func(w http.ResponseWriter, r *http.Request) {
+		var req CompleteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "malformed completion", http.StatusBadRequest)
+			return
+		}
+		completed, err := c.Complete(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !completed {
+			http.Error(w, "lease expired or unknown", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux.HandleFunc("POST "+RenewPath, func(w http.ResponseWriter, r *http.Request) {
+		var req RenewRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "malformed renewal", http.StatusBadRequest)
+			return
+		}
+		lease, err := c.Renew(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if lease == nil {
+			http.Error(w, "lease expired or unknown", http.StatusConflict)
+			return
+		}
+		writeJSON(w, lease)
+	})
+
+	mux.HandleFunc("GET "+StatusPath, func(w http.ResponseWriter, r *http.Request) {
+		status, err := c.Status()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, status)
+	})
+
+	mux.HandleFunc("GET "+ResultsPath, func(w http.ResponseWriter, r *http.Request) {
+		used, err := c.Results()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, struct {
+			URLs map[string]bool `json:"urls"`
+		}{
+			URLs: used.CrawledURLs,
+		})
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
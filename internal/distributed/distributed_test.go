@@ -0,0 +1,361 @@
+package distributed_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/budget"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/distributed"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fingerprint"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/frontier"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/parser"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/store"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/store/resptest"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/trap"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+var logger = utils.NewLogger()
+
+func postJSON(t *testing.T, url string, body interface{}) *http.Response {
+	t.Helper()
+	payload, _ := json.Marshal(body)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", url, err)
+	}
+	return resp
+}
+
+func TestCoordinator_LeaseExpiryReassigns(t *testing.T) {
+	t.Run("Memory Backend", func(t *testing.T) {
+		testLeaseExpiry(t, store.NewMemory())
+	})
+
+	t.Run("RESP Backend", func(t *testing.T) {
+		server, err := resptest.NewServer()
+		if err != nil {
+			t.Fatalf("Failed to start RESP stand-in: %v", err)
+		}
+		defer server.Close()
+
+		backend, err := store.NewRedis(server.Addr, "test:")
+		if err != nil {
+			t.Fatalf("Failed to connect to RESP stand-in: %v", err)
+		}
+		defer backend.Close()
+
+		testLeaseExpiry(t, backend)
+	})
+}
+
+func testLeaseExpiry(t *testing.T, backend store.Backend) {
+	coord := distributed.NewCoordinator("https://example.com", 3, 50*time.Millisecond, backend, logger)
+	coord.Seed("https://example.com")
+
+	ts := httptest.NewServer(coord.Handler())
+	defer ts.Close()
+
+	resp := postJSON(t, ts.URL+distributed.LeasePath, distributed.LeaseRequest{Worker: "dead"})
+	var first distributed.Lease
+	json.NewDecoder(resp.Body).Decode(&first)
+	resp.Body.Close()
+	if first.URL != "https://example.com" {
+		t.Fatalf("Expected lease for seed URL, got %q", first.URL)
+	}
+
+	// The frontier is empty while the lease is outstanding.
+	resp = postJSON(t, ts.URL+distributed.LeasePath, distributed.LeaseRequest{Worker: "alive"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 while lease is held, got %d", resp.StatusCode)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	resp = postJSON(t, ts.URL+distributed.LeasePath, distributed.LeaseRequest{Worker: "alive"})
+	var second distributed.Lease
+	json.NewDecoder(resp.Body).Decode(&second)
+	resp.Body.Close()
+	if second.URL != first.URL || second.ID == first.ID {
+		t.Fatalf("Expected expired lease to be reassigned with a new id, got %+v", second)
+	}
+
+	// The dead worker's late completion must be rejected.
+	resp = postJSON(t, ts.URL+distributed.CompletePath, distributed.CompleteRequest{Lease: first.ID, Worker: "dead"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 for expired lease, got %d", resp.StatusCode)
+	}
+
+	resp = postJSON(t, ts.URL+distributed.CompletePath, distributed.CompleteRequest{Lease: second.ID, Worker: "alive"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 for live lease, got %d", resp.StatusCode)
+	}
+
+	resp = postJSON(t, ts.URL+distributed.LeasePath, distributed.LeaseRequest{Worker: "alive"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("Expected 410 once the crawl is done, got %d", resp.StatusCode)
+	}
+
+	status, err := coord.Status()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if status.Crawled != 1 || status.Requeued != 1 || !status.Done {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+}
+
+func TestCoordinator_WorkersCrawlSite(t *testing.T) {
+	var site *httptest.Server
+	site = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintf(w, `<a href="/a">A</a><a href="/b">B</a><a href="https://external.com/x">X</a>`)
+		case "/a":
+			fmt.Fprintf(w, `<a href="/b">B</a><a href="/a/c">C</a>`)
+		default:
+			fmt.Fprintf(w, `<p>The same text on every other page</p><a href="%s/">Home</a>`, site.URL)
+		}
+	}))
+	defer site.Close()
+
+	// Request uses the default transport; trust the test server's certificate.
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = site.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	coord := distributed.NewCoordinator(site.URL, 3, time.Second, nil, logger)
+	coord.SetDuplicates(fingerprint.NewIndex(fingerprint.DefaultDistance), false)
+	coord.Seed(site.URL)
+	ts := httptest.NewServer(coord.Handler())
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		worker := distributed.NewWorker(fmt.Sprintf("w%d", i), ts.URL, fetcher.NewFetcher(time.Second), parser.NewParser(), logger, ticker)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := worker.Run(ctx); err != nil {
+				t.Errorf("Worker returned error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-coord.Done():
+	default:
+		t.Fatal("Expected coordinator to be done after workers exit")
+	}
+
+	results, err := coord.Results()
+	if err != nil {
+		t.Fatalf("Results failed: %v", err)
+	}
+	crawled := results.CrawledURLs
+	for _, path := range []string{"", "/a", "/b", "/a/c"} {
+		if !crawled[site.URL+path] {
+			t.Errorf("Expected %s to be crawled, got %v", site.URL+path, crawled)
+		}
+	}
+	if len(crawled) != 4 {
+		t.Errorf("Expected 4 crawled URLs, got %d", len(crawled))
+	}
+
+	// The per-page formats get a record for every page, as in a standalone crawl.
+	pages, err := coord.Pages()
+	if err != nil {
+		t.Fatalf("Pages failed: %v", err)
+	}
+	if len(pages) != 4 {
+		t.Fatalf("Expected 4 page records, got %+v", pages)
+	}
+	for _, page := range pages {
+		if page.Status != http.StatusOK || page.ContentHash == "" || page.FetchedAt.IsZero() {
+			t.Errorf("Expected a full record for %s, got %+v", page.URL, page)
+		}
+		if page.URL == site.URL+"/a/c" && page.Depth != 2 {
+			t.Errorf("Expected %s at depth 2, got %d", page.URL, page.Depth)
+		}
+	}
+	// Workers send fingerprints, so the coordinator finds duplicates across them.
+	clusters := output.Clusters(pages)
+	if len(clusters) != 1 || len(clusters[0].Exact) != 1 {
+		t.Fatalf("Expected /b and /a/c to be exact duplicates, got %+v", clusters)
+	}
+	if pair := []string{clusters[0].URL, clusters[0].Exact[0]}; !slices.Contains(pair, site.URL+"/b") || !slices.Contains(pair, site.URL+"/a/c") {
+		t.Errorf("Expected /b and /a/c in the cluster, got %+v", clusters[0])
+	}
+}
+
+func TestCoordinator_RenewalKeepsLeaseAndTimerReaps(t *testing.T) {
+	backend := store.NewMemory()
+	coord := distributed.NewCoordinator("https://example.com", 3, 100*time.Millisecond, backend, logger)
+	coord.Seed("https://example.com")
+
+	ts := httptest.NewServer(coord.Handler())
+	defer ts.Close()
+
+	resp := postJSON(t, ts.URL+distributed.LeasePath, distributed.LeaseRequest{Worker: "slow"})
+	var lease distributed.Lease
+	json.NewDecoder(resp.Body).Decode(&lease)
+	resp.Body.Close()
+	if lease.TTLMillis != 100 {
+		t.Errorf("Expected the lease to carry its 100ms TTL, got %d", lease.TTLMillis)
+	}
+
+	// Renewed past its original TTL, the lease is not handed to anyone else.
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		resp = postJSON(t, ts.URL+distributed.RenewPath, distributed.RenewRequest{Lease: lease.ID, Worker: "slow"})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 renewing a held lease, got %d", resp.StatusCode)
+		}
+	}
+	resp = postJSON(t, ts.URL+distributed.LeasePath, distributed.LeaseRequest{Worker: "other"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 while the renewed lease is held, got %d", resp.StatusCode)
+	}
+	resp = postJSON(t, ts.URL+distributed.RenewPath, distributed.RenewRequest{Lease: lease.ID, Worker: "other"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 renewing another worker's lease, got %d", resp.StatusCode)
+	}
+
+	// Once renewals stop, the timer requeues the URL without any worker calling in.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go coord.ReapExpired(ctx)
+	time.Sleep(250 * time.Millisecond)
+
+	if queued, _ := backend.QueueLen(); queued != 1 {
+		t.Errorf("Expected the expired lease to be requeued by the timer, got %d queued", queued)
+	}
+	resp = postJSON(t, ts.URL+distributed.RenewPath, distributed.RenewRequest{Lease: lease.ID, Worker: "slow"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 renewing an expired lease, got %d", resp.StatusCode)
+	}
+}
+
+func TestWorker_RetriesTransientCoordinatorErrors(t *testing.T) {
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<p>No links</p>`)
+	}))
+	defer site.Close()
+
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = site.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	coord := distributed.NewCoordinator(site.URL, 3, time.Second, nil, logger)
+	coord.Seed(site.URL)
+
+	// The coordinator fails the first lease and the first completion, as if it were restarting.
+	var mu sync.Mutex
+	failed := make(map[string]bool)
+	handler := coord.Handler()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := !failed[r.URL.Path]
+		failed[r.URL.Path] = true
+		mu.Unlock()
+		if fail {
+			http.Error(w, "restarting", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	worker := distributed.NewWorker("w", ts.URL, fetcher.NewFetcher(time.Second), parser.NewParser(), logger, nil)
+	if err := worker.Run(ctx); err != nil {
+		t.Fatalf("Expected the worker to retry through the failures, got %v", err)
+	}
+
+	results, err := coord.Results()
+	if err != nil {
+		t.Fatalf("Results failed: %v", err)
+	}
+	if !results.CrawledURLs[site.URL] {
+		t.Errorf("Expected %s to be crawled, got %v", site.URL, results.CrawledURLs)
+	}
+}
+
+func TestCoordinator_AppliesFrontierSettings(t *testing.T) {
+	coord := distributed.NewCoordinator("https://example.com", 3, time.Minute, store.NewMemory(), logger)
+	coord.SetExcludedFileTypes([]string{".zip"})
+	coord.SetTraps(trap.New(trap.Limits{MaxRepeats: 1}))
+	coord.SetBudget(budget.New(budget.Limits{MaxPages: 3}))
+	coord.SetPoliteness(frontier.Politeness{HostConcurrency: 1})
+	coord.Seed("https://example.com")
+
+	lease, _ := coord.Lease("w1")
+	if lease == nil || lease.URL != "https://example.com" {
+		t.Fatalf("Expected a lease for the seed, got %+v", lease)
+	}
+	coord.Complete(distributed.CompleteRequest{Lease: lease.ID, Worker: "w1", Links: []string{
+		"https://example.com/report.pdf",
+		"https://example.com/archive.zip",
+		"https://example.com/a/a/a",
+		"https://example.com/c",
+		"https://example.com/d",
+	}})
+
+	// .pdf is crawled once the file types are replaced; .zip and the trap never reach the frontier.
+	lease, _ = coord.Lease("w1")
+	if lease == nil || lease.URL != "https://example.com/report.pdf" {
+		t.Fatalf("Expected a lease for the PDF, got %+v", lease)
+	}
+	if held, _ := coord.Lease("w2"); held != nil {
+		t.Errorf("Expected no second lease for a host limited to one at a time, got %s", held.URL)
+	}
+	coord.Complete(distributed.CompleteRequest{Lease: lease.ID, Worker: "w1"})
+
+	lease, _ = coord.Lease("w1")
+	if lease == nil || lease.URL != "https://example.com/c" {
+		t.Fatalf("Expected a lease for /c, got %+v", lease)
+	}
+	coord.Complete(distributed.CompleteRequest{Lease: lease.ID, Worker: "w1"})
+
+	// The third page used up max_pages, so /d is dropped and the crawl ends.
+	if lease, _ = coord.Lease("w1"); lease != nil {
+		t.Fatalf("Expected no lease once the page budget ran out, got %s", lease.URL)
+	}
+	select {
+	case <-coord.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the crawl to finish once the page budget ran out")
+	}
+	if got := coord.StoppedBy(); got != budget.MaxPages {
+		t.Errorf("Expected the crawl to be stopped by %s, got %q", budget.MaxPages, got)
+	}
+	if traps := coord.Traps(); len(traps) != 1 || traps[0].Kind != trap.KindRepeatingSegments {
+		t.Errorf("Expected one repeating segments trap, got %+v", traps)
+	}
+}
@@ -0,0 +1,62 @@
+package distributed
+
+import (
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+)
+
+// Endpoints exposed by the coordinator. Workers talk to these over plain HTTP/JSON.
+const (
+	LeasePath    = "/lease"
+	CompletePath = "/complete"
+	RenewPath    = "/renew"
+	StatusPath   = "/status"
+	ResultsPath  = "/results"
+)
+
+// LeaseRequest is sent by a worker asking for the next URL to crawl.
+type LeaseRequest struct {
+	Worker string `json:"worker"`
+}
+
+// Lease hands a single URL to a worker for a limited time.
+// If the worker does not complete or renew it before ExpiresAt, the URL is put back on the frontier.
+// TTLMillis is how long the lease lasts from when it was granted or renewed, so workers know
+// when to renew it without comparing clocks with the coordinator.
+type Lease struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Base      string    `json:"base"`
+	Depth     int       `json:"depth"`
+	Worker    string    `json:"worker"`
+	ExpiresAt time.Time `json:"expires_at"`
+	TTLMillis int64     `json:"ttl_ms"`
+}
+
+// RenewRequest asks the coordinator for more time on a lease whose URL is still being crawled.
+type RenewRequest struct {
+	Lease  string `json:"lease"`
+	Worker string `json:"worker"`
+}
+
+// CompleteRequest reports the outcome of a lease back to the coordinator. Links are the internal
+// links to crawl next; Page is the record of the page for the per-page output formats.
+type CompleteRequest struct {
+	Lease  string         `json:"lease"`
+	Worker string         `json:"worker"`
+	Links  []string       `json:"links,omitempty"`
+	Error  string         `json:"error,omitempty"`
+	Page   *output.Record `json:"page,omitempty"`
+	Bytes  int            `json:"bytes,omitempty"` // size of the page body, for the byte budget
+}
+
+// Status is a snapshot of the coordinator's progress.
+type Status struct {
+	Queued   int  `json:"queued"`
+	Leased   int  `json:"leased"`
+	Crawled  int  `json:"crawled"`
+	Failed   int  `json:"failed"`
+	Requeued int  `json:"requeued"`
+	Done     bool `json:"done"`
+}
@@ -0,0 +1,322 @@
+package distributed
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fingerprint"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/parser"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shared"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// DefaultPollInterval is how long a worker waits before asking again when the frontier is empty.
+const DefaultPollInterval = 200 * time.Millisecond
+
+// DefaultRetryWindow is how long a worker keeps retrying a coordinator that cannot be reached or
+// fails with a server error before giving up.
+const DefaultRetryWindow = time.Minute
+
+// maxRetryDelay caps the backoff between retries of a failed coordinator call.
+const maxRetryDelay = 5 * time.Second
+
+// ErrLeaseLost is returned when the coordinator no longer recognises a lease, usually because it expired.
+var ErrLeaseLost = errors.New("lease expired or reassigned")
+
+// transientError is a coordinator call that failed in a way worth retrying: the coordinator could
+// not be reached, or answered with a server error.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+
+func (e *transientError) Unwrap() error { return e.err }
+
+// Worker repeatedly leases URLs from a coordinator, crawls them and reports the internal links it found.
+type Worker struct {
+	id           string
+	coordinator  string
+	client       *http.Client
+	fetcher      *fetcher.Fetcher
+	parser       *parser.Parser
+	logger       *utils.Logger
+	rateLimiter  *time.Ticker
+	pollInterval time.Duration
+	retryWindow  time.Duration
+}
+
+// NewWorker returns a worker crawling with fetcher and parser. A nil rateLimiter leaves rate
+// limiting to the fetcher's middlewares.
+func NewWorker(id string, coordinatorURL string, fetcher *fetcher.Fetcher, parser *parser.Parser, logger *utils.Logger, rateLimiter *time.Ticker) *Worker {
+	return &Worker{
+		id:           id,
+		coordinator:  strings.TrimRight(coordinatorURL, "/"),
+		client:       &http.Client{Timeout: 10 * time.Second},
+		fetcher:      fetcher,
+		parser:       parser,
+		logger:       logger.With("worker", id),
+		rateLimiter:  rateLimiter,
+		pollInterval: DefaultPollInterval,
+		retryWindow:  DefaultRetryWindow,
+	}
+}
+
+// Run processes leases until the coordinator reports the crawl is done or the context is cancelled.
+// Calls that fail because the coordinator is unreachable or answers with a server error are retried
+// for up to DefaultRetryWindow before Run gives up.
+func (w *Worker) Run(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var lease *Lease
+		var done bool
+		err := w.retry(ctx, "lease", func() (err error) {
+			lease, done, err = w.lease(ctx)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if done {
+			w.logger.Info("Coordinator reports crawl finished")
+			return nil
+		}
+		if lease == nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(w.pollInterval):
+			}
+			continue
+		}
+
+		result := w.process(ctx, lease)
+		err = w.retry(ctx, "complete", func() error {
+			return w.complete(ctx, result)
+		})
+		if err != nil {
+			if errors.Is(err, ErrLeaseLost) {
+				w.logger.Warn("Lease was lost, discarding result", "url", lease.URL, "lease", lease.ID)
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// retry calls fn until it succeeds, fails with an error that is not transient, or keeps failing
+// for longer than the retry window. The delay between attempts doubles from the poll interval.
+func (w *Worker) retry(ctx context.Context, call string, fn func() error) error {
+	deadline := time.Now().Add(w.retryWindow)
+	delay := w.pollInterval
+	for {
+		err := fn()
+		var transient *transientError
+		if err == nil || !errors.As(err, &transient) || time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		w.logger.Warn("Coordinator call failed, retrying", "call", call, "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// process crawls a single leased URL, renewing the lease while it does. If the lease is lost, the
+// fetch is cancelled since another worker will crawl the URL. Deduplication is left to the
+// coordinator, so each page gets a fresh UsedURL purely for the parser's bookkeeping.
+func (w *Worker) process(ctx context.Context, lease *Lease) CompleteRequest {
+	result := CompleteRequest{Lease: lease.ID, Worker: w.id}
+
+	if w.rateLimiter != nil {
+		<-w.rateLimiter.C
+	}
+	w.logger.Debug("Crawling URL", "url", lease.URL, "depth", lease.Depth)
+
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if lease.TTLMillis > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go w.keepAlive(fetchCtx, cancel, lease, stop)
+	}
+
+	page, err := w.fetcher.FetchContext(fetchCtx, lease.URL, w.logger)
+	if err != nil {
+		result.Error = err.Error()
+		result.Page = &output.Record{Status: statusOf(err), Error: err.Error(), FetchedAt: time.Now()}
+		return result
+	}
+	result.Page = pageRecord(page)
+	result.Bytes = len(page.Body)
+
+	scratch := &shared.UsedURL{
+		CrawledURLs:  make(map[string]bool),
+		VisitedPaths: make(map[string]bool),
+	}
+	result.Links = w.parser.CheckInternal(lease.Base, page.Links, w.logger, lease.URL, scratch)
+	return result
+}
+
+// pageRecord describes a fetched page for the per-page outputs, as the standalone crawler does.
+// The coordinator fills in the URL and depth of the lease, and DuplicateOf from the fingerprints
+// of every worker's pages.
+func pageRecord(page *fetcher.Page) *output.Record {
+	content := fingerprint.Of(page.Body)
+	links := make([]string, 0, len(page.Links))
+	for link := range page.Links {
+		if normalized, err := utils.NormalizeURL(link, page.URL); err == nil {
+			links = append(links, normalized)
+		}
+	}
+	sort.Strings(links)
+
+	return &output.Record{
+		Status:       page.StatusCode,
+		Links:        links,
+		Title:        page.Title,
+		Canonical:    page.Canonical,
+		ContentHash:  fmt.Sprintf("%x", sha256.Sum256(page.Body)),
+		TextHash:     content.Hash,
+		SimHash:      content.Hex(),
+		ETag:         page.Header.Get("ETag"),
+		LastModified: page.Header.Get("Last-Modified"),
+		FetchedAt:    page.FetchedAt,
+		Duration:     float64(page.Duration.Microseconds()) / 1000,
+	}
+}
+
+// statusOf returns the HTTP status a fetch error stands for, or 0 if no response was received.
+func statusOf(err error) int {
+	if errors.Is(err, fetcher.ErrNotFound) {
+		return http.StatusNotFound
+	}
+	return 0
+}
+
+// keepAlive renews lease every third of its TTL until stop is closed, and calls cancel if the
+// coordinator no longer holds the lease for this worker.
+func (w *Worker) keepAlive(ctx context.Context, cancel context.CancelFunc, lease *Lease, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(lease.TTLMillis) * time.Millisecond / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := w.renew(ctx, lease.ID)
+		if errors.Is(err, ErrLeaseLost) {
+			w.logger.Warn("Lease was lost, abandoning URL", "url", lease.URL, "lease", lease.ID)
+			cancel()
+			return
+		}
+		if err != nil {
+			// The lease lasts until the next renewal, which may get through.
+			w.logger.Warn("Failed to renew lease", "url", lease.URL, "lease", lease.ID, "error", err)
+		}
+	}
+}
+
+func (w *Worker) renew(ctx context.Context, lease string) error {
+	resp, err := w.post(ctx, RenewPath, RenewRequest{Lease: lease, Worker: w.id})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusConflict:
+		return ErrLeaseLost
+	case resp.StatusCode >= 500:
+		return &transientError{fmt.Errorf("unexpected renewal response: %s", resp.Status)}
+	default:
+		return fmt.Errorf("unexpected renewal response: %s", resp.Status)
+	}
+}
+
+func (w *Worker) lease(ctx context.Context) (*Lease, bool, error) {
+	resp, err := w.post(ctx, LeasePath, LeaseRequest{Worker: w.id})
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var lease Lease
+		if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+			return nil, false, fmt.Errorf("decoding lease: %w", err)
+		}
+		return &lease, false, nil
+	case http.StatusNoContent:
+		return nil, false, nil
+	case http.StatusGone:
+		return nil, true, nil
+	default:
+		err := fmt.Errorf("unexpected lease response: %s", resp.Status)
+		if resp.StatusCode >= 500 {
+			return nil, false, &transientError{err}
+		}
+		return nil, false, err
+	}
+}
+
+func (w *Worker) complete(ctx context.Context, result CompleteRequest) error {
+	resp, err := w.post(ctx, CompletePath, result)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return ErrLeaseLost
+	default:
+		err := fmt.Errorf("unexpected completion response: %s", resp.Status)
+		if resp.StatusCode >= 500 {
+			return &transientError{err}
+		}
+		return err
+	}
+}
+
+func (w *Worker) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.coordinator+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil && ctx.Err() == nil {
+		// The coordinator could not be reached; it may be restarting.
+		return nil, &transientError{err}
+	}
+	return resp, err
+}
@@ -0,0 +1,586 @@
+package fetcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotCached is returned by the Cache middleware in offline mode for a URL it has no stored
+// response for. It is never retried.
+var ErrNotCached = errors.New("not in cache")
+
+// DefaultCacheSize is the default limit on the total size of a CacheStore, in bytes.
+const DefaultCacheSize = 512 << 20
+
+// maxHeuristicFreshness caps how long a response without explicit freshness is considered fresh.
+const maxHeuristicFreshness = 24 * time.Hour
+
+// heuristicallyCacheable are the statuses RFC 9111 allows a cache to store and serve without
+// explicit freshness information.
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// Cache answers GET requests from store when it holds a fresh response, following RFC 9111 for a
+// private cache: freshness comes from Cache-Control max-age, then Expires, then 10% of the time
+// since Last-Modified (at most a day). Stale responses are revalidated with If-None-Match and
+// If-Modified-Since, and a 304 refreshes the stored copy. Responses are stored unless they are
+// marked no-store, and one is only reused for requests that send the same values of the headers
+// named by its Vary header. Conditional requests from the crawler are answered with 304 when the
+// stored response matches them.
+//
+// In offline mode nothing is sent: stored responses are served however stale they are, and other
+// requests fail with ErrNotCached.
+//
+// Responses served from the store are handed to the fetcher's archiver like those from the
+// network, so archives and mirrors of a cached crawl are complete.
+func Cache(store *CacheStore, offline bool) Middleware {
+	return func(next RoundTripper) RoundTripper {
+		return RoundTripperFunc(func(req *Request) (*http.Response, error) {
+			target := req.HTTP.URL.String()
+			if req.HTTP.Method != http.MethodGet {
+				if offline {
+					return nil, ErrNotCached
+				}
+				return next.RoundTrip(req)
+			}
+
+			entry, err := store.load(target)
+			if err != nil {
+				req.Logger.Warn("Failed to read cached response", "url", target, "error", err)
+			}
+			if entry != nil && !entry.matches(req.HTTP) {
+				entry = nil
+			}
+			if offline {
+				if entry == nil {
+					return nil, ErrNotCached
+				}
+				req.Logger.Debug("Serving URL from cache", "url", target, "offline", true)
+				now := time.Now()
+				return record(req.archiver, req, entry.response(req.HTTP, now), now), nil
+			}
+
+			directives := cacheControl(req.HTTP.Header)
+			if _, ok := directives["no-store"]; ok {
+				return next.RoundTrip(req)
+			}
+			if entry != nil && entry.fresh(directives, time.Now()) {
+				req.Logger.Debug("Serving URL from cache", "url", target)
+				now := time.Now()
+				return record(req.archiver, req, entry.response(req.HTTP, now), now), nil
+			}
+
+			// A stale response is revalidated, unless the crawler sent validators of its own.
+			send := req
+			if entry != nil && !conditional(req.HTTP) && entry.validators() {
+				revalidation := *req
+				revalidation.HTTP = req.HTTP.Clone(req.HTTP.Context())
+				if etag := entry.Header.Get("ETag"); etag != "" {
+					revalidation.HTTP.Header.Set("If-None-Match", etag)
+				}
+				if modified := entry.Header.Get("Last-Modified"); modified != "" {
+					revalidation.HTTP.Header.Set("If-Modified-Since", modified)
+				}
+				send = &revalidation
+			}
+
+			requested := time.Now()
+			resp, err := next.RoundTrip(send)
+			if err != nil {
+				return nil, err
+			}
+			received := time.Now()
+
+			if resp.StatusCode == http.StatusNotModified && entry != nil && entry.validatedBy(resp.Header) {
+				resp.Body.Close()
+				entry.refresh(resp.Header, requested, received)
+				if err := store.save(entry); err != nil {
+					req.Logger.Warn("Failed to cache response", "url", target, "error", err)
+				}
+				req.Logger.Debug("Revalidated cached response", "url", target)
+				return record(req.archiver, req, entry.response(req.HTTP, received), requested), nil
+			}
+			if !storable(req.HTTP, resp) {
+				return resp, nil
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			if err := store.save(newCacheEntry(req.HTTP, resp, body, requested, received)); err != nil {
+				req.Logger.Warn("Failed to cache response", "url", target, "error", err)
+			}
+			return resp, nil
+		})
+	}
+}
+
+// cacheAt is Cache with a store in dir that is opened by the first request, so parsing a chain
+// has no side effects. If the store cannot be opened, every request fails with that error.
+func cacheAt(dir string, maxSize int64, offline bool) Middleware {
+	var once sync.Once
+	var cache Middleware
+	return func(next RoundTripper) RoundTripper {
+		once.Do(func() {
+			store, err := SharedCacheStore(dir, maxSize)
+			if err != nil {
+				err = fmt.Errorf("cache %s: %w", dir, err)
+				cache = func(RoundTripper) RoundTripper {
+					return RoundTripperFunc(func(*Request) (*http.Response, error) { return nil, err })
+				}
+				return
+			}
+			cache = Cache(store, offline)
+		})
+		return cache(next)
+	}
+}
+
+// CacheStore keeps responses for the Cache middleware in a directory, one file per URL. When the
+// files together grow past the store's size, the least recently used are removed.
+type CacheStore struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	size  int64
+	files map[string]*cacheFile
+}
+
+type cacheFile struct {
+	size int64
+	used time.Time
+}
+
+// OpenCacheStore opens the store in dir, creating the directory if needed, and trims it to
+// maxSize bytes.
+func OpenCacheStore(dir string, maxSize int64) (*CacheStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &CacheStore{dir: dir, maxSize: maxSize, files: make(map[string]*cacheFile)}
+	for _, entry := range entries {
+		// Temporary files are left behind by writes that were interrupted.
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".cache" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		s.files[entry.Name()] = &cacheFile{size: info.Size(), used: info.ModTime()}
+		s.size += info.Size()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict()
+	return s, nil
+}
+
+var (
+	sharedMu     sync.Mutex
+	sharedStores = make(map[string]*CacheStore)
+)
+
+// SharedCacheStore returns the store in dir already opened by an earlier call, or opens it with
+// OpenCacheStore. Crawls running at once in one process with the same directory then share a
+// store, so they agree on its size and never remove each other's files being written. The store
+// keeps the maxSize it was first opened with.
+func SharedCacheStore(dir string, maxSize int64) (*CacheStore, error) {
+	key, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if s, ok := sharedStores[key]; ok {
+		return s, nil
+	}
+	s, err := OpenCacheStore(dir, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	sharedStores[key] = s
+	return s, nil
+}
+
+// Size returns the total size of the stored responses in bytes.
+func (s *CacheStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Len returns the number of stored responses.
+func (s *CacheStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files)
+}
+
+func cacheFileName(url string) string {
+	return fmt.Sprintf("%x.cache", sha256.Sum256([]byte(url)))
+}
+
+// load returns the stored response for url, or nil if there is none. A file holds the entry's
+// JSON on its first line, followed by the body.
+func (s *CacheStore) load(url string) (*cacheEntry, error) {
+	name := cacheFileName(url)
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta, body, _ := bytes.Cut(data, []byte("\n"))
+	var entry cacheEntry
+	if err := json.Unmarshal(meta, &entry); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if entry.URL != url {
+		return nil, nil
+	}
+	entry.Body = body
+
+	// The modification time records use, so the eviction order survives restarts.
+	now := time.Now()
+	os.Chtimes(filepath.Join(s.dir, name), now, now)
+	s.mu.Lock()
+	if file, ok := s.files[name]; ok {
+		file.used = now
+	}
+	s.mu.Unlock()
+	return &entry, nil
+}
+
+func (s *CacheStore) save(entry *cacheEntry) error {
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	size := int64(len(meta) + 1 + len(entry.Body))
+	if size > s.maxSize {
+		return nil
+	}
+
+	// Writing to a temporary file first keeps readers from seeing half a response.
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(append(meta, '\n'), entry.Body...))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	name := cacheFileName(entry.URL)
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.files[name]; ok {
+		s.size -= old.size
+	}
+	s.files[name] = &cacheFile{size: size, used: time.Now()}
+	s.size += size
+	s.evict()
+	return nil
+}
+
+// evict removes the least recently used files until the store fits its size. s.mu must be held.
+func (s *CacheStore) evict() {
+	if s.size <= s.maxSize {
+		return
+	}
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return s.files[names[i]].used.Before(s.files[names[j]].used) })
+	for _, name := range names {
+		if s.size <= s.maxSize {
+			return
+		}
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		s.size -= s.files[name].size
+		delete(s.files, name)
+	}
+}
+
+// cacheEntry is a stored response with what is needed to work out its age.
+type cacheEntry struct {
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	// Vary holds the request headers named by the response's Vary header, as they were sent.
+	Vary         http.Header `json:"vary,omitempty"`
+	RequestTime  time.Time   `json:"request_time"`
+	ResponseTime time.Time   `json:"response_time"`
+	Body         []byte      `json:"-"`
+}
+
+func newCacheEntry(req *http.Request, resp *http.Response, body []byte, requested, received time.Time) *cacheEntry {
+	entry := &cacheEntry{
+		URL:          req.URL.String(),
+		Status:       resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		RequestTime:  requested,
+		ResponseTime: received,
+		Body:         body,
+	}
+	for _, name := range varyNames(resp.Header) {
+		if entry.Vary == nil {
+			entry.Vary = make(http.Header)
+		}
+		entry.Vary[name] = req.Header.Values(name)
+	}
+	return entry
+}
+
+// storable reports whether RFC 9111 lets a private cache keep resp.
+func storable(req *http.Request, resp *http.Response) bool {
+	if _, ok := cacheControl(req.Header)["no-store"]; ok {
+		return false
+	}
+	directives := cacheControl(resp.Header)
+	if _, ok := directives["no-store"]; ok {
+		return false
+	}
+	for _, name := range varyNames(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	if heuristicallyCacheable[resp.StatusCode] {
+		return true
+	}
+	// Other final statuses need explicit freshness.
+	_, maxAge := directives["max-age"]
+	_, public := directives["public"]
+	return resp.StatusCode >= 200 && resp.StatusCode != http.StatusPartialContent &&
+		resp.StatusCode != http.StatusNotModified && (maxAge || public || resp.Header.Get("Expires") != "")
+}
+
+// matches reports whether the entry may answer req, which must send the same values of the
+// headers named by Vary as the request the entry was stored for.
+func (e *cacheEntry) matches(req *http.Request) bool {
+	for name, values := range e.Vary {
+		if strings.Join(req.Header.Values(name), ",") != strings.Join(values, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// fresh reports whether the entry can be served without asking the origin, given the request's
+// Cache-Control directives.
+func (e *cacheEntry) fresh(request map[string]string, now time.Time) bool {
+	if _, ok := cacheControl(e.Header)["no-cache"]; ok {
+		return false
+	}
+	if _, ok := request["no-cache"]; ok {
+		return false
+	}
+	age := e.age(now)
+	if value, ok := request["max-age"]; ok {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || age > time.Duration(seconds)*time.Second {
+			return false
+		}
+	}
+	return e.freshness() > age
+}
+
+// freshness is how long after it was generated the response stays fresh.
+func (e *cacheEntry) freshness() time.Duration {
+	if value, ok := cacheControl(e.Header)["max-age"]; ok {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		// An invalid Expires, such as 0, means the response is already stale.
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(e.date())
+	}
+	if !heuristicallyCacheable[e.Status] {
+		return 0
+	}
+	modified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+	return min(e.date().Sub(modified)/10, maxHeuristicFreshness)
+}
+
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// age follows the age calculation of RFC 9111 section 4.2.3.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	var ageValue time.Duration
+	if seconds, err := strconv.Atoi(e.Header.Get("Age")); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	apparentAge := max(0, e.ResponseTime.Sub(e.date()))
+	correctedAge := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparentAge, correctedAge) + now.Sub(e.ResponseTime)
+}
+
+func (e *cacheEntry) validators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// validatedBy reports whether a 304 with header refers to the stored response: its ETag or,
+// failing that, its Last-Modified must match, and one without either is taken to match.
+func (e *cacheEntry) validatedBy(header http.Header) bool {
+	if etag := header.Get("ETag"); etag != "" {
+		return strings.TrimPrefix(etag, "W/") == strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+	}
+	if modified := header.Get("Last-Modified"); modified != "" {
+		return modified == e.Header.Get("Last-Modified")
+	}
+	return true
+}
+
+// refresh updates the entry with the headers of a 304 that revalidated it.
+func (e *cacheEntry) refresh(header http.Header, requested, received time.Time) {
+	for name, values := range header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range":
+			continue
+		}
+		e.Header[name] = values
+	}
+	e.RequestTime, e.ResponseTime = requested, received
+}
+
+// response builds the response to req from the entry: a 304 if req is conditional and the entry
+// matches it, otherwise the stored response.
+func (e *cacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(e.age(now).Seconds())))
+	status, body := e.Status, e.Body
+	if e.Status == http.StatusOK && notModified(req, e.Header) {
+		status, body = http.StatusNotModified, nil
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func conditional(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+// notModified evaluates req's If-None-Match, or if it has none its If-Modified-Since, against a
+// response with header.
+func notModified(req *http.Request, header http.Header) bool {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// cacheControl returns the directives of the Cache-Control header, with lowercase names and
+// unquoted values.
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+func varyNames(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
@@ -1,66 +1,237 @@
 package fetcher
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptrace"
 	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/metrics"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/tracing"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
 )
 
 type Fetcher struct {
-	client *http.Client
+	client         *http.Client
+	replay         bool
+	requestTimeout time.Duration
+	middlewares    []Middleware
+	archiver       Archiver
+	metrics        *metrics.Crawl
+	tracer         *tracing.Tracer
+}
+
+// Exchange is a single HTTP request and response as the fetcher saw it.
+type Exchange struct {
+	Request   *http.Request
+	Response  *http.Response
+	Body      []byte
+	FetchedAt time.Time
+	Duration  time.Duration
+}
+
+// Archiver records every response the fetcher receives, including failed attempts.
+type Archiver interface {
+	Archive(exchange *Exchange) error
+}
+
+type multiArchiver []Archiver
+
+func (m multiArchiver) Archive(exchange *Exchange) error {
+	var errs []error
+	for _, archiver := range m {
+		if err := archiver.Archive(exchange); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MultiArchiver returns an archiver that hands every exchange to each of archivers in turn.
+func MultiArchiver(archivers ...Archiver) Archiver {
+	return multiArchiver(archivers)
 }
 
 func NewFetcher(timeout time.Duration) *Fetcher {
 	return &Fetcher{
-		client: &http.Client{Timeout: timeout},
+		client:         &http.Client{Timeout: timeout},
+		requestTimeout: RequestTimeout,
+		middlewares:    DefaultMiddlewares(),
 	}
 }
 
+// SetMiddlewares replaces the middleware chain every request is sent through, outermost first.
+// A new fetcher starts with DefaultMiddlewares.
+func (f *Fetcher) SetMiddlewares(middlewares ...Middleware) {
+	f.middlewares = middlewares
+}
+
+// Use adds middlewares inside the existing chain, closest to the network.
+func (f *Fetcher) Use(middlewares ...Middleware) {
+	f.middlewares = append(f.middlewares, middlewares...)
+}
+
+// SetRequestTimeout limits each attempt at a request to timeout. It defaults to RequestTimeout.
+func (f *Fetcher) SetRequestTimeout(timeout time.Duration) {
+	f.requestTimeout = timeout
+}
+
+// Replayer is implemented by transports that answer from recorded responses instead of the
+// network, such as a replay archive. Their responses are not retried.
+type Replayer interface {
+	http.RoundTripper
+	Replays() bool
+}
+
+// SetTransport makes the fetcher send its requests through transport instead of the network,
+// for example to replay responses from an archive.
+func (f *Fetcher) SetTransport(transport http.RoundTripper) {
+	f.client.Transport = transport
+	replayer, ok := transport.(Replayer)
+	f.replay = ok && replayer.Replays()
+}
+
+// SetMetrics records request latency, bytes and retries in m.
+func (f *Fetcher) SetMetrics(m *metrics.Crawl) {
+	f.metrics = m
+}
+
+// SetTracer records a span for every request attempt, with its connection phases, and for
+// parsing each page. Spans are children of the span in the context passed to FetchContext.
+func (f *Fetcher) SetTracer(tracer *tracing.Tracer) {
+	f.tracer = tracer
+}
+
+// SetArchiver records every response received by the fetcher with archiver.
+func (f *Fetcher) SetArchiver(archiver Archiver) {
+	f.archiver = archiver
+}
+
+type headerKey struct{}
+
+// WithHeader returns a context whose requests also send header. Values in header replace the
+// fetcher's own, including the User-Agent.
+func WithHeader(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, headerKey{}, header)
+}
+
 // Define a custom error for 404 Not Found
 var ErrNotFound = errors.New("404 Not Found")
 
+// ErrNotInArchive is returned by replay transports that have no response for a URL. It is never retried.
+var ErrNotInArchive = errors.New("not in archive")
+
 // MaxRetry defines the maximum number of retry attempts
 const MaxRetry = 3
 
 // RetryDelay defines the delay between retries
 const InitialRetryDelay = 500 * time.Millisecond
 
-// RequestTimeout defines the timeout for each request
+// RequestTimeout is the default timeout for each request attempt
 const RequestTimeout = 1 * time.Second
 
+// Page is the result of fetching a single URL.
+type Page struct {
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Links      map[string]bool
+	// Title is the text of the page's <title>.
+	Title string
+	// Canonical is the absolute URL of the page's <link rel="canonical">, if it has one.
+	Canonical string
+	// NotModified is set when a conditional request was answered with 304 Not Modified. The page
+	// then has no body, links, title or canonical URL of its own.
+	NotModified bool
+	FetchedAt   time.Time
+	Duration    time.Duration
+}
+
 // FetchLinks retrieves all links from a URL, returning a map of URLs or an error if the page couldn't be fetched.
 func (f *Fetcher) FetchLinks(url string, logger *utils.Logger) (map[string]bool, error) {
-	res, err := Request(url, logger)
+	page, err := f.Fetch(url, logger)
+	if err != nil {
+		return nil, err
+	}
+	return page.Links, nil
+}
+
+// Fetch retrieves a URL and returns the page, including its body and the links found in it.
+func (f *Fetcher) Fetch(url string, logger *utils.Logger) (*Page, error) {
+	return f.FetchContext(context.Background(), url, logger)
+}
+
+// FetchContext is Fetch with a context carrying the trace span the fetch belongs to.
+func (f *Fetcher) FetchContext(ctx context.Context, url string, logger *utils.Logger) (*Page, error) {
+	start := time.Now()
+	res, err := f.RequestContext(ctx, url, logger)
 	if err != nil {
 		if errors.Is(err, ErrNotFound) {
 			return nil, ErrNotFound
 		}
-		logger.Error.Println("Error fetching the page:", err)
+		logger.Error("Error fetching the page", "url", url, "error", err)
 		return nil, err
 	}
 
 	if res == nil {
 		return nil, errors.New("failed to fetch URL after retries")
 	}
+	if res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		return &Page{
+			URL:         url,
+			StatusCode:  res.StatusCode,
+			Header:      res.Header,
+			Links:       map[string]bool{},
+			NotModified: true,
+			FetchedAt:   start,
+			Duration:    time.Since(start),
+		}, nil
+	}
 
-	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	// Closing the body hands the page to the archiver, if one is set.
+	res.Body.Close()
+	if err != nil {
+		logger.Error("Error reading the page", "url", url, "error", err)
+		return nil, err
+	}
+	f.metrics.AddBytes(len(body))
 
-	doc, err := goquery.NewDocumentFromReader(res.Body)
+	_, parseSpan := f.tracer.Start(ctx, "parse", tracing.KindInternal, tracing.Int("html.bytes", len(body)))
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
 	if err != nil {
-		logger.Error.Println("Error parsing the page:", err)
+		logger.Error("Error parsing the page", "url", url, "error", err)
+		parseSpan.RecordError(err)
+		parseSpan.End()
 		return nil, err
 	}
 
 	// Extract links as a map
 	links := extractLinks(doc, logger)
-	return links, nil
+	parseSpan.SetAttributes(tracing.Int("links", len(links)))
+	parseSpan.End()
+	return &Page{
+		URL:        url,
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+		Body:       body,
+		Links:      links,
+		Title:      strings.TrimSpace(doc.Find("title").First().Text()),
+		Canonical:  canonicalURL(doc, res.Request),
+		FetchedAt:  start,
+		Duration:   time.Since(start),
+	}, nil
 }
 
-// Request performs an HTTP GET request to the specified URL with retry logic, exponential backoff, and timeout handling.
+// Request performs an HTTP GET request to the specified URL through the fetcher's middleware chain.
 //
 // Parameters:
 // - url (string): The URL to request.
@@ -68,58 +239,88 @@ func (f *Fetcher) FetchLinks(url string, logger *utils.Logger) (map[string]bool,
 //
 // Returns:
 // - (*http.Response): The HTTP response object if the request is successful.
-// - (error): An error if the request fails after the maximum number of retries or encounters a non-retryable error.
+// - (error): `ErrNotFound` for a 404, or an error if the request fails or ends with a status other than 200 or 304.
 //
 // Behavior:
-// - Configures the HTTP client with a timeout (`RequestTimeout`) to prevent blocking on slow responses.
-// - Retries the request for transient errors (HTTP 5xx) up to `MaxRetry` times with exponential backoff and random jitter to avoid synchronized retries.
-// - Stops retries for client-side errors (HTTP 4xx) or when retries are exhausted.
-// - Closes response bodies for unsuccessful responses to prevent resource leaks.
-// - Exponential backoff starts with `InitialRetryDelay` and doubles after each attempt, capped at 5 seconds.
-// - Adds jitter to retry delays to distribute retries more evenly and reduce server load.
-// - Uses a custom `User-Agent` header to identify the crawler.
-func Request(url string, logger *utils.Logger) (*http.Response, error) {
-	var resp *http.Response
-	var err error
+//   - Configures the HTTP client with a timeout (`RequestTimeout` unless set with SetRequestTimeout) to prevent blocking on slow responses.
+//   - Sends the request through the middlewares set with `SetMiddlewares` and `Use`. By default these retry
+//     transient failures with exponential backoff (`Retry`) and log each attempt (`Logging`).
+//   - Closes response bodies for unsuccessful responses to prevent resource leaks.
+//   - Uses a custom `User-Agent` header to identify the crawler.
+//   - Passes every response to the archiver, if one is set, once its body has been closed.
+func (f *Fetcher) Request(url string, logger *utils.Logger) (*http.Response, error) {
+	return f.RequestContext(context.Background(), url, logger)
+}
 
-	client := &http.Client{
-		Timeout: RequestTimeout,
+// RequestContext is Request with a context carrying the trace span the request belongs to and
+// the CrawlInfo passed to middlewares.
+func (f *Fetcher) RequestContext(ctx context.Context, url string, logger *utils.Logger) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
 	}
-
-	retryDelay := InitialRetryDelay
-
-	for attempt := 1; attempt <= MaxRetry; attempt++ {
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			return nil, err
-		}
-		req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; MonzoCrawler/1.0)")
-
-		logger.Info.Printf("Requesting URL (Attempt %d/%d): %s\n", attempt, MaxRetry, url)
-
-		resp, err = client.Do(req)
-		if err == nil && resp.StatusCode == http.StatusOK {
-			return resp, nil
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; MonzoCrawler/1.0)")
+	if header, ok := ctx.Value(headerKey{}).(http.Header); ok {
+		for name, values := range header {
+			req.Header[name] = values
 		}
+	}
+	info, _ := ctx.Value(crawlInfoKey{}).(CrawlInfo)
 
-		if resp != nil {
-			resp.Body.Close()
-		}
-		if resp != nil && resp.StatusCode == http.StatusNotFound {
-			return nil, ErrNotFound
-		}
+	chain := f.middlewares
+	if f.archiver != nil {
+		chain = append(chain[:len(chain):len(chain)], Record(f.archiver))
+	}
+	resp, err := Chain(RoundTripperFunc(f.send), chain...).RoundTrip(&Request{
+		HTTP:     req,
+		Depth:    info.Depth,
+		Referrer: info.Referrer,
+		Attempt:  1,
+		Replayed: f.replay,
+		Logger:   logger,
+		archiver: f.archiver,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// A 304 only answers a conditional request, whose sender already has the page.
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotModified {
+		return resp, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	return nil, fmt.Errorf("unexpected status %s", resp.Status)
+}
 
-		logger.Info.Printf("Retrying URL after failure (Attempt %d/%d): %s\n", attempt, MaxRetry, url)
+// send makes one attempt at a request over the network, recording its metrics and trace span.
+func (f *Fetcher) send(req *Request) (*http.Response, error) {
+	ctx, span := f.tracer.Start(req.HTTP.Context(), "http.request", tracing.KindClient, tracing.String("http.url", req.HTTP.URL.String()), tracing.Int("attempt", req.Attempt))
+	phases := &phaseTimes{}
+	if span != nil {
+		ctx = httptrace.WithClientTrace(ctx, phases.clientTrace())
+	}
 
-		jitter := time.Duration(float64(retryDelay) * (0.5 + 0.5*utils.RandFloat()))
-		time.Sleep(retryDelay + jitter)
+	client := &http.Client{
+		Timeout:   f.requestTimeout,
+		Transport: f.client.Transport,
+	}
 
-		retryDelay *= 2
-		if retryDelay > 5*time.Second {
-			retryDelay = 5 * time.Second
-		}
+	start := time.Now()
+	resp, err := client.Do(req.HTTP.WithContext(ctx))
+	f.metrics.ObserveFetch(req.HTTP.URL.Host, time.Since(start))
+	if req.Attempt > 1 {
+		f.metrics.Retry()
+	}
+	phases.record(span)
+	if err != nil {
+		span.RecordError(err)
+	} else {
+		span.SetAttributes(tracing.Int("http.status_code", resp.StatusCode))
 	}
-	return nil, err
+	span.End()
+	return resp, err
 }
 
 // extractLinks parses the HTML document to extract all unique hyperlinks (anchor tags) with valid href attributes.
@@ -147,12 +348,30 @@ func extractLinks(doc *goquery.Document, logger *utils.Logger) map[string]bool {
 	doc.Find("a").Each(func(i int, s *goquery.Selection) {
 		if link, exists := s.Attr("href"); exists {
 			if strings.HasPrefix(link, "#") {
-				logger.Info.Println("Ignoring # tag:", link)
+				logger.Debug("Ignoring fragment link", "link", link)
 				return
 			}
 			links[link] = true
-			logger.Info.Println("Found link:", link)
+			logger.Debug("Found link", "link", link)
 		}
 	})
 	return links
 }
+
+// canonicalURL returns the page's <link rel="canonical"> resolved against the URL it was served
+// from, or "" if it has none.
+func canonicalURL(doc *goquery.Document, req *http.Request) string {
+	href, ok := doc.Find(`link[rel~="canonical"]`).First().Attr("href")
+	href = strings.TrimSpace(href)
+	if !ok || href == "" {
+		return ""
+	}
+	if req == nil || req.URL == nil {
+		return href
+	}
+	ref, err := req.URL.Parse(href)
+	if err != nil {
+		return href
+	}
+	return ref.String()
+}
@@ -1,11 +1,14 @@
 package fetcher_test
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -139,3 +142,232 @@ func TestFetchLinks_NonHTMLResponse(t *testing.T) {
 		t.Errorf("Expected no links from non-HTML response, but got %d", len(links))
 	}
 }
+
+type exchangeLog struct {
+	mu       sync.Mutex
+	statuses []int
+}
+
+func (l *exchangeLog) Archive(exchange *fetcher.Exchange) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.statuses = append(l.statuses, exchange.Response.StatusCode)
+	return nil
+}
+
+// TestRequest_MiddlewareChain checks that configured middlewares wrap every attempt in order,
+// see the crawl metadata, and that each attempt is archived.
+func TestRequest_MiddlewareChain(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Expected the header middleware to set Authorization, got %q", r.Header.Get("Authorization"))
+		}
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`<a href="/next">Next</a>`))
+	}))
+	defer ts.Close()
+
+	chain, err := fetcher.ParseMiddlewares("retry?attempts=2&delay=1ms,header?name=Authorization&value=Bearer%20token")
+	if err != nil {
+		t.Fatalf("ParseMiddlewares failed: %v", err)
+	}
+	var seen []string
+	inspect := func(next fetcher.RoundTripper) fetcher.RoundTripper {
+		return fetcher.RoundTripperFunc(func(req *fetcher.Request) (*http.Response, error) {
+			seen = append(seen, fmt.Sprintf("depth=%d referrer=%s attempt=%d", req.Depth, req.Referrer, req.Attempt))
+			return next.RoundTrip(req)
+		})
+	}
+
+	archive := &exchangeLog{}
+	f := fetcher.NewFetcher(time.Second)
+	f.SetMiddlewares(append(chain, inspect)...)
+	f.SetArchiver(archive)
+
+	ctx := fetcher.WithCrawlInfo(context.Background(), fetcher.CrawlInfo{Depth: 2, Referrer: "https://example.com"})
+	page, err := f.FetchContext(ctx, ts.URL, utils.NewLogger())
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", err)
+	}
+	if !page.Links["/next"] {
+		t.Errorf("Expected links from the retried page, got %v", page.Links)
+	}
+
+	want := []string{"depth=2 referrer=https://example.com attempt=1", "depth=2 referrer=https://example.com attempt=2"}
+	if strings.Join(seen, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected middleware to see %v, got %v", want, seen)
+	}
+	if len(archive.statuses) != 2 || archive.statuses[0] != http.StatusServiceUnavailable || archive.statuses[1] != http.StatusOK {
+		t.Errorf("Expected both attempts to be archived, got %v", archive.statuses)
+	}
+
+	if _, err := fetcher.ParseMiddlewares("retry,nope"); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("Expected an error naming the unknown middleware, got %v", err)
+	}
+}
+
+// TestRobots_DisallowsByMostSpecificRule checks robots.txt groups, precedence and wildcards.
+func TestRobots_DisallowsByMostSpecificRule(t *testing.T) {
+	var robotsFetches int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			robotsFetches++
+			w.Write([]byte("User-agent: *\nDisallow: /\n\nUser-agent: OtherBot\nUser-agent: monzocrawler\nDisallow: /private\nAllow: /private/public\nDisallow: /*.php$\nDisallow: /*?session=\n\nUser-agent: Crawler\nDisallow: /search\n"))
+			return
+		}
+		w.Write([]byte(`<p>ok</p>`))
+	}))
+	defer ts.Close()
+
+	f := fetcher.NewFetcher(time.Second)
+	f.SetMiddlewares(fetcher.Robots(fetcher.RobotsAgent))
+
+	for path, allowed := range map[string]bool{
+		"/":                    true,
+		"/private":             false,
+		"/private/notes":       false,
+		"/private/public/page": true,
+		"/index.php":           false,
+		"/index.php/about":     true,
+		"/search":              true,
+		"/search?q=a":          true,
+		"/search?session=1":    false,
+	} {
+		_, err := f.Request(ts.URL+path, utils.NewLogger())
+		if allowed && err != nil {
+			t.Errorf("Expected %s to be allowed, got %v", path, err)
+		}
+		if !allowed && !errors.Is(err, fetcher.ErrDisallowed) {
+			t.Errorf("Expected %s to be disallowed, got %v", path, err)
+		}
+	}
+	if robotsFetches != 1 {
+		t.Errorf("Expected robots.txt to be fetched once per host, got %d", robotsFetches)
+	}
+
+	// A server error only disallows the host until robots.txt can be fetched.
+	var failures int
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" && failures < 1 {
+			failures++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`<p>ok</p>`))
+	}))
+	defer flaky.Close()
+	if _, err := f.Request(flaky.URL+"/", utils.NewLogger()); !errors.Is(err, fetcher.ErrDisallowed) {
+		t.Errorf("Expected the host to be disallowed while robots.txt fails, got %v", err)
+	}
+	if _, err := f.Request(flaky.URL+"/", utils.NewLogger()); err != nil {
+		t.Errorf("Expected robots.txt to be fetched again after a server error, got %v", err)
+	}
+}
+
+// TestCache_ServesFreshResponsesAndRevalidatesStaleOnes checks freshness, revalidation, Vary,
+// no-store and offline mode.
+func TestCache_ServesFreshResponsesAndRevalidatesStaleOnes(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/stale":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		case "/secret":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Write([]byte(`<a href="` + r.URL.Path + `/next">Next</a>`))
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	store, err := fetcher.OpenCacheStore(dir, fetcher.DefaultCacheSize)
+	if err != nil {
+		t.Fatalf("OpenCacheStore failed: %v", err)
+	}
+	f := fetcher.NewFetcher(time.Second)
+	f.SetMiddlewares(fetcher.Cache(store, false))
+	fetch := func(f *fetcher.Fetcher, path string, header http.Header) (*fetcher.Page, error) {
+		ctx := fetcher.WithHeader(context.Background(), header)
+		return f.FetchContext(ctx, ts.URL+path, utils.NewLogger())
+	}
+
+	for i := 0; i < 2; i++ {
+		for _, path := range []string{"/fresh", "/stale", "/secret"} {
+			page, err := fetch(f, path, nil)
+			if err != nil || !page.Links[path+"/next"] {
+				t.Fatalf("Expected %s to be served with its links, got %v, %v", path, page, err)
+			}
+		}
+	}
+	for _, language := range []string{"en", "fr", "en"} {
+		if _, err := fetch(f, "/vary", http.Header{"Accept-Language": {language}}); err != nil {
+			t.Fatalf("Fetching /vary failed: %v", err)
+		}
+	}
+	if requests["/fresh"] != 1 || requests["/stale"] != 2 || requests["/secret"] != 2 || requests["/vary"] != 3 {
+		t.Errorf("Unexpected requests to the origin: %v", requests)
+	}
+	if store.Len() != 3 {
+		t.Errorf("Expected 3 stored responses, got %d", store.Len())
+	}
+
+	// A conditional request from the crawler is answered from the store.
+	page, err := fetch(f, "/stale", http.Header{"If-None-Match": {`"v1"`}})
+	if err != nil || !page.NotModified {
+		t.Errorf("Expected a 304 for a matching conditional request, got %+v, %v", page, err)
+	}
+
+	store, err = fetcher.OpenCacheStore(dir, fetcher.DefaultCacheSize)
+	if err != nil {
+		t.Fatalf("Reopening the store failed: %v", err)
+	}
+	offline := fetcher.NewFetcher(time.Second)
+	offline.SetMiddlewares(fetcher.Retry(3, time.Millisecond), fetcher.Cache(store, true))
+	before := requests["/stale"]
+	if page, err := fetch(offline, "/stale", nil); err != nil || !page.Links["/stale/next"] {
+		t.Errorf("Expected the stale response to be served offline, got %v", err)
+	}
+	if _, err := fetch(offline, "/secret", nil); !errors.Is(err, fetcher.ErrNotCached) {
+		t.Errorf("Expected ErrNotCached for a response that was not stored, got %v", err)
+	}
+	if requests["/stale"] != before || requests["/secret"] != 2 {
+		t.Errorf("Expected no requests in offline mode, got %v", requests)
+	}
+
+	// A store that is too small keeps only the most recently used responses.
+	small, err := fetcher.OpenCacheStore(dir, 800)
+	if err != nil {
+		t.Fatalf("Reopening the store failed: %v", err)
+	}
+	if small.Size() > 800 || small.Len() >= 3 {
+		t.Errorf("Expected the store to be trimmed to its size, got %d responses in %d bytes", small.Len(), small.Size())
+	}
+
+	// Crawls in one process with the same directory share a store.
+	shared, err := fetcher.SharedCacheStore(dir, fetcher.DefaultCacheSize)
+	if err != nil {
+		t.Fatalf("SharedCacheStore failed: %v", err)
+	}
+	if again, err := fetcher.SharedCacheStore(dir+"/.", fetcher.DefaultCacheSize); err != nil || again != shared {
+		t.Errorf("Expected the same store for the same directory, got %p and %p, %v", shared, again, err)
+	}
+}
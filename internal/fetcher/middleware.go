@@ -0,0 +1,425 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// Request is one fetch as it passes through the middleware chain: the HTTP request plus what
+// the crawler knows about it.
+type Request struct {
+	HTTP     *http.Request
+	Depth    int
+	Referrer string
+	// Attempt is 1 for the first try and is increased by the Retry middleware.
+	Attempt int
+	// Replayed is set when the fetcher's transport answers from recorded responses instead of
+	// the network, so trying again would only return the same response.
+	Replayed bool
+	Logger   *utils.Logger
+
+	// archiver is the fetcher's archiver, for middlewares that answer requests themselves.
+	archiver Archiver
+}
+
+// RoundTripper sends a Request. Like http.RoundTripper, it returns a response whose body the
+// caller must close, whatever its status.
+type RoundTripper interface {
+	RoundTrip(req *Request) (*http.Response, error)
+}
+
+// RoundTripperFunc adapts a function to RoundTripper.
+type RoundTripperFunc func(req *Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Middleware wraps a RoundTripper with extra behaviour, such as retrying or logging. The chain is
+// assembled for every request, so state shared between requests must be created outside the
+// returned function.
+type Middleware func(next RoundTripper) RoundTripper
+
+// Chain wraps rt in middlewares; the first middleware is the outermost.
+func Chain(rt RoundTripper, middlewares ...Middleware) RoundTripper {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		rt = middlewares[i](rt)
+	}
+	return rt
+}
+
+// DefaultMiddlewares is the chain a new Fetcher starts with.
+func DefaultMiddlewares() []Middleware {
+	return []Middleware{Retry(MaxRetry, InitialRetryDelay), Logging()}
+}
+
+type crawlInfoKey struct{}
+
+// CrawlInfo is what the crawler knows about a URL it asks the fetcher for.
+type CrawlInfo struct {
+	Depth    int
+	Referrer string
+}
+
+// WithCrawlInfo returns a context whose fetches carry info to the middlewares.
+func WithCrawlInfo(ctx context.Context, info CrawlInfo) context.Context {
+	return context.WithValue(ctx, crawlInfoKey{}, info)
+}
+
+// Retry retries requests that fail or return a status other than 200, 304 or 404, up to
+// attempts tries in total. The delay starts at initialDelay, doubles after each attempt up to 5 seconds,
+// and has random jitter added so retries are not synchronised. Replayed requests, requests for
+// URLs missing from an offline cache, and requests disallowed by robots.txt are not retried.
+func Retry(attempts int, initialDelay time.Duration) Middleware {
+	return func(next RoundTripper) RoundTripper {
+		return RoundTripperFunc(func(req *Request) (*http.Response, error) {
+			delay := initialDelay
+			for attempt := 1; ; attempt++ {
+				try := *req
+				try.Attempt = attempt
+				resp, err := next.RoundTrip(&try)
+				if attempt >= attempts || req.Replayed || !retryable(resp, err) {
+					return resp, err
+				}
+
+				if resp != nil {
+					resp.Body.Close()
+					req.Logger.Warn("Retrying URL after failure", "url", req.HTTP.URL.String(), "attempt", attempt, "status", resp.StatusCode)
+				} else {
+					req.Logger.Warn("Retrying URL after failure", "url", req.HTTP.URL.String(), "attempt", attempt, "error", err)
+				}
+
+				jitter := time.Duration(float64(delay) * (0.5 + 0.5*utils.RandFloat()))
+				select {
+				case <-time.After(delay + jitter):
+				case <-req.HTTP.Context().Done():
+					return nil, req.HTTP.Context().Err()
+				}
+
+				delay *= 2
+				if delay > 5*time.Second {
+					delay = 5 * time.Second
+				}
+			}
+		})
+	}
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, ErrNotInArchive) && !errors.Is(err, ErrNotCached) && !errors.Is(err, ErrDisallowed) && !errors.Is(err, context.Canceled)
+	}
+	return resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified && resp.StatusCode != http.StatusNotFound
+}
+
+// Logging logs every attempt at debug level.
+func Logging() Middleware {
+	return func(next RoundTripper) RoundTripper {
+		return RoundTripperFunc(func(req *Request) (*http.Response, error) {
+			target := req.HTTP.URL.String()
+			req.Logger.Debug("Requesting URL", "url", target, "depth", req.Depth, "referrer", req.Referrer, "attempt", req.Attempt)
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				req.Logger.Debug("Request failed", "url", target, "attempt", req.Attempt, "duration", time.Since(start), "error", err)
+				return nil, err
+			}
+			req.Logger.Debug("Received response", "url", target, "attempt", req.Attempt, "duration", time.Since(start), "status", resp.StatusCode)
+			return resp, nil
+		})
+	}
+}
+
+// RateLimit waits for a tick before every request, so requests sent through the chain are spaced
+// at least one tick apart.
+func RateLimit(tick <-chan time.Time) Middleware {
+	return func(next RoundTripper) RoundTripper {
+		return RoundTripperFunc(func(req *Request) (*http.Response, error) {
+			select {
+			case <-tick:
+			case <-req.HTTP.Context().Done():
+				return nil, req.HTTP.Context().Err()
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// Header sets header on every request, replacing values the fetcher or earlier middlewares set.
+func Header(header http.Header) Middleware {
+	return func(next RoundTripper) RoundTripper {
+		return RoundTripperFunc(func(req *Request) (*http.Response, error) {
+			for name, values := range header {
+				req.HTTP.Header[name] = values
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// ErrInjectedFault is returned by the Faults middleware in place of a network error.
+var ErrInjectedFault = errors.New("injected fault")
+
+// Faults fails a fraction rate of requests without sending them, for testing how the crawl copes
+// with errors. Failed requests get an empty response with status, or ErrInjectedFault if status
+// is 0.
+func Faults(rate float64, status int) Middleware {
+	return func(next RoundTripper) RoundTripper {
+		return RoundTripperFunc(func(req *Request) (*http.Response, error) {
+			if utils.RandFloat() >= rate {
+				return next.RoundTrip(req)
+			}
+			req.Logger.Debug("Injecting fault", "url", req.HTTP.URL.String(), "status", status)
+			if status == 0 {
+				return nil, ErrInjectedFault
+			}
+			return &http.Response{
+				Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+				StatusCode: status,
+				Proto:      "HTTP/1.1",
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     make(http.Header),
+				Body:       http.NoBody,
+				Request:    req.HTTP,
+			}, nil
+		})
+	}
+}
+
+// Record hands every response, with its body, to archiver once the body is closed, so both
+// pages and failed attempts are archived.
+func Record(archiver Archiver) Middleware {
+	return func(next RoundTripper) RoundTripper {
+		return RoundTripperFunc(func(req *Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				return nil, err
+			}
+			return record(archiver, req, resp, start), nil
+		})
+	}
+}
+
+// record makes resp hand itself to archiver once its body is closed. It does nothing without an
+// archiver.
+func record(archiver Archiver, req *Request, resp *http.Response, start time.Time) *http.Response {
+	if archiver == nil {
+		return resp
+	}
+	resp.Body = &recordingBody{ReadCloser: resp.Body, done: func(body []byte) {
+		exchange := &Exchange{
+			Request:   resp.Request,
+			Response:  resp,
+			Body:      body,
+			FetchedAt: start,
+			Duration:  time.Since(start),
+		}
+		if err := archiver.Archive(exchange); err != nil {
+			req.Logger.Error("Failed to archive response", "url", req.HTTP.URL.String(), "error", err)
+		}
+	}}
+	return resp
+}
+
+// recordingBody keeps a copy of everything read and calls done with it when closed. Whatever
+// was not read is drained first so the archive always has the complete body.
+type recordingBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	once sync.Once
+	done func(body []byte)
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	var err error
+	b.once.Do(func() {
+		io.Copy(&b.buf, b.ReadCloser)
+		err = b.ReadCloser.Close()
+		b.done(b.buf.Bytes())
+	})
+	return err
+}
+
+// MiddlewareFactory builds a middleware from the parameters given in its configuration.
+type MiddlewareFactory func(params url.Values) (Middleware, error)
+
+var middlewares = make(map[string]MiddlewareFactory)
+
+// RegisterMiddleware makes a middleware available to ParseMiddlewares under name.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewares[name] = factory
+}
+
+// MiddlewareNames returns the registered middleware names in alphabetical order.
+func MiddlewareNames() []string {
+	names := make([]string, 0, len(middlewares))
+	for name := range middlewares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseMiddlewares builds a chain from a comma-separated list of middleware names, outermost
+// first. Parameters follow a name as a URL query, for example
+// "retry?attempts=5,logging,faults?rate=0.1&status=503".
+func ParseMiddlewares(spec string) ([]Middleware, error) {
+	return ParseMiddlewaresWithDefaults(spec, nil)
+}
+
+// ParseMiddlewaresWithDefaults is like ParseMiddlewares, but parameters missing from a
+// middleware's entry in spec are taken from defaults, keyed by middleware name.
+func ParseMiddlewaresWithDefaults(spec string, defaults map[string]url.Values) ([]Middleware, error) {
+	var chain []Middleware
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, query, _ := strings.Cut(entry, "?")
+		factory, ok := middlewares[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware %q (available: %s)", name, strings.Join(MiddlewareNames(), ", "))
+		}
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: %w", name, err)
+		}
+		for key, values := range defaults[name] {
+			if !params.Has(key) {
+				params[key] = values
+			}
+		}
+		middleware, err := factory(params)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: %w", name, err)
+		}
+		chain = append(chain, middleware)
+	}
+	return chain, nil
+}
+
+func init() {
+	RegisterMiddleware("retry", func(params url.Values) (Middleware, error) {
+		attempts, err := intParam(params, "attempts", MaxRetry)
+		if err != nil {
+			return nil, err
+		}
+		delay, err := durationParam(params, "delay", InitialRetryDelay)
+		if err != nil {
+			return nil, err
+		}
+		if attempts < 1 {
+			return nil, errors.New("attempts must be at least 1")
+		}
+		return Retry(attempts, delay), nil
+	})
+	RegisterMiddleware("logging", func(params url.Values) (Middleware, error) {
+		return Logging(), nil
+	})
+	RegisterMiddleware("ratelimit", func(params url.Values) (Middleware, error) {
+		interval, err := durationParam(params, "interval", time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, errors.New("interval must be positive")
+		}
+		// The ticker is started by the first request, so parsing a chain has no side effects.
+		var once sync.Once
+		var ticks <-chan time.Time
+		return func(next RoundTripper) RoundTripper {
+			once.Do(func() { ticks = time.NewTicker(interval).C })
+			return RateLimit(ticks)(next)
+		}, nil
+	})
+	RegisterMiddleware("robots", func(params url.Values) (Middleware, error) {
+		agent := params.Get("agent")
+		if agent == "" {
+			agent = RobotsAgent
+		}
+		return Robots(agent), nil
+	})
+	RegisterMiddleware("header", func(params url.Values) (Middleware, error) {
+		name := params.Get("name")
+		if name == "" {
+			return nil, errors.New("name is required")
+		}
+		header := make(http.Header)
+		header.Set(name, params.Get("value"))
+		return Header(header), nil
+	})
+	RegisterMiddleware("cache", func(params url.Values) (Middleware, error) {
+		dir := params.Get("dir")
+		if dir == "" {
+			return nil, errors.New("dir is required")
+		}
+		size, err := intParam(params, "max_size_mb", DefaultCacheSize>>20)
+		if err != nil {
+			return nil, err
+		}
+		if size < 1 {
+			return nil, errors.New("max_size_mb must be at least 1")
+		}
+		offline := false
+		if params.Has("offline") {
+			if offline, err = strconv.ParseBool(params.Get("offline")); err != nil {
+				return nil, errors.New("offline must be true or false")
+			}
+		}
+		return cacheAt(dir, int64(size)<<20, offline), nil
+	})
+	RegisterMiddleware("faults", func(params url.Values) (Middleware, error) {
+		rate, err := strconv.ParseFloat(params.Get("rate"), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, errors.New("rate must be a number between 0 and 1")
+		}
+		status, err := intParam(params, "status", 0)
+		if err != nil {
+			return nil, err
+		}
+		return Faults(rate, status), nil
+	})
+}
+
+func intParam(params url.Values, name string, fallback int) (int, error) {
+	if !params.Has(name) {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(params.Get(name))
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a whole number", name)
+	}
+	return n, nil
+}
+
+func durationParam(params url.Values, name string, fallback time.Duration) (time.Duration, error) {
+	if !params.Has(name) {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(params.Get(name))
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration such as 500ms", name)
+	}
+	return d, nil
+}
@@ -0,0 +1,222 @@
+package fetcher
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// RobotsAgent is the product token matched against User-agent lines in robots.txt.
+const RobotsAgent = "MonzoCrawler"
+
+// ErrDisallowed is returned for URLs that robots.txt does not allow the crawler to fetch. It is
+// never retried.
+var ErrDisallowed = errors.New("disallowed by robots.txt")
+
+// Robots rejects requests that the target host's robots.txt disallows for agent, following
+// RFC 9309: the most specific matching rule wins, Allow wins ties, and `*` and `$` wildcards are
+// supported, and rules are matched against the path with its query string. Groups are chosen by
+// comparing their User-agent lines with agent's product token, ignoring case. robots.txt is
+// fetched once per host through the rest of the chain. If it is missing (4xx), everything is
+// allowed; while the server fails (5xx) or cannot be reached, nothing is, and robots.txt is
+// fetched again for the host's next request.
+func Robots(agent string) Middleware {
+	var mu sync.Mutex
+	hosts := make(map[string]*robotsEntry)
+
+	return func(next RoundTripper) RoundTripper {
+		return RoundTripperFunc(func(req *Request) (*http.Response, error) {
+			target := req.HTTP.URL
+			if target.Path == "/robots.txt" {
+				return next.RoundTrip(req)
+			}
+
+			origin := target.Scheme + "://" + target.Host
+			mu.Lock()
+			entry, ok := hosts[origin]
+			if !ok {
+				entry = &robotsEntry{}
+				hosts[origin] = entry
+			}
+			mu.Unlock()
+
+			entry.mu.Lock()
+			rules := entry.rules
+			if rules == nil {
+				var transient bool
+				rules, transient = fetchRobots(next, req, origin, agent)
+				if !transient {
+					entry.rules = rules
+				}
+			}
+			entry.mu.Unlock()
+			path := target.Path
+			if target.RawQuery != "" {
+				path += "?" + target.RawQuery
+			}
+			if !rules.allows(path) {
+				req.Logger.Debug("Skipping URL disallowed by robots.txt", "url", target.String(), "reason", "robots")
+				return nil, ErrDisallowed
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// robotsEntry holds a host's rules once they are known. mu is held while robots.txt is fetched,
+// so it is only fetched once at a time per host.
+type robotsEntry struct {
+	mu    sync.Mutex
+	rules *robotsRules
+}
+
+// fetchRobots returns the rules for agent from origin's robots.txt, and whether they come from a
+// transient failure that should not be remembered.
+func fetchRobots(next RoundTripper, req *Request, origin string, agent string) (*robotsRules, bool) {
+	robotsReq, err := http.NewRequestWithContext(req.HTTP.Context(), "GET", origin+"/robots.txt", nil)
+	if err != nil {
+		return &robotsRules{}, false
+	}
+	robotsReq.Header = req.HTTP.Header.Clone()
+	resp, err := next.RoundTrip(&Request{HTTP: robotsReq, Depth: req.Depth, Referrer: req.HTTP.URL.String(), Attempt: 1, Logger: req.Logger, archiver: req.archiver})
+	if errors.Is(err, ErrNotInArchive) || errors.Is(err, ErrNotCached) {
+		return &robotsRules{}, false
+	}
+	if err != nil {
+		req.Logger.Warn("Failed to fetch robots.txt, disallowing host for now", "url", origin+"/robots.txt", "error", err)
+		return &robotsRules{disallowAll: true}, true
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		req.Logger.Warn("Failed to fetch robots.txt, disallowing host for now", "url", origin+"/robots.txt", "status", resp.StatusCode)
+		return &robotsRules{disallowAll: true}, true
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &robotsRules{}, false
+	}
+	// RFC 9309 asks crawlers to parse at least 500 KiB.
+	return parseRobots(io.LimitReader(resp.Body, 512<<10), agent), false
+}
+
+type robotsRule struct {
+	pattern string
+	allow   bool
+}
+
+type robotsRules struct {
+	disallowAll bool
+	rules       []robotsRule
+}
+
+// parseRobots returns the rules of the group for agent, or of the `*` group if none names it.
+func parseRobots(r io.Reader, agent string) *robotsRules {
+	agent = productToken(agent)
+	var specific, wildcard []robotsRule
+	var matchesAgent, matchesWildcard, foundAgent bool
+	inAgents := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			// Consecutive User-agent lines share the group that follows them.
+			if !inAgents {
+				matchesAgent, matchesWildcard = false, false
+				inAgents = true
+			}
+			name := productToken(value)
+			if name == "*" {
+				matchesWildcard = true
+			} else if name != "" && name == agent {
+				matchesAgent = true
+				foundAgent = true
+			}
+		case "allow", "disallow":
+			inAgents = false
+			if value == "" {
+				continue
+			}
+			rule := robotsRule{pattern: value, allow: key == "allow"}
+			if matchesAgent {
+				specific = append(specific, rule)
+			}
+			if matchesWildcard {
+				wildcard = append(wildcard, rule)
+			}
+		default:
+			inAgents = false
+		}
+	}
+
+	if foundAgent {
+		return &robotsRules{rules: specific}
+	}
+	return &robotsRules{rules: wildcard}
+}
+
+// productToken returns the lowercased product token of a user agent such as MonzoCrawler/1.0.
+func productToken(agent string) string {
+	token, _, _ := strings.Cut(strings.TrimSpace(agent), "/")
+	return strings.ToLower(strings.TrimSpace(token))
+}
+
+// allows reports whether the rules allow path, which includes the query string if there is one.
+func (r *robotsRules) allows(path string) bool {
+	if r.disallowAll {
+		return false
+	}
+	if path == "" {
+		path = "/"
+	}
+	best, allowed := -1, true
+	for _, rule := range r.rules {
+		if !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		length := len(rule.pattern)
+		if length > best || (length == best && rule.allow) {
+			best, allowed = length, rule.allow
+		}
+	}
+	return allowed
+}
+
+// robotsMatch reports whether the unescaped path matches a robots.txt pattern, where `*` matches
+// any run of characters and a trailing `$` anchors the end of the path.
+func robotsMatch(pattern string, path string) bool {
+	if unescaped, err := url.PathUnescape(pattern); err == nil {
+		pattern = unescaped
+	}
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if i == len(parts)-2 && anchored {
+			return strings.HasSuffix(rest, part)
+		}
+		index := strings.Index(rest, part)
+		if index < 0 {
+			return false
+		}
+		rest = rest[index+len(part):]
+	}
+	return !anchored || rest == ""
+}
@@ -0,0 +1,65 @@
+package fetcher
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/tracing"
+)
+
+// phaseTimes collects connection phase timestamps from httptrace hooks, which may fire on other
+// goroutines, so they can be recorded as child spans of a request attempt.
+type phaseTimes struct {
+	mu           sync.Mutex
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	reused       bool
+}
+
+func (p *phaseTimes) set(t *time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t.IsZero() {
+		*t = time.Now()
+	}
+}
+
+func (p *phaseTimes) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			p.mu.Lock()
+			p.reused = info.Reused
+			p.mu.Unlock()
+		},
+		DNSStart:             func(httptrace.DNSStartInfo) { p.set(&p.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { p.set(&p.dnsDone) },
+		ConnectStart:         func(string, string) { p.set(&p.connectStart) },
+		ConnectDone:          func(string, string, error) { p.set(&p.connectDone) },
+		TLSHandshakeStart:    func() { p.set(&p.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { p.set(&p.tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { p.set(&p.wroteRequest) },
+		GotFirstResponseByte: func() { p.set(&p.firstByte) },
+	}
+}
+
+// record adds a child span to span for each phase that happened.
+func (p *phaseTimes) record(span *tracing.Span) {
+	if span == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	span.SetAttributes(tracing.Bool("net.conn_reused", p.reused))
+	span.Record("dns", p.dnsStart, p.dnsDone)
+	span.Record("connect", p.connectStart, p.connectDone)
+	span.Record("tls_handshake", p.tlsStart, p.tlsDone)
+	span.Record("time_to_first_byte", p.wroteRequest, p.firstByte)
+}
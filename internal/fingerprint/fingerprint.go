@@ -0,0 +1,215 @@
+// Package fingerprint identifies pages with the same or nearly the same content: an exact hash of
+// a page's normalised visible text, and a SimHash of it that differs in few bits for similar text.
+package fingerprint
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// DefaultDistance is the largest number of differing SimHash bits at which two pages count as
+// near duplicates.
+const DefaultDistance = 3
+
+// MaxDistance is the largest distance an Index supports.
+const MaxDistance = 15
+
+// shingleSize is the number of consecutive words hashed together into the SimHash.
+const shingleSize = 3
+
+// Fingerprint identifies the content of a page. The zero Fingerprint belongs to pages without
+// visible text, which are never duplicates.
+type Fingerprint struct {
+	// Hash is the hex SHA-256 of the normalised text.
+	Hash    string
+	SimHash uint64
+}
+
+// Of fingerprints an HTML document.
+func Of(body []byte) Fingerprint {
+	words := Words(body)
+	if len(words) == 0 {
+		return Fingerprint{}
+	}
+	return Fingerprint{
+		Hash:    fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(words, " ")))),
+		SimHash: SimHash(words),
+	}
+}
+
+// Parse rebuilds a fingerprint from Hash and the hex form of SimHash, as stored in page records.
+func Parse(hash, simHash string) (Fingerprint, error) {
+	if hash == "" {
+		return Fingerprint{}, nil
+	}
+	sum, err := strconv.ParseUint(simHash, 16, 64)
+	if err != nil {
+		return Fingerprint{}, fmt.Errorf("invalid simhash %q", simHash)
+	}
+	return Fingerprint{Hash: hash, SimHash: sum}, nil
+}
+
+// Hex returns the SimHash as 16 hex digits.
+func (f Fingerprint) Hex() string {
+	if f.Hash == "" {
+		return ""
+	}
+	return fmt.Sprintf("%016x", f.SimHash)
+}
+
+// Words returns the visible text of an HTML document, lowercased and split into words. Text in
+// the title, scripts, styles and templates is left out, as is punctuation.
+func Words(body []byte) []string {
+	var words []string
+	hidden := 0
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return words
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			if invisible(string(name)) {
+				hidden++
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if invisible(string(name)) && hidden > 0 {
+				hidden--
+			}
+		case html.TextToken:
+			if hidden > 0 {
+				continue
+			}
+			text := strings.ToLower(string(tokenizer.Text()))
+			words = append(words, strings.FieldsFunc(text, func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+			})...)
+		}
+	}
+}
+
+func invisible(tag string) bool {
+	switch tag {
+	case "title", "script", "style", "noscript", "template", "svg":
+		return true
+	}
+	return false
+}
+
+// SimHash computes a 64-bit SimHash of words over shingles of consecutive words, so that
+// similar texts get hashes that differ in few bits.
+func SimHash(words []string) uint64 {
+	var weights [64]int
+	n := len(words) - shingleSize + 1
+	size := shingleSize
+	if n < 1 {
+		n, size = 1, len(words)
+	}
+	for i := 0; i < n; i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(words[i:i+size], " ")))
+		sum := h.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+	var hash uint64
+	for bit, weight := range weights {
+		if weight > 0 {
+			hash |= 1 << bit
+		}
+	}
+	return hash
+}
+
+// Distance returns the number of bits in which two SimHashes differ.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Index finds, for each page added, an earlier page with the same or nearly the same content.
+// It is safe for concurrent use.
+type Index struct {
+	distance int
+	mu       sync.Mutex
+	exact    map[string]string
+	// bands splits SimHashes into distance+1 bands: two hashes within distance bits of each
+	// other are equal in at least one band, so only pages sharing a band are compared.
+	bands []map[uint64][]entry
+}
+
+type entry struct {
+	url     string
+	simHash uint64
+}
+
+// NewIndex returns an index that treats pages whose SimHashes differ in at most distance bits as
+// near duplicates; with a distance of 0 only exact duplicates are found. distance must be at
+// most MaxDistance.
+func NewIndex(distance int) *Index {
+	idx := &Index{distance: distance, exact: make(map[string]string)}
+	if distance > 0 {
+		idx.bands = make([]map[uint64][]entry, distance+1)
+		for i := range idx.bands {
+			idx.bands[i] = make(map[uint64][]entry)
+		}
+	}
+	return idx
+}
+
+// Add looks for a page already in the index that url duplicates, and returns its URL and whether
+// the text is exactly the same. If there is none, url is added and "" is returned. Pages without
+// text are never duplicates and are not added.
+func (idx *Index) Add(url string, f Fingerprint) (original string, exact bool) {
+	if f.Hash == "" {
+		return "", false
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if original, ok := idx.exact[f.Hash]; ok {
+		return original, true
+	}
+	best, bestDistance := "", idx.distance+1
+	for i, band := range idx.bands {
+		for _, candidate := range band[idx.band(f.SimHash, i)] {
+			if d := Distance(candidate.simHash, f.SimHash); d < bestDistance {
+				best, bestDistance = candidate.url, d
+			}
+		}
+	}
+	if best != "" {
+		return best, false
+	}
+
+	idx.exact[f.Hash] = url
+	for i, band := range idx.bands {
+		key := idx.band(f.SimHash, i)
+		band[key] = append(band[key], entry{url: url, simHash: f.SimHash})
+	}
+	return "", false
+}
+
+// band returns the bits of hash in band i. The last band takes the bits left over.
+func (idx *Index) band(hash uint64, i int) uint64 {
+	width := 64 / len(idx.bands)
+	shifted := hash >> (i * width)
+	if i == len(idx.bands)-1 {
+		return shifted
+	}
+	return shifted & (1<<width - 1)
+}
@@ -0,0 +1,81 @@
+package fingerprint_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fingerprint"
+)
+
+// page renders an article of n paragraphs, with the given paragraph replaced by changed.
+func page(n int, changed int, text string) []byte {
+	var b strings.Builder
+	b.WriteString("<html><head><title>Deeplink</title><style>p { color: red }</style></head><body><nav>Home About Help</nav>")
+	for i := 0; i < n; i++ {
+		if i == changed {
+			fmt.Fprintf(&b, "<p>%s</p>", text)
+			continue
+		}
+		fmt.Fprintf(&b, "<p>Paragraph %d of the template explains how the app handles this link.</p>", i)
+	}
+	b.WriteString(`<script>track("view")</script></body></html>`)
+	return []byte(b.String())
+}
+
+func TestWords_KeepsOnlyVisibleText(t *testing.T) {
+	words := fingerprint.Words([]byte(`<html><head><title>Title</title></head><body><h1>Hello,   World!</h1><script>var x = "hidden";</script><p>It's 2024</p></body></html>`))
+	if got := strings.Join(words, " "); got != "hello world it s 2024" {
+		t.Errorf("Unexpected words %q", got)
+	}
+	// Markup and whitespace do not change the hash, but the text does.
+	a := fingerprint.Of([]byte("<p>Open the Monzo app</p>"))
+	b := fingerprint.Of([]byte("<div>\n  <b>Open</b> the MONZO app.\n</div>"))
+	c := fingerprint.Of([]byte("<p>Open the Monzo website</p>"))
+	if a.Hash == "" || a.Hash != b.Hash || a.Hash == c.Hash {
+		t.Errorf("Unexpected hashes %q, %q, %q", a.Hash, b.Hash, c.Hash)
+	}
+	if empty := fingerprint.Of([]byte("<script>only()</script>")); empty.Hash != "" || empty.Hex() != "" {
+		t.Errorf("Expected no fingerprint for a page without text, got %+v", empty)
+	}
+}
+
+func TestIndex_FindsExactAndNearDuplicates(t *testing.T) {
+	original := fingerprint.Of(page(40, -1, ""))
+	reformatted := fingerprint.Of([]byte(strings.ReplaceAll(string(page(40, -1, "")), "</p>", "</p>\n\n")))
+	edited := fingerprint.Of(page(40, 7, "This one paragraph is different on the second page."))
+	other := fingerprint.Of([]byte("<p>An entirely different page about savings pots and interest rates.</p>"))
+
+	if d := fingerprint.Distance(original.SimHash, edited.SimHash); d > fingerprint.DefaultDistance {
+		t.Fatalf("Expected a small edit to move the SimHash by at most %d bits, got %d", fingerprint.DefaultDistance, d)
+	}
+	parsed, err := fingerprint.Parse(edited.Hash, edited.Hex())
+	if err != nil || parsed != edited {
+		t.Errorf("Expected Parse to undo Hex, got %+v, %v", parsed, err)
+	}
+
+	index := fingerprint.NewIndex(fingerprint.DefaultDistance)
+	for _, tc := range []struct {
+		url      string
+		f        fingerprint.Fingerprint
+		original string
+		exact    bool
+	}{
+		{"/a", original, "", false},
+		{"/b", reformatted, "/a", true},
+		{"/c", edited, "/a", false},
+		{"/d", other, "", false},
+		{"/e", fingerprint.Fingerprint{}, "", false},
+	} {
+		original, exact := index.Add(tc.url, tc.f)
+		if original != tc.original || exact != tc.exact {
+			t.Errorf("Add(%s) = %q, %v; want %q, %v", tc.url, original, exact, tc.original, tc.exact)
+		}
+	}
+
+	exactOnly := fingerprint.NewIndex(0)
+	exactOnly.Add("/a", original)
+	if original, _ := exactOnly.Add("/c", edited); original != "" {
+		t.Errorf("Expected a distance of 0 to find only exact duplicates, got %q", original)
+	}
+}
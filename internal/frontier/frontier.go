@@ -0,0 +1,313 @@
+// Package frontier decides which waiting URL is crawled next: the one its scorers rate highest,
+// among hosts that per-host politeness allows to be fetched from.
+package frontier
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// Candidate is a URL waiting to be crawled, as scorers see it.
+type Candidate struct {
+	URL      string
+	Depth    int
+	Referrer string
+}
+
+// Scorer rates waiting URLs; the highest score is crawled first. A frontier adds up the scores
+// of all its scorers.
+type Scorer interface {
+	Score(c Candidate) float64
+}
+
+// ScorerFunc adapts a function to Scorer.
+type ScorerFunc func(c Candidate) float64
+
+// Score calls f.
+func (f ScorerFunc) Score(c Candidate) float64 {
+	return f(c)
+}
+
+// LinkObserver is implemented by scorers that learn from the links found on crawled pages, such
+// as the inlink count. URLs still waiting are scored again after each page.
+type LinkObserver interface {
+	ObserveLink(from, to string)
+}
+
+// Getter fetches the body of a URL for scorers that load data before the crawl, such as a
+// sitemap. Crawlers pass one that goes through their own fetcher.
+type Getter func(ctx context.Context, url string) (io.ReadCloser, error)
+
+// Preparer is implemented by scorers that need data before they can score, such as a sitemap.
+// Prepare is called once, before the crawl starts.
+type Preparer interface {
+	Prepare(ctx context.Context, get Getter) error
+}
+
+// Politeness limits how hard one host is crawled, however high its URLs score. A zero limit is
+// no limit.
+type Politeness struct {
+	// HostConcurrency is the most pages fetched from one host at once.
+	HostConcurrency int
+	// HostDelay is the least time between starting two fetches from one host.
+	HostDelay time.Duration
+}
+
+// Frontier hands out a fixed number of worker slots to waiting URLs, best score first and in
+// arrival order among equal scores. When a host is busy or was fetched from too recently, the
+// best URL of another host goes first instead. It is safe for concurrent use.
+type Frontier struct {
+	workers    int
+	politeness Politeness
+	scorers    []Scorer
+
+	mu      sync.Mutex
+	running int
+	seq     uint64
+	hosts   map[string]*hostQueue
+	waiting map[string][]*item
+	timer   *time.Timer
+	wakeAt  time.Time
+}
+
+type item struct {
+	candidate Candidate
+	host      string
+	score     float64
+	seq       uint64
+	index     int
+	ready     chan struct{}
+}
+
+// hostQueue holds the URLs waiting for one host, best first.
+type hostQueue struct {
+	items   []*item
+	running int
+	next    time.Time
+}
+
+func (q *hostQueue) Len() int { return len(q.items) }
+
+func (q *hostQueue) Less(i, j int) bool {
+	return better(q.items[i], q.items[j])
+}
+
+func (q *hostQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.items[i].index = i
+	q.items[j].index = j
+}
+
+func (q *hostQueue) Push(x any) {
+	it := x.(*item)
+	it.index = len(q.items)
+	q.items = append(q.items, it)
+}
+
+func (q *hostQueue) Pop() any {
+	last := len(q.items) - 1
+	it := q.items[last]
+	q.items[last] = nil
+	q.items = q.items[:last]
+	return it
+}
+
+func better(a, b *item) bool {
+	if a.score != b.score {
+		return a.score > b.score
+	}
+	return a.seq < b.seq
+}
+
+// New returns a frontier with workers slots that orders URLs by the sum of scorers. Without
+// scorers, URLs are crawled in the order they arrive.
+func New(workers int, politeness Politeness, scorers ...Scorer) *Frontier {
+	return &Frontier{
+		workers:    workers,
+		politeness: politeness,
+		scorers:    scorers,
+		hosts:      make(map[string]*hostQueue),
+		waiting:    make(map[string][]*item),
+	}
+}
+
+// Acquire waits until c is given a worker slot, and returns the function that gives it back.
+func (f *Frontier) Acquire(c Candidate) (release func()) {
+	host := ""
+	if u, err := url.Parse(c.URL); err == nil {
+		host = u.Host
+	}
+	it := &item{candidate: c, host: host, ready: make(chan struct{})}
+
+	f.mu.Lock()
+	f.seq++
+	it.seq = f.seq
+	it.score = f.score(c)
+	q, ok := f.hosts[host]
+	if !ok {
+		q = &hostQueue{}
+		f.hosts[host] = q
+	}
+	heap.Push(q, it)
+	f.waiting[c.URL] = append(f.waiting[c.URL], it)
+	f.dispatch()
+	f.mu.Unlock()
+
+	<-it.ready
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.running--
+			f.hosts[host].running--
+			f.dispatch()
+		})
+	}
+}
+
+// Prepare prepares the scorers that are Preparers, fetching what they need with get. A scorer
+// that fails to prepare still scores, as if it had no data.
+func (f *Frontier) Prepare(ctx context.Context, get Getter) error {
+	var errs []error
+	for _, scorer := range f.scorers {
+		if preparer, ok := scorer.(Preparer); ok {
+			if err := preparer.Prepare(ctx, get); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Waiting returns the number of URLs waiting for a worker slot.
+func (f *Frontier) Waiting() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, q := range f.hosts {
+		n += q.Len()
+	}
+	return n
+}
+
+// ObserveLinks tells the scorers that are LinkObservers about the links found on pageURL, and
+// scores the URLs they point to again if they are waiting.
+func (f *Frontier) ObserveLinks(pageURL string, links map[string]bool) {
+	var observers []LinkObserver
+	for _, scorer := range f.scorers {
+		if observer, ok := scorer.(LinkObserver); ok {
+			observers = append(observers, observer)
+		}
+	}
+	if len(observers) == 0 {
+		return
+	}
+
+	targets := make([]string, 0, len(links))
+	for link := range links {
+		if target, err := utils.NormalizeURL(link, pageURL); err == nil && target != pageURL {
+			targets = append(targets, target)
+		}
+	}
+	for _, target := range targets {
+		for _, observer := range observers {
+			observer.ObserveLink(pageURL, target)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, target := range targets {
+		for _, it := range f.waiting[target] {
+			it.score = f.score(it.candidate)
+			heap.Fix(f.hosts[it.host], it.index)
+		}
+	}
+}
+
+func (f *Frontier) score(c Candidate) float64 {
+	total := 0.0
+	for _, scorer := range f.scorers {
+		total += scorer.Score(c)
+	}
+	return total
+}
+
+// dispatch gives free worker slots to the best waiting URLs of the hosts that may be fetched
+// from now, and sets a timer for the earliest host still cooling down. f.mu must be held.
+func (f *Frontier) dispatch() {
+	for f.running < f.workers {
+		now := time.Now()
+		var best *hostQueue
+		var wake time.Time
+		for host, q := range f.hosts {
+			switch {
+			case q.Len() == 0:
+				if q.running == 0 && !now.Before(q.next) {
+					delete(f.hosts, host)
+				}
+			case f.politeness.HostConcurrency > 0 && q.running >= f.politeness.HostConcurrency:
+			case now.Before(q.next):
+				if wake.IsZero() || q.next.Before(wake) {
+					wake = q.next
+				}
+			case best == nil || better(q.items[0], best.items[0]):
+				best = q
+			}
+		}
+		if best == nil {
+			if !wake.IsZero() {
+				f.wakeUp(wake)
+			}
+			return
+		}
+
+		it := heap.Pop(best).(*item)
+		f.forget(it)
+		best.running++
+		best.next = now.Add(f.politeness.HostDelay)
+		f.running++
+		close(it.ready)
+	}
+}
+
+// wakeUp makes sure dispatch runs again at t. f.mu must be held.
+func (f *Frontier) wakeUp(t time.Time) {
+	if f.timer != nil && !f.wakeAt.After(t) {
+		return
+	}
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	f.wakeAt = t
+	f.timer = time.AfterFunc(time.Until(t), func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.timer = nil
+		f.dispatch()
+	})
+}
+
+// forget removes it from the URLs waiting to be scored again. f.mu must be held.
+func (f *Frontier) forget(it *item) {
+	items := f.waiting[it.candidate.URL]
+	for i, other := range items {
+		if other == it {
+			items = append(items[:i], items[i+1:]...)
+			break
+		}
+	}
+	if len(items) == 0 {
+		delete(f.waiting, it.candidate.URL)
+		return
+	}
+	f.waiting[it.candidate.URL] = items
+}
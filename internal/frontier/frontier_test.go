@@ -0,0 +1,183 @@
+package frontier_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/frontier"
+)
+
+// crawlOrder holds the only worker slot while urls queue up behind it, then returns the order in
+// which the frontier lets them through.
+func crawlOrder(t *testing.T, f *frontier.Frontier, urls []string, queued func()) []string {
+	t.Helper()
+	release := f.Acquire(frontier.Candidate{URL: "https://example.com/"})
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done := f.Acquire(frontier.Candidate{URL: u, Depth: strings.Count(u, "/") - 2})
+			mu.Lock()
+			order = append(order, u)
+			mu.Unlock()
+			done()
+		}()
+		// Queue one at a time, so that arrival order is the order of urls.
+		deadline := time.Now().Add(time.Second)
+		for f.Waiting() <= i && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if queued != nil {
+		queued()
+	}
+	release()
+	wg.Wait()
+	return order
+}
+
+func TestFrontier_CrawlsBestScoredURLsFirst(t *testing.T) {
+	urls := []string{"https://example.com/a/b/c", "https://example.com/blog/post", "https://example.com/about", "https://example.com/x/y/z"}
+
+	order := crawlOrder(t, frontier.New(1, frontier.Politeness{}), urls, nil)
+	if strings.Join(order, " ") != strings.Join(urls, " ") {
+		t.Errorf("Without scorers, expected arrival order, got %v", order)
+	}
+
+	order = crawlOrder(t, frontier.New(1, frontier.Politeness{}, frontier.Shallowest()), urls, nil)
+	if order[0] != "https://example.com/about" || order[3] != "https://example.com/x/y/z" {
+		t.Errorf("Expected the shallowest URL first, got %v", order)
+	}
+
+	scorers, err := frontier.ParseScorers([]string{"depth", "regex?pattern=/blog/&weight=5"})
+	if err != nil {
+		t.Fatalf("ParseScorers failed: %v", err)
+	}
+	order = crawlOrder(t, frontier.New(1, frontier.Politeness{}, scorers...), urls, nil)
+	if order[0] != "https://example.com/blog/post" {
+		t.Errorf("Expected the blog post weighted first, got %v", order)
+	}
+
+	f := frontier.New(1, frontier.Politeness{}, frontier.Inlinks())
+	order = crawlOrder(t, f, urls, func() {
+		f.ObserveLinks("https://example.com/", map[string]bool{"/x/y/z": true, "https://example.com/about": true})
+		f.ObserveLinks("https://example.com/about", map[string]bool{"/x/y/z": true})
+	})
+	if order[0] != "https://example.com/x/y/z" || order[1] != "https://example.com/about" {
+		t.Errorf("Expected URLs with the most inlinks first, got %v", order)
+	}
+}
+
+func TestFrontier_HoldsBackBusyHosts(t *testing.T) {
+	f := frontier.New(2, frontier.Politeness{HostConcurrency: 1, HostDelay: 50 * time.Millisecond}, frontier.Shallowest())
+	release := f.Acquire(frontier.Candidate{URL: "https://busy.example/"})
+
+	granted := make(chan string, 2)
+	for _, c := range []frontier.Candidate{{URL: "https://busy.example/top", Depth: 1}, {URL: "https://quiet.example/deep/page", Depth: 2}} {
+		go func() {
+			done := f.Acquire(c)
+			granted <- c.URL
+			done()
+		}()
+	}
+	if first := <-granted; first != "https://quiet.example/deep/page" {
+		t.Errorf("Expected the other host to go first while busy.example is fetched from, got %s", first)
+	}
+
+	start := time.Now()
+	release()
+	if second := <-granted; second != "https://busy.example/top" {
+		t.Errorf("Unexpected second URL %s", second)
+	}
+	if waited := time.Since(start); waited < 30*time.Millisecond {
+		t.Errorf("Expected busy.example to be fetched from no sooner than the host delay, waited %s", waited)
+	}
+}
+
+func TestParseScorers_ReadsSitemapsWhenPrepared(t *testing.T) {
+	now := time.Now().UTC()
+	sitemap := filepath.Join(t.TempDir(), "sitemap.xml")
+	os.WriteFile(sitemap, []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://example.com/</loc><priority>1.0</priority></url>
+  <url><loc>https://example.com/news/</loc><lastmod>`+now.Format("2006-01-02")+`</lastmod></url>
+  <url><loc>https://example.com/archive</loc><lastmod>`+now.AddDate(-1, 0, 0).Format(time.RFC3339)+`</lastmod><priority>0.1</priority></url>
+</urlset>`), 0o644)
+
+	// Sitemaps are only read when the frontier is prepared, URLs through the crawler's getter.
+	var fetched []string
+	get := func(ctx context.Context, u string) (io.ReadCloser, error) {
+		fetched = append(fetched, u)
+		return os.Open(sitemap)
+	}
+	scorers, err := frontier.ParseScorers([]string{"sitemap?src=https://example.com/sitemap.xml", "sitemap?src=none.xml&weight=2"})
+	if err != nil {
+		t.Fatalf("ParseScorers failed: %v", err)
+	}
+	if len(fetched) != 0 {
+		t.Errorf("Expected ParseScorers not to fetch sitemaps, fetched %v", fetched)
+	}
+	if err := frontier.New(1, frontier.Politeness{}, scorers...).Prepare(context.Background(), get); err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("Expected preparing a missing sitemap file to fail, got %v", err)
+	}
+	if len(fetched) != 1 || fetched[0] != "https://example.com/sitemap.xml" {
+		t.Errorf("Expected the sitemap to be fetched once through the getter, fetched %v", fetched)
+	}
+	score := func(u string) float64 { return scorers[0].Score(frontier.Candidate{URL: u}) }
+	if !(score("https://example.com/news") > score("https://example.com") && score("https://example.com") > score("https://example.com/archive") && score("https://example.com/archive") > score("https://example.com/unlisted")) {
+		t.Errorf("Unexpected sitemap scores: news %.2f, home %.2f, archive %.2f, unlisted %.2f",
+			score("https://example.com/news"), score("https://example.com"), score("https://example.com/archive"), score("https://example.com/unlisted"))
+	}
+
+	for spec, want := range map[string]string{
+		"pagerank":           `unknown scorer "pagerank"`,
+		"regex":              "scorer regex: pattern is required",
+		"regex?pattern=(":    "scorer regex: error parsing regexp",
+		"depth?weight=heavy": "scorer depth: weight must be a number",
+		"sitemap":            "scorer sitemap: src is required",
+	} {
+		if _, err := frontier.ParseScorers([]string{spec}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ParseScorers(%q) = %v, want an error containing %q", spec, err, want)
+		}
+	}
+}
+
+func TestLoadSitemap_RemoteIndexOnlyFollowsRemoteSitemaps(t *testing.T) {
+	local := filepath.Join(t.TempDir(), "local.xml")
+	os.WriteFile(local, []byte(`<urlset><url><loc>https://example.com/secret</loc></url></urlset>`), 0o644)
+
+	documents := map[string]string{
+		"https://example.com/index.xml": `<sitemapindex>
+  <sitemap><loc>` + local + `</loc></sitemap>
+  <sitemap><loc>file://` + local + `</loc></sitemap>
+  <sitemap><loc>https://example.com/pages.xml</loc></sitemap>
+</sitemapindex>`,
+		"https://example.com/pages.xml": `<urlset><url><loc>https://example.com/news</loc></url></urlset>`,
+	}
+	var fetched []string
+	get := func(ctx context.Context, u string) (io.ReadCloser, error) {
+		fetched = append(fetched, u)
+		return io.NopCloser(strings.NewReader(documents[u])), nil
+	}
+
+	entries, err := frontier.LoadSitemap(context.Background(), "https://example.com/index.xml", get)
+	if err != nil {
+		t.Fatalf("LoadSitemap failed: %v", err)
+	}
+	if _, ok := entries["https://example.com/secret"]; ok {
+		t.Error("Expected a local path listed by a remote index not to be read")
+	}
+	if _, ok := entries["https://example.com/news"]; !ok || len(fetched) != 2 {
+		t.Errorf("Expected only the remote child sitemap to be fetched, fetched %v, got %v", fetched, entries)
+	}
+}
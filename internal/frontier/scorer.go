@@ -0,0 +1,315 @@
+package frontier
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// DefaultHalfLife is how long after its lastmod a sitemap page loses half of its freshness score.
+const DefaultHalfLife = 30 * 24 * time.Hour
+
+// Shallowest scores URLs by minus their depth, so shallow pages are crawled first.
+func Shallowest() Scorer {
+	return ScorerFunc(func(c Candidate) float64 {
+		return -float64(c.Depth)
+	})
+}
+
+// Inlinks scores URLs by the number of crawled pages found linking to them so far.
+func Inlinks() Scorer {
+	return &inlinks{counts: make(map[string]int)}
+}
+
+type inlinks struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (s *inlinks) ObserveLink(from, to string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[to]++
+}
+
+func (s *inlinks) Score(c Candidate) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return float64(s.counts[c.URL])
+}
+
+// Regex scores URLs matching pattern with weight, and others with 0.
+func Regex(pattern *regexp.Regexp, weight float64) Scorer {
+	return ScorerFunc(func(c Candidate) float64 {
+		if pattern.MatchString(c.URL) {
+			return weight
+		}
+		return 0
+	})
+}
+
+// Weighted multiplies the scores of s by weight, and still observes links and prepares if s does.
+func Weighted(s Scorer, weight float64) Scorer {
+	return weighted{s, weight}
+}
+
+type weighted struct {
+	Scorer
+	weight float64
+}
+
+func (w weighted) Score(c Candidate) float64 {
+	return w.weight * w.Scorer.Score(c)
+}
+
+func (w weighted) ObserveLink(from, to string) {
+	if observer, ok := w.Scorer.(LinkObserver); ok {
+		observer.ObserveLink(from, to)
+	}
+}
+
+func (w weighted) Prepare(ctx context.Context, get Getter) error {
+	if preparer, ok := w.Scorer.(Preparer); ok {
+		return preparer.Prepare(ctx, get)
+	}
+	return nil
+}
+
+// SitemapEntry is what a sitemap says about one URL.
+type SitemapEntry struct {
+	// Priority is between 0 and 1; the sitemaps.org default is 0.5.
+	Priority float64
+	LastMod  time.Time
+}
+
+// Sitemap scores URLs listed in entries by their priority plus their freshness: 1 for a page
+// modified now, halving every halfLife since its lastmod. URLs not in the sitemap score 0.
+func Sitemap(entries map[string]SitemapEntry, halfLife time.Duration) Scorer {
+	return ScorerFunc(func(c Candidate) float64 {
+		entry, ok := entries[c.URL]
+		if !ok {
+			return 0
+		}
+		score := entry.Priority
+		if !entry.LastMod.IsZero() && halfLife > 0 {
+			age := max(time.Since(entry.LastMod), 0)
+			score += math.Pow(0.5, float64(age)/float64(halfLife))
+		}
+		return score
+	})
+}
+
+// SitemapAt scores URLs like Sitemap, with the entries of the sitemap at src, a file or an http(s)
+// URL. The sitemap is read when the scorer is prepared; until then, and if it cannot be read,
+// every URL scores 0.
+func SitemapAt(src string, halfLife time.Duration) Scorer {
+	return &sitemapSource{src: src, halfLife: halfLife}
+}
+
+type sitemapSource struct {
+	src      string
+	halfLife time.Duration
+	scorer   Scorer
+}
+
+func (s *sitemapSource) Prepare(ctx context.Context, get Getter) error {
+	entries, err := LoadSitemap(ctx, s.src, get)
+	if err != nil {
+		return err
+	}
+	s.scorer = Sitemap(entries, s.halfLife)
+	return nil
+}
+
+func (s *sitemapSource) Score(c Candidate) float64 {
+	if s.scorer == nil {
+		return 0
+	}
+	return s.scorer.Score(c)
+}
+
+type sitemapDocument struct {
+	URLs []struct {
+		Loc      string `xml:"loc"`
+		LastMod  string `xml:"lastmod"`
+		Priority string `xml:"priority"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// lastModLayouts are the W3C datetime forms sitemaps use for lastmod.
+var lastModLayouts = []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02"}
+
+// LoadSitemap reads the sitemap at src, a file or an http(s) URL fetched with get, and returns
+// its entries keyed by normalised URL. The sitemaps listed by a sitemap index are read too; those
+// listed by an index fetched over http(s) are only read if they are http(s) URLs themselves, so a
+// remote index cannot make the crawler open local files.
+func LoadSitemap(ctx context.Context, src string, get Getter) (map[string]SitemapEntry, error) {
+	entries := make(map[string]SitemapEntry)
+	return entries, loadSitemap(ctx, src, get, entries, true)
+}
+
+func loadSitemap(ctx context.Context, src string, get Getter, entries map[string]SitemapEntry, index bool) error {
+	body, err := openSitemap(ctx, src, get)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var doc sitemapDocument
+	if err := xml.NewDecoder(body).Decode(&doc); err != nil {
+		return fmt.Errorf("sitemap %s: %w", src, err)
+	}
+	for _, u := range doc.URLs {
+		loc, err := utils.NormalizeURL(strings.TrimSpace(u.Loc), src)
+		if err != nil {
+			continue
+		}
+		entry := SitemapEntry{Priority: 0.5}
+		if p, err := strconv.ParseFloat(strings.TrimSpace(u.Priority), 64); err == nil && p >= 0 && p <= 1 {
+			entry.Priority = p
+		}
+		for _, layout := range lastModLayouts {
+			if t, err := time.Parse(layout, strings.TrimSpace(u.LastMod)); err == nil {
+				entry.LastMod = t
+				break
+			}
+		}
+		entries[loc] = entry
+	}
+	if !index {
+		return nil
+	}
+	for _, child := range doc.Sitemaps {
+		loc := strings.TrimSpace(child.Loc)
+		if isHTTP(src) && !isHTTP(loc) {
+			continue
+		}
+		if err := loadSitemap(ctx, loc, get, entries, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func openSitemap(ctx context.Context, src string, get Getter) (io.ReadCloser, error) {
+	if !isHTTP(src) {
+		return os.Open(src)
+	}
+	body, err := get(ctx, src)
+	if err != nil {
+		return nil, fmt.Errorf("sitemap %s: %w", src, err)
+	}
+	return body, nil
+}
+
+func isHTTP(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// ScorerFactory builds a scorer from the parameters given in its configuration.
+type ScorerFactory func(params url.Values) (Scorer, error)
+
+var scorers = make(map[string]ScorerFactory)
+
+// RegisterScorer makes a scorer available to ParseScorers under name.
+func RegisterScorer(name string, factory ScorerFactory) {
+	scorers[name] = factory
+}
+
+// ScorerNames returns the registered scorer names in alphabetical order.
+func ScorerNames() []string {
+	names := make([]string, 0, len(scorers))
+	for name := range scorers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseScorers builds scorers from specs such as "depth", "inlinks?weight=0.5" or
+// "regex?pattern=/blog/&weight=-2". Every scorer takes a weight its scores are multiplied by,
+// which defaults to 1.
+func ParseScorers(specs []string) ([]Scorer, error) {
+	var built []Scorer
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, query, _ := strings.Cut(spec, "?")
+		factory, ok := scorers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown scorer %q (available: %s)", name, strings.Join(ScorerNames(), ", "))
+		}
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("scorer %s: %w", name, err)
+		}
+		weight := 1.0
+		if params.Has("weight") {
+			if weight, err = strconv.ParseFloat(params.Get("weight"), 64); err != nil {
+				return nil, fmt.Errorf("scorer %s: weight must be a number", name)
+			}
+			params.Del("weight")
+		}
+		scorer, err := factory(params)
+		if err != nil {
+			return nil, fmt.Errorf("scorer %s: %w", name, err)
+		}
+		if weight != 1 {
+			scorer = Weighted(scorer, weight)
+		}
+		built = append(built, scorer)
+	}
+	return built, nil
+}
+
+func init() {
+	RegisterScorer("depth", func(params url.Values) (Scorer, error) {
+		return Shallowest(), nil
+	})
+	RegisterScorer("inlinks", func(params url.Values) (Scorer, error) {
+		return Inlinks(), nil
+	})
+	RegisterScorer("regex", func(params url.Values) (Scorer, error) {
+		if !params.Has("pattern") {
+			return nil, errors.New("pattern is required")
+		}
+		pattern, err := regexp.Compile(params.Get("pattern"))
+		if err != nil {
+			return nil, err
+		}
+		return Regex(pattern, 1), nil
+	})
+	RegisterScorer("sitemap", func(params url.Values) (Scorer, error) {
+		src := params.Get("src")
+		if src == "" {
+			return nil, errors.New("src is required")
+		}
+		halfLife := DefaultHalfLife
+		if params.Has("half_life") {
+			d, err := time.ParseDuration(params.Get("half_life"))
+			if err != nil || d <= 0 {
+				return nil, errors.New("half_life must be a positive duration such as 720h")
+			}
+			halfLife = d
+		}
+		return SitemapAt(src, halfLife), nil
+	})
+}
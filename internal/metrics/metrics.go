@@ -0,0 +1,344 @@
+// Package metrics tracks crawl statistics and exposes them in the Prometheus text format.
+// All methods are safe on a nil *Crawl, so components can record unconditionally.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the fetch latency histogram.
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Skip reasons recorded by the crawler and parser.
+const (
+	SkipMaxDepth  = "max_depth"
+	SkipFileType  = "file_type"
+	SkipMalformed = "malformed"
+	SkipDuplicate = "duplicate"
+	SkipExternal  = "external"
+	SkipVisited   = "visited"
+	SkipFiltered  = "filtered"
+	SkipStopped   = "stopped"
+	SkipRobots    = "robots"
+	SkipTrap      = "trap"
+	SkipBudget    = "budget"
+)
+
+// Crawl holds the metrics for one crawl.
+type Crawl struct {
+	startedAt time.Time
+
+	pages    counterVec
+	bytes    atomic.Uint64
+	retries  atomic.Uint64
+	requests counterVec
+	skipped  counterVec
+	frontier atomic.Int64
+	inFlight atomic.Int64
+	latency  histogram
+}
+
+// New returns an empty set of crawl metrics.
+func New() *Crawl {
+	return &Crawl{
+		startedAt: time.Now(),
+		pages:     counterVec{values: make(map[string]*atomic.Uint64)},
+		requests:  counterVec{values: make(map[string]*atomic.Uint64)},
+		skipped:   counterVec{values: make(map[string]*atomic.Uint64)},
+		latency:   histogram{bounds: LatencyBuckets, counts: make([]uint64, len(LatencyBuckets))},
+	}
+}
+
+// ObservePage counts a finished page by status class: 2xx, 3xx, 4xx, 5xx, or error when no
+// response was received.
+func (m *Crawl) ObservePage(status int) {
+	if m == nil {
+		return
+	}
+	m.pages.inc(StatusClass(status))
+}
+
+// ObserveFetch records one HTTP request attempt against host.
+func (m *Crawl) ObserveFetch(host string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requests.inc(host)
+	m.latency.observe(duration.Seconds())
+}
+
+// AddBytes counts downloaded body bytes.
+func (m *Crawl) AddBytes(n int) {
+	if m == nil {
+		return
+	}
+	m.bytes.Add(uint64(n))
+}
+
+// Retry counts a request that is about to be retried.
+func (m *Crawl) Retry() {
+	if m == nil {
+		return
+	}
+	m.retries.Add(1)
+}
+
+// Skip counts a URL that was not crawled, by reason.
+func (m *Crawl) Skip(reason string) {
+	if m == nil {
+		return
+	}
+	m.skipped.inc(reason)
+}
+
+// Enqueue and Dequeue track URLs waiting for a free worker.
+func (m *Crawl) Enqueue() {
+	if m == nil {
+		return
+	}
+	m.frontier.Add(1)
+}
+
+func (m *Crawl) Dequeue() {
+	if m == nil {
+		return
+	}
+	m.frontier.Add(-1)
+}
+
+// WorkerStarted and WorkerDone track workers currently fetching a page.
+func (m *Crawl) WorkerStarted() {
+	if m == nil {
+		return
+	}
+	m.inFlight.Add(1)
+}
+
+func (m *Crawl) WorkerDone() {
+	if m == nil {
+		return
+	}
+	m.inFlight.Add(-1)
+}
+
+// Summary is a point-in-time view of the headline numbers, used for the end-of-crawl report.
+type Summary struct {
+	Pages   map[string]uint64
+	Skipped map[string]uint64
+	// Hosts counts request attempts by host.
+	Hosts    map[string]uint64
+	Bytes    uint64
+	Requests uint64
+	Retries  uint64
+	Frontier int64
+	InFlight int64
+	Latency  Latency
+	Elapsed  time.Duration
+}
+
+// Latency summarises the fetch latency histogram. Percentiles are the upper bound of the bucket
+// they fall in, and at most Max.
+type Latency struct {
+	Mean time.Duration
+	P50  time.Duration
+	P90  time.Duration
+	P99  time.Duration
+	Max  time.Duration
+}
+
+// HostRate returns the request attempts per second made to host over the crawl.
+func (s Summary) HostRate(host string) float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Hosts[host]) / s.Elapsed.Seconds()
+}
+
+// Summary returns the current values.
+func (m *Crawl) Summary() Summary {
+	if m == nil {
+		return Summary{}
+	}
+	hosts := m.requests.snapshot()
+	requests := uint64(0)
+	for _, n := range hosts {
+		requests += n
+	}
+	return Summary{
+		Pages:    m.pages.snapshot(),
+		Skipped:  m.skipped.snapshot(),
+		Hosts:    hosts,
+		Bytes:    m.bytes.Load(),
+		Requests: requests,
+		Retries:  m.retries.Load(),
+		Frontier: m.frontier.Load(),
+		InFlight: m.inFlight.Load(),
+		Latency:  m.latency.summary(),
+		Elapsed:  time.Since(m.startedAt),
+	}
+}
+
+// Total returns the number of pages finished, across all status classes.
+func (s Summary) Total() uint64 {
+	var total uint64
+	for _, n := range s.Pages {
+		total += n
+	}
+	return total
+}
+
+// Handler serves the metrics in the Prometheus text exposition format.
+func (m *Crawl) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WritePrometheus(w)
+	})
+}
+
+// WritePrometheus writes every metric in the Prometheus text exposition format.
+func (m *Crawl) WritePrometheus(w io.Writer) {
+	if m == nil {
+		return
+	}
+	writeVec(w, "crawler_pages_total", "Pages finished, by HTTP status class.", "class", m.pages.snapshot())
+	writeScalar(w, "crawler_bytes_total", "Response body bytes downloaded.", "counter", float64(m.bytes.Load()))
+	writeVec(w, "crawler_requests_total", "HTTP request attempts, by host.", "host", m.requests.snapshot())
+	writeScalar(w, "crawler_retries_total", "HTTP requests retried after a failure.", "counter", float64(m.retries.Load()))
+	writeVec(w, "crawler_skipped_total", "URLs not crawled, by reason.", "reason", m.skipped.snapshot())
+	writeScalar(w, "crawler_frontier_size", "URLs waiting for a free worker.", "gauge", float64(m.frontier.Load()))
+	writeScalar(w, "crawler_inflight_workers", "Workers currently fetching a page.", "gauge", float64(m.inFlight.Load()))
+	m.latency.write(w, "crawler_fetch_duration_seconds", "Latency of HTTP request attempts.")
+}
+
+// StatusClass maps an HTTP status to its class label, or "error" for 0.
+func StatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "error"
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+type counterVec struct {
+	mu     sync.RWMutex
+	values map[string]*atomic.Uint64
+}
+
+func (c *counterVec) inc(label string) {
+	c.mu.RLock()
+	value, ok := c.values[label]
+	c.mu.RUnlock()
+	if !ok {
+		c.mu.Lock()
+		if value, ok = c.values[label]; !ok {
+			value = &atomic.Uint64{}
+			c.values[label] = value
+		}
+		c.mu.Unlock()
+	}
+	value.Add(1)
+}
+
+func (c *counterVec) snapshot() map[string]uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	values := make(map[string]uint64, len(c.values))
+	for label, value := range c.values {
+		values[label] = value.Load()
+	}
+	return values
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	max    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.max = max(h.max, v)
+	h.count++
+}
+
+func (h *histogram) summary() Latency {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return Latency{}
+	}
+	seconds := func(v float64) time.Duration {
+		return time.Duration(v * float64(time.Second))
+	}
+	quantile := func(q float64) time.Duration {
+		rank := uint64(math.Ceil(q * float64(h.count)))
+		for i, bound := range h.bounds {
+			if h.counts[i] >= rank {
+				return seconds(min(bound, h.max))
+			}
+		}
+		return seconds(h.max)
+	}
+	return Latency{
+		Mean: seconds(h.sum / float64(h.count)),
+		P50:  quantile(0.5),
+		P90:  quantile(0.9),
+		P99:  quantile(0.99),
+		Max:  seconds(h.max),
+	}
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.sum), name, h.count)
+}
+
+func writeScalar(w io.Writer, name, help, kind string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, formatFloat(value))
+}
+
+func writeVec(w io.Writer, name, help, label string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	labels := make([]string, 0, len(values))
+	for l := range values {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escapeLabel(l), values[l])
+	}
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
@@ -0,0 +1,91 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/metrics"
+)
+
+func TestCrawl_WritesPrometheusText(t *testing.T) {
+	m := metrics.New()
+	m.ObservePage(200)
+	m.ObservePage(204)
+	m.ObservePage(404)
+	m.ObservePage(0)
+	m.ObserveFetch("monzo.com", 30*time.Millisecond)
+	m.ObserveFetch("monzo.com", 2*time.Second)
+	m.AddBytes(2048)
+	m.Retry()
+	m.Skip(metrics.SkipExternal)
+	m.Enqueue()
+	m.WorkerStarted()
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`crawler_pages_total{class="2xx"} 2`,
+		`crawler_pages_total{class="4xx"} 1`,
+		`crawler_pages_total{class="error"} 1`,
+		`crawler_requests_total{host="monzo.com"} 2`,
+		"crawler_bytes_total 2048",
+		"crawler_retries_total 1",
+		`crawler_skipped_total{reason="external"} 1`,
+		"crawler_frontier_size 1",
+		"crawler_inflight_workers 1",
+		`crawler_fetch_duration_seconds_bucket{le="0.05"} 1`,
+		`crawler_fetch_duration_seconds_bucket{le="+Inf"} 2`,
+		"crawler_fetch_duration_seconds_count 2",
+		"# TYPE crawler_fetch_duration_seconds histogram",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in metrics output:\n%s", want, body)
+		}
+	}
+
+	if summary := m.Summary(); summary.Total() != 4 || summary.Requests != 2 {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+}
+
+func TestSummary_HostsAndLatency(t *testing.T) {
+	m := metrics.New()
+	for i := 0; i < 9; i++ {
+		m.ObserveFetch("monzo.com", 20*time.Millisecond)
+	}
+	m.ObserveFetch("community.monzo.com", 3*time.Second)
+
+	summary := m.Summary()
+	if summary.Hosts["monzo.com"] != 9 || summary.Hosts["community.monzo.com"] != 1 {
+		t.Errorf("Unexpected requests by host: %v", summary.Hosts)
+	}
+	if rate := summary.HostRate("monzo.com"); rate <= 0 {
+		t.Errorf("Expected a positive request rate for monzo.com, got %v", rate)
+	}
+
+	latency := summary.Latency
+	if latency.P50 != 25*time.Millisecond || latency.P90 != 25*time.Millisecond {
+		t.Errorf("Expected p50 and p90 in the 25ms bucket, got %v and %v", latency.P50, latency.P90)
+	}
+	// The slowest request is in the 5s bucket, but no request took longer than 3s.
+	if latency.P99 != 3*time.Second || latency.Max != 3*time.Second {
+		t.Errorf("Expected p99 and max of 3s, got %v and %v", latency.P99, latency.Max)
+	}
+	if latency.Mean != 318*time.Millisecond {
+		t.Errorf("Expected a mean of 318ms, got %v", latency.Mean)
+	}
+}
+
+func TestCrawl_NilIsNoop(t *testing.T) {
+	var m *metrics.Crawl
+	m.ObservePage(200)
+	m.Skip(metrics.SkipDuplicate)
+	if summary := m.Summary(); summary.Total() != 0 {
+		t.Errorf("Expected empty summary from nil metrics, got %+v", summary)
+	}
+}
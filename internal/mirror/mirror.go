@@ -0,0 +1,300 @@
+// Package mirror saves crawled pages to a browsable static copy of a site, rewriting links between
+// saved pages to relative local paths in the way `wget --convert-links` does.
+package mirror
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// linkAttributes maps the elements whose links are rewritten to the attribute holding the link.
+var linkAttributes = map[string]string{
+	"a":      "href",
+	"area":   "href",
+	"link":   "href",
+	"img":    "src",
+	"script": "src",
+	"source": "src",
+	"iframe": "src",
+}
+
+// assetSelector matches the page requisites downloaded when assets are enabled.
+const assetSelector = `img[src], script[src], source[src], link[rel~="stylesheet"][href], link[rel~="icon"][href]`
+
+// Mirror writes every successfully fetched HTML page under dir/<host>/<path>. It implements
+// fetcher.Archiver; call Finish once the crawl is over to download assets and rewrite links.
+type Mirror struct {
+	mu     sync.Mutex
+	dir    string
+	logger *utils.Logger
+	assets *fetcher.Fetcher
+	pages  map[string]string
+	saved  map[string]string
+	files  map[string]string
+	queued map[string]bool
+}
+
+var _ fetcher.Archiver = (*Mirror)(nil)
+
+// New returns a mirror writing into dir.
+func New(dir string, logger *utils.Logger) *Mirror {
+	return &Mirror{
+		dir:    dir,
+		logger: logger,
+		pages:  make(map[string]string),
+		saved:  make(map[string]string),
+		files:  make(map[string]string),
+		queued: make(map[string]bool),
+	}
+}
+
+// SetAssets makes the mirror also download images, scripts and stylesheets served from the same
+// host as a saved page, using f.
+func (m *Mirror) SetAssets(f *fetcher.Fetcher) {
+	m.assets = f
+}
+
+// Archive saves the exchange if it is a successful HTML response.
+func (m *Mirror) Archive(exchange *fetcher.Exchange) error {
+	if exchange.Response.StatusCode != http.StatusOK || !isHTML(exchange.Response.Header, exchange.Body) {
+		return nil
+	}
+
+	pageURL := exchange.Request.URL
+	local := LocalPath(pageURL, true)
+
+	m.mu.Lock()
+	m.pages[pageURL.String()] = local
+	m.saved[local] = pageURL.String()
+	if key, err := utils.NormalizeURL(pageURL.String(), pageURL.String()); err == nil {
+		if _, taken := m.pages[key]; !taken {
+			m.pages[key] = local
+		}
+	}
+	m.mu.Unlock()
+
+	if m.assets != nil {
+		m.queueAssets(pageURL, exchange.Body)
+	}
+	return m.save(local, exchange.Body)
+}
+
+// Finish downloads queued assets and rewrites links in every saved page. Links to pages or assets
+// that were saved become relative paths; all other links become absolute URLs so they still work.
+func (m *Mirror) Finish() error {
+	if m.assets != nil {
+		m.downloadAssets()
+	}
+
+	m.mu.Lock()
+	saved := make(map[string]string, len(m.saved))
+	locals := make([]string, 0, len(m.saved))
+	for local, rawURL := range m.saved {
+		saved[local] = rawURL
+		locals = append(locals, local)
+	}
+	m.mu.Unlock()
+	sort.Strings(locals)
+
+	for _, local := range locals {
+		pageURL, err := url.Parse(saved[local])
+		if err != nil {
+			continue
+		}
+		if err := m.rewrite(local, pageURL); err != nil {
+			return fmt.Errorf("rewriting %s: %w", local, err)
+		}
+	}
+	return nil
+}
+
+// LocalPath maps a URL to a slash-separated path under the mirror root. HTML pages without an
+// .html extension are saved as <path>/index.html, so /about and /about/team do not collide.
+// A query string adds a short hash to the file name, keeping each variant in its own file.
+func LocalPath(u *url.URL, html bool) string {
+	p := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") || p == "/" {
+		p = path.Join(p, "index.html")
+	} else if html {
+		switch strings.ToLower(path.Ext(p)) {
+		case ".html", ".htm":
+		case "":
+			p = path.Join(p, "index.html")
+		default:
+			p += ".html"
+		}
+	}
+
+	if u.RawQuery != "" {
+		sum := sha1.Sum([]byte(u.RawQuery))
+		ext := path.Ext(p)
+		p = strings.TrimSuffix(p, ext) + "@" + hex.EncodeToString(sum[:4]) + ext
+	}
+
+	host := strings.ReplaceAll(u.Host, ":", "_")
+	return host + p
+}
+
+func (m *Mirror) save(local string, body []byte) error {
+	target := filepath.Join(m.dir, filepath.FromSlash(local))
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(target, body, 0o644)
+}
+
+// queueAssets records the same-host requisites of a page for download in Finish.
+func (m *Mirror) queueAssets(pageURL *url.URL, body []byte) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc.Find(assetSelector).Each(func(_ int, s *goquery.Selection) {
+		ref, ok := s.Attr(linkAttributes[goquery.NodeName(s)])
+		if !ok {
+			return
+		}
+		asset, err := pageURL.Parse(strings.TrimSpace(ref))
+		if err != nil || asset.Host != pageURL.Host {
+			return
+		}
+		asset.Fragment = ""
+		m.queued[asset.String()] = true
+	})
+}
+
+func (m *Mirror) downloadAssets() {
+	m.mu.Lock()
+	queued := make([]string, 0, len(m.queued))
+	for asset := range m.queued {
+		if _, done := m.files[asset]; !done {
+			queued = append(queued, asset)
+		}
+	}
+	m.mu.Unlock()
+	sort.Strings(queued)
+
+	for _, asset := range queued {
+		assetURL, err := url.Parse(asset)
+		if err != nil {
+			continue
+		}
+		res, err := m.assets.Request(asset, m.logger)
+		if err != nil || res == nil {
+			m.logger.Warn("Failed to download asset", "url", asset, "error", err)
+			continue
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			m.logger.Warn("Failed to read asset", "url", asset, "error", err)
+			continue
+		}
+
+		local := LocalPath(assetURL, false)
+		if err := m.save(local, body); err != nil {
+			m.logger.Error("Failed to save asset", "url", asset, "error", err)
+			continue
+		}
+		m.mu.Lock()
+		m.files[asset] = local
+		m.mu.Unlock()
+	}
+}
+
+// rewrite points the links of a saved page at local copies where there are any.
+func (m *Mirror) rewrite(local string, pageURL *url.URL) error {
+	target := filepath.Join(m.dir, filepath.FromSlash(local))
+	body, err := os.ReadFile(target)
+	if err != nil {
+		return err
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for element, attr := range linkAttributes {
+		doc.Find(element + "[" + attr + "]").Each(func(_ int, s *goquery.Selection) {
+			ref, _ := s.Attr(attr)
+			if rewritten, ok := m.resolve(local, pageURL, ref); ok {
+				s.SetAttr(attr, rewritten)
+			}
+		})
+	}
+
+	html, err := doc.Html()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(target, []byte(html), 0o644)
+}
+
+// resolve returns the replacement for a link found on the page saved at local.
+func (m *Mirror) resolve(local string, pageURL *url.URL, ref string) (string, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return "", false
+	}
+	link, err := pageURL.Parse(ref)
+	if err != nil || (link.Scheme != "http" && link.Scheme != "https") {
+		return "", false
+	}
+	fragment := link.Fragment
+	link.Fragment = ""
+
+	m.mu.Lock()
+	saved, ok := m.pages[link.String()]
+	if !ok {
+		saved, ok = m.files[link.String()]
+	}
+	if !ok {
+		if key, err := utils.NormalizeURL(link.String(), link.String()); err == nil && link.RawQuery == "" {
+			saved, ok = m.pages[key]
+		}
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		link.Fragment = fragment
+		return link.String(), true
+	}
+
+	relative, err := filepath.Rel(filepath.Dir(filepath.FromSlash(local)), filepath.FromSlash(saved))
+	if err != nil {
+		return "", false
+	}
+	relative = filepath.ToSlash(relative)
+	if fragment != "" {
+		relative += "#" + fragment
+	}
+	return relative, true
+}
+
+func isHTML(header http.Header, body []byte) bool {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
@@ -0,0 +1,152 @@
+package mirror_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/mirror"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		url  string
+		html bool
+		want string
+	}{
+		{"https://example.com", true, "example.com/index.html"},
+		{"https://example.com/about", true, "example.com/about/index.html"},
+		{"https://example.com/blog/", true, "example.com/blog/index.html"},
+		{"https://example.com/page.php", true, "example.com/page.php.html"},
+		{"https://example.com/../../etc/passwd", false, "example.com/etc/passwd"},
+		{"https://example.com:8443/app.css", false, "example.com_8443/app.css"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := mirror.LocalPath(u, tt.html); got != tt.want {
+			t.Errorf("LocalPath(%s) = %s, want %s", tt.url, got, tt.want)
+		}
+	}
+
+	first, _ := url.Parse("https://example.com/search?q=a")
+	second, _ := url.Parse("https://example.com/search?q=b")
+	a, b := mirror.LocalPath(first, true), mirror.LocalPath(second, true)
+	if a == b || !strings.HasPrefix(a, "example.com/search/index@") || !strings.HasSuffix(a, ".html") {
+		t.Errorf("Expected distinct names for query variants, got %s and %s", a, b)
+	}
+}
+
+func TestMirror_SavesPagesWithRelativeLinks(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><head><link rel="stylesheet" href="/static/site.css?v=2"></head><body>
+				<a href="/about/#team">About</a> <a href="/pricing">Pricing</a> <a href="#top">Top</a></body></html>`))
+		case "/about":
+			w.Write([]byte(`<html><body><a href="/">Home</a></body></html>`))
+		case "/static/site.css":
+			w.Header().Set("Content-Type", "text/css")
+			w.Write([]byte(`body { color: black }`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	logger := utils.NewLogger()
+	f := fetcher.NewFetcher(time.Second)
+	m := mirror.New(dir, logger)
+	m.SetAssets(f)
+	f.SetArchiver(m)
+
+	for _, path := range []string{"/", "/about"} {
+		if _, err := f.Fetch(ts.URL+path, logger); err != nil {
+			t.Fatalf("Fetch %s failed: %v", path, err)
+		}
+	}
+	if err := m.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	host := strings.ReplaceAll(strings.TrimPrefix(ts.URL, "http://"), ":", "_")
+	home, err := os.ReadFile(filepath.Join(dir, host, "index.html"))
+	if err != nil {
+		t.Fatalf("Home page not saved: %v", err)
+	}
+	for _, want := range []string{`href="about/index.html#team"`, `href="` + ts.URL + `/pricing"`, `href="#top"`, `href="static/site@`} {
+		if !strings.Contains(string(home), want) {
+			t.Errorf("Expected %s in rewritten home page:\n%s", want, home)
+		}
+	}
+
+	about, _ := os.ReadFile(filepath.Join(dir, host, "about", "index.html"))
+	if !strings.Contains(string(about), `href="../index.html"`) {
+		t.Errorf("Expected link back to home page, got:\n%s", about)
+	}
+
+	assets, _ := filepath.Glob(filepath.Join(dir, host, "static", "site@*.css"))
+	if len(assets) != 1 {
+		t.Errorf("Expected the stylesheet to be mirrored, got %v", assets)
+	}
+}
+
+func TestMirror_SavesPagesServedFromTheCache(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><a href="/about">About</a></body></html>`))
+		case "/about":
+			w.Write([]byte(`<html><body><a href="/">Home</a></body></html>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	store, err := fetcher.OpenCacheStore(t.TempDir(), fetcher.DefaultCacheSize)
+	if err != nil {
+		t.Fatalf("OpenCacheStore failed: %v", err)
+	}
+	logger := utils.NewLogger()
+	warm := fetcher.NewFetcher(time.Second)
+	warm.SetMiddlewares(fetcher.Cache(store, false))
+	for _, path := range []string{"/", "/about"} {
+		if _, err := warm.Fetch(ts.URL+path, logger); err != nil {
+			t.Fatalf("Fetch %s failed: %v", path, err)
+		}
+	}
+	ts.Close()
+
+	// Every page now comes from the store, fresh or offline.
+	for _, offline := range []bool{false, true} {
+		dir := t.TempDir()
+		f := fetcher.NewFetcher(time.Second)
+		f.SetMiddlewares(fetcher.Cache(store, offline))
+		m := mirror.New(dir, logger)
+		f.SetArchiver(m)
+		for _, path := range []string{"/", "/about"} {
+			if _, err := f.Fetch(ts.URL+path, logger); err != nil {
+				t.Fatalf("Fetch %s from the cache failed: %v", path, err)
+			}
+		}
+		if err := m.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+
+		host := strings.ReplaceAll(strings.TrimPrefix(ts.URL, "http://"), ":", "_")
+		for _, local := range []string{"index.html", "about/index.html"} {
+			if _, err := os.Stat(filepath.Join(dir, host, local)); err != nil {
+				t.Errorf("Expected %s to be mirrored from the cache (offline %v): %v", local, offline, err)
+			}
+		}
+	}
+}
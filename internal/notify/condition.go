@@ -0,0 +1,128 @@
+package notify
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Metrics conditions can check. The percentages compare with the previous run, so conditions on
+// them are never met by a first run; new_broken also needs the previous run's page records.
+const (
+	MetricPages     = "pages"
+	MetricBroken    = "broken"
+	MetricNewBroken = "new_broken"
+	MetricPagesDrop = "pages_drop"
+)
+
+var metrics = map[string]struct {
+	percent bool
+	value   func(p Payload) (float64, bool)
+}{
+	MetricPages:  {value: func(p Payload) (float64, bool) { return float64(p.Stats.Pages), true }},
+	MetricBroken: {value: func(p Payload) (float64, bool) { return float64(p.Stats.Broken), true }},
+	MetricNewBroken: {value: func(p Payload) (float64, bool) {
+		return float64(p.Stats.NewBroken), p.Previous != nil && p.Previous.statuses
+	}},
+	MetricPagesDrop: {percent: true, value: func(p Payload) (float64, bool) {
+		if p.Previous == nil || p.Previous.Pages == 0 {
+			return 0, false
+		}
+		drop := float64(p.Previous.Pages-p.Stats.Pages) / float64(p.Previous.Pages) * 100
+		return max(drop, 0), true
+	}},
+}
+
+// Condition is a threshold such as "broken > 10" or "pages_drop >= 10%".
+type Condition struct {
+	Metric    string
+	Op        string
+	Threshold float64
+	spec      string
+}
+
+// ParseCondition reads "<metric> <op> <number>", where op is one of >, >=, <, <=, == or != and
+// metric is pages, broken, new_broken or pages_drop. Only pages_drop, a percentage, takes a %.
+func ParseCondition(spec string) (Condition, error) {
+	spec = strings.TrimSpace(spec)
+	i := strings.IndexAny(spec, "<>=!")
+	if i < 0 {
+		return Condition{}, fmt.Errorf("condition %q: expected <metric> <op> <number>, such as broken > 0", spec)
+	}
+	c := Condition{Metric: strings.TrimSpace(spec[:i]), spec: spec}
+	rest := spec[i:]
+	for _, op := range []string{">=", "<=", "==", "!=", ">", "<"} {
+		if strings.HasPrefix(rest, op) {
+			c.Op = op
+			rest = rest[len(op):]
+			break
+		}
+	}
+	if c.Op == "" {
+		return Condition{}, fmt.Errorf("condition %q: unknown operator", spec)
+	}
+	metric, ok := metrics[c.Metric]
+	if !ok {
+		return Condition{}, fmt.Errorf("condition %q: unknown metric %q (available: %s, %s, %s, %s)", spec, c.Metric, MetricPages, MetricBroken, MetricNewBroken, MetricPagesDrop)
+	}
+	number := strings.TrimSpace(rest)
+	if percent, ok := strings.CutSuffix(number, "%"); ok {
+		if !metric.percent {
+			return Condition{}, fmt.Errorf("condition %q: %s is a count, not a percentage", spec, c.Metric)
+		}
+		number = strings.TrimSpace(percent)
+	}
+	threshold, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return Condition{}, fmt.Errorf("condition %q: invalid number %q", spec, number)
+	}
+	c.Threshold = threshold
+	return c, nil
+}
+
+// ParseConditions parses every spec with ParseCondition.
+func ParseConditions(specs []string) ([]Condition, error) {
+	var conditions []Condition
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		c, err := ParseCondition(spec)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+func (c Condition) String() string {
+	return c.spec
+}
+
+// Check reports whether p meets the condition, with the alert to send if it does.
+func (c Condition) Check(p Payload) (Alert, bool) {
+	value, ok := metrics[c.Metric].value(p)
+	if !ok {
+		return Alert{}, false
+	}
+	var met bool
+	switch c.Op {
+	case ">":
+		met = value > c.Threshold
+	case ">=":
+		met = value >= c.Threshold
+	case "<":
+		met = value < c.Threshold
+	case "<=":
+		met = value <= c.Threshold
+	case "==":
+		met = value == c.Threshold
+	case "!=":
+		met = value != c.Threshold
+	}
+	if !met {
+		return Alert{}, false
+	}
+	return Alert{Condition: c.spec, Metric: c.Metric, Value: value, Threshold: c.Threshold}, true
+}
@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File appends each payload to a file as one line of JSON.
+type File struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (f *File) Notify(ctx context.Context, p Payload) error {
+	line, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	// One write per payload, so payloads from concurrent crawls do not interleave.
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Exec runs a command for each payload, with the payload's JSON on its standard input and its
+// events and job ID in the CRAWLER_EVENTS and CRAWLER_JOB_ID environment variables.
+type Exec struct {
+	Command []string
+	Timeout time.Duration
+}
+
+func (e *Exec) Notify(ctx context.Context, p Payload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, e.Command[0], e.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(), "CRAWLER_EVENTS="+strings.Join(p.Events, ","), "CRAWLER_JOB_ID="+p.Job.ID)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", e.Command[0], err, msg)
+		}
+		return fmt.Errorf("%s: %w", e.Command[0], err)
+	}
+	return nil
+}
+
+func init() {
+	Register("file", func(params url.Values) (Notifier, error) {
+		path := params.Get("path")
+		if path == "" {
+			return nil, errors.New("path is required")
+		}
+		return &File{Path: path}, nil
+	})
+	Register("exec", func(params url.Values) (Notifier, error) {
+		command := strings.Fields(params.Get("command"))
+		if len(command) == 0 {
+			return nil, errors.New("command is required")
+		}
+		// Further arguments can be given one per arg parameter, so they may contain spaces.
+		command = append(command, params["arg"]...)
+		timeout, err := durationParam(params, "timeout", 30*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return &Exec{Command: command, Timeout: timeout}, nil
+	})
+}
@@ -0,0 +1,331 @@
+// Package notify tells people and systems about finished crawls: when a crawl completes, when it
+// fails, and when its numbers cross a threshold such as "broken > 0" or "pages_drop > 10%".
+//
+// Every notifier receives the same Payload, whose JSON form is versioned by SchemaVersion. Fields
+// are only ever added to a version; renaming or removing one means a new version.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+)
+
+// SchemaVersion is the version of the Payload JSON schema.
+const SchemaVersion = 1
+
+// MaxBrokenLinks caps how many broken links a payload lists; Stats.Broken still counts them all.
+const MaxBrokenLinks = 100
+
+// Events a payload can carry. The first three follow the state the crawl finished in, and
+// EventThreshold is added when any condition was met.
+const (
+	EventSucceeded = "succeeded"
+	EventFailed    = "failed"
+	EventCanceled  = "canceled"
+	EventThreshold = "threshold"
+)
+
+// Events lists every event, in the order they are documented.
+var Events = []string{EventSucceeded, EventFailed, EventCanceled, EventThreshold}
+
+// Payload is what every notifier sends.
+type Payload struct {
+	Version int `json:"version"`
+	// Events holds the state event of the crawl and, if any condition was met, EventThreshold.
+	Events []string `json:"events"`
+	Job    Job      `json:"job"`
+	Stats  Stats    `json:"stats"`
+	// Previous is the last successful run of the same job, if there is one to compare with.
+	Previous *Previous `json:"previous,omitempty"`
+	Alerts   []Alert   `json:"alerts"`
+	// BrokenLinks lists up to MaxBrokenLinks pages that returned 4xx or 5xx or could not be
+	// fetched, sorted by URL.
+	BrokenLinks []BrokenLink `json:"broken_links"`
+	SentAt      time.Time    `json:"sent_at"`
+}
+
+// Job identifies the crawl a payload is about.
+type Job struct {
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Schedule string `json:"schedule,omitempty"`
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+	// StoppedBy names the crawl budget, such as max_pages, that ended the crawl early.
+	StoppedBy  string    `json:"stopped_by,omitempty"`
+	Seeds      []string  `json:"seeds"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// Stats are the crawl's headline numbers.
+type Stats struct {
+	Pages  int `json:"pages"`
+	Broken int `json:"broken"`
+	// NewBroken counts broken pages that were not broken in the previous run; it is 0 when there
+	// is no previous run with page statuses to compare with.
+	NewBroken int     `json:"new_broken"`
+	Bytes     uint64  `json:"bytes"`
+	Requests  uint64  `json:"requests"`
+	Elapsed   float64 `json:"elapsed_seconds"`
+}
+
+// Previous summarises the run a payload is compared with.
+type Previous struct {
+	ID         string    `json:"id,omitempty"`
+	Pages      int       `json:"pages"`
+	Broken     int       `json:"broken"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	// statuses is set when the run has page records, so broken pages can be told apart as new.
+	statuses bool
+}
+
+// Alert is a condition that was met.
+type Alert struct {
+	Condition string  `json:"condition"`
+	Metric    string  `json:"metric"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+}
+
+// BrokenLink is a page that returned an error status or could not be fetched.
+type BrokenLink struct {
+	URL    string `json:"url"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// New is set when the page was not broken in the previous run.
+	New bool `json:"new,omitempty"`
+}
+
+// Run is a finished crawl to build a payload from.
+type Run struct {
+	ID       string
+	Name     string
+	Schedule string
+	// State is succeeded, failed or canceled.
+	State    string
+	Error    string
+	Seeds    []string
+	Result   *output.Result
+	Bytes    uint64
+	Requests uint64
+	Elapsed  time.Duration
+}
+
+// NewPayload describes run, compared with previous if it is not nil, and checks conditions
+// against it.
+func NewPayload(run Run, previous *Run, conditions []Condition) Payload {
+	p := Payload{
+		Version: SchemaVersion,
+		Events:  []string{run.State},
+		Job: Job{
+			ID:       run.ID,
+			Name:     run.Name,
+			Schedule: run.Schedule,
+			State:    run.State,
+			Error:    run.Error,
+			Seeds:    run.Seeds,
+		},
+		Stats: Stats{
+			Bytes:    run.Bytes,
+			Requests: run.Requests,
+			Elapsed:  run.Elapsed.Seconds(),
+		},
+		Alerts:      []Alert{},
+		BrokenLinks: []BrokenLink{},
+		SentAt:      time.Now(),
+	}
+	if p.Job.Seeds == nil {
+		p.Job.Seeds = []string{}
+	}
+	if run.Result != nil {
+		p.Job.StartedAt = run.Result.StartedAt
+		p.Job.FinishedAt = run.Result.FinishedAt
+		p.Job.StoppedBy = run.Result.StoppedBy
+		if len(run.Seeds) == 0 && run.Result.Seeds != nil {
+			p.Job.Seeds = run.Result.Seeds
+		}
+	}
+
+	// Without page statuses in the previous run nothing can be told apart as new.
+	var wasBroken map[string]bool
+	if previous != nil && previous.Result != nil {
+		p.Previous = &Previous{
+			ID:         previous.ID,
+			Pages:      pageCount(previous.Result),
+			FinishedAt: previous.Result.FinishedAt,
+		}
+		if len(previous.Result.Pages) > 0 {
+			p.Previous.statuses = true
+			wasBroken = make(map[string]bool)
+			for _, record := range previous.Result.Pages {
+				if broken(record) {
+					wasBroken[record.URL] = true
+					p.Previous.Broken++
+				}
+			}
+		}
+	}
+
+	if run.Result != nil {
+		p.Stats.Pages = pageCount(run.Result)
+		for _, record := range run.Result.Pages {
+			if !broken(record) {
+				continue
+			}
+			p.Stats.Broken++
+			isNew := wasBroken != nil && !wasBroken[record.URL]
+			if isNew {
+				p.Stats.NewBroken++
+			}
+			if len(p.BrokenLinks) < MaxBrokenLinks {
+				p.BrokenLinks = append(p.BrokenLinks, BrokenLink{URL: record.URL, Status: record.Status, Error: record.Error, New: isNew})
+			}
+		}
+	}
+
+	for _, condition := range conditions {
+		if alert, ok := condition.Check(p); ok {
+			p.Alerts = append(p.Alerts, alert)
+		}
+	}
+	if len(p.Alerts) > 0 {
+		p.Events = append(p.Events, EventThreshold)
+	}
+	return p
+}
+
+func broken(record output.Record) bool {
+	return record.Status >= 400 || record.Error != ""
+}
+
+// pageCount counts the pages of a result. Results loaded from the plain json format only have
+// their URLs.
+func pageCount(result *output.Result) int {
+	if len(result.Pages) > 0 {
+		return len(result.Pages)
+	}
+	return len(result.URLs)
+}
+
+// Notifier delivers a payload somewhere.
+type Notifier interface {
+	Notify(ctx context.Context, payload Payload) error
+}
+
+// Target is a configured notifier and the events it is sent.
+type Target struct {
+	Name     string
+	Notifier Notifier
+	// On lists the events the target is interested in; it is sent payloads carrying any of them.
+	On []string
+}
+
+// Wants reports whether the target is interested in p.
+func (t Target) Wants(p Payload) bool {
+	for _, event := range p.Events {
+		for _, on := range t.On {
+			if event == on {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Send delivers p to every target that wants it, and reports the targets that failed.
+func Send(ctx context.Context, targets []Target, p Payload) error {
+	var errs []error
+	for _, target := range targets {
+		if !target.Wants(p) {
+			continue
+		}
+		if err := target.Notifier.Notify(ctx, p); err != nil {
+			errs = append(errs, fmt.Errorf("notifier %s: %w", target.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Factory builds a notifier from the query parameters of its entry in a target spec.
+type Factory func(params url.Values) (Notifier, error)
+
+var notifiers = map[string]Factory{}
+
+// Register makes a notifier available to ParseTargets under name.
+func Register(name string, factory Factory) {
+	notifiers[name] = factory
+}
+
+// Names returns the registered notifier names in alphabetical order.
+func Names() []string {
+	names := make([]string, 0, len(notifiers))
+	for name := range notifiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseTargets builds targets from specs such as
+// "webhook?url=https://example.com/hook&secret_env=HOOK_SECRET&on=failed+threshold". The on
+// parameter lists the events to send, separated by + or given several times; it defaults to
+// every event.
+func ParseTargets(specs []string) ([]Target, error) {
+	var targets []Target
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, query, _ := strings.Cut(spec, "?")
+		factory, ok := notifiers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown notifier %q (available: %s)", name, strings.Join(Names(), ", "))
+		}
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %w", name, err)
+		}
+		on, err := parseEvents(params["on"])
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %w", name, err)
+		}
+		params.Del("on")
+		notifier, err := factory(params)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %w", name, err)
+		}
+		targets = append(targets, Target{Name: name, Notifier: notifier, On: on})
+	}
+	return targets, nil
+}
+
+func parseEvents(values []string) ([]string, error) {
+	var events []string
+	for _, value := range values {
+		// A + in a query string decodes to a space.
+		for _, event := range strings.Fields(value) {
+			known := false
+			for _, e := range Events {
+				known = known || e == event
+			}
+			if !known {
+				return nil, fmt.Errorf("unknown event %q (available: %s)", event, strings.Join(Events, ", "))
+			}
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 {
+		return Events, nil
+	}
+	return events, nil
+}
@@ -0,0 +1,160 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/notify"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+)
+
+func result(pages ...output.Record) *output.Result {
+	r := &output.Result{URLs: make(map[string]bool), Pages: pages}
+	for _, page := range pages {
+		r.URLs[page.URL] = true
+	}
+	return r
+}
+
+func TestNewPayload_ComparesWithThePreviousRunAndChecksConditions(t *testing.T) {
+	previous := &notify.Run{ID: "a", Result: result(
+		output.Record{URL: "https://example.com/", Status: 200},
+		output.Record{URL: "https://example.com/a", Status: 200},
+		output.Record{URL: "https://example.com/b", Status: 200},
+		output.Record{URL: "https://example.com/c", Status: 200},
+		output.Record{URL: "https://example.com/old", Status: 404},
+	)}
+	run := notify.Run{ID: "b", Name: "docs", State: notify.EventSucceeded, Result: result(
+		output.Record{URL: "https://example.com/", Status: 200},
+		output.Record{URL: "https://example.com/a", Status: 500},
+		output.Record{URL: "https://example.com/down", Error: "connection refused"},
+		output.Record{URL: "https://example.com/old", Status: 404},
+	)}
+	conditions, err := notify.ParseConditions([]string{"broken > 2", "new_broken>=2", "pages_drop > 10%", "pages < 1"})
+	if err != nil {
+		t.Fatalf("ParseConditions failed: %v", err)
+	}
+
+	p := notify.NewPayload(run, previous, conditions)
+	if p.Version != notify.SchemaVersion || p.Job.Name != "docs" || p.Previous == nil || p.Previous.ID != "a" {
+		t.Fatalf("Unexpected payload: %+v", p)
+	}
+	if p.Stats.Pages != 4 || p.Stats.Broken != 3 || p.Stats.NewBroken != 2 || p.Previous.Pages != 5 || p.Previous.Broken != 1 {
+		t.Errorf("Unexpected stats: %+v, previous %+v", p.Stats, p.Previous)
+	}
+	if strings.Join(p.Events, ",") != "succeeded,threshold" {
+		t.Errorf("Expected the succeeded and threshold events, got %v", p.Events)
+	}
+	var alerts []string
+	for _, alert := range p.Alerts {
+		alerts = append(alerts, alert.Condition)
+	}
+	if strings.Join(alerts, "|") != "broken > 2|new_broken>=2|pages_drop > 10%" || p.Alerts[2].Value != 20 {
+		t.Errorf("Unexpected alerts: %+v", p.Alerts)
+	}
+	if len(p.BrokenLinks) != 3 || !p.BrokenLinks[0].New || p.BrokenLinks[2].New || p.BrokenLinks[2].URL != "https://example.com/old" {
+		t.Errorf("Unexpected broken links: %+v", p.BrokenLinks)
+	}
+
+	// Without a previous run there is nothing to compare with.
+	p = notify.NewPayload(run, nil, conditions)
+	if len(p.Alerts) != 1 || p.Stats.NewBroken != 0 || p.Previous != nil {
+		t.Errorf("Expected only the broken alert without a previous run, got %+v", p.Alerts)
+	}
+
+	// A previous run with only its URLs cannot tell which broken pages are new.
+	urlsOnly := &notify.Run{Result: &output.Result{URLs: map[string]bool{"https://example.com/": true}}}
+	never, _ := notify.ParseConditions([]string{"new_broken >= 0"})
+	if p = notify.NewPayload(run, urlsOnly, never); len(p.Alerts) != 0 || p.Previous == nil {
+		t.Errorf("Expected new_broken to be unknown against a run without page records, got %+v", p.Alerts)
+	}
+}
+
+func TestParse_RejectsInvalidSettings(t *testing.T) {
+	for _, spec := range []string{"broken", "broken => 1", "links > 1", "broken > 10%", "pages_drop > ten"} {
+		if _, err := notify.ParseCondition(spec); err == nil {
+			t.Errorf("Expected condition %q to be rejected", spec)
+		}
+	}
+	for _, spec := range []string{"email?to=ops", "webhook", "webhook?url=ftp://example.com", "webhook?url=https://example.com&on=done", "file", "exec?command=", "webhook?url=https://example.com&secret_env=NOTIFY_TEST_UNSET"} {
+		if _, err := notify.ParseTargets([]string{spec}); err == nil {
+			t.Errorf("Expected target %q to be rejected", spec)
+		}
+	}
+}
+
+func TestWebhook_SignsThePayload(t *testing.T) {
+	t.Setenv("NOTIFY_TEST_SECRET", "s3cret")
+	var calls int
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if got := r.Header.Get(notify.SignatureHeader); got != notify.Sign("s3cret", body) {
+			t.Errorf("Signature %q does not match the body", got)
+		}
+		if got := r.Header.Get(notify.EventHeader); got != "failed" {
+			t.Errorf("Expected the failed event header, got %q", got)
+		}
+		var p notify.Payload
+		if err := json.Unmarshal(body, &p); err != nil || p.Job.Error != "no seeds" {
+			t.Errorf("Unexpected payload %s: %v", body, err)
+		}
+	}))
+	defer hook.Close()
+
+	targets, err := notify.ParseTargets([]string{
+		"webhook?url=" + hook.URL + "&secret_env=NOTIFY_TEST_SECRET&on=failed+threshold",
+		"webhook?url=" + hook.URL + "/never&on=succeeded",
+	})
+	if err != nil {
+		t.Fatalf("ParseTargets failed: %v", err)
+	}
+	p := notify.NewPayload(notify.Run{State: notify.EventFailed, Error: "no seeds"}, nil, nil)
+	if err := notify.Send(context.Background(), targets, p); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected one retry and no call for the succeeded-only target, got %d calls", calls)
+	}
+}
+
+func TestFileAndExec_ReceiveThePayload(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "notifications.jsonl")
+	copied := filepath.Join(dir, "copied.json")
+	targets, err := notify.ParseTargets([]string{
+		"file?path=" + log,
+		"exec?command=sh&arg=-c&arg=cat > " + copied + " %26%26 test $CRAWLER_EVENTS = canceled",
+	})
+	if err != nil {
+		t.Fatalf("ParseTargets failed: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		p := notify.NewPayload(notify.Run{ID: "job", State: notify.EventCanceled}, nil, nil)
+		if err := notify.Send(context.Background(), targets, p); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	data, _ := os.ReadFile(log)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 {
+		t.Errorf("Expected one line per payload, got %q", data)
+	}
+	var p notify.Payload
+	data, _ = os.ReadFile(copied)
+	if err := json.Unmarshal(data, &p); err != nil || p.Job.ID != "job" {
+		t.Errorf("Expected the command to get the payload on stdin, got %s: %v", data, err)
+	}
+}
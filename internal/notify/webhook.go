@@ -0,0 +1,162 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers set on every webhook request.
+const (
+	// EventHeader lists the payload's events, comma-separated.
+	EventHeader = "X-Crawler-Event"
+	// SignatureHeader is "sha256=" followed by the hex HMAC-SHA256 of the body, keyed with the
+	// webhook's secret. It is only set when a secret is configured.
+	SignatureHeader = "X-Crawler-Signature"
+)
+
+// Webhook POSTs payloads as JSON to a URL. Requests that fail or get a 429 or 5xx response are
+// retried, waiting a second before the first retry and twice as long before each next one.
+type Webhook struct {
+	URL      string
+	Secret   string
+	Attempts int
+	Client   *http.Client
+}
+
+// Sign returns the SignatureHeader value for body, so receivers can check it came from a
+// webhook sharing their secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhook) Notify(ctx context.Context, p Payload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := w.post(ctx, body, p.Events)
+		if err == nil || attempt >= w.Attempts || errors.Is(err, errPermanent) {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+var errPermanent = errors.New("not retried")
+
+func (w *Webhook) post(ctx context.Context, body []byte, events []string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, strings.Join(events, ","))
+	if w.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(w.Secret, body))
+	}
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("%s returned %s", w.URL, resp.Status)
+	default:
+		return fmt.Errorf("%s returned %s: %w", w.URL, resp.Status, errPermanent)
+	}
+}
+
+func init() {
+	Register("webhook", func(params url.Values) (Notifier, error) {
+		target := params.Get("url")
+		if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("url must be an http or https URL, got %q", target)
+		}
+		secret, err := secretParam(params)
+		if err != nil {
+			return nil, err
+		}
+		attempts, err := intParam(params, "attempts", 3)
+		if err != nil {
+			return nil, err
+		}
+		if attempts < 1 {
+			return nil, errors.New("attempts must be at least 1")
+		}
+		timeout, err := durationParam(params, "timeout", 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return &Webhook{URL: target, Secret: secret, Attempts: attempts, Client: &http.Client{Timeout: timeout}}, nil
+	})
+}
+
+// secretParam reads the secret from the secret parameter or, so it need not be stored with the
+// settings, from the environment variable named by secret_env.
+func secretParam(params url.Values) (string, error) {
+	name := params.Get("secret_env")
+	if name == "" {
+		return params.Get("secret"), nil
+	}
+	secret, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("secret_env: %s is not set", name)
+	}
+	return secret, nil
+}
+
+func intParam(params url.Values, name string, fallback int) (int, error) {
+	value := params.Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return n, nil
+}
+
+func durationParam(params url.Values, name string, fallback time.Duration) (time.Duration, error) {
+	value := params.Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be positive", name)
+	}
+	return d, nil
+}
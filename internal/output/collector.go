@@ -0,0 +1,61 @@
+package output
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Collector is a Sink that keeps every record in memory so the final writers can use them.
+type Collector struct {
+	mu      sync.Mutex
+	records []Record
+}
+
+func NewCollector() *Collector {
+	return &Collector{}
+}
+
+func (c *Collector) Write(record Record) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records = append(c.records, record)
+	return nil
+}
+
+func (c *Collector) Close() error {
+	return nil
+}
+
+// Records returns the collected records sorted by URL.
+func (c *Collector) Records() []Record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	records := make([]Record, len(c.records))
+	copy(records, c.records)
+	sort.Slice(records, func(i, j int) bool { return records[i].URL < records[j].URL })
+	return records
+}
+
+type teeSink []Sink
+
+// Tee returns a Sink that writes every record to all of sinks.
+func Tee(sinks ...Sink) Sink {
+	return teeSink(sinks)
+}
+
+func (t teeSink) Write(record Record) error {
+	var errs []error
+	for _, sink := range t {
+		errs = append(errs, sink.Write(record))
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeSink) Close() error {
+	var errs []error
+	for _, sink := range t {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
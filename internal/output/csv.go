@@ -0,0 +1,43 @@
+package output
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register(Format{Name: "csv", Extension: ".csv", Write: writeCSV})
+}
+
+// writeCSV writes one page per row. Outgoing links are joined with spaces in a single column.
+func writeCSV(result *Result, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"url", "depth", "status", "links", "error", "fetched_at", "duration_ms"})
+
+	for _, page := range result.Pages {
+		w.Write([]string{
+			page.URL,
+			strconv.Itoa(page.Depth),
+			strconv.Itoa(page.Status),
+			strings.Join(page.Links, " "),
+			page.Error,
+			page.FetchedAt.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(page.Duration, 'f', -1, 64),
+		})
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,68 @@
+package output
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fingerprint"
+)
+
+// Cluster is a page and the pages crawled after it that repeat its text.
+type Cluster struct {
+	URL string `json:"url"`
+	// Exact pages have the same normalised text as URL; Near pages have text whose SimHash is
+	// within Distance bits of it.
+	Exact []string `json:"exact,omitempty"`
+	Near  []string `json:"near,omitempty"`
+	// Distance is the largest SimHash distance of a near duplicate from URL.
+	Distance int `json:"distance,omitempty"`
+}
+
+// Size returns the number of pages in the cluster, URL included.
+func (c Cluster) Size() int {
+	return 1 + len(c.Exact) + len(c.Near)
+}
+
+// Clusters groups pages by their DuplicateOf field, largest cluster first.
+func Clusters(pages []Record) []Cluster {
+	records := make(map[string]Record, len(pages))
+	for _, page := range pages {
+		records[page.URL] = page
+	}
+	byURL := make(map[string]*Cluster)
+	for _, page := range pages {
+		if page.DuplicateOf == "" {
+			continue
+		}
+		cluster, ok := byURL[page.DuplicateOf]
+		if !ok {
+			cluster = &Cluster{URL: page.DuplicateOf}
+			byURL[page.DuplicateOf] = cluster
+		}
+		original := records[page.DuplicateOf]
+		if page.TextHash != "" && page.TextHash == original.TextHash {
+			cluster.Exact = append(cluster.Exact, page.URL)
+			continue
+		}
+		cluster.Near = append(cluster.Near, page.URL)
+		a, errA := strconv.ParseUint(page.SimHash, 16, 64)
+		b, errB := strconv.ParseUint(original.SimHash, 16, 64)
+		if errA == nil && errB == nil {
+			cluster.Distance = max(cluster.Distance, fingerprint.Distance(a, b))
+		}
+	}
+
+	clusters := make([]Cluster, 0, len(byURL))
+	for _, cluster := range byURL {
+		sort.Strings(cluster.Exact)
+		sort.Strings(cluster.Near)
+		clusters = append(clusters, *cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Size() != clusters[j].Size() {
+			return clusters[i].Size() > clusters[j].Size()
+		}
+		return clusters[i].URL < clusters[j].URL
+	})
+	return clusters
+}
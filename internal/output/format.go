@@ -0,0 +1,149 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Result is everything the final writers need about a finished crawl.
+type Result struct {
+	Seeds []string        `json:"seeds,omitempty"`
+	URLs  map[string]bool `json:"urls"`
+	Pages []Record        `json:"pages,omitempty"`
+	// Duplicates groups pages with the same or nearly the same text, as found by Clusters.
+	Duplicates []Cluster `json:"duplicates,omitempty"`
+	// Traps are the parts of the site where links were not followed because they looked like a
+	// spider trap.
+	Traps []Trap `json:"traps,omitempty"`
+	// StoppedBy names the crawl-wide budget, such as max_pages, that ended the crawl early.
+	StoppedBy  string    `json:"stopped_by,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// Trap is a set of URLs that looked like a spider trap, such as an endless calendar.
+type Trap struct {
+	// Kind is the heuristic that found the trap, and Pattern the URLs it covers.
+	Kind    string `json:"kind"`
+	Pattern string `json:"pattern"`
+	// URLs is the number of URLs that fell into the trap, of which Samples lists the first few.
+	URLs    int      `json:"urls"`
+	Samples []string `json:"samples"`
+}
+
+// SaveResult stores the whole result as JSON at path, so it can be loaded again with LoadResult
+// and written in any format later.
+func SaveResult(result *Result, path string) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// MergeResult returns result with the page records of previous for the URLs result did not
+// reach, so the run state of a crawl cut short keeps the validators of the pages it skipped.
+func MergeResult(previous, result *Result) *Result {
+	if previous == nil {
+		return result
+	}
+	merged := *result
+	merged.URLs = make(map[string]bool, len(result.URLs))
+	for u := range result.URLs {
+		merged.URLs[u] = true
+	}
+	merged.Pages = append([]Record(nil), result.Pages...)
+	reached := make(map[string]bool, len(result.Pages))
+	for _, record := range result.Pages {
+		reached[record.URL] = true
+	}
+	for _, record := range previous.Pages {
+		if !reached[record.URL] {
+			merged.Pages = append(merged.Pages, record)
+			merged.URLs[record.URL] = true
+		}
+	}
+	return &merged
+}
+
+// LoadResult reads a result stored by SaveResult. It also reads the `{"urls": {...}}` files
+// written by the json format, which only have the URLs.
+func LoadResult(path string) (*Result, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var result Result
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if result.URLs == nil {
+		result.URLs = make(map[string]bool)
+	}
+	return &result, nil
+}
+
+// Format is a named writer for a crawl Result.
+type Format struct {
+	Name      string
+	Extension string
+	Write     func(result *Result, path string) error
+}
+
+var registry = make(map[string]Format)
+
+// Register makes a format available to -format. Formats register themselves from init.
+func Register(format Format) {
+	registry[format.Name] = format
+}
+
+// Lookup returns the format registered under name.
+func Lookup(name string) (Format, bool) {
+	format, ok := registry[name]
+	return format, ok
+}
+
+// Names returns the registered format names in alphabetical order.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseFormats resolves a comma-separated list such as "json,csv" into formats.
+func ParseFormats(list string) ([]Format, error) {
+	var formats []Format
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		format, ok := Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown output format %q (available: %s)", name, strings.Join(Names(), ", "))
+		}
+		formats = append(formats, format)
+	}
+	if len(formats) == 0 {
+		return nil, fmt.Errorf("no output format given")
+	}
+	return formats, nil
+}
+
+// PathFor derives the file for a format from the -output path by swapping its extension,
+// so `-output=monzo.json -format=json,csv` writes monzo.json and monzo.csv.
+func PathFor(output string, format Format) string {
+	return strings.TrimSuffix(output, filepath.Ext(output)) + format.Extension
+}
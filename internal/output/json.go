@@ -0,0 +1,40 @@
+package output
+
+import (
+	"encoding/json"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+func init() {
+	Register(Format{Name: "json", Extension: ".json", Write: writeJSON})
+}
+
+// MarshalURLs renders the crawled URLs in the original `{"urls": {...}}` shape.
+func MarshalURLs(urls map[string]bool) ([]byte, error) {
+	return json.MarshalIndent(struct {
+		URLs map[string]bool `json:"urls"`
+	}{
+		URLs: urls,
+	}, "", "  ")
+}
+
+// writeJSON writes the URLs in the original shape, with the duplicate clusters, spider traps and
+// the budget that stopped the crawl alongside them when there are any.
+func writeJSON(result *Result, path string) error {
+	data, err := json.MarshalIndent(struct {
+		URLs       map[string]bool `json:"urls"`
+		Duplicates []Cluster       `json:"duplicates,omitempty"`
+		Traps      []Trap          `json:"traps,omitempty"`
+		StoppedBy  string          `json:"stopped_by,omitempty"`
+	}{
+		URLs:       result.URLs,
+		Duplicates: result.Duplicates,
+		Traps:      result.Traps,
+		StoppedBy:  result.StoppedBy,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.SaveJSONToFile(data, path)
+}
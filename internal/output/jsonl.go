@@ -0,0 +1,102 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultFlushInterval is how often buffered JSON Lines records are flushed.
+const DefaultFlushInterval = time.Second
+
+// JSONLSink writes one JSON object per line for every completed page.
+// Records are buffered and flushed every flush interval and on Close, so a crash loses at most
+// one interval worth of pages rather than the whole crawl.
+type JSONLSink struct {
+	mu      sync.Mutex
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	closer  io.Closer
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewJSONLSink writes records to w. If w is an io.Closer it is closed with the sink.
+func NewJSONLSink(w io.Writer, flushInterval time.Duration) *JSONLSink {
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
+
+	writer := bufio.NewWriter(w)
+	s := &JSONLSink{
+		writer:  writer,
+		encoder: json.NewEncoder(writer),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if closer, ok := w.(io.Closer); ok {
+		s.closer = closer
+	}
+
+	go s.flushPeriodically(flushInterval)
+	return s
+}
+
+// OpenJSONL opens a JSON Lines sink on path. "-" writes to stdout. Named pipes work like regular
+// files, although opening one blocks until a reader is attached.
+func OpenJSONL(path string, flushInterval time.Duration) (*JSONLSink, error) {
+	if path == "-" {
+		return NewJSONLSink(struct{ io.Writer }{os.Stdout}, flushInterval), nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLSink(file, flushInterval), nil
+}
+
+func (s *JSONLSink) Write(record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.encoder.Encode(record)
+}
+
+// Flush writes any buffered records to the underlying writer.
+func (s *JSONLSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writer.Flush()
+}
+
+// Close stops the periodic flush, flushes remaining records and closes the underlying writer.
+func (s *JSONLSink) Close() error {
+	close(s.stop)
+	<-s.done
+
+	err := s.Flush()
+	if s.closer != nil {
+		if closeErr := s.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (s *JSONLSink) flushPeriodically(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.Flush()
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package output
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// markdownTopN caps the per-section lists in the report so it stays readable on large crawls.
+const markdownTopN = 10
+
+func init() {
+	Register(Format{Name: "markdown", Extension: ".md", Write: writeMarkdown})
+}
+
+// writeMarkdown writes a human-readable summary: totals, status breakdown, broken pages with the
+// pages that link to them, the slowest pages, the largest clusters of duplicate pages and any
+// spider traps.
+func writeMarkdown(result *Result, path string) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Crawl Report\n\n")
+	if len(result.Seeds) > 0 {
+		fmt.Fprintf(&b, "- **Seeds:** %s\n", strings.Join(result.Seeds, ", "))
+	}
+	if !result.StartedAt.IsZero() {
+		fmt.Fprintf(&b, "- **Started:** %s\n", result.StartedAt.UTC().Format(time.RFC3339))
+		fmt.Fprintf(&b, "- **Duration:** %s\n", result.FinishedAt.Sub(result.StartedAt).Round(time.Millisecond))
+	}
+
+	failed := 0
+	statuses := make(map[string]int)
+	inlinks := make(map[string][]string)
+	for _, page := range result.Pages {
+		if page.Error != "" {
+			failed++
+		}
+		statuses[statusLabel(page)]++
+		for _, link := range page.Links {
+			inlinks[link] = append(inlinks[link], page.URL)
+		}
+	}
+	fmt.Fprintf(&b, "- **Pages crawled:** %d\n", len(result.URLs))
+	fmt.Fprintf(&b, "- **Pages failed:** %d\n", failed)
+	if result.StoppedBy != "" {
+		fmt.Fprintf(&b, "- **Stopped by budget:** %s\n", result.StoppedBy)
+	}
+	fmt.Fprintf(&b, "\n")
+
+	fmt.Fprintf(&b, "## Status Codes\n\n| Status | Pages |\n|--------|-------|\n")
+	labels := make([]string, 0, len(statuses))
+	for label := range statuses {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		fmt.Fprintf(&b, "| %s | %d |\n", label, statuses[label])
+	}
+
+	fmt.Fprintf(&b, "\n## Broken Pages\n\n")
+	broken := 0
+	for _, page := range result.Pages {
+		if page.Error == "" {
+			continue
+		}
+		broken++
+		fmt.Fprintf(&b, "- `%s` (%s)", page.URL, statusLabel(page))
+		if refs := inlinks[page.URL]; len(refs) > 0 {
+			sort.Strings(refs)
+			if len(refs) > markdownTopN {
+				refs = refs[:markdownTopN]
+			}
+			fmt.Fprintf(&b, ", linked from: %s", strings.Join(refs, ", "))
+		}
+		b.WriteString("\n")
+	}
+	if broken == 0 {
+		b.WriteString("None.\n")
+	}
+
+	fmt.Fprintf(&b, "\n## Slowest Pages\n\n| Page | Time (ms) |\n|------|-----------|\n")
+	slowest := make([]Record, 0, len(result.Pages))
+	for _, page := range result.Pages {
+		if page.Error == "" {
+			slowest = append(slowest, page)
+		}
+	}
+	sort.Slice(slowest, func(i, j int) bool { return slowest[i].Duration > slowest[j].Duration })
+	if len(slowest) > markdownTopN {
+		slowest = slowest[:markdownTopN]
+	}
+	for _, page := range slowest {
+		fmt.Fprintf(&b, "| %s | %.1f |\n", page.URL, page.Duration)
+	}
+
+	if len(result.Duplicates) > 0 {
+		fmt.Fprintf(&b, "\n## Duplicate Pages\n\n| Page | Exact | Near |\n|------|-------|------|\n")
+		clusters := result.Duplicates
+		if len(clusters) > markdownTopN {
+			clusters = clusters[:markdownTopN]
+		}
+		for _, cluster := range clusters {
+			fmt.Fprintf(&b, "| %s | %d | %d |\n", cluster.URL, len(cluster.Exact), len(cluster.Near))
+		}
+	}
+
+	if len(result.Traps) > 0 {
+		fmt.Fprintf(&b, "\n## Spider Traps\n\n")
+		for _, trap := range result.Traps {
+			fmt.Fprintf(&b, "- `%s` (%s, %d URLs), e.g. %s\n", trap.Pattern, trap.Kind, trap.URLs, strings.Join(trap.Samples, ", "))
+		}
+	}
+
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+func statusLabel(page Record) string {
+	if page.Status == 0 {
+		return "error"
+	}
+	return fmt.Sprintf("%d", page.Status)
+}
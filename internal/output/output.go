@@ -0,0 +1,39 @@
+package output
+
+import (
+	"time"
+)
+
+// Record describes a single crawled page.
+type Record struct {
+	URL       string   `json:"url"`
+	Depth     int      `json:"depth"`
+	Status    int      `json:"status,omitempty"`
+	Links     []string `json:"links,omitempty"`
+	Title     string   `json:"title,omitempty"`
+	Canonical string   `json:"canonical,omitempty"`
+	// ContentHash is the hex SHA-256 of the response body.
+	ContentHash string `json:"content_hash,omitempty"`
+	// TextHash is the hex SHA-256 of the page's normalised visible text, and SimHash a 64-bit
+	// SimHash of it in hex, which differs in few bits between pages with similar text.
+	TextHash string `json:"text_hash,omitempty"`
+	SimHash  string `json:"simhash,omitempty"`
+	// DuplicateOf is the earlier page whose text this page repeats exactly or nearly.
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	// ETag and LastModified are the page's validators, sent back on the next incremental crawl.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Unchanged is set when the server answered a conditional request with 304 Not Modified; the
+	// links, title, canonical URL and content hash are then those of the previous crawl.
+	Unchanged bool      `json:"unchanged,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+	Duration  float64   `json:"duration_ms,omitempty"`
+}
+
+// Sink receives page records as soon as each page completes.
+// Implementations must be safe for concurrent use, since every crawl goroutine writes to the same sink.
+type Sink interface {
+	Write(record Record) error
+	Close() error
+}
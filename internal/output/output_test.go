@@ -0,0 +1,267 @@
+package output_test
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+)
+
+// lockedBuffer lets the test read what the sink's flush goroutine has written.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestJSONLSink_FlushesPeriodically(t *testing.T) {
+	buf := &lockedBuffer{}
+	sink := output.NewJSONLSink(buf, 20*time.Millisecond)
+
+	sink.Write(output.Record{URL: "https://example.com", Status: 200})
+	if buf.String() != "" {
+		t.Fatalf("Expected record to be buffered until the next flush, got %q", buf.String())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	var record output.Record
+	if err := json.Unmarshal([]byte(buf.String()), &record); err != nil || record.URL != "https://example.com" {
+		t.Fatalf("Expected flushed record, got %q (%v)", buf.String(), err)
+	}
+
+	sink.Write(output.Record{URL: "https://example.com/about"})
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if got := bytes.Count([]byte(buf.String()), []byte("\n")); got != 2 {
+		t.Errorf("Expected 2 lines after close, got %d", got)
+	}
+}
+
+func TestOpenJSONL_WritesOneRecordPerLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pages.jsonl")
+	sink, err := output.OpenJSONL(path, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenJSONL failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sink.Write(output.Record{URL: "https://example.com", Links: []string{"https://example.com/a"}})
+		}()
+	}
+	wg.Wait()
+	sink.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open output: %v", err)
+	}
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record output.Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Line %d is not valid JSON: %v", lines+1, err)
+		}
+		lines++
+	}
+	if lines != 50 {
+		t.Errorf("Expected 50 lines, got %d", lines)
+	}
+}
+
+func sampleResult() *output.Result {
+	fetched := time.Date(2024, 11, 20, 10, 0, 0, 0, time.UTC)
+	return &output.Result{
+		Seeds: []string{"https://example.com"},
+		URLs: map[string]bool{
+			"https://example.com":       true,
+			"https://example.com/about": true,
+		},
+		Pages: []output.Record{
+			{URL: "https://example.com", Status: 200, Links: []string{"https://example.com/about", "https://example.com/gone"}, FetchedAt: fetched, Duration: 12.5},
+			{URL: "https://example.com/about", Depth: 1, Status: 200, Links: []string{"https://example.com"}, LastModified: "Wed, 20 Nov 2024 09:00:00 GMT", FetchedAt: fetched, Duration: 40},
+			{URL: "https://example.com/gone", Depth: 1, Status: 404, Error: "404 Not Found", FetchedAt: fetched},
+		},
+		StartedAt:  fetched,
+		FinishedAt: fetched.Add(time.Second),
+	}
+}
+
+func TestParseFormats(t *testing.T) {
+	formats, err := output.ParseFormats("json, csv,sitemap,sqlite,markdown")
+	if err != nil || len(formats) != 5 {
+		t.Fatalf("Expected 5 formats, got %v, %v", formats, err)
+	}
+	if _, err := output.ParseFormats("json,yaml"); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+	if got := output.PathFor("out/monzo.json", formats[1]); got != "out/monzo.csv" {
+		t.Errorf("PathFor = %q, want out/monzo.csv", got)
+	}
+}
+
+func TestFormats_WriteEveryFormat(t *testing.T) {
+	dir := t.TempDir()
+	result := sampleResult()
+
+	for _, name := range output.Names() {
+		format, _ := output.Lookup(name)
+		path := output.PathFor(filepath.Join(dir, "crawl.json"), format)
+		if err := format.Write(result, path); err != nil {
+			t.Fatalf("%s writer failed: %v", name, err)
+		}
+		if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+			t.Errorf("%s writer produced no output at %s", name, path)
+		}
+	}
+
+	csvData, _ := os.ReadFile(filepath.Join(dir, "crawl.csv"))
+	if lines := bytes.Count(csvData, []byte("\n")); lines != 4 {
+		t.Errorf("Expected header plus 3 CSV rows, got %d lines", lines)
+	}
+
+	sitemap, _ := os.ReadFile(filepath.Join(dir, "crawl.xml"))
+	if !bytes.Contains(sitemap, []byte("<loc>https://example.com/about</loc>")) || bytes.Contains(sitemap, []byte("/gone")) {
+		t.Errorf("Sitemap should list crawled pages only, got %s", sitemap)
+	}
+	// Only the page whose server sent Last-Modified has a lastmod, and it is not the fetch time.
+	if bytes.Count(sitemap, []byte("<lastmod>")) != 1 || !bytes.Contains(sitemap, []byte("<lastmod>2024-11-20T09:00:00Z</lastmod>")) {
+		t.Errorf("Sitemap lastmod should come from Last-Modified, got %s", sitemap)
+	}
+
+	report, _ := os.ReadFile(filepath.Join(dir, "crawl.md"))
+	if !bytes.Contains(report, []byte("`https://example.com/gone` (404), linked from: https://example.com")) {
+		t.Errorf("Markdown report should list broken pages with referrers, got:\n%s", report)
+	}
+}
+
+func TestSQLite_PagesAndLinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crawl.db")
+	format, _ := output.Lookup("sqlite")
+	if err := format.Write(sampleResult(), path); err != nil {
+		t.Fatalf("sqlite writer failed: %v", err)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var pages, links, broken int
+	db.QueryRow(`SELECT COUNT(*) FROM pages`).Scan(&pages)
+	db.QueryRow(`SELECT COUNT(*) FROM links`).Scan(&links)
+	db.QueryRow(`SELECT COUNT(*) FROM links JOIN pages ON pages.url = links.target WHERE pages.status = 404`).Scan(&broken)
+	if pages != 3 || links != 3 || broken != 1 {
+		t.Errorf("Expected 3 pages, 3 links, 1 broken link, got %d, %d, %d", pages, links, broken)
+	}
+}
+
+func TestSitemap_SplitsLargeCrawls(t *testing.T) {
+	result := &output.Result{Seeds: []string{"https://example.com"}, FinishedAt: time.Now()}
+	for i := 0; i <= output.MaxSitemapURLs; i++ {
+		result.Pages = append(result.Pages, output.Record{URL: fmt.Sprintf("https://example.com/page-%d", i), Status: 200})
+	}
+
+	dir := t.TempDir()
+	format, _ := output.Lookup("sitemap")
+	if err := format.Write(result, filepath.Join(dir, "sitemap.xml")); err != nil {
+		t.Fatalf("sitemap writer failed: %v", err)
+	}
+
+	index, _ := os.ReadFile(filepath.Join(dir, "sitemap.xml"))
+	if !bytes.Contains(index, []byte("<sitemapindex")) ||
+		!bytes.Contains(index, []byte("<loc>https://example.com/sitemap-1.xml</loc>")) ||
+		!bytes.Contains(index, []byte("<loc>https://example.com/sitemap-2.xml</loc>")) {
+		t.Errorf("Expected a sitemap index with two parts, got %s", index)
+	}
+
+	second, _ := os.ReadFile(filepath.Join(dir, "sitemap-2.xml"))
+	if got := bytes.Count(second, []byte("<url>")); got != 1 {
+		t.Errorf("Expected 1 URL in the second sitemap, got %d", got)
+	}
+}
+
+func TestSitemap_KeepsFilesUnderTheByteLimitAndToTheSeedHost(t *testing.T) {
+	result := &output.Result{Seeds: []string{"https://example.com"}, FinishedAt: time.Now()}
+	long := strings.Repeat("a", 4000)
+	for i := 0; i < 14000; i++ {
+		result.Pages = append(result.Pages, output.Record{URL: fmt.Sprintf("https://example.com/%s/%d", long, i), Status: 200})
+	}
+	result.Pages = append(result.Pages, output.Record{URL: "https://other.com/", Status: 200})
+
+	dir := t.TempDir()
+	format, _ := output.Lookup("sitemap")
+	if err := format.Write(result, filepath.Join(dir, "sitemap.xml")); err != nil {
+		t.Fatalf("sitemap writer failed: %v", err)
+	}
+
+	urls := 0
+	for _, part := range []string{"sitemap-1.xml", "sitemap-2.xml"} {
+		data, err := os.ReadFile(filepath.Join(dir, part))
+		if err != nil {
+			t.Fatalf("Expected %s: %v", part, err)
+		}
+		if len(data) > output.MaxSitemapBytes {
+			t.Errorf("Expected %s to be at most %d bytes, got %d", part, output.MaxSitemapBytes, len(data))
+		}
+		if bytes.Contains(data, []byte("other.com")) {
+			t.Errorf("Expected %s to leave out pages on other hosts", part)
+		}
+		urls += bytes.Count(data, []byte("<url>"))
+	}
+	if urls != 14000 {
+		t.Errorf("Expected 14000 URLs across both sitemaps, got %d", urls)
+	}
+}
+
+func TestMergeResult_KeepsPagesTheCrawlDidNotReach(t *testing.T) {
+	previous := &output.Result{Pages: []output.Record{
+		{URL: "https://example.com/", Status: 200, ETag: `"old"`},
+		{URL: "https://example.com/about", Status: 200, ETag: `"about"`},
+	}}
+	result := &output.Result{
+		URLs:      map[string]bool{"https://example.com/": true},
+		Pages:     []output.Record{{URL: "https://example.com/", Status: 200, ETag: `"new"`}},
+		StoppedBy: "max_pages",
+	}
+
+	merged := output.MergeResult(previous, result)
+	if len(merged.Pages) != 2 || merged.Pages[0].ETag != `"new"` || merged.Pages[1].ETag != `"about"` || !merged.URLs["https://example.com/about"] {
+		t.Errorf("Expected the new page and the previous run's other page, got %+v", merged.Pages)
+	}
+	if len(result.Pages) != 1 || result.URLs["https://example.com/about"] {
+		t.Errorf("Expected the result to be left alone, got %+v", result)
+	}
+	if output.MergeResult(nil, result) != result {
+		t.Errorf("Expected the result itself without a previous run")
+	}
+}
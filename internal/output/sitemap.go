@@ -0,0 +1,184 @@
+package output
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxSitemapURLs and MaxSitemapBytes are the most URLs and uncompressed bytes a single sitemap
+// file may hold under the sitemaps.org protocol. Larger crawls are split into several sitemaps
+// referenced from a sitemap index.
+const (
+	MaxSitemapURLs  = 50000
+	MaxSitemapBytes = 50 << 20
+)
+
+const sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+func init() {
+	Register(Format{Name: "sitemap", Extension: ".xml", Write: writeSitemap})
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type urlSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapRef struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	Xmlns    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapRef `xml:"sitemap"`
+}
+
+// writeSitemap writes path as a plain sitemap when the crawl fits in one file. Otherwise
+// path becomes a sitemap index and the URLs go to path-1.xml, path-2.xml and so on. Index entries
+// point at the same directory on the first seed's host, where the files are expected to be served.
+// Since a sitemap may only list URLs on its own host, pages on other hosts are left out.
+func writeSitemap(result *Result, path string) error {
+	base, err := sitemapBase(result)
+	if err != nil {
+		return err
+	}
+	entries := sitemapEntries(result, base)
+	parts := splitSitemap(entries, MaxSitemapURLs, MaxSitemapBytes)
+	if len(parts) <= 1 {
+		return writeXML(path, urlSet{Xmlns: sitemapNamespace, URLs: entries})
+	}
+	if base == nil {
+		return fmt.Errorf("sitemap index needs a seed URL to build sitemap locations")
+	}
+
+	stem := strings.TrimSuffix(path, filepath.Ext(path))
+	index := sitemapIndex{Xmlns: sitemapNamespace}
+	lastMod := result.FinishedAt.UTC().Format(time.RFC3339)
+
+	for i, part := range parts {
+		partPath := fmt.Sprintf("%s-%d.xml", stem, i+1)
+		if err := writeXML(partPath, urlSet{Xmlns: sitemapNamespace, URLs: part}); err != nil {
+			return err
+		}
+
+		loc := base.ResolveReference(&url.URL{Path: filepath.Base(partPath)})
+		index.Sitemaps = append(index.Sitemaps, sitemapRef{Loc: loc.String(), LastMod: lastMod})
+	}
+
+	return writeXML(path, index)
+}
+
+// splitSitemap cuts entries into parts of at most maxURLs entries that each encode to at most
+// maxBytes, as writeXML writes them.
+func splitSitemap(entries []sitemapURL, maxURLs, maxBytes int) [][]sitemapURL {
+	empty, _ := xml.MarshalIndent(urlSet{Xmlns: sitemapNamespace}, "", "  ")
+	overhead := len(xml.Header) + len(empty) + len("\n")
+
+	var parts [][]sitemapURL
+	start, size := 0, overhead
+	for i, entry := range entries {
+		encoded, _ := xml.MarshalIndent(struct {
+			XMLName xml.Name `xml:"url"`
+			sitemapURL
+		}{sitemapURL: entry}, "  ", "  ")
+		entrySize := len(encoded) + len("\n")
+		if i > start && (i-start >= maxURLs || size+entrySize > maxBytes) {
+			parts = append(parts, entries[start:i])
+			start, size = i, overhead
+		}
+		size += entrySize
+	}
+	if start < len(entries) {
+		parts = append(parts, entries[start:])
+	}
+	return parts
+}
+
+// sitemapEntries lists successfully crawled pages on the host of base, or on any host if base
+// is nil, with their Last-Modified time if the server sent one. Failed pages never belong in a
+// sitemap.
+func sitemapEntries(result *Result, base *url.URL) []sitemapURL {
+	onHost := func(loc string) bool {
+		if base == nil {
+			return true
+		}
+		u, err := url.Parse(loc)
+		return err == nil && strings.EqualFold(u.Host, base.Host)
+	}
+
+	var entries []sitemapURL
+	if len(result.Pages) == 0 {
+		for loc, crawled := range result.URLs {
+			if crawled && onHost(loc) {
+				entries = append(entries, sitemapURL{Loc: loc})
+			}
+		}
+	}
+	for _, page := range result.Pages {
+		if page.Error != "" || page.Status >= 300 || !onHost(page.URL) {
+			continue
+		}
+		entry := sitemapURL{Loc: page.URL}
+		// lastmod is when the page last changed, which only the server's Last-Modified tells.
+		if modified, err := http.ParseTime(page.LastModified); err == nil {
+			entry.LastMod = modified.UTC().Format(time.RFC3339)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Loc < entries[j].Loc })
+	return entries
+}
+
+// sitemapBase returns the root of the first seed's host, or nil if the crawl has no seeds.
+func sitemapBase(result *Result) (*url.URL, error) {
+	if len(result.Seeds) == 0 {
+		return nil, nil
+	}
+	seed, err := url.Parse(result.Seeds[0])
+	if err != nil {
+		return nil, err
+	}
+	if seed.Scheme == "" {
+		seed, err = url.Parse("https://" + result.Seeds[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &url.URL{Scheme: seed.Scheme, Host: seed.Host, Path: "/"}, nil
+}
+
+func writeXML(path string, v interface{}) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(file)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return err
+	}
+	if _, err := file.WriteString("\n"); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,79 @@
+package output
+
+import (
+	"database/sql"
+	"os"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	Register(Format{Name: "sqlite", Extension: ".db", Write: writeSQLite})
+}
+
+const sqliteSchema = `
+CREATE TABLE pages (
+	url         TEXT PRIMARY KEY,
+	depth       INTEGER NOT NULL,
+	status      INTEGER NOT NULL,
+	error       TEXT NOT NULL DEFAULT '',
+	fetched_at  TEXT NOT NULL,
+	duration_ms REAL NOT NULL DEFAULT 0
+);
+CREATE TABLE links (
+	source TEXT NOT NULL REFERENCES pages(url),
+	target TEXT NOT NULL,
+	PRIMARY KEY (source, target)
+);
+CREATE INDEX links_target ON links(target);
+`
+
+// writeSQLite writes a fresh database with a pages table and a links table of source/target pairs.
+func writeSQLite(result *Result, path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	pageStmt, err := tx.Prepare(`INSERT OR REPLACE INTO pages (url, depth, status, error, fetched_at, duration_ms) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer pageStmt.Close()
+
+	linkStmt, err := tx.Prepare(`INSERT OR IGNORE INTO links (source, target) VALUES (?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer linkStmt.Close()
+
+	for _, page := range result.Pages {
+		_, err := pageStmt.Exec(page.URL, page.Depth, page.Status, page.Error, page.FetchedAt.UTC().Format(time.RFC3339Nano), page.Duration)
+		if err != nil {
+			return err
+		}
+		for _, link := range page.Links {
+			if _, err := linkStmt.Exec(page.URL, link); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
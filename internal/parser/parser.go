@@ -1,18 +1,39 @@
 package parser
 
 import (
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/metrics"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shared"
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
 	"net/url"
 	"strings"
 )
 
-type Parser struct{}
+type Parser struct {
+	includeSubdomains bool
+	metrics           *metrics.Crawl
+	onSkip            func(link string, reason string)
+}
 
 func NewParser() *Parser {
 	return &Parser{}
 }
 
+// NewParserWithSubdomains returns a Parser that also treats subdomains of the base host
+// (e.g. community.monzo.com for monzo.com) as internal.
+func NewParserWithSubdomains() *Parser {
+	return &Parser{includeSubdomains: true}
+}
+
+// SetMetrics counts links rejected by CheckInternal in m, by reason.
+func (p *Parser) SetMetrics(m *metrics.Crawl) {
+	p.metrics = m
+}
+
+// SetSkipHandler calls handler for every link rejected by CheckInternal, with the reason.
+func (p *Parser) SetSkipHandler(handler func(link string, reason string)) {
+	p.onSkip = handler
+}
+
 // CheckInternal filters and extracts internal URLs from a given set of links.
 // It determines whether a link belongs to the same domain as the base URL and avoids recursive paths.
 //
@@ -48,12 +69,12 @@ func (p *Parser) CheckInternal(base string, links map[string]bool, logger *utils
 
 	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
 		base = "https://" + base
-		logger.Info.Printf("Base URL missing scheme, added default scheme: %s\n", base)
+		logger.Debug("Base URL missing scheme, added default scheme", "url", base)
 	}
 
 	baseURL, err := url.Parse(base)
 	if err != nil {
-		logger.Error.Println("Error parsing base URL:", err)
+		logger.Error("Error parsing base URL", "url", base, "error", err)
 		return internalUrls
 	}
 
@@ -62,33 +83,57 @@ func (p *Parser) CheckInternal(base string, links map[string]bool, logger *utils
 	for link := range links {
 		cleanedLink, err := utils.NormalizeURL(strings.TrimSpace(link), parentURL)
 		if err != nil {
-			logger.Error.Printf("[MALFORMED] Skipping malformed URL: %s, Error: %v\n", link, err)
+			logger.Debug("Skipping malformed URL", "url", link, "reason", "malformed", "error", err)
+			p.skip(link, metrics.SkipMalformed)
 			continue
 		}
 
 		parsedLink, err := url.Parse(cleanedLink)
 
 		if err != nil {
-			logger.Error.Printf("[PARSING ERROR] Error parsing URL: %s, Error: %v\n", cleanedLink, err)
+			logger.Debug("Skipping unparsable URL", "url", cleanedLink, "reason", "malformed", "error", err)
+			p.skip(cleanedLink, metrics.SkipMalformed)
 			continue
 		}
 
-		if parsedLink.Hostname() != baseHostname {
-			logger.Info.Println("[EXTERNAL] Ignored external URL:", cleanedLink)
+		if !p.isInternalHost(parsedLink.Hostname(), baseHostname) {
+			logger.Debug("Ignoring external URL", "url", cleanedLink, "reason", "external")
+			p.skip(cleanedLink, metrics.SkipExternal)
 			continue
 		}
 
+		// Paths on the base host are tracked as-is; other hosts are prefixed so
+		// that /about on two subdomains is not treated as the same page.
 		path := parsedLink.Path
+		if parsedLink.Hostname() != baseHostname {
+			path = parsedLink.Hostname() + path
+		}
 		if used.IsVisitedPath(path) {
-			logger.Info.Printf("[ALREADY VISITED] Ignoring already visited path: %s\n", cleanedLink)
+			logger.Debug("Ignoring already visited path", "url", cleanedLink, "reason", "visited")
+			p.skip(cleanedLink, metrics.SkipVisited)
 			continue
 		}
 
 		used.AddVisitedPath(path)
 
 		internalUrls = append(internalUrls, cleanedLink)
-		logger.Info.Println("Added internal URL:", cleanedLink)
+		logger.Debug("Added internal URL", "url", cleanedLink)
 	}
 
 	return internalUrls
 }
+
+func (p *Parser) skip(link string, reason string) {
+	p.metrics.Skip(reason)
+	if p.onSkip != nil {
+		p.onSkip(link, reason)
+	}
+}
+
+// isInternalHost reports whether host belongs to the crawl rooted at baseHost.
+func (p *Parser) isInternalHost(host string, baseHost string) bool {
+	if host == baseHost {
+		return true
+	}
+	return p.includeSubdomains && strings.HasSuffix(host, "."+baseHost)
+}
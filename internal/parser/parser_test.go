@@ -121,3 +121,29 @@ func TestCheckInternal(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckInternal_Subdomains(t *testing.T) {
+	setup()
+	links := map[string]bool{
+		"https://example.com/about":      true,
+		"https://blog.example.com/about": true,
+		"https://notexample.com/about":   true,
+		"https://external.com/about":     true,
+	}
+
+	t.Run("Subdomains Excluded By Default", func(t *testing.T) {
+		used := &shared.UsedURL{CrawledURLs: map[string]bool{}, VisitedPaths: map[string]bool{}}
+		internalLinks := parserInstance.CheckInternal("https://example.com", links, logger, "https://example.com", used)
+		if len(internalLinks) != 1 {
+			t.Errorf("Expected 1 internal link, got %v", internalLinks)
+		}
+	})
+
+	t.Run("Subdomains Included", func(t *testing.T) {
+		used := &shared.UsedURL{CrawledURLs: map[string]bool{}, VisitedPaths: map[string]bool{}}
+		internalLinks := parser.NewParserWithSubdomains().CheckInternal("https://example.com", links, logger, "https://example.com", used)
+		if len(internalLinks) != 2 {
+			t.Errorf("Expected 2 internal links, got %v", internalLinks)
+		}
+	})
+}
@@ -0,0 +1,197 @@
+// Package progress renders a live view of a running crawl from the crawler's event stream.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/crawler"
+)
+
+// slowestHosts is how many hosts the progress line lists by average fetch time.
+const slowestHosts = 3
+
+// DefaultInterval is how often progress is rendered.
+const DefaultInterval = time.Second
+
+type hostStats struct {
+	fetches int
+	total   time.Duration
+}
+
+// Reporter counts crawl events and periodically writes a progress line. On a terminal the line is
+// redrawn in place; otherwise a new line is written each interval so logs stay readable.
+type Reporter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	tty      bool
+	interval time.Duration
+	started  time.Time
+	queued   int
+	pending  map[string]int
+	done     int
+	failed   int
+	hosts    map[string]*hostStats
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewReporter returns a reporter writing to w every interval. Set tty when w is a terminal.
+func NewReporter(w io.Writer, interval time.Duration, tty bool) *Reporter {
+	return &Reporter{
+		w:        w,
+		tty:      tty,
+		interval: interval,
+		started:  time.Now(),
+		pending:  make(map[string]int),
+		hosts:    make(map[string]*hostStats),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// IsTerminal reports whether f is attached to a terminal.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Handle is a crawler.EventHandler.
+func (r *Reporter) Handle(event crawler.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch event.Type {
+	case crawler.EventQueued:
+		r.queued++
+		r.pending[event.URL]++
+		return
+	case crawler.EventFetched:
+		r.done++
+	case crawler.EventFailed:
+		r.failed++
+	case crawler.EventSkipped:
+		// URLs can be skipped after they were queued, once the crawl stops or a budget runs out.
+		r.dequeue(event.URL)
+		return
+	default:
+		return
+	}
+	r.dequeue(event.URL)
+
+	if u, err := url.Parse(event.URL); err == nil && event.Duration > 0 {
+		stats, ok := r.hosts[u.Host]
+		if !ok {
+			stats = &hostStats{}
+			r.hosts[u.Host] = stats
+		}
+		stats.fetches++
+		stats.total += event.Duration
+	}
+}
+
+// dequeue takes url off the queue if it was counted as queued. Callers must hold r.mu.
+func (r *Reporter) dequeue(url string) {
+	if r.pending[url] == 0 {
+		return
+	}
+	r.pending[url]--
+	if r.pending[url] == 0 {
+		delete(r.pending, url)
+	}
+	r.queued--
+}
+
+// Start renders progress every interval until Stop is called.
+func (r *Reporter) Start() {
+	go func() {
+		defer close(r.stopped)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.render(false)
+			}
+		}
+	}()
+}
+
+// Stop renders the final state and ends the progress line.
+func (r *Reporter) Stop() {
+	close(r.stop)
+	<-r.stopped
+	r.render(true)
+}
+
+// Line returns the current progress line.
+func (r *Reporter) Line() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	elapsed := time.Since(r.started)
+	finished := r.done + r.failed
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(finished) / elapsed.Seconds()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d done, %d queued, %d failed | %.1f pages/s", r.done, r.queued, r.failed, rate)
+	if rate > 0 && r.queued > 0 {
+		eta := time.Duration(float64(r.queued) / rate * float64(time.Second))
+		fmt.Fprintf(&b, " | ETA %s", eta.Round(time.Second))
+	}
+	if slowest := r.slowest(); len(slowest) > 0 {
+		fmt.Fprintf(&b, " | slowest: %s", strings.Join(slowest, ", "))
+	}
+	return b.String()
+}
+
+// slowest lists the hosts with the highest average fetch time. Callers must hold r.mu.
+func (r *Reporter) slowest() []string {
+	type hostAverage struct {
+		host    string
+		average time.Duration
+	}
+	averages := make([]hostAverage, 0, len(r.hosts))
+	for host, stats := range r.hosts {
+		averages = append(averages, hostAverage{host, stats.total / time.Duration(stats.fetches)})
+	}
+	sort.Slice(averages, func(i, j int) bool {
+		if averages[i].average != averages[j].average {
+			return averages[i].average > averages[j].average
+		}
+		return averages[i].host < averages[j].host
+	})
+	if len(averages) > slowestHosts {
+		averages = averages[:slowestHosts]
+	}
+
+	slowest := make([]string, len(averages))
+	for i, a := range averages {
+		slowest[i] = fmt.Sprintf("%s %s", a.host, a.average.Round(time.Millisecond))
+	}
+	return slowest
+}
+
+func (r *Reporter) render(final bool) {
+	line := r.Line()
+	if !r.tty {
+		fmt.Fprintln(r.w, line)
+		return
+	}
+	// Return to the start of the line and clear it before redrawing.
+	fmt.Fprintf(r.w, "\r\033[K%s", line)
+	if final {
+		fmt.Fprintln(r.w)
+	}
+}
@@ -0,0 +1,62 @@
+package progress_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/crawler"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/progress"
+)
+
+func feed(r *progress.Reporter) {
+	for _, u := range []string{"https://monzo.com", "https://monzo.com/about", "https://slow.monzo.com", "https://monzo.com/gone"} {
+		r.Handle(crawler.Event{Type: crawler.EventQueued, URL: u})
+	}
+	r.Handle(crawler.Event{Type: crawler.EventFetched, URL: "https://monzo.com", Status: 200, Duration: 100 * time.Millisecond})
+	r.Handle(crawler.Event{Type: crawler.EventFetched, URL: "https://slow.monzo.com", Status: 200, Duration: 900 * time.Millisecond})
+	r.Handle(crawler.Event{Type: crawler.EventFailed, URL: "https://monzo.com/gone", Status: 404, Duration: 50 * time.Millisecond, Err: errors.New("404 Not Found")})
+}
+
+func TestReporter_Line(t *testing.T) {
+	r := progress.NewReporter(&bytes.Buffer{}, time.Hour, false)
+	feed(r)
+
+	line := r.Line()
+	if !strings.HasPrefix(line, "2 done, 1 queued, 1 failed | ") {
+		t.Errorf("Unexpected counts in %q", line)
+	}
+	if !strings.Contains(line, "ETA ") || !strings.Contains(line, "slowest: slow.monzo.com 900ms, monzo.com 75ms") {
+		t.Errorf("Expected ETA and slowest hosts in %q", line)
+	}
+
+	// Only skips of queued URLs, such as those left when the crawl stops, shorten the queue.
+	r.Handle(crawler.Event{Type: crawler.EventSkipped, URL: "https://monzo.com", Reason: "duplicate"})
+	r.Handle(crawler.Event{Type: crawler.EventSkipped, URL: "https://monzo.com/about", Reason: "stopped"})
+	if line := r.Line(); !strings.HasPrefix(line, "2 done, 0 queued, 1 failed | ") {
+		t.Errorf("Expected skipped URLs to leave the queue, got %q", line)
+	}
+}
+
+func TestReporter_RendersInPlaceOnTerminal(t *testing.T) {
+	var tty, plain bytes.Buffer
+	for _, c := range []struct {
+		buf *bytes.Buffer
+		tty bool
+	}{{&tty, true}, {&plain, false}} {
+		r := progress.NewReporter(c.buf, 5*time.Millisecond, c.tty)
+		feed(r)
+		r.Start()
+		time.Sleep(20 * time.Millisecond)
+		r.Stop()
+	}
+
+	if !strings.Contains(tty.String(), "\r\033[K") || strings.Count(tty.String(), "\n") != 1 {
+		t.Errorf("Expected in-place updates ending in one newline, got %q", tty.String())
+	}
+	if strings.Contains(plain.String(), "\033[") || strings.Count(plain.String(), "\n") < 2 {
+		t.Errorf("Expected plain periodic lines, got %q", plain.String())
+	}
+}
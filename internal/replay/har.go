@@ -0,0 +1,77 @@
+package replay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// harFile covers the parts of the HAR 1.2 format needed to replay responses.
+type harFile struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	Request struct {
+		URL string `json:"url"`
+	} `json:"request"`
+	Response struct {
+		Status      int    `json:"status"`
+		HTTPVersion string `json:"httpVersion"`
+		Headers     []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"headers"`
+		Content struct {
+			Text     string `json:"text"`
+			Encoding string `json:"encoding"`
+		} `json:"content"`
+	} `json:"response"`
+}
+
+// LoadHAR adds every entry in a HAR file, as exported by browser developer tools, to the archive.
+// Entries without a response, which browsers record for blocked or aborted requests, are skipped.
+func (a *Archive) LoadHAR(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		return err
+	}
+
+	for _, entry := range har.Log.Entries {
+		if entry.Response.Status == 0 {
+			continue
+		}
+
+		header := make(http.Header)
+		for _, h := range entry.Response.Headers {
+			header.Add(h.Name, h.Value)
+		}
+		// The stored text is already decoded, so drop framing headers that no longer describe it.
+		header.Del("Content-Encoding")
+		header.Del("Content-Length")
+		header.Del("Transfer-Encoding")
+
+		body := []byte(entry.Response.Content.Text)
+		if entry.Response.Content.Encoding == "base64" {
+			if body, err = base64.StdEncoding.DecodeString(entry.Response.Content.Text); err != nil {
+				return fmt.Errorf("entry %s: %w", entry.Request.URL, err)
+			}
+		}
+
+		proto := entry.Response.HTTPVersion
+		if _, _, ok := http.ParseHTTPVersion(proto); !ok {
+			proto = "HTTP/1.1"
+		}
+		a.add(entry.Request.URL, &response{status: entry.Response.Status, proto: proto, header: header, body: body})
+	}
+	return nil
+}
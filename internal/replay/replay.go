@@ -0,0 +1,168 @@
+// Package replay serves archived responses in place of the network, so a crawl can be re-run
+// offline from WARC or HAR files with exactly the responses that were originally received.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/warc"
+)
+
+// NotInArchiveError reports a request for a URL the archive has no response for.
+// It matches fetcher.ErrNotInArchive with errors.Is, so the fetcher does not retry it.
+type NotInArchiveError struct {
+	URL string
+}
+
+func (e *NotInArchiveError) Error() string {
+	return fmt.Sprintf("%s: %v", e.URL, fetcher.ErrNotInArchive)
+}
+
+func (e *NotInArchiveError) Unwrap() error {
+	return fetcher.ErrNotInArchive
+}
+
+type response struct {
+	status int
+	proto  string
+	header http.Header
+	body   []byte
+}
+
+// Archive holds archived responses by URL and replays them as an http.RoundTripper.
+// When a URL was captured more than once, the last capture wins, matching the final retry.
+type Archive struct {
+	mu        sync.RWMutex
+	responses map[string]*response
+}
+
+var _ fetcher.Replayer = (*Archive)(nil)
+
+// NewArchive returns an empty archive.
+func NewArchive() *Archive {
+	return &Archive{responses: make(map[string]*response)}
+}
+
+// Load reads every file into one archive. Files ending in .har are read as HAR, anything else as WARC.
+func Load(paths ...string) (*Archive, error) {
+	archive := NewArchive()
+	for _, path := range paths {
+		var err error
+		if strings.EqualFold(filepath.Ext(path), ".har") {
+			err = archive.LoadHAR(path)
+		} else {
+			err = archive.LoadWARC(path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", path, err)
+		}
+	}
+	return archive, nil
+}
+
+// Add stores a response for rawURL, replacing any earlier one.
+func (a *Archive) Add(rawURL string, status int, header http.Header, body []byte) {
+	a.add(rawURL, &response{status: status, proto: "HTTP/1.1", header: header, body: body})
+}
+
+func (a *Archive) add(rawURL string, res *response) {
+	if res.header == nil {
+		res.header = make(http.Header)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.responses[rawURL] = res
+	if key, err := utils.NormalizeURL(rawURL, rawURL); err == nil {
+		a.responses[key] = res
+	}
+}
+
+// Len returns the number of URLs, including normalized aliases, the archive can answer.
+func (a *Archive) Len() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.responses)
+}
+
+// LoadWARC adds every response record in a WARC file to the archive.
+func (a *Archive) LoadWARC(path string) error {
+	reader, err := warc.Open(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record.Type() != warc.TypeResponse {
+			continue
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(record.Content)), nil)
+		if err != nil {
+			return fmt.Errorf("record %s: %w", record.ID(), err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("record %s: %w", record.ID(), err)
+		}
+		a.add(record.TargetURI(), &response{status: res.StatusCode, proto: res.Proto, header: res.Header, body: body})
+	}
+}
+
+// Replays reports that the archive answers from recorded responses, so the fetcher does not
+// retry them.
+func (a *Archive) Replays() bool {
+	return true
+}
+
+// RoundTrip answers the request from the archive, or fails with a *NotInArchiveError.
+func (a *Archive) RoundTrip(req *http.Request) (*http.Response, error) {
+	rawURL := req.URL.String()
+
+	a.mu.RLock()
+	res, ok := a.responses[rawURL]
+	if !ok {
+		if key, err := utils.NormalizeURL(rawURL, rawURL); err == nil {
+			res, ok = a.responses[key]
+		}
+	}
+	a.mu.RUnlock()
+
+	if !ok {
+		return nil, &NotInArchiveError{URL: rawURL}
+	}
+
+	proto := res.proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	major, minor, _ := http.ParseHTTPVersion(proto)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", res.status, http.StatusText(res.status)),
+		StatusCode:    res.status,
+		Proto:         proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        res.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(res.body)),
+		ContentLength: int64(len(res.body)),
+		Request:       req,
+	}, nil
+}
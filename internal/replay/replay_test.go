@@ -0,0 +1,92 @@
+package replay_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/replay"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/warc"
+)
+
+func TestArchive_ReplaysWARCWithoutNetwork(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<a href="/pricing">Pricing</a>`))
+	}))
+	logger := utils.NewLogger()
+
+	writer, err := warc.NewWriter(t.TempDir(), "crawl", 0)
+	if err != nil {
+		t.Fatalf("NewWriter failed: %v", err)
+	}
+	live := fetcher.NewFetcher(time.Second)
+	live.SetArchiver(writer)
+	if _, err := live.Fetch(ts.URL, logger); err != nil {
+		t.Fatalf("Live fetch failed: %v", err)
+	}
+	writer.Close()
+	ts.Close()
+
+	archive, err := replay.Load(writer.Files()...)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	offline := fetcher.NewFetcher(time.Second)
+	offline.SetTransport(archive)
+
+	links, err := offline.FetchLinks(ts.URL, logger)
+	if err != nil || !links["/pricing"] {
+		t.Fatalf("Expected replayed links, got %v, %v", links, err)
+	}
+
+	_, err = offline.FetchLinks(ts.URL+"/missing", logger)
+	var miss *replay.NotInArchiveError
+	if !errors.As(err, &miss) || !errors.Is(err, fetcher.ErrNotInArchive) || miss.URL != ts.URL+"/missing" {
+		t.Errorf("Expected a NotInArchiveError for the miss, got %v", err)
+	}
+}
+
+func TestArchive_AddMatchesNormalizedURLs(t *testing.T) {
+	archive := replay.NewArchive()
+	archive.Add("http://example.com/about/", http.StatusOK, nil, []byte("about"))
+
+	req, _ := http.NewRequest("GET", "https://example.com/about", nil)
+	res, err := archive.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected normalized lookup to hit, got %v, %v", res, err)
+	}
+}
+
+type countingArchiver struct {
+	exchanges int
+}
+
+func (a *countingArchiver) Archive(exchange *fetcher.Exchange) error {
+	a.exchanges++
+	return nil
+}
+
+func TestArchive_ReplayedErrorsAreNotRetried(t *testing.T) {
+	archive := replay.NewArchive()
+	archive.Add("https://example.com/down", http.StatusServiceUnavailable, nil, []byte("down"))
+
+	offline := fetcher.NewFetcher(time.Second)
+	offline.SetTransport(archive)
+	attempts := &countingArchiver{}
+	offline.SetArchiver(attempts)
+
+	start := time.Now()
+	if _, err := offline.Fetch("https://example.com/down", utils.NewLogger()); err == nil {
+		t.Fatal("Expected the replayed 503 to fail the fetch")
+	}
+	if attempts.exchanges != 1 {
+		t.Errorf("Expected a single attempt, got %d", attempts.exchanges)
+	}
+	if elapsed := time.Since(start); elapsed >= fetcher.InitialRetryDelay {
+		t.Errorf("Expected no retry delay, took %v", elapsed)
+	}
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/config"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+)
+
+// SubmitRequest is the body of POST /jobs. Config uses the same settings as a -config file, in
+// JSON; settings left out keep their defaults, and Profile is applied on top of them.
+type SubmitRequest struct {
+	Name    string          `json:"name,omitempty"`
+	Profile string          `json:"profile,omitempty"`
+	Config  json.RawMessage `json:"config"`
+}
+
+// ScheduleRequest is the body of POST /schedules: a job to submit every time Cron fires.
+type ScheduleRequest struct {
+	SubmitRequest
+	Cron   string          `json:"cron"`
+	Jitter config.Duration `json:"jitter,omitempty"`
+	Retain int             `json:"retain,omitempty"`
+}
+
+// ScheduleStatus is a schedule with its kept runs, newest first.
+type ScheduleStatus struct {
+	Schedule
+	Runs []Job `json:"runs"`
+}
+
+// Handler exposes the manager as a REST API:
+//
+//	POST   /jobs                      submit a job (SubmitRequest), returns the Job
+//	GET    /jobs                      list jobs, newest first
+//	GET    /jobs/{id}                 a job with its live stats
+//	POST   /jobs/{id}/cancel          cancel a queued or running job
+//	DELETE /jobs/{id}                 delete a finished job and its result
+//	GET    /jobs/{id}/results?format= download the result in any output format (default json)
+//	POST   /schedules                 add a schedule (ScheduleRequest), returns the Schedule
+//	GET    /schedules                 list schedules
+//	GET    /schedules/{id}            a schedule with its run history (ScheduleStatus)
+//	DELETE /schedules/{id}            stop a schedule
+func (m *Manager) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /jobs", func(w http.ResponseWriter, r *http.Request) {
+		var req SubmitRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "malformed job: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg, err := req.config()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		job, err := m.Submit(req.Name, req.Profile, cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, job)
+	})
+
+	mux.HandleFunc("GET /jobs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.List())
+	})
+
+	mux.HandleFunc("GET /jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		job, err := m.Get(r.PathValue("id"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, job)
+	})
+
+	mux.HandleFunc("POST /jobs/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := m.Cancel(id); err != nil {
+			writeError(w, err)
+			return
+		}
+		job, err := m.Get(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, job)
+	})
+
+	mux.HandleFunc("DELETE /jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := m.Delete(r.PathValue("id")); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /jobs/{id}/results", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("format")
+		if name == "" {
+			name = "json"
+		}
+		format, ok := output.Lookup(name)
+		if !ok {
+			http.Error(w, "unknown output format "+name, http.StatusBadRequest)
+			return
+		}
+		id := r.PathValue("id")
+		result, err := m.Result(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := serveResult(w, result, format, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	mux.HandleFunc("POST /schedules", func(w http.ResponseWriter, r *http.Request) {
+		var req ScheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "malformed schedule: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg, err := req.config()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		schedule, err := m.AddSchedule(Schedule{
+			Name:    req.Name,
+			Cron:    req.Cron,
+			Jitter:  req.Jitter,
+			Retain:  req.Retain,
+			Profile: req.Profile,
+			Config:  cfg,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", "/schedules/"+schedule.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, schedule)
+	})
+
+	mux.HandleFunc("GET /schedules", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Schedules())
+	})
+
+	mux.HandleFunc("GET /schedules/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		schedule, err := m.GetSchedule(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, ScheduleStatus{Schedule: schedule, Runs: m.Runs(id)})
+	})
+
+	mux.HandleFunc("DELETE /schedules/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := m.RemoveSchedule(r.PathValue("id")); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
+
+// RequireToken only lets requests through to next if they carry token as a bearer token in their
+// Authorization header.
+func RequireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="crawler"`)
+			http.Error(w, "missing or wrong API token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// config decodes the request's settings on top of the defaults and its profile.
+func (req SubmitRequest) config() (config.Config, error) {
+	if len(req.Config) == 0 {
+		req.Config = json.RawMessage("{}")
+	}
+	return config.Decode(req.Config, "json", req.Profile)
+}
+
+// serveResult writes result in format to a temporary file, since formats such as sqlite can
+// only write files, and sends it as an attachment.
+func serveResult(w http.ResponseWriter, result *output.Result, format output.Format, id string) error {
+	dir, err := os.MkdirTemp("", "crawler-result-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, id+format.Extension)
+	if err := format.Write(result, path); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	contentType := mime.TypeByExtension(format.Extension)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(path)}))
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrFinished), errors.Is(err, ErrNotFinished), errors.Is(err, ErrNoResult):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrShutdown):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,75 @@
+// Package service runs crawl jobs on demand for the `serve` subcommand. Each job crawls with its
+// own settings, metrics and results; job metadata and results are kept on disk so they survive
+// a restart.
+package service
+
+import (
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/config"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/metrics"
+)
+
+// State is where a job is in its life cycle.
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+	StateCanceled  State = "canceled"
+)
+
+// Finished reports whether a job in this state will not change again.
+func (s State) Finished() bool {
+	return s == StateSucceeded || s == StateFailed || s == StateCanceled
+}
+
+// Job is one crawl submitted to the service.
+type Job struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Profile string `json:"profile,omitempty"`
+	// Schedule is the ID of the schedule that submitted the job, if any.
+	Schedule   string        `json:"schedule,omitempty"`
+	Config     config.Config `json:"config"`
+	State      State         `json:"state"`
+	Error      string        `json:"error,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	StartedAt  *time.Time    `json:"started_at,omitempty"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+	Stats      Stats         `json:"stats"`
+}
+
+// Stats are a job's crawl statistics, updated live while it runs.
+type Stats struct {
+	Pages    uint64            `json:"pages"`
+	Failed   uint64            `json:"failed"`
+	Skipped  uint64            `json:"skipped"`
+	Bytes    uint64            `json:"bytes"`
+	Requests uint64            `json:"requests"`
+	Retries  uint64            `json:"retries"`
+	Queued   int64             `json:"queued"`
+	InFlight int64             `json:"in_flight"`
+	Elapsed  float64           `json:"elapsed_seconds"`
+	ByClass  map[string]uint64 `json:"by_class,omitempty"`
+}
+
+func newStats(summary metrics.Summary) Stats {
+	stats := Stats{
+		Pages:    summary.Total(),
+		Failed:   summary.Pages["4xx"] + summary.Pages["5xx"] + summary.Pages["error"],
+		Bytes:    summary.Bytes,
+		Requests: summary.Requests,
+		Retries:  summary.Retries,
+		Queued:   summary.Frontier,
+		InFlight: summary.InFlight,
+		Elapsed:  summary.Elapsed.Seconds(),
+		ByClass:  summary.Pages,
+	}
+	for _, n := range summary.Skipped {
+		stats.Skipped += n
+	}
+	return stats
+}
@@ -0,0 +1,529 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/config"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/metrics"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+	"github.com/ivan-vladimirov/monzo-web-crawler/pkg/crawler"
+)
+
+// DefaultMaxJobs is how many jobs run at once unless configured otherwise; the rest wait.
+const DefaultMaxJobs = 2
+
+var (
+	// ErrNotFound is returned for job IDs the manager does not know.
+	ErrNotFound = errors.New("job not found")
+	// ErrFinished is returned when cancelling a job that has already finished.
+	ErrFinished = errors.New("job already finished")
+	// ErrNotFinished is returned when deleting a job that is still queued or running.
+	ErrNotFinished = errors.New("job has not finished; cancel it first")
+	// ErrNoResult is returned for results of jobs that have not finished or produced none.
+	ErrNoResult = errors.New("job has no result yet")
+	// ErrShutdown is returned for jobs and schedules submitted after Shutdown.
+	ErrShutdown = errors.New("service is shutting down")
+)
+
+// Manager runs crawl jobs concurrently, each with its own crawler, and keeps their metadata and
+// results under a data directory: <dir>/<id>/job.json and <dir>/<id>/result.json. Schedules
+// that submit jobs repeatedly are kept in <dir>/schedules.json.
+type Manager struct {
+	dir       string
+	logger    *utils.Logger
+	slots     chan struct{}
+	transport http.RoundTripper
+	notifiers map[string]bool
+	secretEnv map[string]bool
+
+	mu           sync.Mutex
+	jobs         map[string]*Job
+	running      map[string]*run
+	schedules    map[string]*Schedule
+	stopSchedule map[string]context.CancelFunc
+	nextID       int
+	closed       bool
+	onFinish     []func(Job)
+	wg           sync.WaitGroup
+}
+
+// run is the live state of a job that has been started.
+type run struct {
+	cancel  context.CancelFunc
+	metrics *metrics.Crawl
+}
+
+// NewManager loads the jobs stored under dir, creating it if needed. Jobs that were queued or
+// running when the service last stopped are marked as failed, since their crawl was lost.
+func NewManager(dir string, maxJobs int, logger *utils.Logger) (*Manager, error) {
+	if maxJobs < 1 {
+		maxJobs = DefaultMaxJobs
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		dir:          dir,
+		logger:       logger,
+		slots:        make(chan struct{}, maxJobs),
+		jobs:         make(map[string]*Job),
+		running:      make(map[string]*run),
+		schedules:    make(map[string]*Schedule),
+		stopSchedule: make(map[string]context.CancelFunc),
+		notifiers:    map[string]bool{"webhook": true},
+		secretEnv:    make(map[string]bool),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name(), "job.json"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			return nil, fmt.Errorf("job %s: %w", entry.Name(), err)
+		}
+		// Jobs stored before inline secrets were rejected may still hold one.
+		changed := redactSecrets(&job.Config)
+		if !job.State.Finished() {
+			now := time.Now()
+			job.State = StateFailed
+			job.Error = "interrupted by a service restart"
+			job.FinishedAt = &now
+			changed = true
+		}
+		if changed {
+			if err := m.save(&job); err != nil {
+				return nil, err
+			}
+		}
+		m.jobs[job.ID] = &job
+	}
+	if err := m.loadSchedules(); err != nil {
+		return nil, err
+	}
+	logger.Info("Loaded stored jobs", "jobs", len(m.jobs), "schedules", len(m.schedules), "dir", dir)
+	return m, nil
+}
+
+// SetTransport makes every job send its requests through transport instead of the network.
+func (m *Manager) SetTransport(transport http.RoundTripper) {
+	m.transport = transport
+}
+
+// AllowNotifiers lets submitted jobs use the named notifiers. Only webhook is allowed by default:
+// file and exec would let anyone who can reach the API write files or run commands on the host.
+func (m *Manager) AllowNotifiers(names ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range names {
+		m.notifiers[name] = true
+	}
+}
+
+// AllowSecretEnv lets submitted webhooks read their secret from the named environment variables
+// with secret_env. No variable is allowed by default, since any other would hand the host's
+// environment to whoever can reach the API.
+func (m *Manager) AllowSecretEnv(names ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range names {
+		if name != "" {
+			m.secretEnv[name] = true
+		}
+	}
+}
+
+// OnFinish registers fn to be called with every job once it has finished, whatever its state.
+func (m *Manager) OnFinish(fn func(Job)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onFinish = append(m.onFinish, fn)
+}
+
+// Submit validates cfg and queues a crawl with it, returning the new job.
+func (m *Manager) Submit(name string, profile string, cfg config.Config) (Job, error) {
+	if err := m.validateJob(cfg); err != nil {
+		return Job{}, err
+	}
+	return m.submit(name, profile, cfg, "")
+}
+
+// validateJob checks cfg like the command line does, and also rejects the settings that read or
+// write files on the service's host, since jobs come from whoever can reach the API.
+func (m *Manager) validateJob(cfg config.Config) error {
+	var errs []error
+	if len(cfg.Fetch.Replay) > 0 {
+		errs = append(errs, errors.New("fetch.replay: not allowed in service jobs"))
+	}
+	if cfg.Fetch.CacheDir != "" {
+		errs = append(errs, errors.New("fetch.cache_dir: not allowed in service jobs"))
+	}
+	// Jobs report through the API; they may not write files on the host.
+	if cfg.Output.JSONL != "" {
+		errs = append(errs, errors.New("output.jsonl: not allowed in service jobs"))
+	}
+	if cfg.Output.WARCDir != "" {
+		errs = append(errs, errors.New("output.warc_dir: not allowed in service jobs"))
+	}
+	if cfg.Output.Mirror != "" {
+		errs = append(errs, errors.New("output.mirror: not allowed in service jobs"))
+	}
+	for _, spec := range cfg.Fetch.Middleware {
+		if name, _, _ := strings.Cut(strings.TrimSpace(spec), "?"); name == "cache" {
+			errs = append(errs, errors.New("fetch.middleware: cache is not allowed in service jobs"))
+		}
+	}
+	for _, spec := range cfg.Crawl.Scorers {
+		name, query, _ := strings.Cut(strings.TrimSpace(spec), "?")
+		params, _ := url.ParseQuery(query)
+		src := params.Get("src")
+		if name == "sitemap" && !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+			errs = append(errs, fmt.Errorf("crawl.scorers: sitemap %q must be an http or https URL in service jobs", src))
+		}
+	}
+	m.mu.Lock()
+	for _, spec := range cfg.Notify.Targets {
+		name, query, _ := strings.Cut(strings.TrimSpace(spec), "?")
+		if !m.notifiers[name] {
+			errs = append(errs, fmt.Errorf("notify.targets: %s is not allowed in service jobs", name))
+		}
+		// Jobs are stored and served as submitted, so secrets may only come from the host.
+		params, _ := url.ParseQuery(query)
+		if params.Has("secret") {
+			errs = append(errs, fmt.Errorf("notify.targets: %s secret is not allowed in service jobs; use secret_env", name))
+		}
+		if env := params.Get("secret_env"); env != "" && !m.secretEnv[env] {
+			errs = append(errs, fmt.Errorf("notify.targets: %s secret_env %s is not allowed in service jobs", name, env))
+		}
+	}
+	m.mu.Unlock()
+	// Checked before Validate, which parses the settings rejected above.
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if len(cfg.Crawl.URLs) == 0 {
+		return errors.New("crawl.urls: at least one URL is required")
+	}
+	return nil
+}
+
+// redactSecrets removes inline secrets from cfg's notify targets, reporting whether there were any.
+func redactSecrets(cfg *config.Config) bool {
+	redacted := false
+	for i, spec := range cfg.Notify.Targets {
+		name, query, ok := strings.Cut(strings.TrimSpace(spec), "?")
+		params, err := url.ParseQuery(query)
+		if !ok || err != nil || !params.Has("secret") {
+			continue
+		}
+		params.Del("secret")
+		cfg.Notify.Targets[i] = name + "?" + params.Encode()
+		redacted = true
+	}
+	return redacted
+}
+
+// submit queues a job that has been validated, as a run of schedule if it is not empty.
+func (m *Manager) submit(name string, profile string, cfg config.Config, schedule string) (Job, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return Job{}, ErrShutdown
+	}
+	m.nextID++
+	job := &Job{
+		ID:        strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.Itoa(m.nextID),
+		Name:      name,
+		Profile:   profile,
+		Schedule:  schedule,
+		Config:    cfg,
+		State:     StateQueued,
+		CreatedAt: time.Now(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	live := &run{cancel: cancel}
+	m.jobs[job.ID] = job
+	m.running[job.ID] = live
+	err := m.save(job)
+	snapshot := *job
+	m.mu.Unlock()
+	if err != nil {
+		return Job{}, err
+	}
+
+	m.wg.Add(1)
+	go m.run(ctx, job.ID, live)
+	return snapshot, nil
+}
+
+// List returns every job, newest first.
+func (m *Manager) List() []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]Job, 0, len(m.jobs))
+	for id := range m.jobs {
+		jobs = append(jobs, m.snapshot(id))
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+	return jobs
+}
+
+// Get returns the job with id, with live stats if it is running.
+func (m *Manager) Get(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.jobs[id]; !ok {
+		return Job{}, ErrNotFound
+	}
+	return m.snapshot(id), nil
+}
+
+// Cancel stops a queued or running job. Pages already being fetched are finished and the
+// partial result is kept.
+func (m *Manager) Cancel(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	live, ok := m.running[id]
+	if !ok || job.State.Finished() {
+		return ErrFinished
+	}
+	live.cancel()
+	return nil
+}
+
+// Delete removes a finished job with its result. Queued and running jobs must be cancelled
+// first.
+func (m *Manager) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if !job.State.Finished() {
+		return ErrNotFinished
+	}
+	if err := os.RemoveAll(filepath.Join(m.dir, id)); err != nil {
+		return err
+	}
+	delete(m.jobs, id)
+	return nil
+}
+
+// Result loads the result of a finished job.
+func (m *Manager) Result(id string) (*output.Result, error) {
+	job, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if !job.State.Finished() {
+		return nil, ErrNoResult
+	}
+	result, err := output.LoadResult(m.resultPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoResult
+	}
+	return result, err
+}
+
+// Shutdown stops the schedules, cancels every job that has not finished and waits for them to
+// stop.
+func (m *Manager) Shutdown() {
+	m.mu.Lock()
+	m.closed = true
+	for _, stop := range m.stopSchedule {
+		stop()
+	}
+	for _, live := range m.running {
+		live.cancel()
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// snapshot copies the job with id, filling in live stats. Callers must hold m.mu.
+func (m *Manager) snapshot(id string) Job {
+	job := *m.jobs[id]
+	if live, ok := m.running[id]; ok && live.metrics != nil {
+		job.Stats = newStats(live.metrics.Summary())
+	}
+	return job
+}
+
+func (m *Manager) run(ctx context.Context, id string, live *run) {
+	defer m.wg.Done()
+	logger := m.logger.With("job", id)
+
+	select {
+	case m.slots <- struct{}{}:
+		defer func() { <-m.slots }()
+	case <-ctx.Done():
+		m.finish(id, StateCanceled, nil)
+		return
+	}
+
+	crawlMetrics := crawler.NewMetrics()
+	now := time.Now()
+	m.mu.Lock()
+	job := m.jobs[id]
+	job.State = StateRunning
+	job.StartedAt = &now
+	live.metrics = crawlMetrics
+	cfg := job.Config
+	started := *job
+	if err := m.save(job); err != nil {
+		logger.Error("Failed to store job", "error", err)
+	}
+	m.mu.Unlock()
+	logger.Info("Job started", "urls", cfg.Crawl.URLs)
+
+	var previous *output.Result
+	if cfg.Fetch.Incremental {
+		previous = m.previousResult(started, logger)
+	}
+	result, err := m.crawl(ctx, cfg, previous, crawlMetrics, logger)
+	if result == nil {
+		logger.Error("Job failed", "error", err)
+		m.finish(id, StateFailed, err)
+		return
+	}
+	// The result is stored first, so it is there for the OnFinish callbacks.
+	if err := output.SaveResult(result, m.resultPath(id)); err != nil {
+		logger.Error("Failed to store job result", "error", err)
+	}
+	if ctx.Err() != nil {
+		m.finish(id, StateCanceled, nil)
+		return
+	}
+	m.finish(id, StateSucceeded, nil)
+}
+
+// previousResult returns the result of the job's previous successful run, which an incremental
+// job is crawled against, or nil if there is none.
+func (m *Manager) previousResult(job Job, logger *utils.Logger) *output.Result {
+	prev, ok := m.previous(job)
+	if !ok {
+		logger.Info("No previous run, crawling every page")
+		return nil
+	}
+	result, err := m.Result(prev.ID)
+	if err != nil {
+		logger.Warn("Failed to load the previous run, crawling every page", "previous", prev.ID, "error", err)
+		return nil
+	}
+	logger.Info("Recrawling incrementally", "previous", prev.ID, "pages", len(result.Pages))
+	return result
+}
+
+// crawl runs one job's crawl, incrementally against previous if it is not nil. It returns the
+// partial result along with ctx's error if the job is cancelled, and a nil result if the crawl
+// could not start.
+func (m *Manager) crawl(ctx context.Context, cfg config.Config, previous *output.Result, crawlMetrics *metrics.Crawl, logger *utils.Logger) (*output.Result, error) {
+	opts, err := cfg.CrawlerOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, crawler.WithLogger(logger.Logger), crawler.WithMetrics(crawlMetrics))
+	if m.transport != nil {
+		opts = append(opts, crawler.WithTransport(m.transport))
+	}
+	if previous != nil {
+		opts = append(opts, crawler.WithPrevious(previous))
+	}
+
+	c, err := crawler.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.Run(ctx, cfg.Crawl.URLs...)
+}
+
+// finish records the final state of a job and its stats, then tells the OnFinish callbacks and
+// the job's notifiers.
+func (m *Manager) finish(id string, state State, err error) {
+	m.mu.Lock()
+	now := time.Now()
+	job := m.jobs[id]
+	job.Stats = m.snapshot(id).Stats
+	job.State = state
+	job.FinishedAt = &now
+	if err != nil {
+		job.Error = err.Error()
+	}
+	if live, ok := m.running[id]; ok {
+		live.cancel()
+		delete(m.running, id)
+	}
+	if saveErr := m.save(job); saveErr != nil {
+		m.logger.Error("Failed to store job", "job", id, "error", saveErr)
+	}
+	snapshot := *job
+	callbacks := m.onFinish
+	m.mu.Unlock()
+
+	m.logger.Info("Job finished", "job", id, "state", state, "pages", snapshot.Stats.Pages)
+	for _, fn := range callbacks {
+		fn(snapshot)
+	}
+	m.notify(snapshot)
+
+	// Old runs are pruned last, so the notifications can still compare with the previous one.
+	if snapshot.Schedule != "" {
+		m.mu.Lock()
+		m.prune(snapshot.Schedule)
+		m.mu.Unlock()
+	}
+}
+
+// save writes the job's metadata to disk. Callers must hold m.mu.
+func (m *Manager) save(job *Job) error {
+	dir := filepath.Join(m.dir, job.ID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "job.json")
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (m *Manager) resultPath(id string) string {
+	return filepath.Join(m.dir, id, "result.json")
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/notify"
+)
+
+// notify sends the finished job to the notifiers in its settings, comparing it with the previous
+// successful run of the same schedule, or of the same name for jobs submitted by hand.
+func (m *Manager) notify(job Job) {
+	targets, conditions, err := job.Config.Notifiers()
+	if err != nil {
+		m.logger.Error("Invalid notifier settings", "job", job.ID, "error", err)
+		return
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	var previous *notify.Run
+	if prev, ok := m.previous(job); ok {
+		previous = m.notifyRun(prev)
+	}
+	payload := notify.NewPayload(*m.notifyRun(job), previous, conditions)
+	if err := notify.Send(context.Background(), targets, payload); err != nil {
+		m.logger.Error("Failed to send notifications", "job", job.ID, "error", err)
+		return
+	}
+	m.logger.Debug("Sent notifications", "job", job.ID, "events", payload.Events)
+}
+
+// previous returns the last successful run of the same job before job.
+func (m *Manager) previous(job Job) (Job, bool) {
+	if job.Schedule == "" && job.Name == "" {
+		return Job{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found *Job
+	for _, other := range m.jobs {
+		if other.ID == job.ID || other.State != StateSucceeded || !other.CreatedAt.Before(job.CreatedAt) {
+			continue
+		}
+		same := other.Schedule == job.Schedule && (job.Schedule != "" || other.Name == job.Name)
+		if same && (found == nil || other.CreatedAt.After(found.CreatedAt)) {
+			found = other
+		}
+	}
+	if found == nil {
+		return Job{}, false
+	}
+	return *found, true
+}
+
+func (m *Manager) notifyRun(job Job) *notify.Run {
+	run := &notify.Run{
+		ID:       job.ID,
+		Name:     job.Name,
+		Schedule: job.Schedule,
+		State:    string(job.State),
+		Error:    job.Error,
+		Seeds:    job.Config.Crawl.URLs,
+		Bytes:    job.Stats.Bytes,
+		Requests: job.Stats.Requests,
+		Elapsed:  time.Duration(job.Stats.Elapsed * float64(time.Second)),
+	}
+	if result, err := m.Result(job.ID); err == nil {
+		run.Result = result
+	}
+	return run
+}
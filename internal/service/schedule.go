@@ -0,0 +1,286 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/config"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/cron"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// DefaultRetain is how many finished runs of a schedule are kept when it does not say.
+const DefaultRetain = 10
+
+// Schedule submits a job with the same settings every time its cron expression fires. A run is
+// skipped if the schedule's previous run is still going.
+type Schedule struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Cron is a five-field cron expression, a macro such as @daily, or "@every <duration>".
+	Cron string `json:"cron"`
+	// Jitter delays each run by a random amount up to this long, so schedules that fire at the
+	// same time do not all start together.
+	Jitter config.Duration `json:"jitter,omitempty"`
+	// Retain is how many finished runs are kept; older runs and their results are deleted.
+	Retain    int           `json:"retain"`
+	Profile   string        `json:"profile,omitempty"`
+	Config    config.Config `json:"config"`
+	CreatedAt time.Time     `json:"created_at"`
+	NextRun   *time.Time    `json:"next_run,omitempty"`
+	LastRun   *time.Time    `json:"last_run,omitempty"`
+	// Skipped counts runs that were due while the previous run was still going.
+	Skipped int `json:"skipped"`
+}
+
+// AddSchedule validates the schedule's cron expression and settings and starts running it. The
+// ID, creation time and run bookkeeping are filled in by the manager.
+func (m *Manager) AddSchedule(s Schedule) (Schedule, error) {
+	expr, err := cron.Parse(s.Cron)
+	if err != nil {
+		return Schedule{}, err
+	}
+	if err := m.validateJob(s.Config); err != nil {
+		return Schedule{}, err
+	}
+	if s.Jitter < 0 {
+		return Schedule{}, errors.New("jitter must not be negative")
+	}
+	if s.Retain == 0 {
+		s.Retain = DefaultRetain
+	}
+	if s.Retain < 0 {
+		return Schedule{}, errors.New("retain must be at least 1")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return Schedule{}, ErrShutdown
+	}
+	m.nextID++
+	s.ID = "s" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.Itoa(m.nextID)
+	s.CreatedAt = time.Now()
+	s.NextRun, s.LastRun, s.Skipped = nil, nil, 0
+	m.schedules[s.ID] = &s
+	if err := m.saveSchedules(); err != nil {
+		delete(m.schedules, s.ID)
+		return Schedule{}, err
+	}
+	m.startSchedule(&s, expr)
+	return s, nil
+}
+
+// Schedules returns every schedule, oldest first.
+func (m *Manager) Schedules() []Schedule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	schedules := make([]Schedule, 0, len(m.schedules))
+	for _, s := range m.schedules {
+		schedules = append(schedules, *s)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].CreatedAt.Before(schedules[j].CreatedAt) })
+	return schedules
+}
+
+// GetSchedule returns the schedule with id.
+func (m *Manager) GetSchedule(id string) (Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.schedules[id]
+	if !ok {
+		return Schedule{}, ErrNotFound
+	}
+	return *s, nil
+}
+
+// Runs returns the kept runs of the schedule with id, newest first.
+func (m *Manager) Runs(id string) []Job {
+	runs := []Job{}
+	for _, job := range m.List() {
+		if job.Schedule == id {
+			runs = append(runs, job)
+		}
+	}
+	return runs
+}
+
+// RemoveSchedule stops the schedule with id. A run in progress carries on, and past runs are
+// kept until they are deleted with Delete.
+func (m *Manager) RemoveSchedule(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.schedules[id]; !ok {
+		return ErrNotFound
+	}
+	if stop, ok := m.stopSchedule[id]; ok {
+		stop()
+		delete(m.stopSchedule, id)
+	}
+	delete(m.schedules, id)
+	return m.saveSchedules()
+}
+
+// loadSchedules reads the stored schedules and starts them. Runs missed while the service was
+// down are not made up; each schedule next fires at its first time after now.
+func (m *Manager) loadSchedules() error {
+	data, err := os.ReadFile(m.schedulesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var schedules []*Schedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return fmt.Errorf("%s: %w", m.schedulesPath(), err)
+	}
+	redacted := false
+	for _, s := range schedules {
+		expr, err := cron.Parse(s.Cron)
+		if err != nil {
+			return fmt.Errorf("schedule %s: %w", s.ID, err)
+		}
+		redacted = redactSecrets(&s.Config) || redacted
+		m.schedules[s.ID] = s
+		m.startSchedule(s, expr)
+	}
+	if redacted {
+		return m.saveSchedules()
+	}
+	return nil
+}
+
+// startSchedule runs the schedule in the background until it is removed or the manager shuts
+// down. Callers must hold m.mu.
+func (m *Manager) startSchedule(s *Schedule, expr cron.Schedule) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.stopSchedule[s.ID] = cancel
+	m.wg.Add(1)
+	go m.runSchedule(ctx, s.ID, expr, time.Duration(s.Jitter))
+}
+
+func (m *Manager) runSchedule(ctx context.Context, id string, expr cron.Schedule, jitter time.Duration) {
+	defer m.wg.Done()
+	logger := m.logger.With("schedule", id)
+	for {
+		next := expr.Next(time.Now())
+		if next.IsZero() {
+			logger.Warn("Schedule never fires again")
+			return
+		}
+		next = next.Add(time.Duration(float64(jitter) * utils.RandFloat()))
+
+		m.mu.Lock()
+		if s, ok := m.schedules[id]; ok {
+			s.NextRun = &next
+		}
+		m.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		m.trigger(id, logger)
+	}
+}
+
+// trigger submits a run of the schedule with id, unless its previous run is still going.
+func (m *Manager) trigger(id string, logger *utils.Logger) {
+	m.mu.Lock()
+	s, ok := m.schedules[id]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	for _, job := range m.jobs {
+		if job.Schedule == id && !job.State.Finished() {
+			s.Skipped++
+			m.saveSchedulesLogged()
+			m.mu.Unlock()
+			logger.Warn("Skipping scheduled run, the previous run is still going", "job", job.ID)
+			return
+		}
+	}
+	name, profile, cfg := s.Name, s.Profile, s.Config
+	m.mu.Unlock()
+
+	job, err := m.submit(name, profile, cfg, id)
+	if err != nil {
+		logger.Error("Failed to start scheduled run", "error", err)
+		return
+	}
+	logger.Info("Started scheduled run", "job", job.ID)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.schedules[id]; ok {
+		s.LastRun = &job.CreatedAt
+		m.saveSchedulesLogged()
+	}
+}
+
+// prune deletes the oldest finished runs of a schedule beyond the number it retains. Callers
+// must hold m.mu.
+func (m *Manager) prune(scheduleID string) {
+	s, ok := m.schedules[scheduleID]
+	if !ok {
+		return
+	}
+	var finished []*Job
+	for _, job := range m.jobs {
+		if job.Schedule == scheduleID && job.State.Finished() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= s.Retain {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].CreatedAt.After(finished[j].CreatedAt) })
+	for _, job := range finished[s.Retain:] {
+		if err := os.RemoveAll(filepath.Join(m.dir, job.ID)); err != nil {
+			m.logger.Error("Failed to delete old run", "job", job.ID, "error", err)
+			continue
+		}
+		delete(m.jobs, job.ID)
+		m.logger.Debug("Deleted old run", "schedule", scheduleID, "job", job.ID)
+	}
+}
+
+// saveSchedules stores every schedule. Callers must hold m.mu.
+func (m *Manager) saveSchedules() error {
+	schedules := make([]*Schedule, 0, len(m.schedules))
+	for _, s := range m.schedules {
+		schedules = append(schedules, s)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].CreatedAt.Before(schedules[j].CreatedAt) })
+	data, err := json.MarshalIndent(schedules, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := m.schedulesPath()
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (m *Manager) saveSchedulesLogged() {
+	if err := m.saveSchedules(); err != nil {
+		m.logger.Error("Failed to store schedules", "error", err)
+	}
+}
+
+func (m *Manager) schedulesPath() string {
+	return filepath.Join(m.dir, "schedules.json")
+}
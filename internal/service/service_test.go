@@ -0,0 +1,401 @@
+package service_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/notify"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/service"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+func newSite(t *testing.T, release chan struct{}) *httptest.Server {
+	t.Helper()
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<a href="/about">About</a><a href="/slow">Slow</a>`))
+		case "/about":
+			w.Write([]byte(`<p>About us</p>`))
+		case "/slow":
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			w.Write([]byte(`<p>Finally</p>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(site.Close)
+	return site
+}
+
+func submit(t *testing.T, api *httptest.Server, body string) (*http.Response, service.Job) {
+	t.Helper()
+	resp, err := http.Post(api.URL+"/jobs", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var job service.Job
+	if resp.StatusCode == http.StatusCreated {
+		if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+			t.Fatalf("Failed to decode job: %v", err)
+		}
+	}
+	return resp, job
+}
+
+func getJob(t *testing.T, api *httptest.Server, id string) service.Job {
+	t.Helper()
+	resp, err := http.Get(api.URL + "/jobs/" + id)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var job service.Job
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		t.Fatalf("Failed to decode job: %v", err)
+	}
+	return job
+}
+
+func waitFor(t *testing.T, api *httptest.Server, id string, done func(service.Job) bool) service.Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job := getJob(t, api, id)
+		if done(job) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Job %s did not get there in time, last seen: %+v", id, job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func jobConfig(url string) string {
+	return `{"name": "docs", "config": {"crawl": {"urls": ["` + url + `"], "delay": "0s", "rate_limit": "1ms"}, "fetch": {"middleware": []}}}`
+}
+
+func TestManager_RunsJobsAndKeepsThemAcrossRestarts(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	site := newSite(t, release)
+	dir := t.TempDir()
+	logger := utils.NewLogger()
+
+	manager, err := service.NewManager(dir, 2, logger)
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	manager.SetTransport(site.Client().Transport)
+	api := httptest.NewServer(manager.Handler())
+	defer api.Close()
+
+	resp, _ := submit(t, api, `{"config": {"crawl": {"workers": 0}, "log": {"format": "xml"}}}`)
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected an invalid config to be rejected, got %d %s", resp.StatusCode, body)
+	}
+
+	resp, job := submit(t, api, jobConfig(site.URL))
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != "/jobs/"+job.ID {
+		t.Fatalf("Expected the job to be created, got %d at %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	job = waitFor(t, api, job.ID, func(job service.Job) bool { return job.State.Finished() })
+	if job.State != service.StateSucceeded || job.Stats.Pages != 3 || job.Name != "docs" {
+		t.Fatalf("Expected a successful crawl of 3 pages, got %+v", job)
+	}
+
+	csv, err := http.Get(api.URL + "/jobs/" + job.ID + "/results?format=csv")
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	body, _ := io.ReadAll(csv.Body)
+	csv.Body.Close()
+	if csv.StatusCode != http.StatusOK || !bytes.Contains(body, []byte(site.URL+"/about")) {
+		t.Errorf("Expected a CSV with the crawled pages, got %d %s", csv.StatusCode, body)
+	}
+	if !strings.Contains(csv.Header.Get("Content-Disposition"), job.ID+".csv") {
+		t.Errorf("Expected the CSV as an attachment, got %q", csv.Header.Get("Content-Disposition"))
+	}
+	api.Close()
+
+	restarted, err := service.NewManager(dir, 2, logger)
+	if err != nil {
+		t.Fatalf("NewManager after restart failed: %v", err)
+	}
+	jobs := restarted.List()
+	if len(jobs) != 1 || jobs[0].ID != job.ID || jobs[0].State != service.StateSucceeded || jobs[0].Stats.Pages != 3 {
+		t.Fatalf("Expected the finished job to survive a restart, got %+v", jobs)
+	}
+	result, err := restarted.Result(job.ID)
+	if err != nil || len(result.URLs) != 3 {
+		t.Errorf("Expected the stored result after a restart, got %v, %v", result, err)
+	}
+}
+
+func TestManager_CancelsARunningJob(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	site := newSite(t, release)
+
+	manager, err := service.NewManager(t.TempDir(), 1, utils.NewLogger())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	manager.SetTransport(site.Client().Transport)
+	defer manager.Shutdown()
+	api := httptest.NewServer(manager.Handler())
+	defer api.Close()
+
+	_, running := submit(t, api, jobConfig(site.URL))
+	_, queued := submit(t, api, jobConfig(site.URL))
+	waitFor(t, api, running.ID, func(job service.Job) bool { return job.Stats.Pages >= 2 })
+	if job := getJob(t, api, queued.ID); job.State != service.StateQueued {
+		t.Errorf("Expected the second job to wait for the first, got %s", job.State)
+	}
+
+	for _, id := range []string{queued.ID, running.ID} {
+		resp, err := http.Post(api.URL+"/jobs/"+id+"/cancel", "application/json", nil)
+		if err != nil || resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("Cancel failed: %v %v", resp.Status, err)
+		}
+		resp.Body.Close()
+		job := waitFor(t, api, id, func(job service.Job) bool { return job.State.Finished() })
+		if job.State != service.StateCanceled {
+			t.Errorf("Expected job %s to be canceled, got %s", id, job.State)
+		}
+	}
+
+	resp, err := http.Post(api.URL+"/jobs/"+running.ID+"/cancel", "application/json", nil)
+	if err != nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected cancelling a finished job to conflict, got %v %v", resp.Status, err)
+	}
+	resp, err = http.Get(api.URL + "/jobs/missing")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected an unknown job to be 404, got %v %v", resp.Status, err)
+	}
+}
+
+func TestManager_RunsSchedulesAndKeepsTheirHistory(t *testing.T) {
+	release := make(chan struct{})
+	site := newSite(t, release)
+	dir := t.TempDir()
+
+	manager, err := service.NewManager(dir, 2, utils.NewLogger())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	manager.SetTransport(site.Client().Transport)
+	var mu sync.Mutex
+	finished := 0
+	manager.OnFinish(func(job service.Job) {
+		mu.Lock()
+		defer mu.Unlock()
+		finished++
+	})
+	api := httptest.NewServer(manager.Handler())
+	defer api.Close()
+
+	resp, err := http.Post(api.URL+"/schedules", "application/json", strings.NewReader(`{"cron": "61 * * * *"}`))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected an invalid cron expression to be rejected, got %v %v", resp.Status, err)
+	}
+
+	resp, err = http.Post(api.URL+"/schedules", "application/json", strings.NewReader(`{"name": "nightly", "cron": "@every 30ms", "jitter": "5ms", "retain": 2,
+		"config": {"crawl": {"urls": ["`+site.URL+`"], "delay": "0s", "rate_limit": "1ms"}, "fetch": {"middleware": [], "request_timeout": "10s"}}}`))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to add schedule: %v %v", resp.Status, err)
+	}
+	var schedule service.Schedule
+	json.NewDecoder(resp.Body).Decode(&schedule)
+	resp.Body.Close()
+
+	// The first run hangs on /slow, so the runs due meanwhile are skipped.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, _ := manager.GetSchedule(schedule.ID)
+		if s.Skipped >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected runs to be skipped while the first one runs, got %+v", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runs := manager.Runs(schedule.ID); len(runs) != 1 || runs[0].State != service.StateRunning || runs[0].Name != "nightly" {
+		t.Fatalf("Expected a single running run, got %+v", runs)
+	}
+
+	close(release)
+	for {
+		mu.Lock()
+		n := finished
+		mu.Unlock()
+		if n >= 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected at least 4 finished runs, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	manager.Shutdown()
+
+	restarted, err := service.NewManager(dir, 2, utils.NewLogger())
+	if err != nil {
+		t.Fatalf("NewManager after restart failed: %v", err)
+	}
+	defer restarted.Shutdown()
+	if _, err := restarted.GetSchedule(schedule.ID); err != nil {
+		t.Fatalf("Expected the schedule to survive a restart: %v", err)
+	}
+	runs := restarted.Runs(schedule.ID)
+	if len(runs) > 3 {
+		t.Errorf("Expected at most 2 kept runs plus one interrupted by the shutdown, got %d", len(runs))
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != len(runs)+1 {
+		t.Errorf("Expected pruned runs to be deleted from disk, found %d entries for %d runs", len(entries), len(runs))
+	}
+
+	if err := restarted.RemoveSchedule(schedule.ID); err != nil {
+		t.Fatalf("RemoveSchedule failed: %v", err)
+	}
+	if len(restarted.Schedules()) != 0 {
+		t.Errorf("Expected no schedules after removing it")
+	}
+	for _, run := range runs {
+		if err := restarted.Delete(run.ID); err != nil {
+			t.Errorf("Deleting run %s failed: %v", run.ID, err)
+		}
+	}
+	if err := restarted.Delete(schedule.ID); !errors.Is(err, service.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown job, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected deleted runs to be removed from disk, found %d entries", len(entries))
+	}
+}
+
+func TestManager_NotifiesWhenJobsFinish(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	site := newSite(t, release)
+	log := filepath.Join(t.TempDir(), "notifications.jsonl")
+
+	manager, err := service.NewManager(t.TempDir(), 1, utils.NewLogger())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	manager.SetTransport(site.Client().Transport)
+	manager.AllowNotifiers("file")
+	defer manager.Shutdown()
+	api := httptest.NewServer(manager.Handler())
+	defer api.Close()
+
+	body := `{"name": "docs", "config": {"crawl": {"urls": ["` + site.URL + `"], "delay": "0s", "rate_limit": "1ms"}, "fetch": {"middleware": []},
+		"notify": {"targets": ["file?path=` + log + `&on=threshold"], "conditions": ["pages < 5"]}}}`
+	for i := 0; i < 2; i++ {
+		_, job := submit(t, api, body)
+		waitFor(t, api, job.ID, func(job service.Job) bool { return job.State.Finished() })
+	}
+	resp, _ := submit(t, api, `{"config": {"crawl": {"urls": ["`+site.URL+`"]}, "notify": {"targets": ["pager"]}}}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an unknown notifier to be rejected, got %d", resp.StatusCode)
+	}
+	for _, unsafe := range []string{
+		`"notify": {"targets": ["exec?command=/bin/true"]}`,
+		`"fetch": {"replay": ["/etc/passwd"]}`,
+		`"fetch": {"cache_dir": "/tmp"}`,
+		`"output": {"warc_dir": "/tmp"}`,
+		`"crawl": {"urls": ["` + site.URL + `"], "scorers": ["sitemap?src=/etc/passwd"]}`,
+		`"notify": {"targets": ["webhook?url=https://example.com/hook&secret=hunter2"]}`,
+		`"notify": {"targets": ["webhook?url=https://example.com/hook&secret_env=HOME"]}`,
+	} {
+		resp, _ := submit(t, api, `{"config": {"crawl": {"urls": ["`+site.URL+`"]}, `+unsafe+`}}`)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", unsafe, resp.StatusCode)
+		}
+	}
+
+	secured := httptest.NewServer(service.RequireToken("s3cret", manager.Handler()))
+	defer secured.Close()
+	if resp, err := http.Get(secured.URL + "/jobs"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a request without the API token to be refused, got %v %v", resp, err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, secured.URL+"/jobs", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a request with the API token to be served, got %v %v", resp, err)
+	}
+	// Notifications are sent after a job is marked finished; Shutdown waits for them.
+	manager.Shutdown()
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatalf("Expected notifications to be written: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a notification per job, got %q", data)
+	}
+	var first, second notify.Payload
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[1]), &second)
+	if first.Previous != nil || first.Stats.Pages != 3 || len(first.Alerts) != 1 {
+		t.Errorf("Unexpected first notification: %s", lines[0])
+	}
+	if second.Previous == nil || second.Previous.ID != first.Job.ID || second.Job.Name != "docs" {
+		t.Errorf("Expected the second run to be compared with the first, got %s", lines[1])
+	}
+}
+
+func TestManager_KeepsWebhookSecretsOutOfStoredJobs(t *testing.T) {
+	dir := t.TempDir()
+	stored := `{"id": "old", "state": "succeeded", "created_at": "2024-01-01T00:00:00Z",
+		"config": {"notify": {"targets": ["webhook?url=https://example.com/hook&secret=hunter2&on=failed"]}}}`
+	os.MkdirAll(filepath.Join(dir, "old"), 0o755)
+	os.WriteFile(filepath.Join(dir, "old", "job.json"), []byte(stored), 0o644)
+
+	manager, err := service.NewManager(dir, 1, utils.NewLogger())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	defer manager.Shutdown()
+	data, _ := os.ReadFile(filepath.Join(dir, "old", "job.json"))
+	if bytes.Contains(data, []byte("hunter2")) {
+		t.Errorf("Expected the stored secret to be removed, got %s", data)
+	}
+	if job, _ := manager.Get("old"); len(job.Config.Notify.Targets) != 1 || strings.Contains(job.Config.Notify.Targets[0], "hunter2") {
+		t.Errorf("Expected the served job without its secret, got %q", job.Config.Notify.Targets)
+	}
+
+	t.Setenv("CRAWLER_HOOK_SECRET", "hunter2")
+	manager.AllowSecretEnv("CRAWLER_HOOK_SECRET")
+	release := make(chan struct{})
+	close(release)
+	site := newSite(t, release)
+	manager.SetTransport(site.Client().Transport)
+	api := httptest.NewServer(manager.Handler())
+	defer api.Close()
+	resp, job := submit(t, api, `{"config": {"crawl": {"urls": ["`+site.URL+`"], "delay": "0s", "rate_limit": "1ms"},
+		"notify": {"targets": ["webhook?url=`+site.URL+`/hook&secret_env=CRAWLER_HOOK_SECRET&on=canceled"]}}}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected an allowed secret_env to be accepted, got %d", resp.StatusCode)
+	}
+	waitFor(t, api, job.ID, func(job service.Job) bool { return job.State.Finished() })
+}
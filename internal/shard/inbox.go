@@ -0,0 +1,371 @@
+package shard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InboxPath is the HTTP path a shard accepts forwarded URLs on.
+const InboxPath = "/inbox"
+
+// Entry is a URL handed from one shard to the shard that owns its host.
+// Base is carried along so the receiving shard applies the same internal-link rules.
+type Entry struct {
+	URL  string `json:"url"`
+	Base string `json:"base"`
+}
+
+// Forwarder delivers URLs to the shard that owns them.
+type Forwarder interface {
+	Forward(shard int, entry Entry) error
+}
+
+// Inbox yields URLs forwarded to the local shard since the last call. It also passes the shards'
+// states between them, so none finishes while another may still forward it work.
+type Inbox interface {
+	Poll() ([]Entry, error)
+	// Publish tells the other shards the local shard's state.
+	Publish(state State) error
+	// States returns the last state of every shard, by index, and whether each is known yet.
+	States() ([]State, error)
+}
+
+// State is what a shard tells the others about itself: whether it is idle, with nothing
+// crawling and nothing arriving, and how many URLs it has forwarded and received.
+type State struct {
+	Known    bool  `json:"-"`
+	Idle     bool  `json:"idle"`
+	Sent     int64 `json:"sent"`
+	Received int64 `json:"received"`
+}
+
+// Finished reports whether a crawl split between shards is over: every shard is idle and every
+// URL forwarded has been received. States are read one shard at a time, so a shard may turn busy
+// after it was read; before is the previous reading, and both must show the same settled crawl.
+func Finished(before, now []State) bool {
+	if len(before) != len(now) {
+		return false
+	}
+	var sent, received int64
+	for i, state := range now {
+		if !state.Known || !state.Idle || state != before[i] {
+			return false
+		}
+		sent += state.Sent
+		received += state.Received
+	}
+	return sent == received
+}
+
+// InboxFile returns the file shard i reads forwarded URLs from inside dir.
+func InboxFile(dir string, shard int) string {
+	return filepath.Join(dir, fmt.Sprintf("shard-%d.inbox", shard))
+}
+
+// DirForwarder appends entries as JSON lines to the owning shard's inbox file.
+// Each entry is written with a single O_APPEND write, so several processes can share the directory.
+type DirForwarder struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewDirForwarder(dir string) (*DirForwarder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DirForwarder{dir: dir}, nil
+}
+
+func (f *DirForwarder) Forward(shard int, entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(InboxFile(f.dir, shard), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(line)
+	return err
+}
+
+// rotateGrace is how long a DirInbox keeps reading an inbox file after moving it aside, for
+// forwarders that opened it just before.
+const rotateGrace = time.Second
+
+// clockSlack allows for file modification times that lag the clock, and for clocks of hosts
+// sharing the directory that are slightly apart.
+const clockSlack = time.Second
+
+// DirInbox reads the local shard's inbox file. Each poll moves the file aside and reads it, so
+// forwarders start a new one and entries already read are not read again by a later run. The
+// shard's state is kept next to it, in a file the other shards read. Shards must publish their
+// state regularly: a state file not written since the inbox was created is left over from an
+// earlier run.
+type DirInbox struct {
+	dir       string
+	shard     int
+	count     int
+	path      string
+	started   time.Time
+	rotated   string
+	rotatedAt time.Time
+	offset    int64
+}
+
+// NewDirInbox returns the inbox of shard, one of count shards sharing dir.
+func NewDirInbox(dir string, shard, count int) *DirInbox {
+	return &DirInbox{dir: dir, shard: shard, count: count, path: InboxFile(dir, shard), started: time.Now()}
+}
+
+func (in *DirInbox) Poll() ([]Entry, error) {
+	if in.rotated == "" {
+		rotated := fmt.Sprintf("%s.%d", in.path, time.Now().UnixNano())
+		err := os.Rename(in.path, rotated)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		in.rotated, in.rotatedAt, in.offset = rotated, time.Now(), 0
+	}
+
+	entries, err := in.read()
+	if err == nil && time.Since(in.rotatedAt) >= rotateGrace {
+		err = os.Remove(in.rotated)
+		in.rotated = ""
+	}
+	return entries, err
+}
+
+// read returns the complete lines of the file moved aside that have not been read yet.
+func (in *DirInbox) read() ([]Entry, error) {
+	file, err := os.Open(in.rotated)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(in.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial line is still being written; pick it up on the next poll.
+			break
+		}
+		if err != nil {
+			return entries, err
+		}
+		in.offset += int64(len(line))
+
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (in *DirInbox) statePath(shard int) string {
+	return filepath.Join(in.dir, fmt.Sprintf("shard-%d.state", shard))
+}
+
+// Publish writes the shard's state file, replacing it in one step so readers never see half of it.
+func (in *DirInbox) Publish(state State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	path := in.statePath(in.shard)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// States reads the state files of every shard. A shard without one, or with one last written
+// before this inbox was created, has not started yet.
+func (in *DirInbox) States() ([]State, error) {
+	states := make([]State, in.count)
+	for i := range states {
+		info, err := os.Stat(in.statePath(i))
+		if errors.Is(err, os.ErrNotExist) || err == nil && info.ModTime().Before(in.started.Add(-clockSlack)) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(in.statePath(i))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &states[i]); err != nil {
+			return nil, fmt.Errorf("shard %d state: %w", i, err)
+		}
+		states[i].Known = true
+	}
+	return states, nil
+}
+
+// HTTPForwarder POSTs entries to the inbox endpoint of the owning shard.
+// Endpoints are indexed by shard number.
+type HTTPForwarder struct {
+	endpoints []string
+	client    *http.Client
+}
+
+func NewHTTPForwarder(endpoints []string) *HTTPForwarder {
+	trimmed := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		trimmed[i] = strings.TrimRight(endpoint, "/")
+	}
+	return &HTTPForwarder{endpoints: trimmed, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (f *HTTPForwarder) Forward(shard int, entry Entry) error {
+	if shard < 0 || shard >= len(f.endpoints) {
+		return fmt.Errorf("no endpoint configured for shard %d", shard)
+	}
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Post(f.endpoints[shard]+InboxPath, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("shard %d rejected forwarded URL: %s", shard, resp.Status)
+	}
+	return nil
+}
+
+// StatusPath is the HTTP path a shard reports its State on.
+const StatusPath = "/status"
+
+// HTTPInbox buffers entries POSTed to its handler until they are polled, and serves the shard's
+// state to the others on GET /status.
+type HTTPInbox struct {
+	shard     int
+	endpoints []string
+	client    *http.Client
+
+	mu      sync.Mutex
+	pending []Entry
+	state   State
+	peers   []State
+}
+
+// NewHTTPInbox returns the inbox of shard, given the inbox endpoints of every shard by index.
+func NewHTTPInbox(shard int, endpoints []string) *HTTPInbox {
+	trimmed := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		trimmed[i] = strings.TrimRight(endpoint, "/")
+	}
+	return &HTTPInbox{
+		shard:     shard,
+		endpoints: trimmed,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		peers:     make([]State, len(endpoints)),
+	}
+}
+
+func (in *HTTPInbox) Poll() ([]Entry, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	entries := in.pending
+	in.pending = nil
+	return entries, nil
+}
+
+func (in *HTTPInbox) Publish(state State) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.state = state
+	return nil
+}
+
+// States asks every other shard for its state. A shard that cannot be reached keeps the last
+// state it reported, since one that has finished stops answering.
+func (in *HTTPInbox) States() ([]State, error) {
+	for i, endpoint := range in.endpoints {
+		if i == in.shard {
+			continue
+		}
+		resp, err := in.client.Get(endpoint + StatusPath)
+		if err != nil {
+			continue
+		}
+		var state State
+		err = json.NewDecoder(resp.Body).Decode(&state)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("shard %d status: %w", i, err)
+		}
+		state.Known = true
+		in.mu.Lock()
+		in.peers[i] = state
+		in.mu.Unlock()
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	states := append([]State(nil), in.peers...)
+	if in.shard >= 0 && in.shard < len(states) {
+		states[in.shard] = in.state
+		states[in.shard].Known = true
+	}
+	return states, nil
+}
+
+// Handler accepts forwarded entries on POST /inbox and reports the shard's state on GET /status.
+func (in *HTTPInbox) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+InboxPath, func(w http.ResponseWriter, r *http.Request) {
+		var entry Entry
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil || entry.URL == "" {
+			http.Error(w, "malformed entry", http.StatusBadRequest)
+			return
+		}
+		in.mu.Lock()
+		in.pending = append(in.pending, entry)
+		in.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("GET "+StatusPath, func(w http.ResponseWriter, r *http.Request) {
+		in.mu.Lock()
+		state := in.state
+		in.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	})
+	return mux
+}
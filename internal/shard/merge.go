@@ -0,0 +1,31 @@
+package shard
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// MergeOutputs combines the JSON outputs written by each shard into a single URL set.
+// Each file is expected to have the standard `{"urls": {...}}` shape.
+func MergeOutputs(paths ...string) (map[string]bool, error) {
+	merged := make(map[string]bool)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var output struct {
+			URLs map[string]bool `json:"urls"`
+		}
+		if err := json.Unmarshal(data, &output); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+
+		for url, crawled := range output.URLs {
+			merged[url] = merged[url] || crawled
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,100 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// DefaultReplicas is the number of virtual nodes each shard gets on the ring.
+// More replicas spread hosts more evenly at the cost of a larger ring.
+const DefaultReplicas = 128
+
+// Ring is a consistent-hash ring mapping keys (hosts) to shard indexes.
+// Every instance built with the same shard count produces the same mapping,
+// so crawler processes agree on ownership without talking to each other.
+type Ring struct {
+	hashes []uint32
+	owners map[uint32]int
+}
+
+func NewRing(shards int, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	r := &Ring{owners: make(map[uint32]int)}
+	for shard := 0; shard < shards; shard++ {
+		for replica := 0; replica < replicas; replica++ {
+			h := hashKey(fmt.Sprintf("shard-%d-%d", shard, replica))
+			if _, taken := r.owners[h]; taken {
+				continue
+			}
+			r.owners[h] = shard
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Owner returns the shard responsible for key.
+func (r *Ring) Owner(key string) int {
+	if len(r.hashes) == 0 {
+		return 0
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// Assignment describes which hosts the local crawler instance owns.
+//
+// Ownership is decided per host, so everything that is keyed by host - politeness delays,
+// rate limiting and robots rules - lives entirely inside the one instance that owns it and
+// behaves exactly as it would in a single-instance crawl.
+type Assignment struct {
+	Index int
+	Count int
+	ring  *Ring
+}
+
+func NewAssignment(index int, count int) (*Assignment, error) {
+	if count < 1 {
+		return nil, errors.New("shard count must be at least 1")
+	}
+	if index < 0 || index >= count {
+		return nil, fmt.Errorf("shard index %d out of range [0, %d)", index, count)
+	}
+	return &Assignment{Index: index, Count: count, ring: NewRing(count, DefaultReplicas)}, nil
+}
+
+// OwnerOf returns the shard that owns the host of rawURL.
+func (a *Assignment) OwnerOf(rawURL string) (int, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if host == "" {
+		return 0, fmt.Errorf("URL has no host: %s", rawURL)
+	}
+	return a.ring.Owner(host), nil
+}
+
+// Owns reports whether the local shard is responsible for rawURL.
+func (a *Assignment) Owns(rawURL string) bool {
+	owner, err := a.OwnerOf(rawURL)
+	return err == nil && owner == a.Index
+}
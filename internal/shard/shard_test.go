@@ -0,0 +1,200 @@
+package shard_test
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shard"
+)
+
+func TestAssignment_OwnershipIsConsistent(t *testing.T) {
+	const count = 4
+	assignments := make([]*shard.Assignment, count)
+	for i := range assignments {
+		a, err := shard.NewAssignment(i, count)
+		if err != nil {
+			t.Fatalf("NewAssignment(%d, %d) failed: %v", i, count, err)
+		}
+		assignments[i] = a
+	}
+
+	perShard := make(map[int]int)
+	for i := 0; i < 200; i++ {
+		host := fmt.Sprintf("https://host-%d.example.com/page", i)
+
+		owners := 0
+		for _, a := range assignments {
+			if a.Owns(host) {
+				owners++
+				perShard[a.Index]++
+			}
+		}
+		if owners != 1 {
+			t.Fatalf("Expected exactly one owner for %s, got %d", host, owners)
+		}
+
+		// Every path on the same host must land on the same shard.
+		first, _ := assignments[0].OwnerOf(host)
+		second, _ := assignments[0].OwnerOf(fmt.Sprintf("https://HOST-%d.example.com/other?q=1", i))
+		if first != second {
+			t.Errorf("Host %d split across shards %d and %d", i, first, second)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		if perShard[i] == 0 {
+			t.Errorf("Shard %d owns no hosts: %v", i, perShard)
+		}
+	}
+}
+
+func TestNewAssignment_InvalidFlags(t *testing.T) {
+	testCases := []struct {
+		index, count int
+	}{
+		{0, 0},
+		{-1, 2},
+		{2, 2},
+	}
+	for _, tc := range testCases {
+		if _, err := shard.NewAssignment(tc.index, tc.count); err == nil {
+			t.Errorf("Expected error for index %d, count %d", tc.index, tc.count)
+		}
+	}
+}
+
+func TestDirInbox_ReceivesForwardedEntries(t *testing.T) {
+	dir := t.TempDir()
+	forwarder, err := shard.NewDirForwarder(dir)
+	if err != nil {
+		t.Fatalf("NewDirForwarder failed: %v", err)
+	}
+	inbox := shard.NewDirInbox(dir, 1, 2)
+
+	entries, err := inbox.Poll()
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("Expected empty inbox, got %v, %v", entries, err)
+	}
+
+	forwarder.Forward(1, shard.Entry{URL: "https://a.example.com/x", Base: "https://example.com"})
+	forwarder.Forward(0, shard.Entry{URL: "https://b.example.com/y", Base: "https://example.com"})
+
+	// A half-written line must wait until it is complete.
+	file, _ := os.OpenFile(shard.InboxFile(dir, 1), os.O_WRONLY|os.O_APPEND, 0o644)
+	file.WriteString(`{"url":"https://a.example.com/z"`)
+
+	entries, _ = inbox.Poll()
+	if len(entries) != 1 || entries[0].URL != "https://a.example.com/x" {
+		t.Fatalf("Expected one complete entry, got %v", entries)
+	}
+
+	file.WriteString(`,"base":"https://example.com"}` + "\n")
+	file.Close()
+
+	entries, _ = inbox.Poll()
+	if len(entries) != 1 || entries[0].URL != "https://a.example.com/z" {
+		t.Errorf("Expected the completed entry on the next poll, got %v", entries)
+	}
+
+	// Entries already read are not read again, even by the next run of the shard.
+	if entries, _ := shard.NewDirInbox(dir, 1, 2).Poll(); len(entries) != 0 {
+		t.Errorf("Expected read entries not to be replayed, got %v", entries)
+	}
+}
+
+func TestFinished_WaitsForEveryShard(t *testing.T) {
+	dir := t.TempDir()
+	first, second := shard.NewDirInbox(dir, 0, 2), shard.NewDirInbox(dir, 1, 2)
+	read := func() []shard.State {
+		states, err := first.States()
+		if err != nil {
+			t.Fatalf("States failed: %v", err)
+		}
+		return states
+	}
+
+	first.Publish(shard.State{Idle: true, Sent: 1})
+	if before := read(); shard.Finished(before, read()) {
+		t.Fatal("Expected a shard that has not started to keep the crawl going")
+	}
+	second.Publish(shard.State{Idle: true})
+	if before := read(); shard.Finished(before, read()) {
+		t.Error("Expected a forwarded URL that has not been received to keep the crawl going")
+	}
+	second.Publish(shard.State{Idle: true, Received: 1})
+	before := read()
+	if !shard.Finished(before, read()) {
+		t.Error("Expected the crawl to be finished once every shard is idle and every URL received")
+	}
+	second.Publish(shard.State{Received: 1})
+	if shard.Finished(before, read()) {
+		t.Error("Expected a busy shard to keep the crawl going")
+	}
+
+	// State files left by an earlier run do not count for a shard that has not started again.
+	old := time.Now().Add(-time.Hour)
+	second.Publish(shard.State{Idle: true, Received: 1})
+	os.Chtimes(filepath.Join(dir, "shard-1.state"), old, old)
+	first = shard.NewDirInbox(dir, 0, 2)
+	if states := read(); states[1].Known {
+		t.Errorf("Expected a state file from an earlier run to be ignored, got %+v", states[1])
+	}
+}
+
+func TestHTTPInbox_ReceivesForwardedEntries(t *testing.T) {
+	inbox := shard.NewHTTPInbox(1, nil)
+	ts := httptest.NewServer(inbox.Handler())
+	defer ts.Close()
+
+	forwarder := shard.NewHTTPForwarder([]string{"http://unused", ts.URL + "/"})
+	if err := forwarder.Forward(1, shard.Entry{URL: "https://a.example.com", Base: "https://example.com"}); err != nil {
+		t.Fatalf("Forward failed: %v", err)
+	}
+	if err := forwarder.Forward(5, shard.Entry{URL: "https://a.example.com"}); err == nil {
+		t.Error("Expected error forwarding to an unknown shard")
+	}
+
+	entries, _ := inbox.Poll()
+	if len(entries) != 1 || entries[0].Base != "https://example.com" {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+	if entries, _ := inbox.Poll(); len(entries) != 0 {
+		t.Errorf("Expected inbox to be drained, got %v", entries)
+	}
+
+	// The other shard learns this one's state, and keeps it once this one stops answering.
+	inbox.Publish(shard.State{Idle: true, Received: 1})
+	other := shard.NewHTTPInbox(0, []string{"http://unused", ts.URL})
+	states, err := other.States()
+	if err != nil || !states[1].Known || !states[1].Idle || states[1].Received != 1 {
+		t.Errorf("Unexpected states %+v, %v", states, err)
+	}
+	ts.Close()
+	if states, _ := other.States(); !states[1].Idle || states[1].Received != 1 {
+		t.Errorf("Expected the last state of a finished shard to be kept, got %+v", states)
+	}
+}
+
+func TestMergeOutputs(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "shard-0.json")
+	second := filepath.Join(dir, "shard-1.json")
+	os.WriteFile(first, []byte(`{"urls":{"https://a.example.com":true,"https://shared.example.com":true}}`), 0o644)
+	os.WriteFile(second, []byte(`{"urls":{"https://b.example.com":true,"https://shared.example.com":true}}`), 0o644)
+
+	merged, err := shard.MergeOutputs(first, second)
+	if err != nil {
+		t.Fatalf("MergeOutputs failed: %v", err)
+	}
+	if len(merged) != 3 {
+		t.Errorf("Expected 3 merged URLs, got %v", merged)
+	}
+
+	if _, err := shard.MergeOutputs(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// Memory is an in-process Backend. It is the default when no shared backend is configured.
+type Memory struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	seen     map[string]bool
+	frontier []Task
+	leases   map[string]Lease
+	crawled  map[string]bool
+	pages    map[string][]byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		now:     time.Now,
+		seen:    make(map[string]bool),
+		leases:  make(map[string]Lease),
+		crawled: make(map[string]bool),
+		pages:   make(map[string][]byte),
+	}
+}
+
+func (m *Memory) Claim(url string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seen[url] {
+		return false, nil
+	}
+	m.seen[url] = true
+	return true, nil
+}
+
+func (m *Memory) Push(task Task) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.frontier = append(m.frontier, task)
+	return nil
+}
+
+func (m *Memory) Pop() (*Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.frontier) == 0 {
+		return nil, nil
+	}
+	task := m.frontier[0]
+	m.frontier = m.frontier[1:]
+	return &task, nil
+}
+
+func (m *Memory) QueueLen() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.frontier), nil
+}
+
+func (m *Memory) AddLease(lease Lease) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.leases[lease.ID] = lease
+	return nil
+}
+
+func (m *Memory) TakeLease(id string) (*Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lease, ok := m.leases[id]
+	if !ok || !m.now().Before(lease.ExpiresAt) {
+		return nil, nil
+	}
+	delete(m.leases, id)
+	return &lease, nil
+}
+
+func (m *Memory) ExpiredLeases(now time.Time) ([]Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var expired []Lease
+	for id, lease := range m.leases {
+		if now.Before(lease.ExpiresAt) {
+			continue
+		}
+		delete(m.leases, id)
+		expired = append(expired, lease)
+	}
+	return expired, nil
+}
+
+func (m *Memory) LeaseCount() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.leases), nil
+}
+
+func (m *Memory) MarkCrawled(url string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.crawled[url] = true
+	return nil
+}
+
+func (m *Memory) Crawled() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	urls := make([]string, 0, len(m.crawled))
+	for url := range m.crawled {
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+func (m *Memory) SavePage(url string, record []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pages[url] = record
+	return nil
+}
+
+func (m *Memory) Pages() ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records := make([][]byte, 0, len(m.pages))
+	for _, record := range m.pages {
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,217 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Redis is a Backend stored in any server speaking the Redis protocol.
+//
+// Key layout, all under a common prefix so several crawls can share a server:
+// - seen        set of claimed URLs, SADD
+// - frontier    list of JSON tasks, RPUSH/LPOP
+// - lease:<id>  liveness key with a PX TTL matching the lease expiry
+// - leases      sorted set of lease ids scored by expiry in unix milliseconds
+// - lease-data  hash of lease id to JSON lease, kept so expired leases can be requeued
+// - crawled     set of successfully crawled URLs
+// - pages       hash of URL to JSON page record
+type Redis struct {
+	client *Client
+	prefix string
+}
+
+func NewRedis(addr string, prefix string) (*Redis, error) {
+	client, err := Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Do("PING"); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("pinging %s: %w", addr, err)
+	}
+	return &Redis{client: client, prefix: prefix}, nil
+}
+
+func (r *Redis) key(parts ...string) string {
+	key := r.prefix
+	for i, part := range parts {
+		if i > 0 {
+			key += ":"
+		}
+		key += part
+	}
+	return key
+}
+
+// Reset deletes the crawl state under the prefix, so a new crawl does not find the URLs of an
+// earlier one already claimed or queued. Lease liveness keys are left to expire.
+func (r *Redis) Reset() error {
+	_, err := r.client.Do("DEL", r.key("seen"), r.key("frontier"), r.key("leases"), r.key("lease-data"), r.key("crawled"), r.key("pages"))
+	return err
+}
+
+func (r *Redis) Claim(url string) (bool, error) {
+	reply, err := r.client.Do("SADD", r.key("seen"), url)
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+func (r *Redis) Push(task Task) error {
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Do("RPUSH", r.key("frontier"), string(payload))
+	return err
+}
+
+func (r *Redis) Pop() (*Task, error) {
+	reply, err := r.client.Do("LPOP", r.key("frontier"))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	var task Task
+	if err := json.Unmarshal([]byte(reply.(string)), &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (r *Redis) QueueLen() (int, error) {
+	return r.integer("LLEN", r.key("frontier"))
+}
+
+func (r *Redis) AddLease(lease Lease) error {
+	payload, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(lease.ExpiresAt).Milliseconds()
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	if _, err := r.client.Do("HSET", r.key("lease-data"), lease.ID, string(payload)); err != nil {
+		return err
+	}
+	if _, err := r.client.Do("ZADD", r.key("leases"), strconv.FormatInt(lease.ExpiresAt.UnixMilli(), 10), lease.ID); err != nil {
+		return err
+	}
+	_, err = r.client.Do("SET", r.key("lease", lease.ID), lease.Worker, "PX", strconv.FormatInt(ttl, 10))
+	return err
+}
+
+func (r *Redis) TakeLease(id string) (*Lease, error) {
+	// The liveness key disappears on its own once the TTL passes, so a missing key
+	// means the lease expired even if nobody has reaped it yet.
+	live, err := r.client.Do("DEL", r.key("lease", id))
+	if err != nil {
+		return nil, err
+	}
+	if live != int64(1) {
+		return nil, nil
+	}
+	return r.removeLease(id)
+}
+
+func (r *Redis) ExpiredLeases(now time.Time) ([]Lease, error) {
+	reply, err := r.client.Do("ZRANGEBYSCORE", r.key("leases"), "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []Lease
+	for _, id := range reply.([]interface{}) {
+		lease, err := r.removeLease(id.(string))
+		if err != nil {
+			return expired, err
+		}
+		if lease != nil {
+			expired = append(expired, *lease)
+		}
+	}
+	return expired, nil
+}
+
+// removeLease drops a lease from the index. Only the caller whose ZREM succeeds gets the
+// lease back, so a lease is never both completed and requeued.
+func (r *Redis) removeLease(id string) (*Lease, error) {
+	removed, err := r.client.Do("ZREM", r.key("leases"), id)
+	if err != nil || removed != int64(1) {
+		return nil, err
+	}
+
+	data, err := r.client.Do("HGET", r.key("lease-data"), id)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	if _, err := r.client.Do("HDEL", r.key("lease-data"), id); err != nil {
+		return nil, err
+	}
+
+	var lease Lease
+	if err := json.Unmarshal([]byte(data.(string)), &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+func (r *Redis) LeaseCount() (int, error) {
+	return r.integer("ZCARD", r.key("leases"))
+}
+
+func (r *Redis) MarkCrawled(url string) error {
+	_, err := r.client.Do("SADD", r.key("crawled"), url)
+	return err
+}
+
+func (r *Redis) Crawled() ([]string, error) {
+	reply, err := r.client.Do("SMEMBERS", r.key("crawled"))
+	if err != nil {
+		return nil, err
+	}
+	members := reply.([]interface{})
+	urls := make([]string, len(members))
+	for i, member := range members {
+		urls[i] = member.(string)
+	}
+	return urls, nil
+}
+
+func (r *Redis) SavePage(url string, record []byte) error {
+	_, err := r.client.Do("HSET", r.key("pages"), url, string(record))
+	return err
+}
+
+func (r *Redis) Pages() ([][]byte, error) {
+	reply, err := r.client.Do("HVALS", r.key("pages"))
+	if err != nil {
+		return nil, err
+	}
+	values := reply.([]interface{})
+	records := make([][]byte, len(values))
+	for i, value := range values {
+		records[i] = []byte(value.(string))
+	}
+	return records, nil
+}
+
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+func (r *Redis) integer(args ...string) (int, error) {
+	reply, err := r.client.Do(args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("%s: expected integer reply, got %T", args[0], reply)
+	}
+	return int(n), nil
+}
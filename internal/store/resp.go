@@ -0,0 +1,129 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RespError is an error reply ("-ERR ...") returned by a RESP server.
+type RespError string
+
+func (e RespError) Error() string {
+	return string(e)
+}
+
+// ReadValue decodes one RESP value. Simple and bulk strings decode to string, integers to int64,
+// arrays to []interface{}, null bulk strings and arrays to nil, and error replies to RespError.
+func ReadValue(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("resp: empty line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return RespError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("resp: invalid bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("resp: invalid array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = ReadValue(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("resp: unexpected type byte %q", line[0])
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("resp: malformed line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// WriteCommand encodes args as a RESP array of bulk strings.
+func WriteCommand(w *bufio.Writer, args ...string) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return w.Flush()
+}
+
+// Client is a minimal RESP client over a single connection. Commands are serialised,
+// which is plenty for the coordinator's request rate.
+type Client struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func Dial(addr string) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}, nil
+}
+
+// Do sends a command and returns its reply. Error replies are returned as a RespError.
+func (c *Client) Do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := WriteCommand(c.writer, args...); err != nil {
+		return nil, err
+	}
+	reply, err := ReadValue(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	if respErr, ok := reply.(RespError); ok {
+		return nil, respErr
+	}
+	return reply, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,433 @@
+// Package resptest provides an in-process server speaking the Redis protocol, so code using
+// the RESP backend can be tested without a real Redis. It implements only the commands the
+// crawler uses, with the same reply shapes as Redis.
+package resptest
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/store"
+)
+
+type entry struct {
+	str     string
+	list    []string
+	hash    map[string]string
+	set     map[string]bool
+	zset    map[string]float64
+	expires time.Time
+}
+
+// Server is a RESP stand-in listening on a random local port.
+type Server struct {
+	Addr string
+
+	listener net.Listener
+	mu       sync.Mutex
+	data     map[string]*entry
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a server on 127.0.0.1. Call Close when done.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{Addr: listener.Addr().String(), listener: listener, data: make(map[string]*entry), conns: make(map[net.Conn]bool)}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Close stops accepting connections and disconnects all clients.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		value, err := store.ReadValue(reader)
+		if err != nil {
+			return
+		}
+		parts, ok := value.([]interface{})
+		if !ok || len(parts) == 0 {
+			writeReply(writer, store.RespError("ERR protocol error"))
+			continue
+		}
+		args := make([]string, len(parts))
+		for i, part := range parts {
+			args[i], _ = part.(string)
+		}
+
+		s.mu.Lock()
+		reply := s.execute(strings.ToUpper(args[0]), args[1:])
+		s.mu.Unlock()
+
+		writeReply(writer, reply)
+	}
+}
+
+// lookup returns a live key, dropping it if its TTL has passed.
+func (s *Server) lookup(key string) *entry {
+	e, ok := s.data[key]
+	if !ok {
+		return nil
+	}
+	if !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		delete(s.data, key)
+		return nil
+	}
+	return e
+}
+
+func (s *Server) lookupOrCreate(key string) *entry {
+	if e := s.lookup(key); e != nil {
+		return e
+	}
+	e := &entry{}
+	s.data[key] = e
+	return e
+}
+
+func (s *Server) execute(cmd string, args []string) interface{} {
+	arity := map[string]int{
+		"PING": 0, "FLUSHALL": 0, "GET": 1, "SET": 2, "SETNX": 2, "DEL": 1, "EXISTS": 1, "INCR": 1,
+		"RPUSH": 2, "LPUSH": 2, "LPOP": 1, "LLEN": 1, "HSET": 3, "HGET": 2, "HDEL": 2, "HVALS": 1,
+		"SADD": 2, "SMEMBERS": 1, "SCARD": 1, "SISMEMBER": 2,
+		"ZADD": 3, "ZREM": 2, "ZCARD": 1, "ZRANGEBYSCORE": 3, "ZPOPMIN": 1,
+	}
+	min, known := arity[cmd]
+	if !known {
+		return store.RespError(fmt.Sprintf("ERR unknown command '%s'", cmd))
+	}
+	if len(args) < min {
+		return store.RespError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+	}
+
+	switch cmd {
+	case "PING":
+		return simple("PONG")
+	case "FLUSHALL":
+		s.data = make(map[string]*entry)
+		return simple("OK")
+	case "GET":
+		if e := s.lookup(args[0]); e != nil {
+			return e.str
+		}
+		return nil
+	case "SET":
+		return s.set(args)
+	case "SETNX":
+		if s.lookup(args[0]) != nil {
+			return int64(0)
+		}
+		s.data[args[0]] = &entry{str: args[1]}
+		return int64(1)
+	case "DEL", "EXISTS":
+		var n int64
+		for _, key := range args {
+			if s.lookup(key) != nil {
+				n++
+				if cmd == "DEL" {
+					delete(s.data, key)
+				}
+			}
+		}
+		return n
+	case "INCR":
+		e := s.lookupOrCreate(args[0])
+		n, _ := strconv.ParseInt(e.str, 10, 64)
+		n++
+		e.str = strconv.FormatInt(n, 10)
+		return n
+	case "RPUSH", "LPUSH":
+		e := s.lookupOrCreate(args[0])
+		for _, v := range args[1:] {
+			if cmd == "RPUSH" {
+				e.list = append(e.list, v)
+			} else {
+				e.list = append([]string{v}, e.list...)
+			}
+		}
+		return int64(len(e.list))
+	case "LPOP":
+		e := s.lookup(args[0])
+		if e == nil || len(e.list) == 0 {
+			return nil
+		}
+		v := e.list[0]
+		e.list = e.list[1:]
+		if len(e.list) == 0 {
+			delete(s.data, args[0])
+		}
+		return v
+	case "LLEN":
+		if e := s.lookup(args[0]); e != nil {
+			return int64(len(e.list))
+		}
+		return int64(0)
+	case "HSET":
+		e := s.lookupOrCreate(args[0])
+		if e.hash == nil {
+			e.hash = make(map[string]string)
+		}
+		var added int64
+		for i := 1; i+1 < len(args); i += 2 {
+			if _, ok := e.hash[args[i]]; !ok {
+				added++
+			}
+			e.hash[args[i]] = args[i+1]
+		}
+		return added
+	case "HGET":
+		if e := s.lookup(args[0]); e != nil {
+			if v, ok := e.hash[args[1]]; ok {
+				return v
+			}
+		}
+		return nil
+	case "HVALS":
+		values := []interface{}{}
+		if e := s.lookup(args[0]); e != nil {
+			for _, v := range e.hash {
+				values = append(values, v)
+			}
+		}
+		return values
+	case "HDEL":
+		var n int64
+		if e := s.lookup(args[0]); e != nil {
+			for _, field := range args[1:] {
+				if _, ok := e.hash[field]; ok {
+					delete(e.hash, field)
+					n++
+				}
+			}
+		}
+		return n
+	case "SADD":
+		e := s.lookupOrCreate(args[0])
+		if e.set == nil {
+			e.set = make(map[string]bool)
+		}
+		var added int64
+		for _, member := range args[1:] {
+			if !e.set[member] {
+				e.set[member] = true
+				added++
+			}
+		}
+		return added
+	case "SMEMBERS":
+		members := []interface{}{}
+		if e := s.lookup(args[0]); e != nil {
+			for member := range e.set {
+				members = append(members, member)
+			}
+		}
+		return members
+	case "SCARD":
+		if e := s.lookup(args[0]); e != nil {
+			return int64(len(e.set))
+		}
+		return int64(0)
+	case "SISMEMBER":
+		if e := s.lookup(args[0]); e != nil && e.set[args[1]] {
+			return int64(1)
+		}
+		return int64(0)
+	case "ZADD":
+		e := s.lookupOrCreate(args[0])
+		if e.zset == nil {
+			e.zset = make(map[string]float64)
+		}
+		var added int64
+		for i := 1; i+1 < len(args); i += 2 {
+			score, err := parseScore(args[i])
+			if err != nil {
+				return store.RespError("ERR value is not a valid float")
+			}
+			if _, ok := e.zset[args[i+1]]; !ok {
+				added++
+			}
+			e.zset[args[i+1]] = score
+		}
+		return added
+	case "ZREM":
+		var n int64
+		if e := s.lookup(args[0]); e != nil {
+			for _, member := range args[1:] {
+				if _, ok := e.zset[member]; ok {
+					delete(e.zset, member)
+					n++
+				}
+			}
+		}
+		return n
+	case "ZCARD":
+		if e := s.lookup(args[0]); e != nil {
+			return int64(len(e.zset))
+		}
+		return int64(0)
+	case "ZRANGEBYSCORE":
+		min, errMin := parseScore(args[1])
+		max, errMax := parseScore(args[2])
+		if errMin != nil || errMax != nil {
+			return store.RespError("ERR min or max is not a float")
+		}
+		members := []interface{}{}
+		for _, m := range s.sortedMembers(args[0]) {
+			if m.score >= min && m.score <= max {
+				members = append(members, m.member)
+			}
+		}
+		return members
+	case "ZPOPMIN":
+		sorted := s.sortedMembers(args[0])
+		if len(sorted) == 0 {
+			return []interface{}{}
+		}
+		delete(s.data[args[0]].zset, sorted[0].member)
+		return []interface{}{sorted[0].member, strconv.FormatFloat(sorted[0].score, 'f', -1, 64)}
+	}
+	return store.RespError("ERR unhandled command")
+}
+
+// set implements SET key value [NX] [PX milliseconds | EX seconds].
+func (s *Server) set(args []string) interface{} {
+	key, value := args[0], args[1]
+	var nx bool
+	var expires time.Time
+
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "PX", "EX":
+			if i+1 >= len(args) {
+				return store.RespError("ERR syntax error")
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return store.RespError("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Millisecond
+			if strings.ToUpper(args[i]) == "EX" {
+				unit = time.Second
+			}
+			expires = time.Now().Add(time.Duration(n) * unit)
+			i++
+		default:
+			return store.RespError("ERR syntax error")
+		}
+	}
+
+	if nx && s.lookup(key) != nil {
+		return nil
+	}
+	s.data[key] = &entry{str: value, expires: expires}
+	return simple("OK")
+}
+
+type scored struct {
+	member string
+	score  float64
+}
+
+func (s *Server) sortedMembers(key string) []scored {
+	e := s.lookup(key)
+	if e == nil {
+		return nil
+	}
+	members := make([]scored, 0, len(e.zset))
+	for member, score := range e.zset {
+		members = append(members, scored{member, score})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].score != members[j].score {
+			return members[i].score < members[j].score
+		}
+		return members[i].member < members[j].member
+	})
+	return members
+}
+
+func parseScore(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "-inf":
+		return math.Inf(-1), nil
+	case "+inf", "inf":
+		return math.Inf(1), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+type simple string
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	writeValue(w, reply)
+	w.Flush()
+}
+
+func writeValue(w *bufio.Writer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case simple:
+		fmt.Fprintf(w, "+%s\r\n", string(v))
+	case store.RespError:
+		fmt.Fprintf(w, "-%s\r\n", string(v))
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeValue(w, item)
+		}
+	}
+}
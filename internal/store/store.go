@@ -0,0 +1,53 @@
+package store
+
+import (
+	"time"
+)
+
+// Task is a URL waiting on the frontier.
+type Task struct {
+	URL   string `json:"url"`
+	Depth int    `json:"depth"`
+}
+
+// Lease records a Task handed to a worker until ExpiresAt.
+type Lease struct {
+	ID        string    `json:"id"`
+	Task      Task      `json:"task"`
+	Worker    string    `json:"worker"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Backend holds the shared state of a crawl: the set of URLs claimed so far, the frontier,
+// outstanding leases and the URLs that were crawled successfully.
+//
+// Implementations must make Claim and TakeLease atomic, so that several coordinators
+// sharing one backend never queue the same URL twice or complete the same lease twice.
+type Backend interface {
+	// Claim marks url as seen. It returns true only for the first caller.
+	Claim(url string) (bool, error)
+	// Push appends a task to the frontier.
+	Push(task Task) error
+	// Pop removes the next task from the frontier, or returns nil if it is empty.
+	Pop() (*Task, error)
+	// QueueLen returns the number of tasks on the frontier.
+	QueueLen() (int, error)
+	// AddLease records a lease that stays live until its ExpiresAt.
+	AddLease(lease Lease) error
+	// TakeLease removes and returns a live lease, or nil if it is unknown or has expired.
+	TakeLease(id string) (*Lease, error)
+	// ExpiredLeases removes and returns leases that expired at or before now.
+	ExpiredLeases(now time.Time) ([]Lease, error)
+	// LeaseCount returns the number of leases that have not been taken or reaped.
+	LeaseCount() (int, error)
+	// MarkCrawled records a successfully crawled URL.
+	MarkCrawled(url string) error
+	// Crawled returns every URL recorded by MarkCrawled.
+	Crawled() ([]string, error)
+	// SavePage stores the JSON record of a crawled or failed page, replacing any earlier one for url.
+	SavePage(url string, record []byte) error
+	// Pages returns every record stored by SavePage, in no particular order.
+	Pages() ([][]byte, error)
+	// Close releases any resources held by the backend.
+	Close() error
+}
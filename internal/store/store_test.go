@@ -0,0 +1,198 @@
+package store_test
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/store"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/store/resptest"
+)
+
+// forEachBackend runs fn against the in-memory backend and the RESP backend on a stand-in server.
+func forEachBackend(t *testing.T, fn func(t *testing.T, backend store.Backend)) {
+	t.Run("Memory", func(t *testing.T) {
+		fn(t, store.NewMemory())
+	})
+
+	t.Run("RESP", func(t *testing.T) {
+		server, err := resptest.NewServer()
+		if err != nil {
+			t.Fatalf("Failed to start RESP stand-in: %v", err)
+		}
+		defer server.Close()
+
+		backend, err := store.NewRedis(server.Addr, "crawl:")
+		if err != nil {
+			t.Fatalf("NewRedis failed: %v", err)
+		}
+		defer backend.Close()
+
+		fn(t, backend)
+	})
+}
+
+func TestBackend_ClaimOnlyOnce(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend store.Backend) {
+		first, err := backend.Claim("https://example.com/a")
+		if err != nil || !first {
+			t.Fatalf("Expected first claim to succeed, got %v, %v", first, err)
+		}
+		second, err := backend.Claim("https://example.com/a")
+		if err != nil || second {
+			t.Errorf("Expected second claim to fail, got %v, %v", second, err)
+		}
+	})
+}
+
+func TestBackend_FrontierIsFIFO(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend store.Backend) {
+		for i, url := range []string{"https://example.com/a", "https://example.com/b"} {
+			if err := backend.Push(store.Task{URL: url, Depth: i}); err != nil {
+				t.Fatalf("Push failed: %v", err)
+			}
+		}
+		if n, _ := backend.QueueLen(); n != 2 {
+			t.Errorf("Expected queue length 2, got %d", n)
+		}
+
+		first, _ := backend.Pop()
+		second, _ := backend.Pop()
+		empty, _ := backend.Pop()
+		if first == nil || first.URL != "https://example.com/a" || second == nil || second.Depth != 1 || empty != nil {
+			t.Errorf("Unexpected pop order: %+v, %+v, %+v", first, second, empty)
+		}
+	})
+}
+
+func TestBackend_LeasesExpire(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend store.Backend) {
+		task := store.Task{URL: "https://example.com/a"}
+		backend.AddLease(store.Lease{ID: "short", Task: task, Worker: "w1", ExpiresAt: time.Now().Add(30 * time.Millisecond)})
+		backend.AddLease(store.Lease{ID: "long", Task: task, Worker: "w2", ExpiresAt: time.Now().Add(time.Minute)})
+
+		if n, _ := backend.LeaseCount(); n != 2 {
+			t.Fatalf("Expected 2 leases, got %d", n)
+		}
+
+		time.Sleep(60 * time.Millisecond)
+
+		if lease, err := backend.TakeLease("short"); err != nil || lease != nil {
+			t.Errorf("Expected expired lease to be unavailable, got %+v, %v", lease, err)
+		}
+
+		expired, err := backend.ExpiredLeases(time.Now())
+		if err != nil || len(expired) != 1 || expired[0].ID != "short" || expired[0].Task.URL != task.URL {
+			t.Errorf("Expected the short lease to be reaped, got %+v, %v", expired, err)
+		}
+
+		lease, err := backend.TakeLease("long")
+		if err != nil || lease == nil || lease.Worker != "w2" {
+			t.Errorf("Expected live lease to be taken, got %+v, %v", lease, err)
+		}
+		if lease, _ := backend.TakeLease("long"); lease != nil {
+			t.Error("Expected a lease to be taken only once")
+		}
+		if n, _ := backend.LeaseCount(); n != 0 {
+			t.Errorf("Expected no leases left, got %d", n)
+		}
+	})
+}
+
+func TestBackend_Crawled(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend store.Backend) {
+		backend.MarkCrawled("https://example.com/b")
+		backend.MarkCrawled("https://example.com/a")
+		backend.MarkCrawled("https://example.com/a")
+
+		urls, err := backend.Crawled()
+		if err != nil {
+			t.Fatalf("Crawled failed: %v", err)
+		}
+		sort.Strings(urls)
+		if len(urls) != 2 || urls[0] != "https://example.com/a" {
+			t.Errorf("Unexpected crawled URLs: %v", urls)
+		}
+	})
+}
+
+func TestBackend_PagesKeepTheLastRecordPerURL(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend store.Backend) {
+		backend.SavePage("https://example.com/a", []byte(`{"status":500}`))
+		backend.SavePage("https://example.com/a", []byte(`{"status":200}`))
+		backend.SavePage("https://example.com/b", []byte(`{"status":404}`))
+
+		pages, err := backend.Pages()
+		if err != nil {
+			t.Fatalf("Pages failed: %v", err)
+		}
+		records := make([]string, len(pages))
+		for i, page := range pages {
+			records[i] = string(page)
+		}
+		sort.Strings(records)
+		if len(records) != 2 || records[0] != `{"status":200}` || records[1] != `{"status":404}` {
+			t.Errorf("Unexpected page records: %v", records)
+		}
+	})
+}
+
+func TestRedis_ResetForgetsTheLastCrawl(t *testing.T) {
+	server, err := resptest.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to start RESP stand-in: %v", err)
+	}
+	defer server.Close()
+
+	backend, err := store.NewRedis(server.Addr, "crawl:")
+	if err != nil {
+		t.Fatalf("NewRedis failed: %v", err)
+	}
+	defer backend.Close()
+	backend.Claim("https://example.com/a")
+	backend.Push(store.Task{URL: "https://example.com/b"})
+	backend.MarkCrawled("https://example.com/a")
+	backend.SavePage("https://example.com/a", []byte(`{}`))
+
+	if err := backend.Reset(); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if claimed, err := backend.Claim("https://example.com/a"); err != nil || !claimed {
+		t.Errorf("Expected a URL of the last crawl to be claimable again, got %v, %v", claimed, err)
+	}
+	if n, _ := backend.QueueLen(); n != 0 {
+		t.Errorf("Expected an empty frontier, got %d tasks", n)
+	}
+	if urls, _ := backend.Crawled(); len(urls) != 0 {
+		t.Errorf("Expected no crawled URLs, got %v", urls)
+	}
+	if pages, _ := backend.Pages(); len(pages) != 0 {
+		t.Errorf("Expected no page records, got %d", len(pages))
+	}
+}
+
+func TestClient_ErrorReply(t *testing.T) {
+	server, err := resptest.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to start RESP stand-in: %v", err)
+	}
+	defer server.Close()
+
+	client, err := store.Dial(server.Addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+
+	_, err = client.Do("NOSUCHCOMMAND")
+	var respErr store.RespError
+	if !errors.As(err, &respErr) {
+		t.Errorf("Expected RespError, got %v", err)
+	}
+
+	// The connection stays usable after an error reply.
+	if reply, err := client.Do("PING"); err != nil || reply != "PONG" {
+		t.Errorf("Expected PONG, got %v, %v", reply, err)
+	}
+}
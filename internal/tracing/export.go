@@ -0,0 +1,200 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceName identifies the crawler in exported resources.
+const ServiceName = "monzo-web-crawler"
+
+// TracesPath is where OTLP/HTTP collectors accept trace exports.
+const TracesPath = "/v1/traces"
+
+// Exporter sends batches of finished spans somewhere.
+type Exporter interface {
+	Export(spans []SpanData) error
+	Close() error
+}
+
+// FileExporter appends one OTLP/JSON export request per line to a file, the same layout the
+// OpenTelemetry collector's file exporter writes, so the file can be replayed into a collector.
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileExporter opens path for appending.
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file}, nil
+}
+
+func (e *FileExporter) Export(spans []SpanData) error {
+	data, err := Marshal(spans)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.file.Write(append(data, '\n'))
+	return err
+}
+
+func (e *FileExporter) Close() error {
+	return e.file.Close()
+}
+
+// HTTPExporter posts OTLP/JSON export requests to a collector's OTLP/HTTP receiver.
+type HTTPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewHTTPExporter exports to endpoint, the collector's base URL such as http://localhost:4318.
+func NewHTTPExporter(endpoint string) *HTTPExporter {
+	return &HTTPExporter{
+		endpoint: strings.TrimRight(endpoint, "/") + TracesPath,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *HTTPExporter) Export(spans []SpanData) error {
+	data, err := Marshal(spans)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *HTTPExporter) Close() error {
+	return nil
+}
+
+// The types below follow the OTLP/JSON encoding: IDs are hex, 64-bit integers are strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              Kind       `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// statusError is the OTLP status code for a failed span.
+const statusError = 2
+
+// Marshal encodes spans as an OTLP/JSON ExportTraceServiceRequest.
+func Marshal(spans []SpanData) ([]byte, error) {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(spans))}
+	scope.Scope.Name = ServiceName
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        encodeAttrs(s.Attrs),
+		}
+		if s.ParentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.ParentID[:])
+		}
+		if s.Err != "" {
+			span.Status = otlpStatus{Code: statusError, Message: s.Err}
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: encodeAttrs([]Attr{String("service.name", ServiceName)})},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+}
+
+func encodeAttrs(attrs []Attr) []otlpAttr {
+	encoded := make([]otlpAttr, 0, len(attrs))
+	for _, attr := range attrs {
+		var value otlpValue
+		switch v := attr.Value.(type) {
+		case string:
+			value.StringValue = &v
+		case bool:
+			value.BoolValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		encoded = append(encoded, otlpAttr{Key: attr.Key, Value: value})
+	}
+	return encoded
+}
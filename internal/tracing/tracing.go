@@ -0,0 +1,218 @@
+// Package tracing records spans for each crawled URL and exports them as OTLP/JSON, either to a
+// local file or to an OpenTelemetry collector. A nil *Tracer and nil *Span are valid no-ops, so
+// tracing can be threaded through the crawler without checks at every call site.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// DefaultFlushInterval is how often finished spans are exported.
+const DefaultFlushInterval = 5 * time.Second
+
+// maxBatch is the most spans sent in one export.
+const maxBatch = 512
+
+// Kind is the OTLP span kind.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindClient   Kind = 3
+)
+
+// Attr is a span attribute. Values may be strings, bools, ints, int64s or float64s.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key, value string) Attr    { return Attr{key, value} }
+func Int(key string, value int) Attr   { return Attr{key, value} }
+func Bool(key string, value bool) Attr { return Attr{key, value} }
+
+// SpanData is a finished span as handed to exporters.
+type SpanData struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte
+	Name     string
+	Kind     Kind
+	Start    time.Time
+	End      time.Time
+	Attrs    []Attr
+	Err      string
+}
+
+// Span is an operation in progress.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// Tracer creates spans and exports them in batches.
+type Tracer struct {
+	exporter Exporter
+	mu       sync.Mutex
+	pending  []SpanData
+	done     chan struct{}
+	wg       sync.WaitGroup
+	onError  func(error)
+}
+
+// NewTracer returns a tracer exporting finished spans every interval. Export errors are passed
+// to onError, which may be nil.
+func NewTracer(exporter Exporter, interval time.Duration, onError func(error)) *Tracer {
+	t := &Tracer{exporter: exporter, done: make(chan struct{}), onError: onError}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-ticker.C:
+				t.Flush()
+			}
+		}
+	}()
+	return t
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the span stored in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start begins a span, as a child of the span in ctx if there is one, and returns a context
+// carrying the new span.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind, attrs ...Attr) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: t, data: SpanData{Name: name, Kind: kind, Start: time.Now(), Attrs: attrs}}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.data.TraceID = parent.data.TraceID
+		span.data.ParentID = parent.data.SpanID
+	} else {
+		rand.Read(span.data.TraceID[:])
+	}
+	rand.Read(span.data.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Shutdown exports any remaining spans and stops the tracer.
+func (t *Tracer) Shutdown() error {
+	if t == nil {
+		return nil
+	}
+	close(t.done)
+	t.wg.Wait()
+	err := t.Flush()
+	if closeErr := t.exporter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (t *Tracer) finish(data SpanData) {
+	t.mu.Lock()
+	t.pending = append(t.pending, data)
+	full := len(t.pending) >= maxBatch
+	t.mu.Unlock()
+	if full {
+		go t.Flush()
+	}
+}
+
+// Flush exports the spans finished so far.
+func (t *Tracer) Flush() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	batch := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	var err error
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > maxBatch {
+			n = maxBatch
+		}
+		if exportErr := t.exporter.Export(batch[:n]); exportErr != nil {
+			err = exportErr
+			if t.onError != nil {
+				t.onError(exportErr)
+			}
+		}
+		batch = batch[n:]
+	}
+	return err
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attrs = append(s.data.Attrs, attrs...)
+}
+
+// RecordError marks the span as failed.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Err = err.Error()
+}
+
+// Record adds an already finished child span, such as a phase timed by an httptrace hook.
+func (s *Span) Record(name string, start, end time.Time, attrs ...Attr) {
+	if s == nil || start.IsZero() || end.IsZero() {
+		return
+	}
+	child := SpanData{
+		TraceID:  s.data.TraceID,
+		ParentID: s.data.SpanID,
+		Name:     name,
+		Kind:     KindInternal,
+		Start:    start,
+		End:      end,
+		Attrs:    attrs,
+	}
+	rand.Read(child.SpanID[:])
+	s.tracer.finish(child)
+}
+
+// End finishes the span. Only the first call has any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	s.tracer.finish(data)
+}
@@ -0,0 +1,170 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/crawler"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/parser"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shared"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/tracing"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+type exportedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Status       struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+type exportRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []exportedSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// collector stands in for an OpenTelemetry collector's OTLP/HTTP receiver.
+type collector struct {
+	mu    sync.Mutex
+	spans []exportedSpan
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != tracing.TracesPath || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func TestTracer_ExportsCrawlSpansToCollector(t *testing.T) {
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`<a href="/gone">Gone</a>`))
+	}))
+	defer site.Close()
+
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = site.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	c := &collector{}
+	otlp := httptest.NewServer(c)
+	defer otlp.Close()
+
+	tracer := tracing.NewTracer(tracing.NewHTTPExporter(otlp.URL), time.Hour, func(err error) { t.Errorf("export failed: %v", err) })
+	cr := crawler.NewCrawler(fetcher.NewFetcher(time.Second), parser.NewParser(), utils.NewLogger(), time.NewTicker(time.Millisecond), 1)
+	cr.SetTracer(tracer)
+
+	used := &shared.UsedURL{CrawledURLs: make(map[string]bool), VisitedPaths: make(map[string]bool)}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	cr.Crawl(site.URL, 1, site.URL, 0, used, &wg, utils.NewLogger())
+	wg.Wait()
+
+	if err := tracer.Shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	byName := make(map[string][]exportedSpan)
+	for _, span := range c.spans {
+		byName[span.Name] = append(byName[span.Name], span)
+	}
+	for _, name := range []string{"crawl", "http.request", "connect", "tls_handshake", "time_to_first_byte", "parse", "check_internal"} {
+		if len(byName[name]) == 0 {
+			t.Fatalf("Expected a %s span, got %v", name, byName)
+		}
+	}
+
+	crawls := make(map[string]exportedSpan)
+	for _, span := range byName["crawl"] {
+		crawls[span.SpanID] = span
+	}
+	if len(crawls) != 2 {
+		t.Fatalf("Expected a crawl span per URL, got %d", len(crawls))
+	}
+	failed := 0
+	for _, span := range crawls {
+		if span.Status.Code == 2 {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("Expected the 404 page's crawl span to be marked failed, got %d failed", failed)
+	}
+
+	for _, name := range []string{"http.request", "parse", "check_internal"} {
+		for _, span := range byName[name] {
+			if parent, ok := crawls[span.ParentSpanID]; !ok || parent.TraceID != span.TraceID {
+				t.Errorf("%s span should be a child of a crawl span: %+v", name, span)
+			}
+		}
+	}
+
+	attempts := make(map[string]bool)
+	for _, span := range byName["http.request"] {
+		attempts[span.SpanID] = true
+	}
+	for _, span := range byName["connect"] {
+		if !attempts[span.ParentSpanID] {
+			t.Errorf("connect span should be a child of a request attempt: %+v", span)
+		}
+	}
+}
+
+func TestFileExporter_WritesOneRequestPerLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	exporter, err := tracing.NewFileExporter(path)
+	if err != nil {
+		t.Fatalf("NewFileExporter failed: %v", err)
+	}
+	tracer := tracing.NewTracer(exporter, time.Hour, nil)
+
+	for i := 0; i < 2; i++ {
+		_, span := tracer.Start(context.Background(), "crawl", tracing.KindInternal, tracing.String("url", "https://monzo.com"))
+		span.RecordError(errors.New("boom"))
+		span.End()
+		tracer.Flush()
+	}
+	tracer.Shutdown()
+
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 export requests, got %d", len(lines))
+	}
+	var req exportRequest
+	if err := json.Unmarshal([]byte(lines[0]), &req); err != nil || req.ResourceSpans[0].ScopeSpans[0].Spans[0].Status.Code != 2 {
+		t.Errorf("Unexpected export request %s (%v)", lines[0], err)
+	}
+}
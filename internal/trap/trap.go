@@ -0,0 +1,314 @@
+// Package trap detects spider traps: parts of a site, such as calendars, faceted search or
+// session IDs in paths, where following links would keep producing new URLs forever.
+package trap
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+)
+
+// Kinds of trap, as reported in output.Trap.Kind.
+const (
+	// KindLongURL is a URL longer than Limits.MaxURLLength.
+	KindLongURL = "long_url"
+	// KindRepeatingSegments is a path with one segment more than Limits.MaxRepeats times, as
+	// produced by relative links that resolve one level deeper on every page.
+	KindRepeatingSegments = "repeating_segments"
+	// KindPatternBudget is a path pattern, such as /calendar/{n}/{n}, with more than
+	// Limits.PatternBudget URLs.
+	KindPatternBudget = "pattern_budget"
+	// KindBudget is a pattern given in Limits.Budgets with more URLs than its budget.
+	KindBudget = "budget"
+	// KindQueryVariants is a page linked with more than Limits.QueryVariants query strings. The
+	// crawler drops queries, so these are reported but never crawled twice.
+	KindQueryVariants = "query_variants"
+)
+
+// MaxSamples is the number of URLs kept as examples of each trap.
+const MaxSamples = 5
+
+// Limits are the thresholds beyond which URLs count as a trap. A zero limit turns its heuristic
+// off.
+type Limits struct {
+	MaxURLLength int
+	// MaxRepeats is the most times one segment may appear in a path.
+	MaxRepeats int
+	// PatternBudget is the most URLs crawled per path pattern, in which numbers and long IDs are
+	// replaced by placeholders. Paths matching one of Budgets use that budget instead.
+	PatternBudget int
+	QueryVariants int
+	Budgets       []Budget
+}
+
+// DefaultLimits returns limits that leave ordinary sites alone.
+func DefaultLimits() Limits {
+	return Limits{MaxURLLength: 512, MaxRepeats: 2, PatternBudget: 1000, QueryVariants: 50}
+}
+
+// Budget caps the number of URLs crawled whose path matches Pattern. In the pattern, * matches
+// within one path segment, as in path.Match, and a final /** matches everything below.
+type Budget struct {
+	Pattern string
+	Max     int
+}
+
+// ParseBudget parses a budget written as pattern=max, such as /calendar/**=50.
+func ParseBudget(spec string) (Budget, error) {
+	pattern, limit, ok := strings.Cut(spec, "=")
+	if !ok {
+		return Budget{}, fmt.Errorf("budget %q must be pattern=max, such as /calendar/**=50", spec)
+	}
+	pattern = strings.TrimSpace(pattern)
+	if !strings.HasPrefix(pattern, "/") {
+		return Budget{}, fmt.Errorf("budget pattern %q must start with /", pattern)
+	}
+	for _, segment := range segments(strings.TrimSuffix(pattern, "/**")) {
+		if _, err := path.Match(segment, ""); err != nil {
+			return Budget{}, fmt.Errorf("budget pattern %q: %w", pattern, err)
+		}
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(limit))
+	if err != nil || n < 0 {
+		return Budget{}, fmt.Errorf("budget %q must end in a number of URLs", spec)
+	}
+	return Budget{Pattern: pattern, Max: n}, nil
+}
+
+// ParseBudgets parses each of specs with ParseBudget.
+func ParseBudgets(specs []string) ([]Budget, error) {
+	var budgets []Budget
+	var errs []error
+	for _, spec := range specs {
+		budget, err := ParseBudget(spec)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		budgets = append(budgets, budget)
+	}
+	return budgets, errors.Join(errs...)
+}
+
+func (b Budget) matches(segs []string) bool {
+	pattern, below := strings.CutSuffix(b.Pattern, "/**")
+	want := segments(pattern)
+	if len(segs) < len(want) || (!below && len(segs) != len(want)) || (below && len(segs) == len(want)) {
+		return false
+	}
+	for i, segment := range want {
+		if ok, _ := path.Match(segment, segs[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Detector checks URLs against Limits and keeps the traps it finds. It is safe for concurrent
+// use.
+type Detector struct {
+	limits Limits
+
+	mu       sync.Mutex
+	counts   map[string]int
+	checked  map[string]string
+	variants map[string]map[string]bool
+	traps    map[string]*output.Trap
+}
+
+// New returns a detector that enforces limits.
+func New(limits Limits) *Detector {
+	return &Detector{
+		limits:   limits,
+		counts:   make(map[string]int),
+		checked:  make(map[string]string),
+		variants: make(map[string]map[string]bool),
+		traps:    make(map[string]*output.Trap),
+	}
+}
+
+// Check counts rawURL, a normalised URL about to be crawled, against the limits. It returns the
+// kind of trap the URL falls into, or "" if it may be crawled. Each URL is only counted once, so
+// a page linked from many others does not use up its pattern's budget; checking it again returns
+// the same answer.
+func (d *Detector) Check(rawURL string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if kind, ok := d.checked[rawURL]; ok {
+		return kind
+	}
+	kind := d.check(rawURL)
+	d.checked[rawURL] = kind
+	return kind
+}
+
+// check counts rawURL against the limits. d.mu must be held.
+func (d *Detector) check(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	segs := segments(u.Path)
+
+	if d.limits.MaxURLLength > 0 && len(rawURL) > d.limits.MaxURLLength {
+		return d.report(KindLongURL, u.Host+Pattern(u.Path), rawURL)
+	}
+	if d.limits.MaxRepeats > 0 && maxRepeats(segs) > d.limits.MaxRepeats {
+		return d.report(KindRepeatingSegments, u.Host+Pattern(u.Path), rawURL)
+	}
+	for _, budget := range d.limits.Budgets {
+		if !budget.matches(segs) {
+			continue
+		}
+		key := KindBudget + " " + budget.Pattern
+		d.counts[key]++
+		if d.counts[key] > budget.Max {
+			return d.report(KindBudget, budget.Pattern, rawURL)
+		}
+		return ""
+	}
+	if d.limits.PatternBudget > 0 {
+		pattern := u.Host + Pattern(u.Path)
+		d.counts[pattern]++
+		if d.counts[pattern] > d.limits.PatternBudget {
+			return d.report(KindPatternBudget, pattern, rawURL)
+		}
+	}
+	return ""
+}
+
+// ObserveLinks records the query strings of the links on pageURL that stay on its host, to report
+// pages that are linked with ever more query variants, as faceted search and session IDs are.
+func (d *Detector) ObserveLinks(pageURL string, links map[string]bool) {
+	if d.limits.QueryVariants <= 0 {
+		return
+	}
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for link := range links {
+		ref, err := url.Parse(strings.TrimSpace(link))
+		if err != nil {
+			continue
+		}
+		target := base.ResolveReference(ref)
+		if target.RawQuery == "" || target.Host != base.Host {
+			continue
+		}
+		key := target.Host + strings.TrimRight(target.Path, "/")
+		seen, ok := d.variants[key]
+		if !ok {
+			seen = make(map[string]bool)
+			d.variants[key] = seen
+		}
+		if seen[target.RawQuery] {
+			continue
+		}
+		seen[target.RawQuery] = true
+		if len(seen) > d.limits.QueryVariants {
+			target.Fragment = ""
+			d.report(KindQueryVariants, key+"?*", target.String())
+		}
+	}
+}
+
+// report records rawURL as falling into the trap of kind at pattern. d.mu must be held.
+func (d *Detector) report(kind, pattern, rawURL string) string {
+	key := kind + " " + pattern
+	t, ok := d.traps[key]
+	if !ok {
+		t = &output.Trap{Kind: kind, Pattern: pattern}
+		d.traps[key] = t
+	}
+	t.URLs++
+	if len(t.Samples) < MaxSamples {
+		t.Samples = append(t.Samples, rawURL)
+	}
+	return kind
+}
+
+// Traps returns the traps found so far, those with the most URLs first.
+func (d *Detector) Traps() []output.Trap {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	traps := make([]output.Trap, 0, len(d.traps))
+	for _, t := range d.traps {
+		trap := *t
+		trap.Samples = append([]string(nil), t.Samples...)
+		traps = append(traps, trap)
+	}
+	sort.Slice(traps, func(i, j int) bool {
+		if traps[i].URLs != traps[j].URLs {
+			return traps[i].URLs > traps[j].URLs
+		}
+		return traps[i].Kind+traps[i].Pattern < traps[j].Kind+traps[j].Pattern
+	})
+	return traps
+}
+
+var digits = regexp.MustCompile(`[0-9]+`)
+
+// Pattern generalises a path by replacing numbers with {n} and segments that look like IDs or
+// hashes with {id}, so /calendar/2024/05 and /calendar/1999/12 share /calendar/{n}/{n}.
+func Pattern(p string) string {
+	segs := segments(p)
+	for i, segment := range segs {
+		if looksLikeID(segment) {
+			segs[i] = "{id}"
+			continue
+		}
+		segs[i] = digits.ReplaceAllString(segment, "{n}")
+	}
+	return "/" + strings.Join(segs, "/")
+}
+
+// looksLikeID reports whether a segment is a long mix of letters and digits, such as a UUID,
+// a hash or a session ID.
+func looksLikeID(segment string) bool {
+	if len(segment) < 16 {
+		return false
+	}
+	var letters, numbers int
+	for _, r := range segment {
+		switch {
+		case unicode.IsDigit(r):
+			numbers++
+		case unicode.IsLetter(r):
+			letters++
+		case r != '-' && r != '_':
+			return false
+		}
+	}
+	return letters > 0 && numbers > 0
+}
+
+func segments(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func maxRepeats(segs []string) int {
+	counts := make(map[string]int, len(segs))
+	most := 0
+	for _, segment := range segs {
+		counts[segment]++
+		most = max(most, counts[segment])
+	}
+	return most
+}
@@ -0,0 +1,85 @@
+package trap_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/trap"
+)
+
+func TestDetector_FlagsEachKindOfTrap(t *testing.T) {
+	budgets, err := trap.ParseBudgets([]string{"/search/*=2", "/calendar/**=3"})
+	if err != nil {
+		t.Fatalf("ParseBudgets failed: %v", err)
+	}
+	d := trap.New(trap.Limits{MaxURLLength: 60, MaxRepeats: 2, PatternBudget: 3, QueryVariants: 2, Budgets: budgets})
+
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{"https://example.com/about", ""},
+		{"https://example.com/a/b/a/b", ""},
+		{"https://example.com/a/b/a/b/a", trap.KindRepeatingSegments},
+		{"https://example.com/session/" + strings.Repeat("x", 40), trap.KindLongURL},
+		{"https://example.com/search/shoes", ""},
+		// A URL linked again is not counted again.
+		{"https://example.com/search/shoes", ""},
+		{"https://example.com/search/shoes", ""},
+		{"https://example.com/search/hats", ""},
+		{"https://example.com/search/socks", trap.KindBudget},
+		{"https://example.com/search/socks", trap.KindBudget},
+		{"https://example.com/search/socks/red", ""},
+		{"https://example.com/calendar", ""},
+		{"https://example.com/calendar/2024/01", ""},
+		{"https://example.com/calendar/2024/02", ""},
+		{"https://example.com/calendar/2024/03", ""},
+		{"https://example.com/calendar/2024/04", trap.KindBudget},
+		{"https://example.com/news/2024/01", ""},
+		{"https://example.com/news/2023/12", ""},
+		{"https://example.com/news/2023/11", ""},
+		{"https://example.com/news/2023/10", trap.KindPatternBudget},
+		{"https://example.com/user/3f2a9c1e7b6d4a58/settings", ""},
+	} {
+		if got := d.Check(tc.url); got != tc.want {
+			t.Errorf("Check(%s) = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+
+	links := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		links[fmt.Sprintf("/shop?color=red&page=%d", i)] = true
+	}
+	links["https://other.example/shop?page=9"] = true
+	d.ObserveLinks("https://example.com/", links)
+
+	traps := make(map[string]string)
+	for _, found := range d.Traps() {
+		traps[found.Kind+" "+found.Pattern] = fmt.Sprintf("%d %d", found.URLs, len(found.Samples))
+	}
+	for key, want := range map[string]string{
+		"repeating_segments example.com/a/b/a/b/a":                "1 1",
+		"budget /search/*":                                        "1 1",
+		"budget /calendar/**":                                     "1 1",
+		"pattern_budget example.com/news/{n}/{n}":                 "1 1",
+		"query_variants example.com/shop?*":                       "3 3",
+		"long_url example.com/session/" + strings.Repeat("x", 40): "1 1",
+	} {
+		if traps[key] != want {
+			t.Errorf("Expected trap %q with %s URLs and samples, got %q", key, want, traps[key])
+		}
+	}
+	if len(traps) != 6 {
+		t.Errorf("Unexpected traps: %v", traps)
+	}
+
+	if trap.Pattern("/user/3f2a9c1e7b6d4a58/page-2") != "/user/{id}/page-{n}" {
+		t.Errorf("Unexpected pattern %q", trap.Pattern("/user/3f2a9c1e7b6d4a58/page-2"))
+	}
+	for _, spec := range []string{"/calendar", "calendar/**=5", "/search/[=1", "/search/*=many"} {
+		if _, err := trap.ParseBudget(spec); err == nil {
+			t.Errorf("Expected budget %q to be rejected", spec)
+		}
+	}
+}
@@ -1,19 +1,48 @@
 package utils
 
 import (
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"strings"
 )
 
+// Logger is a leveled, structured logger. Messages describe what happened; the URL, depth, status
+// and attempt they concern are attached as fields so logs can be filtered and parsed.
 type Logger struct {
-	Info  *log.Logger
-	Error *log.Logger
+	*slog.Logger
 }
 
-// NewLogger initializes and returns a new Logger instance.
+// NewLogger initializes and returns a new Logger instance writing text at info level to stderr.
+// Stdout is left for crawl output.
 func NewLogger() *Logger {
-	return &Logger{
-		Info:  log.New(os.Stdout, "INFO: ", log.LstdFlags),
-		Error: log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile),
+	return &Logger{slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))}
+}
+
+// NewLoggerTo returns a logger writing records at or above level to w, as "text" or "json".
+func NewLoggerTo(w io.Writer, format string, level slog.Level) (*Logger, error) {
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "text", "":
+		return &Logger{slog.New(slog.NewTextHandler(w, options))}, nil
+	case "json":
+		return &Logger{slog.New(slog.NewJSONHandler(w, options))}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
 	}
 }
+
+// ParseLevel parses a level name: debug, info, warn or error.
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// With returns a logger that adds the given fields to every record.
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{l.Logger.With(args...)}
+}
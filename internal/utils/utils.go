@@ -14,7 +14,9 @@ import (
 
 var validAbsoluteURLPattern = regexp.MustCompile(`^((https?|ftp):\/\/)?(([a-zA-Z0-9.-]+\.[a-zA-Z]{2,})|(\d{1,3}(\.\d{1,3}){3})|(\[([a-fA-F0-9:]+)\]))(:[0-9]{1,5})?(\/.*)?$`)
 var validRelativeURLPattern = regexp.MustCompile(`^/[^?#]*$`)
-var excludedFileTypes = []string{".pdf", ".jpg", ".png", ".docx"}
+
+// DefaultExcludedFileTypes are the file extensions the crawler does not fetch unless configured otherwise.
+var DefaultExcludedFileTypes = []string{".pdf", ".jpg", ".png", ".docx"}
 
 // SaveJSONToFile writes a given data structure as a JSON file.
 // Parameters:
@@ -55,9 +57,15 @@ func RandFloat() float64 {
 // Returns:
 // - bool: True if the URL's file extension matches any in the excluded file types list; false otherwise.
 func IsExcludedFileType(url string) bool {
+	return HasFileType(url, DefaultExcludedFileTypes)
+}
+
+// HasFileType reports whether the URL's file extension is one of types, ignoring case. Each
+// type is an extension with its leading dot, such as ".pdf".
+func HasFileType(url string, types []string) bool {
 	ext := strings.ToLower(filepath.Ext(url))
-	for _, excluded := range excludedFileTypes {
-		if ext == excluded {
+	for _, excluded := range types {
+		if ext == strings.ToLower(excluded) {
 			return true
 		}
 	}
@@ -1,6 +1,9 @@
 package utils_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
 	"testing"
 
 	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
@@ -141,3 +144,33 @@ func TestNormalizeURL(t *testing.T) {
 		})
 	}
 }
+
+func TestNewLoggerTo_JSONWithFields(t *testing.T) {
+	level, err := utils.ParseLevel("warn")
+	if err != nil || level != slog.LevelWarn {
+		t.Fatalf("ParseLevel(warn) = %v, %v", level, err)
+	}
+	if _, err := utils.ParseLevel("loud"); err == nil {
+		t.Error("Expected error for unknown level")
+	}
+
+	var buf bytes.Buffer
+	logger, err := utils.NewLoggerTo(&buf, "json", level)
+	if err != nil {
+		t.Fatalf("NewLoggerTo failed: %v", err)
+	}
+	logger.Info("Crawling URL", "url", "https://example.com")
+	logger.With("worker", "w1").Warn("Failed to fetch URL", "url", "https://example.com/gone", "depth", 1, "status", 500)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected exactly one JSON record above the level, got %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "Failed to fetch URL" || record["worker"] != "w1" || record["status"] != float64(500) {
+		t.Errorf("Unexpected record: %v", record)
+	}
+
+	if _, err := utils.NewLoggerTo(&buf, "xml", level); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
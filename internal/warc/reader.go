@@ -0,0 +1,130 @@
+package warc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Reader iterates over the records of a WARC file, compressed or not.
+type Reader struct {
+	r      *bufio.Reader
+	closer io.Closer
+}
+
+// NewReader returns a reader over r. Gzip input, including one member per record, is detected
+// from its magic bytes.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return &Reader{r: bufio.NewReader(zr)}, nil
+	}
+	return &Reader{r: br}, nil
+}
+
+// Open returns a reader over the WARC file at path. Close the reader to release the file.
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader.closer = file
+	return reader, nil
+}
+
+// Close releases the file opened by Open.
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// Next returns the next record, or io.EOF once the archive is exhausted.
+func (r *Reader) Next() (*Record, error) {
+	version, err := r.line()
+	for err == nil && version == "" {
+		version, err = r.line()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(version, "WARC/") {
+		return nil, fmt.Errorf("warc: expected version line, got %q", version)
+	}
+
+	record := &Record{}
+	length := -1
+	for {
+		line, err := r.line()
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("warc: malformed header line %q", line)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if strings.EqualFold(name, "Content-Length") {
+			if length, err = strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("warc: invalid Content-Length %q", value)
+			}
+			continue
+		}
+		record.Header.Add(name, value)
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("warc: record %s has no Content-Length", record.ID())
+	}
+
+	record.Content = make([]byte, length)
+	if _, err := io.ReadFull(r.r, record.Content); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return record, nil
+}
+
+// line reads one CRLF- or LF-terminated line without its terminator.
+func (r *Reader) line() (string, error) {
+	line, err := r.r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// HTTPResponse parses a response record's content block. The body is fully buffered, so the
+// response does not need to be closed.
+func (r *Record) HTTPResponse() (*http.Response, error) {
+	if r.Type() != TypeResponse {
+		return nil, fmt.Errorf("warc: record %s is a %s record, not a response", r.ID(), r.Type())
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(r.Content)), nil)
+}
+
+// HTTPRequest parses a request record's content block.
+func (r *Record) HTTPRequest() (*http.Request, error) {
+	if r.Type() != TypeRequest {
+		return nil, fmt.Errorf("warc: record %s is a %s record, not a request", r.ID(), r.Type())
+	}
+	return http.ReadRequest(bufio.NewReader(bytes.NewReader(r.Content)))
+}
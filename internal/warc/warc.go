@@ -0,0 +1,84 @@
+// Package warc writes fetched responses to WARC/1.1 archives and reads them back, so a crawl can
+// be re-parsed offline or replayed without touching the network.
+package warc
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"strings"
+)
+
+// Version is the WARC version written to every record.
+const Version = "WARC/1.1"
+
+// Record types written by the crawler.
+const (
+	TypeWarcinfo = "warcinfo"
+	TypeRequest  = "request"
+	TypeResponse = "response"
+	TypeMetadata = "metadata"
+)
+
+// Field is a single named WARC header field.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Header holds a record's named fields in the order they appear in the archive.
+type Header []Field
+
+// Get returns the value of the first field called name, ignoring case, or "" if there is none.
+func (h Header) Get(name string) string {
+	for _, field := range h {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Add appends a field to the header.
+func (h *Header) Add(name, value string) {
+	*h = append(*h, Field{Name: name, Value: value})
+}
+
+// Record is one WARC record: its named fields and the content block that follows them.
+type Record struct {
+	Header  Header
+	Content []byte
+}
+
+// Type returns the record's WARC-Type.
+func (r *Record) Type() string {
+	return r.Header.Get("WARC-Type")
+}
+
+// ID returns the record's WARC-Record-ID.
+func (r *Record) ID() string {
+	return r.Header.Get("WARC-Record-ID")
+}
+
+// TargetURI returns the URL the record was captured from.
+func (r *Record) TargetURI() string {
+	return r.Header.Get("WARC-Target-URI")
+}
+
+// newRecordID returns a fresh urn:uuid record identifier.
+func newRecordID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("warc: reading random bytes: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// digest formats a SHA-1 digest the way WARC-Block-Digest and WARC-Payload-Digest expect.
+func digest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,112 @@
+package warc_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/warc"
+)
+
+func readAll(t *testing.T, path string) []*warc.Record {
+	t.Helper()
+	reader, err := warc.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer reader.Close()
+
+	var records []*warc.Record
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		records = append(records, record)
+	}
+}
+
+func TestWriter_ArchivesFetchesForOfflineReading(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/about">About</a>`))
+	}))
+	defer ts.Close()
+
+	writer, err := warc.NewWriter(t.TempDir(), "crawl", warc.DefaultMaxSize)
+	if err != nil {
+		t.Fatalf("NewWriter failed: %v", err)
+	}
+	f := fetcher.NewFetcher(10 * time.Second)
+	f.SetArchiver(writer)
+	if _, err := f.Fetch(ts.URL, utils.NewLogger()); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	writer.Close()
+
+	files := writer.Files()
+	if len(files) != 1 || !strings.HasSuffix(files[0], "-00000.warc.gz") {
+		t.Fatalf("Expected one archive file, got %v", files)
+	}
+
+	records := readAll(t, files[0])
+	var types []string
+	for _, record := range records {
+		types = append(types, record.Type())
+	}
+	if strings.Join(types, ",") != "warcinfo,response,request,metadata" {
+		t.Fatalf("Unexpected record types: %v", types)
+	}
+
+	response := records[1]
+	if response.TargetURI() != ts.URL || records[2].Header.Get("WARC-Concurrent-To") != response.ID() {
+		t.Errorf("Request record should point at response %s for %s", response.ID(), ts.URL)
+	}
+	res, err := response.HTTPResponse()
+	if err != nil {
+		t.Fatalf("HTTPResponse failed: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != `<a href="/about">About</a>` {
+		t.Errorf("Unexpected archived response: %d %q", res.StatusCode, body)
+	}
+	if req, err := records[2].HTTPRequest(); err != nil || req.Header.Get("User-Agent") == "" {
+		t.Errorf("Expected archived request with User-Agent, got %v, %v", req, err)
+	}
+}
+
+func TestWriter_RollsOverBySize(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html></html>"))
+	}))
+	defer ts.Close()
+
+	writer, err := warc.NewWriter(t.TempDir(), "crawl", 1)
+	if err != nil {
+		t.Fatalf("NewWriter failed: %v", err)
+	}
+	f := fetcher.NewFetcher(10 * time.Second)
+	f.SetArchiver(writer)
+	for _, path := range []string{"/a", "/b", "/c"} {
+		f.Fetch(ts.URL+path, utils.NewLogger())
+	}
+	writer.Close()
+
+	files := writer.Files()
+	if len(files) != 3 {
+		t.Fatalf("Expected a file per exchange, got %v", files)
+	}
+	for _, file := range files {
+		if records := readAll(t, file); len(records) != 4 || records[0].Type() != warc.TypeWarcinfo {
+			t.Errorf("Expected warcinfo plus one exchange in %s, got %d records", file, len(records))
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package warc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+)
+
+// DefaultMaxSize is the compressed size at which a writer starts a new archive file.
+const DefaultMaxSize = 1 << 30
+
+// Writer archives fetched responses to gzip-compressed WARC files in a directory. Each record is
+// its own gzip member, so readers can seek to any record, and a new file is started once the
+// current one grows past the size limit. It implements fetcher.Archiver.
+type Writer struct {
+	mu      sync.Mutex
+	dir     string
+	prefix  string
+	maxSize int64
+	started time.Time
+	serial  int
+	file    *os.File
+	written int64
+	files   []string
+}
+
+var _ fetcher.Archiver = (*Writer)(nil)
+
+// NewWriter creates dir if needed and returns a writer producing files named
+// prefix-<timestamp>-<serial>.warc.gz. A maxSize of zero or less never rolls over.
+func NewWriter(dir, prefix string, maxSize int64) (*Writer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		dir:     dir,
+		prefix:  prefix,
+		maxSize: maxSize,
+		started: time.Now().UTC(),
+	}, nil
+}
+
+// Files lists the archive files written so far, oldest first.
+func (w *Writer) Files() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.files...)
+}
+
+// Archive writes a request, response and metadata record for the exchange. The three records always
+// land in the same file; rollover happens between exchanges.
+func (w *Writer) Archive(exchange *fetcher.Exchange) error {
+	target := exchange.Request.URL.String()
+	date := exchange.FetchedAt.UTC().Format(time.RFC3339Nano)
+
+	var request bytes.Buffer
+	if err := exchange.Request.Write(&request); err != nil {
+		return err
+	}
+	response := responseBlock(exchange.Response, exchange.Body)
+
+	responseID := newRecordID()
+	records := []Record{
+		{
+			Header: Header{
+				{"WARC-Type", TypeResponse},
+				{"WARC-Record-ID", responseID},
+				{"WARC-Date", date},
+				{"WARC-Target-URI", target},
+				{"Content-Type", "application/http; msgtype=response"},
+				{"WARC-Block-Digest", digest(response)},
+				{"WARC-Payload-Digest", digest(exchange.Body)},
+			},
+			Content: response,
+		},
+		{
+			Header: Header{
+				{"WARC-Type", TypeRequest},
+				{"WARC-Record-ID", newRecordID()},
+				{"WARC-Date", date},
+				{"WARC-Target-URI", target},
+				{"WARC-Concurrent-To", responseID},
+				{"Content-Type", "application/http; msgtype=request"},
+				{"WARC-Block-Digest", digest(request.Bytes())},
+			},
+			Content: request.Bytes(),
+		},
+		{
+			Header: Header{
+				{"WARC-Type", TypeMetadata},
+				{"WARC-Record-ID", newRecordID()},
+				{"WARC-Date", date},
+				{"WARC-Target-URI", target},
+				{"WARC-Concurrent-To", responseID},
+				{"Content-Type", "application/warc-fields"},
+			},
+			Content: warcFields(
+				Field{"fetchTimeMs", strconv.FormatInt(exchange.Duration.Milliseconds(), 10)},
+				Field{"statusCode", strconv.Itoa(exchange.Response.StatusCode)},
+			),
+		},
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	for i := range records {
+		if err := w.write(&records[i]); err != nil {
+			return err
+		}
+	}
+	if w.maxSize > 0 && w.written >= w.maxSize {
+		return w.closeFile()
+	}
+	return nil
+}
+
+// Close finishes the current archive file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeFile()
+}
+
+// open starts the next archive file and writes its warcinfo record.
+func (w *Writer) open() error {
+	name := fmt.Sprintf("%s-%s-%05d.warc.gz", w.prefix, w.started.Format("20060102150405"), w.serial)
+	file, err := os.Create(filepath.Join(w.dir, name))
+	if err != nil {
+		return err
+	}
+	w.serial++
+	w.file = file
+	w.written = 0
+	w.files = append(w.files, file.Name())
+
+	info := Record{
+		Header: Header{
+			{"WARC-Type", TypeWarcinfo},
+			{"WARC-Record-ID", newRecordID()},
+			{"WARC-Date", time.Now().UTC().Format(time.RFC3339Nano)},
+			{"WARC-Filename", name},
+			{"Content-Type", "application/warc-fields"},
+		},
+		Content: warcFields(
+			Field{"software", "monzo-web-crawler"},
+			Field{"format", "WARC File Format 1.1"},
+			Field{"conformsTo", "https://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/"},
+		),
+	}
+	return w.write(&info)
+}
+
+// write appends the record to the current file as a single gzip member.
+func (w *Writer) write(record *Record) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	fmt.Fprintf(zw, "%s\r\n", Version)
+	for _, field := range record.Header {
+		fmt.Fprintf(zw, "%s: %s\r\n", field.Name, field.Value)
+	}
+	fmt.Fprintf(zw, "Content-Length: %d\r\n\r\n", len(record.Content))
+	zw.Write(record.Content)
+	zw.Write([]byte("\r\n\r\n"))
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	n, err := w.file.Write(buf.Bytes())
+	w.written += int64(n)
+	return err
+}
+
+func (w *Writer) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// responseBlock rebuilds the HTTP response as received. Go's transport may already have decoded a
+// chunked or compressed body, so the framing headers are rewritten to match the stored body.
+func responseBlock(resp *http.Response, body []byte) []byte {
+	header := resp.Header.Clone()
+	header.Del("Transfer-Encoding")
+	if resp.Uncompressed {
+		header.Del("Content-Encoding")
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	var buf bytes.Buffer
+	proto := resp.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	status := resp.Status
+	if status == "" {
+		status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	fmt.Fprintf(&buf, "%s %s\r\n", proto, status)
+	header.Write(&buf)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// warcFields encodes fields as an application/warc-fields block.
+func warcFields(fields ...Field) []byte {
+	var buf bytes.Buffer
+	for _, field := range fields {
+		fmt.Fprintf(&buf, "%s: %s\r\n", field.Name, field.Value)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,329 @@
+// Package crawler is the public API of the web crawler, for embedding it in other programs.
+//
+// A Crawler is configured with functional options and steered with callbacks:
+//
+//	c, err := crawler.New(crawler.WithMaxDepth(2), crawler.WithWorkers(4))
+//	if err != nil {
+//		return err
+//	}
+//	c.OnLink(func(link *crawler.Link) bool {
+//		return !strings.Contains(link.URL, "/admin/")
+//	})
+//	c.OnPage(func(page *crawler.Page) {
+//		fmt.Println(page.URL, len(page.Links))
+//	})
+//	result, err := c.Run(ctx, "https://monzo.com")
+//
+// Like the command-line crawler, it stays on each seed's host, normalises URLs to https without
+// query or fragment, and skips non-HTML file types.
+package crawler
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/budget"
+	engine "github.com/ivan-vladimirov/monzo-web-crawler/internal/crawler"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fingerprint"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/frontier"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/metrics"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/parser"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shard"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shared"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/trap"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// Record is what the crawler reports for each page it fetched or failed to fetch.
+type Record = output.Record
+
+// Result is a finished crawl, as written by the output formats.
+type Result = output.Result
+
+// Cluster is a page and the later pages that duplicate its text, as listed in Result.Duplicates.
+type Cluster = output.Cluster
+
+// Trap is a spider trap found while crawling, as listed in Result.Traps.
+type Trap = output.Trap
+
+// Sink receives a Record as soon as each page completes.
+type Sink = output.Sink
+
+// Exchange is a single HTTP request and response, as handed to an Archiver.
+type Exchange = fetcher.Exchange
+
+// Archiver records every HTTP exchange, such as the WARC writer does.
+type Archiver = fetcher.Archiver
+
+// Middleware wraps every fetch, for example to add headers, retry or check robots.txt.
+type Middleware = fetcher.Middleware
+
+// FetchRequest is a request as middlewares see it, with its crawl depth and referrer.
+type FetchRequest = fetcher.Request
+
+// RoundTripper sends a FetchRequest; middlewares wrap one.
+type RoundTripper = fetcher.RoundTripper
+
+// RoundTripperFunc adapts a function to RoundTripper.
+type RoundTripperFunc = fetcher.RoundTripperFunc
+
+// DefaultMiddlewares retries failed requests and logs every attempt.
+func DefaultMiddlewares() []Middleware {
+	return fetcher.DefaultMiddlewares()
+}
+
+// Metrics holds crawl statistics; see NewMetrics.
+type Metrics = metrics.Crawl
+
+// NewMetrics returns an empty set of crawl metrics for WithMetrics.
+func NewMetrics() *Metrics {
+	return metrics.New()
+}
+
+// Event is one step of the crawl: a URL queued, fetched, failed or skipped.
+type Event = engine.Event
+
+// EventType identifies what happened to a URL.
+type EventType = engine.EventType
+
+const (
+	EventQueued  = engine.EventQueued
+	EventFetched = engine.EventFetched
+	EventFailed  = engine.EventFailed
+	EventSkipped = engine.EventSkipped
+)
+
+// Crawler crawls from one or more seeds. Create one with New.
+type Crawler struct {
+	opts      options
+	engine    *engine.Crawler
+	logger    *utils.Logger
+	used      *shared.UsedURL
+	collector *output.Collector
+	traps     *trap.Detector
+	budget    *budget.Tracker
+	fetcher   *fetcher.Fetcher
+	parser    *parser.Parser
+	frontier  *frontier.Frontier
+	inbox     shard.Inbox
+	sent      atomic.Int64
+	prepared  sync.Once
+	closers   []func() error
+	closed    sync.Once
+
+	wg      sync.WaitGroup
+	active  atomic.Int64
+	mu      sync.Mutex
+	seeds   []string
+	started time.Time
+
+	onResponse []func(*Response)
+	onPage     []func(*Page)
+	onSkip     []func(*Skip)
+	onError    []func(*FetchError)
+	onEvent    []func(Event)
+}
+
+// New returns a crawler configured by opts, or an error if the options are invalid or the files
+// and servers they ask for cannot be opened. Close it once the crawl is over.
+func New(opts ...Option) (*Crawler, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	logger := o.logger
+	if logger == nil {
+		logger = utils.NewLogger()
+	}
+
+	c := &Crawler{
+		opts:      o,
+		logger:    logger,
+		collector: output.NewCollector(),
+		traps:     trap.New(o.traps),
+		budget:    budget.New(o.budget),
+		used: &shared.UsedURL{
+			CrawledURLs:  make(map[string]bool),
+			VisitedPaths: make(map[string]bool),
+		},
+	}
+
+	// The max_duration clock must not run out after the crawl is over.
+	c.closers = append(c.closers, func() error {
+		c.budget.Stop()
+		return nil
+	})
+	if err := c.open(&c.opts); err != nil {
+		c.Close()
+		return nil, err
+	}
+	o = c.opts
+
+	f := newFetcher(&o)
+	f.SetArchiver(responseArchiver{c})
+	c.fetcher = f
+
+	p := parser.NewParser()
+	if o.subdomains {
+		p = parser.NewParserWithSubdomains()
+	}
+	c.parser = p
+
+	c.engine = engine.NewCrawler(f, p, logger, o.limiter, o.workers)
+	c.engine.OnEvent(c.dispatch)
+	if o.setTypes {
+		c.engine.SetExcludedFileTypes(o.fileTypes)
+	}
+	c.engine.SetSink(output.Tee(append([]Sink{c.collector}, o.sinks...)...))
+	if o.metrics != nil {
+		c.engine.SetMetrics(o.metrics)
+	}
+	if o.tracer != nil {
+		c.engine.SetTracer(o.tracer)
+	}
+	if o.shard != nil {
+		c.engine.SetSharding(o.shard, o.forwarder)
+	}
+	if o.previous != nil {
+		c.engine.SetPrevious(o.previous)
+	}
+	c.engine.SetTraps(c.traps)
+	c.engine.SetBudget(c.budget)
+	politeness := o.politeness
+	politeness.HostDelay = max(politeness.HostDelay, o.delay)
+	c.frontier = frontier.New(o.workers, politeness, o.scorers...)
+	c.engine.SetFrontier(c.frontier)
+	if o.distance >= 0 {
+		c.engine.SetDuplicates(fingerprint.NewIndex(o.distance), o.skipDups)
+	}
+	return c, nil
+}
+
+// Run crawls from seeds until there is nothing left to crawl, a crawl-wide budget runs out or ctx
+// is done, and returns the result. If ctx is done first, pages already being fetched are finished and the partial result
+// is returned with ctx's error. A crawler given WithShards only crawls the seeds it owns, and runs
+// until it has been idle for the shards' idle time.
+func (c *Crawler) Run(ctx context.Context, seeds ...string) (*Result, error) {
+	c.mu.Lock()
+	c.seeds = append(c.seeds, seeds...)
+	c.mu.Unlock()
+	if c.inbox != nil {
+		return c.runSharded(ctx, seeds)
+	}
+	for _, seed := range seeds {
+		c.Visit(seed)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return c.Result(), nil
+	case <-ctx.Done():
+		c.Stop()
+		<-done
+		return c.Result(), ctx.Err()
+	}
+}
+
+// Visit starts crawling from url in the background; use Wait to block until it is done. Unlike
+// Run, it does not record url as a seed of the Result.
+func (c *Crawler) Visit(url string) {
+	c.visit(url, url)
+}
+
+// visit starts crawling from url, treating links as internal by the rules for base.
+func (c *Crawler) visit(url string, base string) {
+	c.prepared.Do(c.prepare)
+	c.mu.Lock()
+	if c.started.IsZero() {
+		c.started = time.Now()
+	}
+	c.mu.Unlock()
+
+	c.wg.Add(1)
+	c.active.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer c.active.Add(-1)
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		c.engine.Crawl(url, c.opts.maxDepth, base, c.opts.delay, c.used, wg, c.logger)
+		wg.Wait()
+	}()
+}
+
+// prepare loads what the scorers need before the first URL is crawled, such as sitemaps, through
+// the crawler's own fetcher so they are rate limited, cached, replayed and checked against
+// robots.txt like pages.
+func (c *Crawler) prepare() {
+	get := func(ctx context.Context, url string) (io.ReadCloser, error) {
+		resp, err := c.fetcher.RequestContext(ctx, url, c.logger)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	if err := c.frontier.Prepare(context.Background(), get); err != nil {
+		c.logger.Warn("Failed to prepare scorers, crawling without their data", "error", err)
+	}
+}
+
+// Wait blocks until every visited URL, and everything reachable from it, has been crawled.
+func (c *Crawler) Wait() {
+	c.wg.Wait()
+}
+
+// Busy reports whether any visit is still in progress.
+func (c *Crawler) Busy() bool {
+	return c.active.Load() > 0
+}
+
+// Crawled reports whether url has already been fetched.
+func (c *Crawler) Crawled(url string) bool {
+	return c.used.IsCrawledURL(url)
+}
+
+// Stop skips every URL not yet being fetched, so visits finish soon after.
+func (c *Crawler) Stop() {
+	c.engine.Stop()
+}
+
+// Result returns what has been crawled so far.
+func (c *Crawler) Result() *Result {
+	c.mu.Lock()
+	seeds := append([]string(nil), c.seeds...)
+	started := c.started
+	c.mu.Unlock()
+
+	c.used.Mux.RLock()
+	urls := make(map[string]bool, len(c.used.CrawledURLs))
+	for url, ok := range c.used.CrawledURLs {
+		urls[url] = ok
+	}
+	c.used.Mux.RUnlock()
+
+	pages := c.collector.Records()
+	return &Result{
+		Seeds:      seeds,
+		URLs:       urls,
+		Pages:      pages,
+		Duplicates: output.Clusters(pages),
+		Traps:      c.traps.Traps(),
+		StoppedBy:  c.budget.Exhausted(),
+		StartedAt:  started,
+		FinishedAt: time.Now(),
+	}
+}
@@ -0,0 +1,673 @@
+package crawler_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/pkg/crawler"
+)
+
+func TestCrawler_CallbacksSteerTheCrawl(t *testing.T) {
+	var mu sync.Mutex
+	headers := make(map[string]string)
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers[r.URL.Path] = r.Header.Get("X-Crawler-Test")
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<a href="/about">About</a><a href="/private">Private</a><a href="/old">Old</a><a href="/gone">Gone</a><a href="https://external.example/">Out</a>`))
+		case "/about", "/new":
+			w.Write([]byte(`<p>Nothing to see</p>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	c, err := crawler.New(
+		crawler.WithTransport(site.Client().Transport),
+		crawler.WithRateLimit(time.Millisecond),
+		crawler.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	var pages, failed, responses []string
+	skipped := make(map[string]string)
+	c.OnRequest(func(r *crawler.Request) bool {
+		r.Header.Set("X-Crawler-Test", "seen")
+		return true
+	})
+	c.OnLink(func(link *crawler.Link) bool {
+		switch link.URL {
+		case site.URL + "/private":
+			return false
+		case site.URL + "/old":
+			link.URL = site.URL + "/new"
+		}
+		return true
+	})
+	c.OnPage(func(page *crawler.Page) {
+		mu.Lock()
+		defer mu.Unlock()
+		pages = append(pages, page.URL)
+		if page.URL == site.URL && len(page.Links) != 5 {
+			t.Errorf("Expected the home page to carry all 5 links, got %v", page.Links)
+		}
+	})
+	c.OnError(func(err *crawler.FetchError) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, err.URL)
+		if err.Status != http.StatusNotFound {
+			t.Errorf("Expected a 404 for %s, got %d", err.URL, err.Status)
+		}
+	})
+	c.OnSkip(func(skip *crawler.Skip) {
+		mu.Lock()
+		defer mu.Unlock()
+		skipped[skip.URL] = skip.Reason
+	})
+	c.OnResponse(func(r *crawler.Response) {
+		mu.Lock()
+		defer mu.Unlock()
+		responses = append(responses, r.Request.URL.Path)
+	})
+
+	result, err := c.Run(context.Background(), site.URL)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	sort.Strings(pages)
+	if want := []string{site.URL, site.URL + "/about", site.URL + "/new"}; !equal(pages, want) {
+		t.Errorf("Expected pages %v, got %v", want, pages)
+	}
+	if !equal(failed, []string{site.URL + "/gone"}) {
+		t.Errorf("Expected /gone to fail, got %v", failed)
+	}
+	if skipped[site.URL+"/private"] != "filtered" {
+		t.Errorf("Expected the vetoed link to be skipped as filtered, got %v", skipped)
+	}
+	if skipped["https://external.example"] != "external" {
+		t.Errorf("Expected the external link to be skipped as external, got %v", skipped)
+	}
+	if headers["/old"] != "" || headers["/private"] != "" {
+		t.Errorf("Vetoed or rewritten links should not be requested: %v", headers)
+	}
+	for path, header := range headers {
+		if header != "seen" {
+			t.Errorf("Expected the OnRequest header on %s, got %q", path, header)
+		}
+	}
+	if len(responses) != 4 {
+		t.Errorf("Expected 4 responses, got %v", responses)
+	}
+
+	if !equal(result.Seeds, []string{site.URL}) || len(result.URLs) != 3 || len(result.Pages) != 4 {
+		t.Errorf("Unexpected result: seeds %v, %d URLs, %d pages", result.Seeds, len(result.URLs), len(result.Pages))
+	}
+}
+
+func TestCrawler_RecrawlsIncrementally(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("ETag", `"home-v1"`)
+			if r.Header.Get("If-None-Match") == `"home-v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte(`<title>Home</title><a href="/about">About</a>`))
+		case "/about":
+			w.Write([]byte(`<p>About</p>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	run := func(opts ...crawler.Option) (*crawler.Result, []*crawler.Page) {
+		opts = append(opts,
+			crawler.WithTransport(site.Client().Transport),
+			crawler.WithRateLimit(time.Millisecond),
+			crawler.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		)
+		c, err := crawler.New(opts...)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		var pages []*crawler.Page
+		c.OnPage(func(page *crawler.Page) {
+			mu.Lock()
+			defer mu.Unlock()
+			pages = append(pages, page)
+		})
+		result, err := c.Run(context.Background(), site.URL)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		return result, pages
+	}
+
+	first, _ := run()
+	second, pages := run(crawler.WithPrevious(first))
+
+	if requests["/"] != 2 || requests["/about"] != 2 {
+		t.Errorf("Expected each page to be requested once per run, got %v", requests)
+	}
+	if len(second.Pages) != 2 || !second.URLs[site.URL+"/about"] {
+		t.Fatalf("Expected the links of the unchanged page to be followed, got %+v", second.Pages)
+	}
+	home, about := second.Pages[0], second.Pages[1]
+	if !home.Unchanged || home.Status != http.StatusOK || home.ETag != `"home-v1"` || home.Title != "Home" ||
+		home.ContentHash != first.Pages[0].ContentHash {
+		t.Errorf("Expected the home page to be kept from the first run, got %+v", home)
+	}
+	if about.Unchanged {
+		t.Errorf("Pages without validators should be fetched again, got %+v", about)
+	}
+	for _, page := range pages {
+		if page.URL == site.URL && !page.Unchanged {
+			t.Errorf("Expected OnPage to see the home page as unchanged")
+		}
+	}
+}
+
+func TestCrawler_ClustersDuplicatePages(t *testing.T) {
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<p>Welcome to the home page of the bank.</p><a href="/deeplinks/a">A</a><a href="/deeplinks/b">B</a>`))
+		case "/deeplinks/a", "/deeplinks/b":
+			// The same template for every deep link; only the link target differs.
+			w.Write([]byte(`<h1>Open this page in the app</h1><p>Download the app to continue.</p><a href="` + r.URL.Path + `/more">More</a>`))
+		default:
+			w.Write([]byte(`<p>More about ` + r.URL.Path + `</p>`))
+		}
+	}))
+	defer site.Close()
+
+	for _, skip := range []bool{false, true} {
+		c, err := crawler.New(
+			crawler.WithTransport(site.Client().Transport),
+			crawler.WithRateLimit(time.Millisecond),
+			crawler.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+			crawler.WithSkipDuplicates(skip),
+		)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		result, err := c.Run(context.Background(), site.URL)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+
+		if len(result.Duplicates) != 1 || len(result.Duplicates[0].Exact) != 1 {
+			t.Fatalf("Expected one cluster of the two deep links, got %+v", result.Duplicates)
+		}
+		cluster := result.Duplicates[0]
+		pair := []string{cluster.URL, cluster.Exact[0]}
+		sort.Strings(pair)
+		if !equal(pair, []string{site.URL + "/deeplinks/a", site.URL + "/deeplinks/b"}) {
+			t.Errorf("Unexpected cluster %+v", cluster)
+		}
+		for _, page := range result.Pages {
+			if page.TextHash == "" || len(page.SimHash) != 16 {
+				t.Errorf("Expected %s to be fingerprinted, got %+v", page.URL, page)
+			}
+			if (page.URL == cluster.Exact[0]) != (page.DuplicateOf == cluster.URL) {
+				t.Errorf("Unexpected duplicate_of %q on %s", page.DuplicateOf, page.URL)
+			}
+		}
+		if want := map[bool]int{false: 5, true: 4}[skip]; len(result.Pages) != want {
+			t.Errorf("With skip %v, expected %d pages, got %d", skip, want, len(result.Pages))
+		}
+	}
+}
+
+func TestCrawler_StopsAtSpiderTraps(t *testing.T) {
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var year, month int
+		switch {
+		case r.URL.Path == "/":
+			w.Write([]byte(`<a href="/calendar/2024/1">Calendar</a><a href="/a/x">Docs</a>`))
+		case fmtScan(r.URL.Path, "/calendar/%d/%d", &year, &month):
+			// Every month links to the next, forever.
+			fmt.Fprintf(w, `<a href="/calendar/%d/%d">Next</a>`, year, month+1)
+		default:
+			// A broken link builder that nests one level deeper on every page.
+			fmt.Fprintf(w, `<a href="/a%s">Again</a>`, r.URL.Path)
+		}
+	}))
+	defer site.Close()
+
+	limits := crawler.TrapLimits{MaxRepeats: 2, PatternBudget: 3}
+	c, err := crawler.New(
+		crawler.WithTransport(site.Client().Transport),
+		crawler.WithRateLimit(time.Millisecond),
+		crawler.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		crawler.WithTrapLimits(limits),
+	)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	var mu sync.Mutex
+	skipped := make(map[string]string)
+	c.OnSkip(func(skip *crawler.Skip) {
+		mu.Lock()
+		defer mu.Unlock()
+		skipped[skip.URL] = skip.Reason
+	})
+	result, err := c.Run(context.Background(), site.URL)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if len(result.Pages) != 6 {
+		t.Errorf("Expected the home page, three months and two docs pages, got %d pages", len(result.Pages))
+	}
+	for _, url := range []string{site.URL + "/calendar/2024/4", site.URL + "/a/a/a/x"} {
+		if skipped[url] != "trap" {
+			t.Errorf("Expected %s to be skipped as a trap, got %q", url, skipped[url])
+		}
+	}
+	kinds := make(map[string]crawler.Trap)
+	for _, trap := range result.Traps {
+		kinds[trap.Kind] = trap
+	}
+	if trap := kinds["pattern_budget"]; trap.URLs != 1 || len(trap.Samples) != 1 || trap.Samples[0] != site.URL+"/calendar/2024/4" {
+		t.Errorf("Unexpected pattern budget trap %+v", trap)
+	}
+	if trap := kinds["repeating_segments"]; trap.URLs != 1 {
+		t.Errorf("Unexpected repeating segments trap %+v", trap)
+	}
+}
+
+func TestCrawler_StopsWhenBudgetRunsOut(t *testing.T) {
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<a href="/docs/a">A</a><a href="/docs/b">B</a><a href="/docs/c">C</a><a href="/about">About</a><a href="/careers">Careers</a>`))
+	}))
+	defer site.Close()
+
+	for _, tc := range []struct {
+		budget    crawler.Budget
+		pages     int
+		stoppedBy string
+		skip      string
+	}{
+		{crawler.Budget{MaxPages: 3}, 3, "max_pages", "stopped"},
+		{crawler.Budget{MaxPagesPerPath: []crawler.PathBudget{{Prefix: "/docs", Max: 1}}}, 4, "", "budget"},
+	} {
+		c, err := crawler.New(
+			crawler.WithTransport(site.Client().Transport),
+			crawler.WithRateLimit(time.Millisecond),
+			crawler.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+			crawler.WithBudget(tc.budget),
+		)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		var mu sync.Mutex
+		reasons := make(map[string]int)
+		c.OnSkip(func(skip *crawler.Skip) {
+			mu.Lock()
+			defer mu.Unlock()
+			reasons[skip.Reason]++
+		})
+		result, err := c.Run(context.Background(), site.URL)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+
+		if len(result.Pages) != tc.pages || result.StoppedBy != tc.stoppedBy {
+			t.Errorf("With %+v, expected %d pages stopped by %q, got %d stopped by %q", tc.budget, tc.pages, tc.stoppedBy, len(result.Pages), result.StoppedBy)
+		}
+		if reasons[tc.skip] == 0 {
+			t.Errorf("With %+v, expected URLs skipped as %q, got %v", tc.budget, tc.skip, reasons)
+		}
+	}
+}
+
+func TestCrawler_MaxDurationCancelsFetchesUnderWay(t *testing.T) {
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Write([]byte(`<a href="/slow">Slow</a>`))
+	}))
+	defer site.Close()
+
+	c, err := crawler.New(
+		crawler.WithTransport(site.Client().Transport),
+		crawler.WithRateLimit(time.Millisecond),
+		crawler.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		crawler.WithBudget(crawler.Budget{MaxDuration: 200 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+	var mu sync.Mutex
+	skipped := make(map[string]string)
+	c.OnSkip(func(skip *crawler.Skip) {
+		mu.Lock()
+		defer mu.Unlock()
+		skipped[skip.URL] = skip.Reason
+	})
+
+	start := time.Now()
+	result, err := c.Run(context.Background(), site.URL)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the slow fetch to be cancelled when the time budget ran out, Run took %v", elapsed)
+	}
+	if result.StoppedBy != "max_duration" || skipped[site.URL+"/slow"] != "stopped" {
+		t.Errorf("Expected /slow to be stopped by max_duration, got %q and skips %v", result.StoppedBy, skipped)
+	}
+}
+
+func TestCrawler_CrawlsBestScoredPagesFirst(t *testing.T) {
+	var sitemaps atomic.Int32
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sitemap.xml" {
+			sitemaps.Add(1)
+			w.Write([]byte(`<urlset><url><loc>https://` + r.Host + `/elsewhere</loc></url></urlset>`))
+			return
+		}
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<a href="/a/deep/page">A</a><a href="/b">B</a><a href="/pricing">Pricing</a><a href="/c">C</a>`))
+			return
+		}
+		// The links of the home page queue up while the first of them is fetched.
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer site.Close()
+
+	// The sitemap is only reachable through the crawler's transport, which trusts the test server.
+	scorers, err := crawler.ParseScorers("depth", "regex?pattern=/pricing$&weight=10", "sitemap?src="+site.URL+"/sitemap.xml")
+	if err != nil {
+		t.Fatalf("ParseScorers failed: %v", err)
+	}
+	c, err := crawler.New(
+		crawler.WithTransport(site.Client().Transport),
+		crawler.WithRateLimit(time.Millisecond),
+		crawler.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		crawler.WithWorkers(1),
+		crawler.WithScorers(scorers...),
+		crawler.WithPoliteness(crawler.Politeness{HostConcurrency: 1}),
+	)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	var order []string
+	c.OnPage(func(page *crawler.Page) {
+		order = append(order, page.URL)
+	})
+	if _, err := c.Run(context.Background(), site.URL); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if sitemaps.Load() != 1 {
+		t.Errorf("Expected the sitemap to be fetched once by the crawler, got %d", sitemaps.Load())
+	}
+	scores := map[string]int{site.URL + "/pricing": 3, site.URL + "/b": 2, site.URL + "/c": 2, site.URL + "/a/deep/page": 1}
+	if len(order) != 5 {
+		t.Fatalf("Expected 5 pages, got %v", order)
+	}
+	for i := 3; i < len(order); i++ {
+		if scores[order[i]] > scores[order[i-1]] {
+			t.Errorf("Expected the pages that waited to be crawled best score first, got %v", order)
+		}
+	}
+}
+
+func TestCrawler_DelaySpacesFetchesFromOneHost(t *testing.T) {
+	var mu sync.Mutex
+	var started []time.Time
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/a">A</a><a href="/b">B</a>`))
+	}))
+	defer site.Close()
+
+	// Fetches are timed as they leave the crawler, so the TLS handshake of the first one
+	// doesn't shorten the gap to the second.
+	transport := site.Client().Transport
+	c, err := crawler.New(
+		crawler.WithTransport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			mu.Lock()
+			started = append(started, time.Now())
+			mu.Unlock()
+			return transport.RoundTrip(r)
+		})),
+		crawler.WithRateLimit(time.Millisecond),
+		crawler.WithDelay(100*time.Millisecond),
+		crawler.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, err := c.Run(context.Background(), site.URL); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if len(started) != 3 {
+		t.Fatalf("Expected 3 fetches, got %d", len(started))
+	}
+	for i := 1; i < len(started); i++ {
+		if gap := started[i].Sub(started[i-1]); gap < 90*time.Millisecond {
+			t.Errorf("Expected fetches at least 100ms apart, fetch %d started %v after the previous one", i, gap)
+		}
+	}
+}
+
+func TestCrawler_FinishesOutputsOnClose(t *testing.T) {
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<a href="/about">About</a>`))
+			return
+		}
+		w.Write([]byte(`<a href="/">Home</a>`))
+	}))
+	defer site.Close()
+
+	dir := t.TempDir()
+	c, err := crawler.New(
+		crawler.WithTransport(site.Client().Transport),
+		crawler.WithRateLimit(time.Millisecond),
+		crawler.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		crawler.WithJSONL(filepath.Join(dir, "pages.jsonl"), time.Hour),
+		crawler.WithWARC(filepath.Join(dir, "warc"), "crawl", 1<<20),
+		crawler.WithMirror(filepath.Join(dir, "mirror"), false),
+	)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, err := c.Run(context.Background(), site.URL); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "pages.jsonl"))
+	if err != nil || strings.Count(string(data), "\n") != 2 {
+		t.Errorf("Expected a JSONL record per page once closed, got %q %v", data, err)
+	}
+	for _, sub := range []string{"warc", "mirror"} {
+		files := 0
+		filepath.WalkDir(filepath.Join(dir, sub), func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				files++
+			}
+			return nil
+		})
+		if files == 0 {
+			t.Errorf("Expected files in %s", sub)
+		}
+	}
+}
+
+func TestCrawler_RateLimitsMirroredAssets(t *testing.T) {
+	var mu sync.Mutex
+	var started []time.Time
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".png") {
+			mu.Lock()
+			started = append(started, time.Now())
+			mu.Unlock()
+			w.Header().Set("Content-Type", "image/png")
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<img src="/1.png"><img src="/2.png"><img src="/3.png"><img src="/4.png">`))
+	}))
+	defer site.Close()
+
+	c, err := crawler.New(
+		crawler.WithTransport(site.Client().Transport),
+		crawler.WithRateLimit(50*time.Millisecond),
+		crawler.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		crawler.WithMirror(t.TempDir(), true),
+	)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, err := c.Run(context.Background(), site.URL); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if len(started) != 4 {
+		t.Fatalf("Expected 4 asset fetches, got %d", len(started))
+	}
+	// The first fetch may take a tick left over from the crawl; the rest wait for their own.
+	if span := started[3].Sub(started[0]); span < 90*time.Millisecond {
+		t.Errorf("Expected the asset fetches to be rate limited, all 4 started within %v", span)
+	}
+}
+
+func TestNew_RejectsInvalidOptions(t *testing.T) {
+	if _, err := crawler.New(crawler.WithWorkers(0), crawler.WithRateLimit(0)); err == nil {
+		t.Fatal("Expected an error for zero workers and no rate limit")
+	}
+	if _, err := crawler.New(crawler.WithReplay(filepath.Join(t.TempDir(), "missing.warc"))); err == nil {
+		t.Fatal("Expected an error for a missing replay archive")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func fmtScan(s, format string, args ...any) bool {
+	n, err := fmt.Sscanf(s, format, args...)
+	return err == nil && n == len(args)
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCrawler_ShardsIgnoreStateLeftByAnEarlierRun(t *testing.T) {
+	// example.com belongs to shard 0 and blog.example.com to shard 1.
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "example.com" {
+			w.Write([]byte(`<a href="https://blog.example.com/">Blog</a>`))
+			return
+		}
+		w.Write([]byte(`<p>Blog</p>`))
+	}))
+	defer site.Close()
+	transport := site.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.InsecureSkipVerify = true
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, site.Listener.Addr().String())
+	}
+
+	// Shard 1 of an earlier run finished idle, having received as many URLs as shard 0 sends now.
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "shard-1.state")
+	os.WriteFile(stale, []byte(`{"idle": true, "sent": 0, "received": 1}`), 0o644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(stale, old, old)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results := make([]*crawler.Result, 2)
+	finished := make([]time.Time, 2)
+	var wg sync.WaitGroup
+	run := func(i int) {
+		c, err := crawler.New(
+			crawler.WithTransport(transport),
+			crawler.WithRateLimit(time.Millisecond),
+			crawler.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+			crawler.WithSubdomains(true),
+			crawler.WithShards(crawler.Shards{Index: i, Count: 2, InboxDir: dir, Idle: 200 * time.Millisecond}),
+		)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], err = c.Run(ctx, "https://example.com")
+			finished[i] = time.Now()
+			if err != nil {
+				t.Errorf("Shard %d failed: %v", i, err)
+			}
+		}()
+	}
+	run(0)
+	time.Sleep(2 * time.Second)
+	started := time.Now()
+	run(1)
+	wg.Wait()
+
+	if finished[0].Before(started) {
+		t.Error("Expected shard 0 to wait for shard 1 to start instead of trusting its old state")
+	}
+	if !results[0].URLs["https://example.com"] || !results[1].URLs["https://blog.example.com"] {
+		t.Errorf("Expected each shard to crawl its own host, got %v and %v", results[0].URLs, results[1].URLs)
+	}
+}
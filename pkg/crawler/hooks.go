@@ -0,0 +1,178 @@
+package crawler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	engine "github.com/ivan-vladimirov/monzo-web-crawler/internal/crawler"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// Request is a URL about to be queued for fetching. Header is sent with every attempt.
+type Request = engine.Request
+
+// Link is an internal link found on a page. Callbacks may rewrite URL.
+type Link = engine.Link
+
+// Response is one HTTP response, including those of attempts that are retried.
+type Response struct {
+	Request    *http.Request
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Duration   time.Duration
+}
+
+// Page is a successfully fetched page. Links are absolute and sorted.
+type Page struct {
+	URL        string
+	Depth      int
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Links      []string
+	// Unchanged is set when an incremental crawl got 304 Not Modified for the page. Body is then
+	// empty, and Links are those of the previous crawl.
+	Unchanged bool
+	FetchedAt time.Time
+	Duration  time.Duration
+}
+
+// Skip is a URL or link that was not crawled.
+type Skip struct {
+	URL    string
+	Depth  int
+	Reason string
+}
+
+// FetchError is a page that could not be fetched. Status is 404 for missing pages and 0 when no
+// response was received.
+type FetchError struct {
+	URL    string
+	Depth  int
+	Status int
+	Err    error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("fetching %s: %v", e.URL, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// Callbacks must be registered before the crawl starts. They are called from crawl goroutines,
+// possibly concurrently, so they must be safe for concurrent use.
+
+// OnRequest calls fn for every URL, seeds included, before it is queued. fn may add headers to
+// the request; returning false skips the URL.
+func (c *Crawler) OnRequest(fn func(request *Request) bool) {
+	c.engine.FilterRequests(fn)
+}
+
+// OnLink calls fn for every internal link found on a page before it is queued. fn may rewrite
+// link.URL; returning false drops the link.
+func (c *Crawler) OnLink(fn func(link *Link) bool) {
+	c.engine.FilterLinks(fn)
+}
+
+// OnResponse calls fn for every HTTP response received.
+func (c *Crawler) OnResponse(fn func(response *Response)) {
+	c.onResponse = append(c.onResponse, fn)
+}
+
+// OnPage calls fn for every page fetched successfully.
+func (c *Crawler) OnPage(fn func(page *Page)) {
+	c.onPage = append(c.onPage, fn)
+}
+
+// OnSkip calls fn for every URL or link that is not crawled, with the reason.
+func (c *Crawler) OnSkip(fn func(skip *Skip)) {
+	c.onSkip = append(c.onSkip, fn)
+}
+
+// OnError calls fn for every page that could not be fetched.
+func (c *Crawler) OnError(fn func(err *FetchError)) {
+	c.onError = append(c.onError, fn)
+}
+
+// OnEvent calls fn for every crawl event, the stream the other callbacks are built on.
+func (c *Crawler) OnEvent(fn func(event Event)) {
+	c.onEvent = append(c.onEvent, fn)
+}
+
+func (c *Crawler) dispatch(event Event) {
+	for _, fn := range c.onEvent {
+		fn(event)
+	}
+
+	switch event.Type {
+	case EventFetched:
+		if len(c.onPage) == 0 {
+			return
+		}
+		page := newPage(event.Page, event.Depth)
+		for _, fn := range c.onPage {
+			fn(page)
+		}
+	case EventFailed:
+		err := &FetchError{URL: event.URL, Depth: event.Depth, Status: event.Status, Err: event.Err}
+		for _, fn := range c.onError {
+			fn(err)
+		}
+	case EventSkipped:
+		skip := &Skip{URL: event.URL, Depth: event.Depth, Reason: event.Reason}
+		for _, fn := range c.onSkip {
+			fn(skip)
+		}
+	}
+}
+
+// responseArchiver passes every exchange to the OnResponse callbacks and to the archivers given
+// as options.
+type responseArchiver struct {
+	c *Crawler
+}
+
+func (a responseArchiver) Archive(exchange *fetcher.Exchange) error {
+	c := a.c
+	if len(c.onResponse) > 0 {
+		response := &Response{
+			Request:    exchange.Request,
+			StatusCode: exchange.Response.StatusCode,
+			Header:     exchange.Response.Header,
+			Body:       exchange.Body,
+			Duration:   exchange.Duration,
+		}
+		for _, fn := range c.onResponse {
+			fn(response)
+		}
+	}
+	return fetcher.MultiArchiver(c.opts.archivers...).Archive(exchange)
+}
+
+func newPage(page *fetcher.Page, depth int) *Page {
+	links := make([]string, 0, len(page.Links))
+	for link := range page.Links {
+		if normalized, err := utils.NormalizeURL(link, page.URL); err == nil {
+			links = append(links, normalized)
+		}
+	}
+	sort.Strings(links)
+
+	return &Page{
+		URL:        page.URL,
+		Depth:      depth,
+		StatusCode: page.StatusCode,
+		Header:     page.Header,
+		Body:       page.Body,
+		Links:      links,
+		Unchanged:  page.NotModified,
+		FetchedAt:  page.FetchedAt,
+		Duration:   page.Duration,
+	}
+}
@@ -0,0 +1,358 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/budget"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fingerprint"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/frontier"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shard"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/tracing"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/trap"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/utils"
+)
+
+// Defaults used when the matching option is not given.
+const (
+	DefaultMaxDepth  = 3
+	DefaultDelay     = 100 * time.Millisecond
+	DefaultRateLimit = 100 * time.Millisecond
+	DefaultWorkers   = 10
+	DefaultTimeout   = 10 * time.Second
+	DefaultShardIdle = 10 * time.Second
+)
+
+// Option configures a Crawler.
+type Option func(*options)
+
+type options struct {
+	maxDepth   int
+	delay      time.Duration
+	rateLimit  time.Duration
+	workers    int
+	timeout    time.Duration
+	attempt    time.Duration
+	fileTypes  []string
+	setTypes   bool
+	subdomains bool
+	logger     *utils.Logger
+	transport  http.RoundTripper
+	archivers  []Archiver
+	chain      []Middleware
+	setChain   bool
+	sinks      []Sink
+	metrics    *Metrics
+	tracer     *tracing.Tracer
+	limiter    *time.Ticker
+	shard      *shard.Assignment
+	forwarder  shard.Forwarder
+	previous   *Result
+	distance   int
+	skipDups   bool
+	traps      TrapLimits
+	budget     Budget
+	scorers    []Scorer
+	politeness Politeness
+	replay     []string
+	warc       *warcOptions
+	mirror     string
+	assets     bool
+	jsonl      string
+	flush      time.Duration
+	traceFile  string
+	traceTo    string
+	shards     *Shards
+}
+
+type warcOptions struct {
+	dir     string
+	prefix  string
+	maxSize int64
+}
+
+func defaultOptions() options {
+	return options{
+		maxDepth:  DefaultMaxDepth,
+		delay:     DefaultDelay,
+		rateLimit: DefaultRateLimit,
+		workers:   DefaultWorkers,
+		timeout:   DefaultTimeout,
+		distance:  fingerprint.DefaultDistance,
+		traps:     trap.DefaultLimits(),
+	}
+}
+
+func (o *options) validate() error {
+	var errs []error
+	if o.maxDepth < 0 {
+		errs = append(errs, errors.New("max depth must not be negative"))
+	}
+	if o.rateLimit <= 0 {
+		errs = append(errs, errors.New("rate limit interval must be positive"))
+	}
+	if o.workers < 1 {
+		errs = append(errs, errors.New("at least one worker is required"))
+	}
+	if o.timeout <= 0 {
+		errs = append(errs, errors.New("timeout must be positive"))
+	}
+	if o.attempt < 0 {
+		errs = append(errs, errors.New("request timeout must not be negative"))
+	}
+	if o.distance > fingerprint.MaxDistance {
+		errs = append(errs, fmt.Errorf("duplicate distance must be at most %d bits", fingerprint.MaxDistance))
+	}
+	if o.budget.MaxPages < 0 || o.budget.MaxBytes < 0 || o.budget.MaxDuration < 0 || o.budget.MaxPagesPerHost < 0 {
+		errs = append(errs, errors.New("budgets must not be negative"))
+	}
+	if o.delay < 0 {
+		errs = append(errs, errors.New("delay must not be negative"))
+	}
+	if o.politeness.HostConcurrency < 0 || o.politeness.HostDelay < 0 {
+		errs = append(errs, errors.New("host politeness limits must not be negative"))
+	}
+	if (o.shard == nil) != (o.forwarder == nil) {
+		errs = append(errs, errors.New("sharding needs both an assignment and a forwarder"))
+	}
+	if o.shards != nil && o.shard != nil {
+		errs = append(errs, errors.New("shards and sharding cannot both be set"))
+	}
+	if o.warc != nil && o.warc.maxSize <= 0 {
+		errs = append(errs, errors.New("WARC file size must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// WithMaxDepth limits the crawl to URLs at most depth path segments deep.
+func WithMaxDepth(depth int) Option {
+	return func(o *options) { o.maxDepth = depth }
+}
+
+// WithDelay makes fetches from one host start at least delay apart. It is the host delay of
+// WithPoliteness when that is shorter.
+func WithDelay(delay time.Duration) Option {
+	return func(o *options) { o.delay = delay }
+}
+
+// WithRateLimit sets the minimum interval between two fetches across all workers.
+func WithRateLimit(interval time.Duration) Option {
+	return func(o *options) { o.rateLimit = interval }
+}
+
+// WithWorkers sets how many pages are fetched concurrently.
+func WithWorkers(n int) Option {
+	return func(o *options) { o.workers = n }
+}
+
+// WithTimeout sets the HTTP client timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) { o.timeout = timeout }
+}
+
+// WithRequestTimeout limits each attempt at a request, including retries, to timeout. It
+// defaults to one second.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(o *options) { o.attempt = timeout }
+}
+
+// WithExcludedFileTypes skips URLs with any of the given file extensions, such as ".pdf",
+// instead of the default PDFs, images and Word documents.
+func WithExcludedFileTypes(types ...string) Option {
+	return func(o *options) {
+		o.fileTypes = types
+		o.setTypes = true
+	}
+}
+
+// WithSubdomains treats subdomains of each seed's host as internal.
+func WithSubdomains(enabled bool) Option {
+	return func(o *options) { o.subdomains = enabled }
+}
+
+// WithLogger logs through logger instead of a text logger on stderr.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) { o.logger = &utils.Logger{Logger: logger} }
+}
+
+// WithTransport sends requests through transport instead of http.DefaultTransport.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(o *options) { o.transport = transport }
+}
+
+// WithMiddlewares sends every request through middlewares, outermost first, instead of
+// DefaultMiddlewares. Requests are rate limited after the last of them.
+func WithMiddlewares(middlewares ...Middleware) Option {
+	return func(o *options) {
+		o.chain = middlewares
+		o.setChain = true
+	}
+}
+
+// WithArchiver hands every HTTP exchange, including failed attempts, to archiver. It may be given
+// more than once.
+func WithArchiver(archiver Archiver) Option {
+	return func(o *options) { o.archivers = append(o.archivers, archiver) }
+}
+
+// WithSink streams a record to sink as soon as each page completes. It may be given more than once.
+func WithSink(sink Sink) Option {
+	return func(o *options) { o.sinks = append(o.sinks, sink) }
+}
+
+// WithMetrics records crawl metrics in m.
+func WithMetrics(m *Metrics) Option {
+	return func(o *options) { o.metrics = m }
+}
+
+// WithTracer records a trace span for every crawled URL.
+func WithTracer(tracer *tracing.Tracer) Option {
+	return func(o *options) { o.tracer = tracer }
+}
+
+// WithSharding restricts the crawl to hosts owned by assignment, handing links to other hosts to
+// forwarder.
+func WithSharding(assignment *shard.Assignment, forwarder shard.Forwarder) Option {
+	return func(o *options) {
+		o.shard = assignment
+		o.forwarder = forwarder
+	}
+}
+
+// WithShards makes the crawler one of s.Count shards splitting a crawl by host. Run then only
+// crawls the seeds and links this shard owns, forwards the others to their shard and crawls the
+// URLs forwarded to it, until it has been idle for s.Idle.
+func WithShards(s Shards) Option {
+	return func(o *options) {
+		if s.Count > 1 {
+			o.shards = &s
+		}
+	}
+}
+
+// WithReplay serves responses from the given WARC and HAR files instead of the network. The files
+// are read by New.
+func WithReplay(files ...string) Option {
+	return func(o *options) { o.replay = files }
+}
+
+// WithWARC archives every HTTP exchange in WARC files in dir named after prefix, starting a new
+// file once the current one reaches maxSize bytes.
+func WithWARC(dir, prefix string, maxSize int64) Option {
+	return func(o *options) { o.warc = &warcOptions{dir, prefix, maxSize} }
+}
+
+// WithMirror saves crawled pages under dir with their links rewritten for offline browsing, once
+// the crawler is closed. With assets set, the images, scripts and stylesheets they use are fetched
+// and saved too, through the same middlewares and transport as pages.
+func WithMirror(dir string, assets bool) Option {
+	return func(o *options) {
+		o.mirror = dir
+		o.assets = assets
+	}
+}
+
+// WithJSONL streams one JSON record per page to path, a file, a named pipe or - for stdout,
+// flushing every flushInterval.
+func WithJSONL(path string, flushInterval time.Duration) Option {
+	return func(o *options) {
+		o.jsonl = path
+		o.flush = flushInterval
+	}
+}
+
+// WithTraceExport records a trace span for every crawled URL and writes them as OTLP/JSON to file
+// if it is set, otherwise to the collector at endpoint.
+func WithTraceExport(file, endpoint string) Option {
+	return func(o *options) {
+		o.traceFile = file
+		o.traceTo = endpoint
+	}
+}
+
+// WithPrevious makes the crawl incremental against previous, the result of an earlier crawl.
+// Pages that had an ETag or Last-Modified header are requested conditionally, and when the server
+// answers 304 Not Modified, their links are taken from previous instead of the page being
+// downloaded again. Their records are marked Unchanged.
+func WithPrevious(previous *Result) Option {
+	return func(o *options) { o.previous = previous }
+}
+
+// WithDuplicateDistance sets how many of the 64 SimHash bits two pages' text may differ in for the
+// later page to count as a near duplicate of the earlier one. It defaults to 3; 0 only finds
+// exact duplicates and a negative distance turns duplicate detection off. Duplicates name their
+// original in Record.DuplicateOf and are grouped in Result.Duplicates.
+func WithDuplicateDistance(bits int) Option {
+	return func(o *options) { o.distance = bits }
+}
+
+// WithSkipDuplicates stops the crawl from following links on pages that duplicate a page already
+// crawled, such as many URLs serving the same template.
+func WithSkipDuplicates(enabled bool) Option {
+	return func(o *options) { o.skipDups = enabled }
+}
+
+// TrapLimits are the thresholds beyond which links count as a spider trap and are not followed.
+type TrapLimits = trap.Limits
+
+// TrapBudget caps the number of URLs crawled under a path pattern such as /calendar/**.
+type TrapBudget = trap.Budget
+
+// WithTrapLimits replaces the default spider trap limits, which skip URLs over 512 characters,
+// paths repeating a segment more than twice and path patterns with more than 1000 URLs, and
+// report pages linked with more than 50 query strings. Zero limits turn their check off. Traps
+// are listed in Result.Traps and their URLs reported to OnSkip as "trap".
+func WithTrapLimits(limits TrapLimits) Option {
+	return func(o *options) { o.traps = limits }
+}
+
+// Budget limits the pages, bytes and time of the whole crawl, and the pages per host and per path
+// prefix. Zero limits are no limit.
+type Budget = budget.Limits
+
+// PathBudget caps the number of pages fetched under a path prefix such as /blog.
+type PathBudget = budget.PathLimit
+
+// WithBudget sets the crawl's budgets. When the pages, bytes or time run out, the crawl stops as
+// it does on Stop and Result.StoppedBy names the budget; URLs over a per-host or per-path cap are
+// reported to OnSkip as "budget" and the crawl goes on.
+func WithBudget(b Budget) Option {
+	return func(o *options) { o.budget = b }
+}
+
+// Scorer rates URLs waiting to be crawled; the URL with the highest total score across all
+// scorers is fetched next. Scorers that also implement LinkObserver see every link found.
+type Scorer = frontier.Scorer
+
+// ScorerFunc adapts a function to Scorer.
+type ScorerFunc = frontier.ScorerFunc
+
+// Candidate is a URL waiting to be crawled, as a Scorer sees it.
+type Candidate = frontier.Candidate
+
+// LinkObserver is implemented by scorers that learn from the links on crawled pages.
+type LinkObserver = frontier.LinkObserver
+
+// Politeness limits how hard one host is crawled, whatever the scores.
+type Politeness = frontier.Politeness
+
+// ParseScorers builds the built-in scorers from specs such as "depth",
+// "sitemap?src=https://monzo.com/sitemap.xml", "inlinks" or "regex?pattern=/blog/&weight=2".
+func ParseScorers(specs ...string) ([]Scorer, error) {
+	return frontier.ParseScorers(specs)
+}
+
+// WithScorers crawls the waiting URL with the highest total score first. Without scorers, URLs
+// are crawled in the order they are found.
+func WithScorers(scorers ...Scorer) Option {
+	return func(o *options) { o.scorers = scorers }
+}
+
+// WithPoliteness limits the pages fetched from one host at once and the time between them. The
+// frontier then fetches from another host rather than wait, even if its URLs score lower.
+func WithPoliteness(p Politeness) Option {
+	return func(o *options) { o.politeness = p }
+}
@@ -0,0 +1,125 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/fetcher"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/mirror"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/output"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/replay"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/tracing"
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/warc"
+)
+
+// open starts the rate limit ticker, loads the replay archive and creates the tracer, streams,
+// archives and shard inbox the options ask for, adding them to o. What must be finished after the
+// crawl is left for Close.
+func (c *Crawler) open(o *options) error {
+	limiter := time.NewTicker(o.rateLimit)
+	c.closers = append(c.closers, func() error {
+		limiter.Stop()
+		return nil
+	})
+	o.limiter = limiter
+
+	if len(o.replay) > 0 {
+		archive, err := replay.Load(o.replay...)
+		if err != nil {
+			return fmt.Errorf("loading replay archive: %w", err)
+		}
+		c.logger.Info("Replaying archived responses", "urls", archive.Len())
+		o.transport = archive
+	}
+
+	if o.traceFile != "" || o.traceTo != "" {
+		var exporter tracing.Exporter = tracing.NewHTTPExporter(o.traceTo)
+		if o.traceFile != "" {
+			fileExporter, err := tracing.NewFileExporter(o.traceFile)
+			if err != nil {
+				return fmt.Errorf("setting up tracing: %w", err)
+			}
+			exporter = fileExporter
+		}
+		tracer := tracing.NewTracer(exporter, tracing.DefaultFlushInterval, func(err error) {
+			c.logger.Warn("Failed to export trace spans", "error", err)
+		})
+		c.closers = append(c.closers, tracer.Shutdown)
+		o.tracer = tracer
+	}
+
+	if o.jsonl != "" {
+		sink, err := output.OpenJSONL(o.jsonl, o.flush)
+		if err != nil {
+			return fmt.Errorf("opening JSONL output: %w", err)
+		}
+		c.closers = append(c.closers, sink.Close)
+		o.sinks = append(o.sinks, sink)
+	}
+
+	if o.warc != nil {
+		archive, err := warc.NewWriter(o.warc.dir, o.warc.prefix, o.warc.maxSize)
+		if err != nil {
+			return fmt.Errorf("creating WARC archive: %w", err)
+		}
+		c.closers = append(c.closers, archive.Close)
+		o.archivers = append(o.archivers, archive)
+	}
+
+	if o.mirror != "" {
+		site := mirror.New(o.mirror, c.logger)
+		// Links can only be rewritten once every page has been saved.
+		c.closers = append(c.closers, site.Finish)
+		o.archivers = append(o.archivers, site)
+		if o.assets {
+			// Assets are fetched like pages, so they are replayed, archived and rate limited the
+			// same way, taking turns with the pages on one ticker.
+			assets := newFetcher(o)
+			assets.Use(fetcher.RateLimit(o.limiter.C))
+			if o.metrics != nil {
+				assets.SetMetrics(o.metrics)
+			}
+			assets.SetArchiver(fetcher.MultiArchiver(o.archivers...))
+			site.SetAssets(assets)
+		}
+	}
+
+	if o.shards != nil {
+		if err := c.openShards(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close finishes what the crawl's outputs need once it is over: it rewrites the mirror's links,
+// closes the WARC and JSONL files, exports the remaining trace spans, stops the shard inbox and
+// stops the rate limiter and the max_duration clock.
+// Call it after Run, even if Run failed.
+func (c *Crawler) Close() error {
+	var errs []error
+	c.closed.Do(func() {
+		for i := len(c.closers) - 1; i >= 0; i-- {
+			if err := c.closers[i](); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// newFetcher returns a fetcher with the timeouts, middlewares and transport of o.
+func newFetcher(o *options) *fetcher.Fetcher {
+	f := fetcher.NewFetcher(o.timeout)
+	if o.transport != nil {
+		f.SetTransport(o.transport)
+	}
+	if o.attempt > 0 {
+		f.SetRequestTimeout(o.attempt)
+	}
+	if o.setChain {
+		f.SetMiddlewares(o.chain...)
+	}
+	return f
+}
@@ -0,0 +1,155 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/shard"
+)
+
+// inboxPollInterval is how often a shard checks its inbox for forwarded URLs.
+const inboxPollInterval = 500 * time.Millisecond
+
+// Shards splits a crawl by host between Count crawlers, each run with its own Index. Links to
+// hosts owned by another shard are forwarded to it, through files in InboxDir or, when Peers is
+// set, over HTTP.
+type Shards struct {
+	Index int
+	Count int
+	// InboxDir is the directory the shards share to forward URLs to each other.
+	InboxDir string
+	// Peers are the inbox URLs of every shard, by index. This shard serves its own on Listen.
+	Peers  []string
+	Listen string
+	// Idle is how long a shard waits with nothing crawling and nothing arriving before it
+	// checks whether the other shards are done too. It defaults to DefaultShardIdle.
+	Idle time.Duration
+}
+
+// openShards sets up the shard assignment and the inbox and forwarder other shards share.
+func (c *Crawler) openShards(o *options) error {
+	assignment, err := shard.NewAssignment(o.shards.Index, o.shards.Count)
+	if err != nil {
+		return err
+	}
+	o.shard = assignment
+
+	if len(o.shards.Peers) == 0 {
+		forwarder, err := shard.NewDirForwarder(o.shards.InboxDir)
+		if err != nil {
+			return fmt.Errorf("creating shard inbox: %w", err)
+		}
+		o.forwarder = countingForwarder{forwarder, &c.sent}
+		c.inbox = shard.NewDirInbox(o.shards.InboxDir, assignment.Index, assignment.Count)
+		// The shard counts as busy until it first polls, so the others wait for it to start.
+		return c.inbox.Publish(shard.State{})
+	}
+
+	inbox := shard.NewHTTPInbox(assignment.Index, o.shards.Peers)
+	server := &http.Server{Addr: o.shards.Listen, Handler: inbox.Handler()}
+	go func() {
+		c.logger.Info("Shard inbox listening", "shard", assignment.Index, "addr", o.shards.Listen)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			c.logger.Error("Shard inbox server stopped", "error", err)
+		}
+	}()
+	c.closers = append(c.closers, server.Close)
+	o.forwarder = countingForwarder{shard.NewHTTPForwarder(o.shards.Peers), &c.sent}
+	c.inbox = inbox
+	return nil
+}
+
+// countingForwarder counts the URLs forwarded to other shards, so they know when all of them
+// have arrived.
+type countingForwarder struct {
+	shard.Forwarder
+	sent *atomic.Int64
+}
+
+func (f countingForwarder) Forward(index int, entry shard.Entry) error {
+	if err := f.Forwarder.Forward(index, entry); err != nil {
+		return err
+	}
+	f.sent.Add(1)
+	return nil
+}
+
+// runSharded crawls the seeds this shard owns and any URLs other shards forward to it. Since
+// another shard may forward work at any time, it only returns once every shard has been idle -
+// nothing crawling and nothing arriving - with every forwarded URL received, or ctx is done.
+func (c *Crawler) runSharded(ctx context.Context, seeds []string) (*Result, error) {
+	for _, seed := range seeds {
+		if c.opts.shard.Owns(seed) {
+			c.Visit(seed)
+		} else {
+			c.logger.Info("Seed is owned by another shard", "url", seed)
+		}
+	}
+
+	idle := c.opts.shards.Idle
+	if idle <= 0 {
+		idle = DefaultShardIdle
+	}
+	ticker := time.NewTicker(inboxPollInterval)
+	defer ticker.Stop()
+
+	var received int64
+	var settled []shard.State
+	lastActivity := time.Now()
+	for {
+		entries, err := c.inbox.Poll()
+		if err != nil {
+			c.logger.Error("Failed to read shard inbox", "error", err)
+		}
+		received += int64(len(entries))
+		for _, entry := range entries {
+			if c.Crawled(entry.URL) {
+				continue
+			}
+			c.logger.Debug("Received forwarded URL", "url", entry.URL, "base", entry.Base)
+			// The base is the seed the link was found under, so the same links count as internal.
+			base := entry.Base
+			if base == "" {
+				base = entry.URL
+			}
+			c.visit(entry.URL, base)
+		}
+
+		busy := len(entries) > 0 || c.Busy()
+		if busy {
+			lastActivity = time.Now()
+		}
+		// The state is published on every poll, even unchanged, so other shards can tell it from
+		// one left behind by an earlier run.
+		state := shard.State{Known: true, Idle: !busy, Sent: c.sent.Load(), Received: received}
+		if err := c.inbox.Publish(state); err != nil {
+			c.logger.Error("Failed to publish shard state", "error", err)
+		}
+
+		if !busy && time.Since(lastActivity) >= idle {
+			states, err := c.inbox.States()
+			if err != nil {
+				c.logger.Error("Failed to read shard states", "error", err)
+			} else if shard.Finished(settled, states) {
+				return c.Result(), nil
+			}
+			settled = states
+		} else {
+			settled = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			c.Stop()
+			c.Wait()
+			// Other shards stop waiting for this one.
+			c.inbox.Publish(shard.State{Idle: true, Sent: c.sent.Load(), Received: received})
+			return c.Result(), ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/ivan-vladimirov/monzo-web-crawler/internal/distributed"
+)
+
+// RunWorker crawls the URLs leased from the coordinator at coordinatorURL until it reports the
+// crawl is finished or ctx is done. The coordinator decides which URLs are crawled; they are
+// fetched and parsed as in Run, through the same middlewares, transport, rate limit and archivers.
+// An empty id defaults to the host name and process ID.
+func (c *Crawler) RunWorker(ctx context.Context, coordinatorURL, id string) error {
+	if id == "" {
+		hostname, _ := os.Hostname()
+		id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	// The fetcher is already rate limited, so the worker needs no ticker of its own.
+	worker := distributed.NewWorker(id, coordinatorURL, c.fetcher, c.parser, c.logger, nil)
+	return worker.Run(ctx)
+}